@@ -15,20 +15,35 @@
 # limitations under the License.
 
 
-for sub in manifest \
+for sub in . \
+  manifest \
   gitiles \
   cache \
   fs \
   populate \
+  trace \
+  bench \
+  config \
+  cookie \
 cmd/slothfs-deref-manifest \
 cmd/slothfs-repofs \
-cmd/slothfs-manifestfs \
 cmd/slothfs-populate \
 cmd/slothfs-gitilesfs \
+cmd/slothfs-hostfs \
+cmd/slothfs-localfs \
 cmd/slothfs-deref-repo \
 cmd/slothfs-gitiles-test \
+cmd/slothfs-log \
+cmd/slothfs-archive \
+cmd/slothfs-manifest-diff \
+cmd/slothfs-verify \
+cmd/slothfs-materialize \
+cmd/slothfs-bench \
+cmd/slothfs-admin \
+cmd/slothfs-patch \
   ; do
   p=github.com/google/slothfs/${sub}
+  p=${p%/.}
   go clean $p
   go test $p
   go install $p
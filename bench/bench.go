@@ -0,0 +1,223 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench measures how a SlothFS workspace performs compared
+// to a regular checkout: how long mounting and syncing take, and how
+// long reads of a recorded list of files take.
+package bench
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// ReadTrace reads a list of paths, one per line, as written to
+// .slothfs/accessed with -track_access. Empty lines and lines
+// starting with '#' are skipped.
+func ReadTrace(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		paths = append(paths, l)
+	}
+	return paths, scanner.Err()
+}
+
+// Latencies summarizes the time taken to read files.
+type Latencies struct {
+	Count  int
+	Errors int
+	Bytes  int64
+	Total  time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+// Replay reads the files of the trace below dir in order, and
+// returns how long the reads took. Files that can't be read are
+// counted as errors.
+func Replay(dir string, paths []string) *Latencies {
+	var l Latencies
+	var durations []time.Duration
+	for _, p := range paths {
+		start := time.Now()
+		content, err := ioutil.ReadFile(filepath.Join(dir, p))
+		dt := time.Since(start)
+		if err != nil {
+			l.Errors++
+			continue
+		}
+		l.Bytes += int64(len(content))
+		l.Total += dt
+		durations = append(durations, dt)
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	l.Count = len(durations)
+	l.P50 = percentile(durations, 50)
+	l.P90 = percentile(durations, 90)
+	l.P99 = percentile(durations, 99)
+	if l.Count > 0 {
+		l.Max = durations[l.Count-1]
+	}
+	return &l
+}
+
+// TimeCommand runs a shell command line, and returns how long it took.
+func TimeCommand(cmdLine string) (time.Duration, error) {
+	cmd := exec.Command("/bin/sh", "-c", cmdLine)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("%q: %v", cmdLine, err)
+	}
+	return time.Since(start), nil
+}
+
+// isMounted returns whether dir is on another device than its parent.
+func isMounted(dir string) bool {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return false
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &parent); err != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+// TimeMount starts a shell command line that mounts a file system at
+// mountPoint, and returns how long it took for the mount to appear.
+// The returned function unmounts the file system, and waits for the
+// command to exit.
+func TimeMount(cmdLine, mountPoint string, timeout time.Duration) (time.Duration, func() error, error) {
+	if isMounted(mountPoint) {
+		return 0, nil, fmt.Errorf("%s is already mounted", mountPoint)
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", cmdLine)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return 0, nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	deadline := time.After(timeout)
+	for !isMounted(mountPoint) {
+		select {
+		case err := <-exited:
+			return 0, nil, fmt.Errorf("%q exited before mounting: %v", cmdLine, err)
+		case <-deadline:
+			cmd.Process.Kill()
+			<-exited
+			return 0, nil, fmt.Errorf("%s not mounted after %v", mountPoint, timeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	dt := time.Since(start)
+
+	stop := func() error {
+		if out, err := exec.Command("fusermount", "-u", mountPoint).CombinedOutput(); err != nil {
+			cmd.Process.Kill()
+			<-exited
+			return fmt.Errorf("fusermount -u %s: %v, %s", mountPoint, err, out)
+		}
+		return <-exited
+	}
+	return dt, stop, nil
+}
+
+// Result holds the measurements for one tree.
+type Result struct {
+	// Name labels the tree in the report.
+	Name string
+
+	// Mount and Sync are zero if they were not measured.
+	Mount time.Duration
+	Sync  time.Duration
+
+	Reads *Latencies
+}
+
+// WriteReport writes a table comparing the results, with a column
+// for each result.
+func WriteReport(w io.Writer, results []*Result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	row := func(label string, value func(r *Result) string) {
+		fmt.Fprintf(tw, "%s\t", label)
+		for _, r := range results {
+			fmt.Fprintf(tw, "%s\t", value(r))
+		}
+		fmt.Fprintln(tw)
+	}
+	duration := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		return d.Round(time.Microsecond).String()
+	}
+	reads := func(f func(l *Latencies) string) func(r *Result) string {
+		return func(r *Result) string {
+			if r.Reads == nil {
+				return "-"
+			}
+			return f(r.Reads)
+		}
+	}
+
+	row("", func(r *Result) string { return r.Name })
+	row("mount", func(r *Result) string { return duration(r.Mount) })
+	row("sync", func(r *Result) string { return duration(r.Sync) })
+	row("files read", reads(func(l *Latencies) string { return fmt.Sprint(l.Count) }))
+	row("read errors", reads(func(l *Latencies) string { return fmt.Sprint(l.Errors) }))
+	row("bytes read", reads(func(l *Latencies) string { return fmt.Sprint(l.Bytes) }))
+	row("total read time", reads(func(l *Latencies) string { return duration(l.Total) }))
+	row("p50", reads(func(l *Latencies) string { return duration(l.P50) }))
+	row("p90", reads(func(l *Latencies) string { return duration(l.P90) }))
+	row("p99", reads(func(l *Latencies) string { return duration(l.P99) }))
+	row("max", reads(func(l *Latencies) string { return duration(l.Max) }))
+	return tw.Flush()
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTrace(t *testing.T) {
+	got, err := ReadTrace(strings.NewReader("a/b\n\n# comment\n  c \n"))
+	if err != nil {
+		t.Fatalf("ReadTrace: %v", err)
+	}
+	if want := []string{"a/b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var ds []time.Duration
+	for i := 1; i <= 10; i++ {
+		ds = append(ds, time.Duration(i))
+	}
+	for p, want := range map[int]time.Duration{50: 5, 90: 9, 99: 10, 100: 10} {
+		if got := percentile(ds, p); got != want {
+			t.Errorf("percentile(%d): got %v, want %v", p, got, want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("percentile of nothing: got %v", got)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "sub/b"} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := Replay(dir, []string{"a", "sub/b", "missing"})
+	if l.Count != 2 || l.Errors != 1 || l.Bytes != 10 {
+		t.Errorf("got %+v, want 2 files, 1 error, 10 bytes", l)
+	}
+	if l.Max < l.P50 || l.Total < l.Max {
+		t.Errorf("inconsistent latencies %+v", l)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, []*Result{
+		{Name: "slothfs", Mount: time.Second, Reads: &Latencies{Count: 3, P50: time.Millisecond}},
+		{Name: "checkout"},
+	}); err != nil {
+		t.Fatalf("WriteReport: %v", err)
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	for _, want := range [][]string{
+		{"slothfs", "checkout"},
+		{"mount", "1s", "-"},
+		{"files", "read", "3", "-"},
+		{"p50", "1ms", "-"},
+	} {
+		found := false
+		for _, l := range lines {
+			if reflect.DeepEqual(strings.Fields(l), want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("report lacks row %v:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestTimeCommand(t *testing.T) {
+	if _, err := TimeCommand("true"); err != nil {
+		t.Errorf("TimeCommand(true): %v", err)
+	}
+	if _, err := TimeCommand("false"); err == nil {
+		t.Error("TimeCommand(false) succeeded")
+	}
+}
@@ -17,6 +17,8 @@
 package cache
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
@@ -28,7 +30,20 @@ type Cache struct {
 	Tree *TreeCache
 	Blob *CAS
 
-	root string
+	// Fetches records network fetches of blobs and trees.
+	Fetches *FetchLog
+
+	// Nodes assigns inode numbers to file content. It is shared
+	// by all routes.
+	Nodes *NodeCache
+
+	// Queue bounds the number of concurrent network fetches: blobs
+	// and trees from Gitiles, and git clones and fetches. It is
+	// shared by all routes.
+	Queue *FetchQueue
+
+	root   string
+	routes []routedCache
 }
 
 // Options defines configurable options for the different caches.
@@ -36,14 +51,99 @@ type Options struct {
 	// FetchFrequency controls how often we run git fetch on the
 	// locally cached git repositories.
 	FetchFrequency time.Duration
+
+	// Offline disables all network access: no clones and no
+	// fetches are run.
+	Offline bool
+
+	// CloneFilter, if set, makes clones partial clones using the
+	// given filter spec, eg. "blob:none" or "blob:limit=1m". Blobs
+	// left out of the clone are fetched by git when they are read.
+	CloneFilter string
+
+	// ReferenceDir, if set, is a directory holding mirrors of the
+	// repositories, laid out by URL path (eg. a repo --mirror
+	// checkout). New clones borrow objects from a matching mirror
+	// with --reference, and then --dissociate from it.
+	ReferenceDir string
+
+	// URLRewrites are applied to git URLs before cloning or
+	// fetching.
+	URLRewrites []URLRewrite
+
+	// GitSSHCommand, if set, is used as GIT_SSH_COMMAND for ssh://
+	// URLs, eg. "ssh -i /path/to/key".
+	GitSSHCommand string
+
+	// CredentialHelper, if set, is the git credential helper for
+	// authenticated https URLs, eg. "store" or "gcloud.sh".
+	CredentialHelper string
+
+	// ProtocolOverrides maps URL prefixes to the prefixes that git
+	// should use instead, eg. "https://host/" to
+	// "persistent-https://host/". Unlike URLRewrites, they are
+	// applied by git (as url.<base>.insteadOf), so they don't change
+	// where the clone is stored.
+	ProtocolOverrides map[string]string
+
+	// Routes send repositories to other cache directories. Each
+	// route is a complete cache, with its own git, blob and tree
+	// storage; fetches are all logged in the main cache.
+	Routes []Route
+
+	// PersistInodes stores the inode numbers handed out for file
+	// content in the cache directory, so files keep their inode
+	// numbers when the file system is mounted again.
+	PersistInodes bool
+
+	// MaxFetches, if positive, is the maximum number of network
+	// fetches that run at the same time. Commands default to
+	// DefaultMaxFetches.
+	MaxFetches int
 }
 
+// DefaultMaxFetches is the default for the -max_fetches flags.
+const DefaultMaxFetches = 32
+
 // NewCache sets up a Cache instance according to the given options.
 func NewCache(d string, opts Options) (*Cache, error) {
 	if opts.FetchFrequency == 0 {
 		opts.FetchFrequency = 12 * time.Hour
 	}
 
+	c, err := newCache(d, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.PersistInodes {
+		if c.Nodes, err = OpenNodeCache(NodeCachePath(c.root)); err != nil {
+			return nil, err
+		}
+	} else {
+		c.Nodes = NewNodeCache()
+	}
+	c.Queue = NewFetchQueue(opts.MaxFetches)
+	c.Git.queue = c.Queue
+
+	routeOpts := opts
+	routeOpts.Routes = nil
+	for _, r := range opts.Routes {
+		rc, err := newCache(r.Dir, routeOpts, c.Fetches)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.Pattern, err)
+		}
+		rc.Nodes = c.Nodes
+		rc.Queue = c.Queue
+		rc.Git.queue = c.Queue
+		c.routes = append(c.routes, routedCache{r.Pattern, rc})
+	}
+	return c, nil
+}
+
+// newCache sets up a cache in d. If fl is nil, fetches are logged in
+// d.
+func newCache(d string, opts Options, fl *FetchLog) (*Cache, error) {
 	d, err := filepath.Abs(d)
 	if err != nil {
 		return nil, err
@@ -51,6 +151,9 @@ func NewCache(d string, opts Options) (*Cache, error) {
 	if err := os.MkdirAll(d, 0700); err != nil {
 		return nil, err
 	}
+	if err := checkLayout(d); err != nil {
+		return nil, err
+	}
 
 	g, err := newGitCache(filepath.Join(d, "git"), opts)
 	if err != nil {
@@ -67,10 +170,34 @@ func NewCache(d string, opts Options) (*Cache, error) {
 		return nil, err
 	}
 
+	if fl == nil {
+		fl, err = newFetchLog(FetchLogPath(d))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Cache{Git: g, Tree: t, Blob: c,
-		root: d,
+		Fetches: fl,
+		root:    d,
 	}, nil
 }
 
 // Root returns the directory holding the cache storage.
 func (c *Cache) Root() string { return c.root }
+
+// CheckWritable verifies that new data can be stored in the cache
+// and in all its routes.
+func (c *Cache) CheckWritable() error {
+	for _, d := range c.Roots() {
+		f, err := ioutil.TempFile(d, "health")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
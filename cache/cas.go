@@ -16,9 +16,11 @@ package cache
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
 )
@@ -52,29 +54,132 @@ func (c *CAS) Open(id plumbing.Hash) (*os.File, bool) {
 	return f, err == nil
 }
 
-// Write writes the given data under the given ID atomically.
-func (c *CAS) Write(id plumbing.Hash, data []byte) error {
+// Link hardlinks the blob to dest. The file is read-only, and must
+// not be changed: that would corrupt the blob. dest must be on the
+// same file system as the CAS.
+func (c *CAS) Link(id plumbing.Hash, dest string) error {
+	return os.Link(c.path(id), dest)
+}
+
+// Blocks returns the number of 512-byte blocks the blob occupies on
+// disk, and whether it is present at all.
+func (c *CAS) Blocks(id plumbing.Hash) (int64, bool) {
+	fi, err := os.Stat(c.path(id))
+	if err != nil {
+		return 0, false
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks), true
+	}
+	return (fi.Size() + 511) / 512, true
+}
+
+// Size returns the size of the blob, and whether it is present.
+func (c *CAS) Size(id plumbing.Hash) (int64, bool) {
+	fi, err := os.Stat(c.path(id))
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// Write copies the data from r and stores it under the given ID
+// atomically. The data is not held in memory, so it can be used for
+// blobs of any size. It returns the number of bytes written.
+func (c *CAS) Write(id plumbing.Hash, r io.Reader) (int64, error) {
 	// TODO(hanwen): we should run data through the git hash to
 	// verify that it is what it says it is.
 	f, err := ioutil.TempFile(c.dir, "tmp")
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if err := f.Chmod(0444); err != nil {
-		return err
+	n, err := c.writeTemp(f, r)
+	p := c.path(id)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(p), 0700); err == nil {
+			err = os.Rename(f.Name(), p)
+		}
 	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	if err := syncDir(filepath.Dir(p)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
 
-	if _, err := f.Write(data); err != nil {
-		return err
+// Remove deletes the blob, eg. because it is corrupt.
+func (c *CAS) Remove(id plumbing.Hash) error {
+	return os.Remove(c.path(id))
+}
+
+// Verify checks that the data of the blob matches its ID.
+func (c *CAS) Verify(id plumbing.Hash, f *os.File) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
 	}
-	if err := f.Close(); err != nil {
-		return err
+	h := plumbing.NewHasher(plumbing.BlobObject, fi.Size())
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, fi.Size())); err != nil {
+		return false, err
 	}
-	p := c.path(id)
-	dir := filepath.Dir(p)
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	return h.Sum() == id, nil
+}
+
+// Export hardlinks the given blobs into dir, using the same
+// layout as the CAS: the file for a blob with hex ID "abcdef..." is
+// "abc/def...". No data is copied, so dir must be on the same file
+// system as the CAS. Blobs that are already in dir are skipped. It
+// returns the IDs that are not in the CAS.
+func (c *CAS) Export(dir string, ids []plumbing.Hash) (missing []plumbing.Hash, err error) {
+	dest := &CAS{dir: dir}
+	for _, id := range ids {
+		src := c.path(id)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			missing = append(missing, id)
+			continue
+		}
+
+		p := dest.path(id)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Link(src, p); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+func (c *CAS) writeTemp(f *os.File, r io.Reader) (int64, error) {
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(0444)
+	}
+	if err == nil {
+		// Otherwise, a crash may leave a truncated blob after
+		// the rename, which we would serve as valid content.
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// syncDir flushes the directory entries of dir to disk, so a file
+// renamed into it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
 		return err
 	}
-	return os.Rename(f.Name(), c.path(id))
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
@@ -0,0 +1,143 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestCASExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cas, err := NewCAS(filepath.Join(dir, "cas"))
+	if err != nil {
+		t.Fatalf("NewCAS: %v", err)
+	}
+
+	data := []byte("hello")
+	id := plumbing.ComputeHash(plumbing.BlobObject, data)
+	if _, err := cas.Write(id, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	absent := plumbing.ComputeHash(plumbing.BlobObject, []byte("absent"))
+
+	out := filepath.Join(dir, "out")
+	for i := 0; i < 2; i++ {
+		missing, err := cas.Export(out, []plumbing.Hash{id, absent})
+		if err != nil {
+			t.Fatalf("Export: %v", err)
+		}
+		if len(missing) != 1 || missing[0] != absent {
+			t.Errorf("got missing %v, want %v", missing, absent)
+		}
+	}
+
+	exported := filepath.Join(out, id.String()[:3], id.String()[3:])
+	fi, err := os.Stat(exported)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	orig, err := os.Stat(cas.path(id))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !os.SameFile(fi, orig) {
+		t.Errorf("%s is not a hardlink to the CAS", exported)
+	}
+}
+
+func TestCASBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cas, err := NewCAS(dir)
+	if err != nil {
+		t.Fatalf("NewCAS: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("x"), 10000)
+	id := plumbing.ComputeHash(plumbing.BlobObject, data)
+	if _, ok := cas.Blocks(id); ok {
+		t.Fatalf("Blocks(%s) reported blob as present before writing", id)
+	}
+
+	if n, err := cas.Write(id, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Write: %v", err)
+	} else if n != int64(len(data)) {
+		t.Errorf("Write: got %d bytes, want %d", n, len(data))
+	}
+	if size, ok := cas.Size(id); !ok || size != int64(len(data)) {
+		t.Errorf("Size: got %d, %v, want %d", size, ok, len(data))
+	}
+	blocks, ok := cas.Blocks(id)
+	if !ok {
+		t.Fatalf("Blocks(%s): not present after writing", id)
+	}
+	if blocks*512 < int64(len(data)) {
+		t.Errorf("got %d blocks, want at least %d bytes", blocks, len(data))
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestCASWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cas, err := NewCAS(dir)
+	if err != nil {
+		t.Fatalf("NewCAS: %v", err)
+	}
+
+	id := plumbing.ComputeHash(plumbing.BlobObject, []byte("hello"))
+	rd := io.MultiReader(bytes.NewReader([]byte("hel")), failingReader{})
+	if _, err := cas.Write(id, rd); err == nil {
+		t.Fatal("Write succeeded for failing reader")
+	}
+	if f, ok := cas.Open(id); ok {
+		f.Close()
+		t.Errorf("truncated blob %s is in the cache", id)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "tmp*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) > 0 {
+		t.Errorf("temporary files left behind: %v", names)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// commitTimesDir is the directory within the tree cache that holds
+// the times of the last commits touching files, by commit. Like
+// treeMetaDir, its name is not 3 characters long.
+const commitTimesDir = "times"
+
+func (c *TreeCache) commitTimesPath(commit *plumbing.Hash) string {
+	str := commit.String()
+	return filepath.Join(c.dir, commitTimesDir, str[:3], str[3:])
+}
+
+// CommitTimes returns the recorded times of the last commits that
+// touched files in the history of commit, by path. Since commits
+// don't change, these times never go stale.
+func (c *TreeCache) CommitTimes(commit *plumbing.Hash) (map[string]time.Time, error) {
+	times := map[string]time.Time{}
+	content, err := ioutil.ReadFile(c.commitTimesPath(commit))
+	if os.IsNotExist(err) {
+		return times, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &times); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.commitTimesPath(commit), err)
+	}
+	return times, nil
+}
+
+// AddCommitTimes records times for commit, adding to the times
+// recorded before.
+func (c *TreeCache) AddCommitTimes(commit *plumbing.Hash, times map[string]time.Time) error {
+	all, err := c.CommitTimes(commit)
+	if err != nil {
+		return err
+	}
+	for p, t := range times {
+		all[p] = t
+	}
+	return c.writeJSON(c.commitTimesPath(commit), all)
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestCommitTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	commitID := plumbing.ComputeHash(plumbing.CommitObject, []byte("commit"))
+	if got, err := c.Tree.CommitTimes(&commitID); err != nil || len(got) != 0 {
+		t.Fatalf("CommitTimes: got %v, %v, want empty", got, err)
+	}
+
+	t1 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	if err := c.Tree.AddCommitTimes(&commitID, map[string]time.Time{"a": t1}); err != nil {
+		t.Fatalf("AddCommitTimes: %v", err)
+	}
+	if err := c.Tree.AddCommitTimes(&commitID, map[string]time.Time{"dir/b": t2}); err != nil {
+		t.Fatalf("AddCommitTimes: %v", err)
+	}
+	got, err := c.Tree.CommitTimes(&commitID)
+	if err != nil {
+		t.Fatalf("CommitTimes: %v", err)
+	}
+	if want := map[string]time.Time{"a": t1, "dir/b": t2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The times are not mistaken for trees.
+	if infos, err := c.Tree.List(); err != nil || len(infos) != 0 {
+		t.Errorf("List: got %v, %v, want no trees", infos, err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FetchRecord describes a single fetch of a blob or tree over the
+// network.
+type FetchRecord struct {
+	Time time.Time
+
+	// Kind is "blob" or "tree".
+	Kind string
+	Repo string
+	Path string `json:",omitempty"`
+	ID   string
+
+	Bytes   int
+	Latency time.Duration
+
+	// Trigger says what caused the fetch, eg. "open" or "read".
+	Trigger string
+	Error   string `json:",omitempty"`
+}
+
+// FetchStats aggregates fetch records.
+type FetchStats struct {
+	Count   int
+	Errors  int
+	Bytes   int64
+	Latency time.Duration
+}
+
+func (s *FetchStats) add(r *FetchRecord) {
+	s.Count++
+	if r.Error != "" {
+		s.Errors++
+	}
+	s.Bytes += int64(r.Bytes)
+	s.Latency += r.Latency
+}
+
+// FetchLog records network fetches as JSON lines, and keeps
+// per-repository statistics for the fetches since it was opened.
+type FetchLog struct {
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	stats map[string]*FetchStats
+}
+
+// FetchLogPath returns the location of the fetch log for the cache
+// in the given directory.
+func FetchLogPath(dir string) string {
+	return filepath.Join(dir, "git", "slothfs-logs", "fetches.jsonl")
+}
+
+func newFetchLog(path string) (*FetchLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FetchLog{
+		f:     f,
+		enc:   json.NewEncoder(f),
+		stats: map[string]*FetchStats{},
+	}, nil
+}
+
+// Record adds a fetch to the log. It is safe to call on a nil
+// FetchLog.
+func (l *FetchLog) Record(r FetchRecord) {
+	if l == nil {
+		return
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := l.stats[r.Repo]
+	if st == nil {
+		st = &FetchStats{}
+		l.stats[r.Repo] = st
+	}
+	st.add(&r)
+
+	if err := l.enc.Encode(&r); err != nil {
+		log.Printf("FetchLog: %v", err)
+	}
+}
+
+// Stats returns the statistics for the fetches recorded since the
+// log was opened, keyed by repository.
+func (l *FetchLog) Stats() map[string]FetchStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := map[string]FetchStats{}
+	for k, v := range l.stats {
+		result[k] = *v
+	}
+	return result
+}
+
+// ReadFetchLog parses a fetch log.
+func ReadFetchLog(r io.Reader) ([]FetchRecord, error) {
+	var result []FetchRecord
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var rec FetchRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, err
+		}
+		result = append(result, rec)
+	}
+	return result, scanner.Err()
+}
+
+// AggregateFetches computes statistics for the given records, keyed
+// by repository.
+func AggregateFetches(records []FetchRecord) map[string]*FetchStats {
+	result := map[string]*FetchStats{}
+	for i := range records {
+		r := &records[i]
+		st := result[r.Repo]
+		if st == nil {
+			st = &FetchStats{}
+			result[r.Repo] = st
+		}
+		st.add(r)
+	}
+	return result
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFetchLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "fetches.jsonl")
+	l, err := newFetchLog(p)
+	if err != nil {
+		t.Fatalf("newFetchLog: %v", err)
+	}
+
+	records := []FetchRecord{
+		{Kind: "blob", Repo: "a", Path: "f1", Bytes: 10, Latency: time.Second, Trigger: "open"},
+		{Kind: "blob", Repo: "a", Path: "f2", Bytes: 20, Latency: 3 * time.Second, Trigger: "read"},
+		{Kind: "tree", Repo: "b", Latency: time.Second, Trigger: "lookup", Error: "404"},
+	}
+	for _, r := range records {
+		l.Record(r)
+	}
+
+	want := map[string]FetchStats{
+		"a": {Count: 2, Bytes: 30, Latency: 4 * time.Second},
+		"b": {Count: 1, Errors: 1, Latency: time.Second},
+	}
+	if got := l.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats: got %v, want %v", got, want)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	read, err := ReadFetchLog(f)
+	if err != nil {
+		t.Fatalf("ReadFetchLog: %v", err)
+	}
+	if len(read) != len(records) {
+		t.Fatalf("got %d records, want %d", len(read), len(records))
+	}
+	agg := AggregateFetches(read)
+	for k, v := range want {
+		if got := agg[k]; got == nil || *got != v {
+			t.Errorf("AggregateFetches[%s]: got %v, want %v", k, got, v)
+		}
+	}
+}
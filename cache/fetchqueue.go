@@ -0,0 +1,182 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// fetchQueueLogInterval is how often the queue logs its progress
+// while fetches are waiting.
+var fetchQueueLogInterval = 10 * time.Second
+
+// FetchQueueStats describes the state of a FetchQueue.
+type FetchQueueStats struct {
+	Running int
+	Waiting int
+
+	// Done counts the fetches that finished since the queue was
+	// created.
+	Done int64
+}
+
+// FetchQueue bounds the number of network fetches that run at the
+// same time, so a process reading many files, like grep -r, doesn't
+// start thousands of downloads at once. Waiting fetches are admitted
+// round robin by repository, so reads in one repository are not
+// starved by a scan of another. It is safe for concurrent use from
+// multiple goroutines.
+type FetchQueue struct {
+	max int
+
+	mu      sync.Mutex
+	running int
+	done    int64
+
+	// waiting holds a FIFO of waiters for each repository in
+	// order, which holds the repositories with waiters.
+	waiting map[string][]chan struct{}
+	order   []string
+
+	lastLog time.Time
+}
+
+// NewFetchQueue returns a queue that runs at most max fetches at the
+// same time. If max is not positive, fetches never wait.
+func NewFetchQueue(max int) *FetchQueue {
+	return &FetchQueue{
+		max:     max,
+		waiting: map[string][]chan struct{}{},
+	}
+}
+
+// Acquire waits until a fetch for the given repository may run. If
+// it returns nil, Release must be called when the fetch is done.
+func (q *FetchQueue) Acquire(ctx context.Context, repo string) error {
+	q.mu.Lock()
+	if q.max <= 0 || (q.running < q.max && len(q.order) == 0) {
+		q.running++
+		q.mu.Unlock()
+		return nil
+	}
+
+	ch := make(chan struct{})
+	if len(q.waiting[repo]) == 0 {
+		q.order = append(q.order, repo)
+	}
+	q.waiting[repo] = append(q.waiting[repo], ch)
+	q.logLocked()
+	q.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-ch:
+		// Admitted while giving up; pass the slot on.
+		q.running--
+		q.admitLocked()
+	default:
+		q.removeLocked(repo, ch)
+	}
+	return ctx.Err()
+}
+
+// Release ends a fetch started with Acquire.
+func (q *FetchQueue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	q.done++
+	q.admitLocked()
+}
+
+// admitLocked starts waiting fetches while there is room, taking
+// one from each repository in turn.
+func (q *FetchQueue) admitLocked() {
+	for len(q.order) > 0 && (q.max <= 0 || q.running < q.max) {
+		repo := q.order[0]
+		q.order = q.order[1:]
+
+		waiters := q.waiting[repo]
+		ch := waiters[0]
+		if len(waiters) > 1 {
+			q.waiting[repo] = waiters[1:]
+			q.order = append(q.order, repo)
+		} else {
+			delete(q.waiting, repo)
+		}
+
+		q.running++
+		close(ch)
+	}
+}
+
+// removeLocked removes a waiter that gave up.
+func (q *FetchQueue) removeLocked(repo string, ch chan struct{}) {
+	waiters := q.waiting[repo]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) > 0 {
+		q.waiting[repo] = waiters
+		return
+	}
+
+	delete(q.waiting, repo)
+	for i, r := range q.order {
+		if r == repo {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (q *FetchQueue) statsLocked() FetchQueueStats {
+	s := FetchQueueStats{Running: q.running, Done: q.done}
+	for _, w := range q.waiting {
+		s.Waiting += len(w)
+	}
+	return s
+}
+
+// logLocked logs the progress of the queue, at most once per
+// fetchQueueLogInterval.
+func (q *FetchQueue) logLocked() {
+	if time.Since(q.lastLog) < fetchQueueLogInterval {
+		return
+	}
+	q.lastLog = time.Now()
+	s := q.statsLocked()
+	log.Printf("fetch queue: %d running, %d waiting in %d repositories, %d done", s.Running, s.Waiting, len(q.order), s.Done)
+}
+
+// Stats returns the current state of the queue.
+func (q *FetchQueue) Stats() FetchQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.statsLocked()
+}
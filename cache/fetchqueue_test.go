@@ -0,0 +1,89 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitFor waits until the queue has n waiters.
+func waitFor(t *testing.T, q *FetchQueue, n int) {
+	for i := 0; q.Stats().Waiting != n; i++ {
+		if i > 1000 {
+			t.Fatalf("got %d waiters, want %d", q.Stats().Waiting, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFetchQueueFairness(t *testing.T) {
+	q := NewFetchQueue(1)
+	ctx := context.Background()
+	if err := q.Acquire(ctx, "a"); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	admitted := make(chan string, 3)
+	for i, name := range []string{"a1", "a2", "b1"} {
+		go func(name string) {
+			if err := q.Acquire(ctx, name[:1]); err != nil {
+				t.Errorf("Acquire(%s): %v", name, err)
+			}
+			admitted <- name
+		}(name)
+		waitFor(t, q, i+1)
+	}
+
+	var got []string
+	for range []int{1, 2, 3} {
+		q.Release()
+		got = append(got, <-admitted)
+	}
+	q.Release()
+
+	if want := []string{"a1", "b1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+	if s := q.Stats(); s != (FetchQueueStats{Done: 4}) {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestFetchQueueCancel(t *testing.T) {
+	q := NewFetchQueue(1)
+	if err := q.Acquire(context.Background(), "a"); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() { errs <- q.Acquire(ctx, "b") }()
+	waitFor(t, q, 1)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+
+	q.Release()
+	if s := q.Stats(); s != (FetchQueueStats{Done: 1}) {
+		t.Errorf("got stats %+v", s)
+	}
+	if err := q.Acquire(context.Background(), "c"); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+}
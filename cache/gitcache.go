@@ -16,7 +16,9 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/url"
@@ -24,10 +26,14 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
 // gitCache manages a set of bare git repositories.  Repositories are
@@ -39,13 +45,53 @@ type gitCache struct {
 
 	// Directory to store log files for fetches and clones.
 	logDir string
+
+	// Directory to move broken repositories to.
+	quarantineDir string
+
+	// If set, never access the network.
+	offline bool
+
+	// Filter spec for partial clones, if any.
+	cloneFilter string
+
+	// Directory with mirrors to use as clone references, if any.
+	referenceDir string
+
+	// Rules for rewriting repository URLs.
+	rewrites []URLRewrite
+
+	// Bounds the clones and fetches running at the same time,
+	// together with the Gitiles fetches. It is set by NewCache.
+	queue *FetchQueue
+
+	// Credential configuration for git; see Options.
+	sshCommand        string
+	credentialHelper  string
+	protocolOverrides map[string]string
+
+	// Repositories that passed git fsck after failing, and the
+	// number of broken repositories that were quarantined.
+	repairMu    sync.Mutex
+	checked     map[string]bool
+	quarantined int
 }
 
 // newGitCache constructs a gitCache object.
 func newGitCache(baseDir string, opts Options) (*gitCache, error) {
 	c := gitCache{
-		dir:    filepath.Join(baseDir),
-		logDir: filepath.Join(baseDir, "slothfs-logs"),
+		dir:           filepath.Join(baseDir),
+		logDir:        filepath.Join(baseDir, "slothfs-logs"),
+		quarantineDir: filepath.Join(baseDir, quarantineDirName),
+		checked:       map[string]bool{},
+		offline:       opts.Offline,
+		cloneFilter:   opts.CloneFilter,
+		referenceDir:  opts.ReferenceDir,
+		rewrites:      opts.URLRewrites,
+
+		sshCommand:        opts.GitSSHCommand,
+		credentialHelper:  opts.CredentialHelper,
+		protocolOverrides: opts.ProtocolOverrides,
 	}
 	if err := os.MkdirAll(c.logDir, 0700); err != nil {
 		return nil, err
@@ -53,7 +99,7 @@ func newGitCache(baseDir string, opts Options) (*gitCache, error) {
 	if err := os.MkdirAll(c.dir, 0700); err != nil {
 		return nil, err
 	}
-	if opts.FetchFrequency > 0 {
+	if opts.FetchFrequency > 0 && !opts.Offline {
 		go c.recurringFetch(opts.FetchFrequency)
 	}
 
@@ -77,30 +123,69 @@ func (c *gitCache) logfile() (*os.File, error) {
 	return os.Create(nm)
 }
 
+// acquire waits for a slot in the fetch queue, if there is one, and
+// returns the function to release it.
+func (c *gitCache) acquire(repo string) func() {
+	if c.queue == nil {
+		return func() {}
+	}
+	// Without a context, Acquire can't fail.
+	c.queue.Acquire(context.Background(), repo)
+	return c.queue.Release
+}
+
 // Fetch updates the local clone of the given repository.
 func (c *gitCache) Fetch(dir string) error {
-	if err := c.runGit(c.dir, "--git-dir="+dir, "fetch", "origin"); err != nil {
+	if c.offline {
+		return fmt.Errorf("fetch %s: cache is offline", dir)
+	}
+	release := c.acquire(dir)
+	var errOut bytes.Buffer
+	err := c.runGitProgress(c.dir, &errOut, "--git-dir="+dir, "fetch", "origin")
+	release()
+	if err != nil {
+		// An interrupted fetch may have left the repository
+		// broken. Most failures are network errors though, which
+		// are not worth a git fsck.
+		if corruptGitOutput.Match(errOut.Bytes()) && c.repair(dir, err) {
+			return fmt.Errorf("fetch %s: %v; repository was corrupt and is quarantined", dir, err)
+		}
 		return err
 	}
 
 	return nil
 }
 
-// FetchAll finds all known repos and runs git-fetch on them.
-func (c *gitCache) FetchAll() error {
+// repoDirs returns the directories of all cloned repos.
+func (c *gitCache) repoDirs() ([]string, error) {
 	dir, err := filepath.EvalSymlinks(c.dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var dirs []string
 	if err := filepath.Walk(dir, func(n string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && filepath.Dir(n) == dir && fi.Name() == quarantineDirName {
+			return filepath.SkipDir
+		}
 		if fi.IsDir() && strings.HasSuffix(n, ".git") {
 			dirs = append(dirs, n)
 			return filepath.SkipDir
 		}
 		return nil
 	}); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+// FetchAll finds all known repos and runs git-fetch on them.
+func (c *gitCache) FetchAll() error {
+	dirs, err := c.repoDirs()
+	if err != nil {
 		return err
 	}
 
@@ -113,8 +198,45 @@ func (c *gitCache) FetchAll() error {
 	return nil
 }
 
+// Update clones the repository, or fetches it if it was cloned
+// before.
+func (c *gitCache) Update(url string) error {
+	p, err := c.gitPath(RewriteURL(c.rewrites, url))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(p); err == nil {
+		return c.Fetch(p)
+	}
+	_, err = c.Open(url)
+	return err
+}
+
+// Remove deletes the clone of the repository, eg. to reclaim space
+// or to start over with a fresh clone. It returns the directory
+// that was removed, or "" if the repository was not cloned.
+func (c *gitCache) Remove(url string) (string, error) {
+	p, err := c.gitPath(RewriteURL(c.rewrites, url))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(p); os.IsNotExist(err) {
+		return "", nil
+	}
+	return p, os.RemoveAll(p)
+}
+
+// scpURL matches the scp-like syntax for ssh URLs, eg.
+// git@host:path/to/repo.
+var scpURL = regexp.MustCompile(`^(?:([^@/]+)@)?([^:/]+):(.*)$`)
+
 // gitPath transforms a URL into a path under the gitCache directory.
 func (c *gitCache) gitPath(u string) (string, error) {
+	if !strings.Contains(u, "://") {
+		if m := scpURL.FindStringSubmatch(u); m != nil {
+			u = "ssh://" + m[2] + "/" + strings.TrimPrefix(m[3], "/")
+		}
+	}
 	parsed, err := url.Parse(u)
 	if err != nil {
 		return "", err
@@ -131,20 +253,78 @@ func (c *gitCache) gitPath(u string) (string, error) {
 	return filepath.Join(c.dir, parsed.Host, p+".git"), nil
 }
 
+// referencePath returns the path of a mirror of the given URL under
+// the reference directory, or "" if there is none.
+func (c *gitCache) referencePath(u string) string {
+	if c.referenceDir == "" {
+		return ""
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+
+	p := strings.TrimSuffix(path.Clean(parsed.Path), "/.git")
+	p = strings.TrimSuffix(p, ".git")
+	for _, candidate := range []string{
+		filepath.Join(c.referenceDir, p+".git"),
+		filepath.Join(c.referenceDir, p),
+	} {
+		if fi, err := os.Stat(candidate); err == nil && fi.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// gitCommand returns a command for running git with the credential
+// configuration of the cache.
+func (c *gitCache) gitCommand(args ...string) *exec.Cmd {
+	var config []string
+	if c.credentialHelper != "" {
+		config = append(config, "-c", "credential.helper="+c.credentialHelper)
+	}
+	var prefixes []string
+	for prefix := range c.protocolOverrides {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		config = append(config, "-c", fmt.Sprintf("url.%s.insteadOf=%s", c.protocolOverrides[prefix], prefix))
+	}
+
+	cmd := exec.Command("git", append(config, args...)...)
+	// We run in the background, so nobody can answer prompts.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if c.sshCommand != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+c.sshCommand)
+	}
+	return cmd
+}
+
 // runGit runs git with the given arguments under the given directory.
 func (c *gitCache) runGit(dir string, args ...string) error {
+	return c.runGitProgress(dir, nil, args...)
+}
+
+// runGitProgress is like runGit, but also copies the standard error
+// of git, where it reports progress, to progress if it is non-nil.
+func (c *gitCache) runGitProgress(dir string, progress io.Writer, args ...string) error {
 	logfile, err := c.logfile()
 	if err != nil {
 		return err
 	}
 	defer logfile.Close()
 
-	cmd := exec.Command("git", args...)
+	cmd := c.gitCommand(args...)
 	cmd.Dir = dir
 
 	var out, errOut bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &errOut
+	if progress != nil {
+		cmd.Stderr = io.MultiWriter(&errOut, progress)
+	}
 	runErr := cmd.Run()
 
 	if _, err := fmt.Fprintf(logfile, "args: %s\ndir:%s\nEXIT: %s\n\nOUT\n%s\n\nERR\n\n", cmd.Args,
@@ -166,37 +346,98 @@ func (c *gitCache) runGit(dir string, args ...string) error {
 
 // OpenLocal returns an opened repository for the given URL, if it is available locally.
 func (c *gitCache) OpenLocal(url string) *git.Repository {
+	url = RewriteURL(c.rewrites, url)
 	p, err := c.gitPath(url)
 	if err != nil {
 		return nil
 	}
 	repo, err := git.PlainOpen(p)
 	if err != nil {
+		// A directory without HEAD, eg. from an interrupted
+		// clone, also counts as not existing.
+		c.repair(p, err)
 		return nil
 	}
 	return repo
 }
 
+// catBlob reads a blob using the git command line tool. For partial
+// clones, this fetches the blob from the remote if it is missing.
+func (c *gitCache) catBlob(url string, id plumbing.Hash) ([]byte, error) {
+	url = RewriteURL(c.rewrites, url)
+	p, err := c.gitPath(url)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := c.gitCommand("--git-dir="+p, "cat-file", "blob", id.String())
+	if c.offline {
+		cmd.Env = append(cmd.Env, "GIT_NO_LAZY_FETCH=1")
+	}
+	var errOut bytes.Buffer
+	cmd.Stderr = &errOut
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v (%s)", cmd.Args, err, strings.TrimSpace(errOut.String()))
+	}
+	return out, nil
+}
+
 // Open returns an opened repository for the given URL. If necessary,
 // the repository is cloned.
 func (c *gitCache) Open(url string) (*git.Repository, error) {
+	return c.open(url, nil)
+}
+
+// open is like Open, but writes the progress output of git clone to
+// progress if it is non-nil.
+func (c *gitCache) open(url string, progress io.Writer) (*git.Repository, error) {
 	// TODO(hanwen): multiple concurrent calls to Open() with the
 	// same URL may race, resulting in a double clone. It's unclear
 	// what will happen in that case.
+	url = RewriteURL(c.rewrites, url)
 	p, err := c.gitPath(url)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := os.Lstat(p); os.IsNotExist(err) {
-		dir, base := filepath.Split(p)
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, err
-		}
-		if err := c.runGit(dir, "clone", "--bare", "--progress", "--verbose", url, base); err != nil {
-			return nil, err
+	if _, err := os.Lstat(p); err == nil {
+		repo, err := git.PlainOpen(p)
+		if err == nil || !c.repair(p, err) {
+			return repo, err
 		}
 	}
-	repo, err := git.PlainOpen(p)
-	return repo, err
+
+	if c.offline {
+		return nil, fmt.Errorf("%s: not cloned, and cache is offline", url)
+	}
+	dir, base := filepath.Split(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Clone next to the final location, so an interrupted clone
+	// doesn't leave a broken repository behind.
+	partial := base + partialSuffix
+	if err := os.RemoveAll(filepath.Join(dir, partial)); err != nil {
+		return nil, err
+	}
+	args := []string{"clone", "--bare", "--progress", "--verbose"}
+	if c.cloneFilter != "" {
+		args = append(args, "--filter="+c.cloneFilter)
+	}
+	if ref := c.referencePath(url); ref != "" {
+		args = append(args, "--reference", ref, "--dissociate")
+	}
+	args = append(args, url, partial)
+	release := c.acquire(url)
+	err = c.runGitProgress(dir, progress, args...)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(dir, partial), p); err != nil {
+		return nil, err
+	}
+	return git.PlainOpen(p)
 }
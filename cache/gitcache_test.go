@@ -18,11 +18,13 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
 func TestGitCache(t *testing.T) {
@@ -115,3 +117,308 @@ func TestThreadSafety(t *testing.T) {
 		}
 	}
 }
+
+func TestGitCacheOffline(t *testing.T) {
+	testRepo, err := initTest()
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	defer testRepo.Cleanup()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := newGitCache(dir, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("newGitCache(%s): %v", dir, err)
+	}
+
+	url := "file://" + testRepo.dir
+	if _, err := cache.Open(url); err == nil {
+		t.Errorf("Open(%s) succeeded in offline mode", url)
+	}
+	if r := cache.OpenLocal(url); r != nil {
+		t.Errorf("OpenLocal(%s) succeeded", url)
+	}
+}
+
+func TestGitCacheRepair(t *testing.T) {
+	testRepo, err := initTest()
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	defer testRepo.Cleanup()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := newGitCache(dir, Options{})
+	if err != nil {
+		t.Fatalf("newGitCache(%s): %v", dir, err)
+	}
+
+	url := "file://" + testRepo.dir
+	if _, err := cache.Open(url); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	p, err := cache.gitPath(url)
+	if err != nil {
+		t.Fatalf("gitPath: %v", err)
+	}
+
+	// Break the clone like an interrupted clone would.
+	if err := os.Remove(filepath.Join(p, "HEAD")); err != nil {
+		t.Fatal(err)
+	}
+	if r := cache.OpenLocal(url); r != nil {
+		t.Error("OpenLocal succeeded on a broken repository")
+	}
+	if got := cache.Quarantined(); got != 1 {
+		t.Errorf("got %d quarantined, want 1", got)
+	}
+	if _, err := os.Lstat(p); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%s): got %v, want not exist", p, err)
+	}
+	if dirs, err := cache.repoDirs(); err != nil || len(dirs) != 0 {
+		t.Errorf("repoDirs: got %v, %v, want none", dirs, err)
+	}
+
+	if _, err := cache.Open(url); err != nil {
+		t.Fatalf("Open after quarantine: %v", err)
+	}
+	if r := cache.OpenLocal(url); r == nil {
+		t.Error("OpenLocal failed after cloning again")
+	}
+
+	// A fetch that fails because the remote is gone doesn't call
+	// for a check.
+	testRepo.Cleanup()
+	if err := cache.Fetch(p); err == nil {
+		t.Fatal("Fetch from a removed remote succeeded")
+	}
+	if cache.checked[p] || cache.Quarantined() != 1 {
+		t.Errorf("failed fetch checked the repository")
+	}
+}
+
+func TestGitCachePartialClone(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(src)
+
+	cmd := exec.Command("/bin/sh", "-euxc",
+		strings.Join([]string{
+			"cd " + src,
+			"git init",
+			"git config uploadpack.allowFilter true",
+			"echo hello > file",
+			"git add file",
+			"git commit -m msg file",
+		}, " && "))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%s: %v", cmd.Args, err)
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := newGitCache(dir, Options{CloneFilter: "blob:none"})
+	if err != nil {
+		t.Fatalf("newGitCache(%s): %v", dir, err)
+	}
+
+	url := "file://" + src
+	if _, err := cache.Open(url); err != nil {
+		t.Fatalf("Open(%s): %v", url, err)
+	}
+
+	id := plumbing.ComputeHash(plumbing.BlobObject, []byte("hello\n"))
+	lazy := newLazyRepo(url, cache)
+	if _, err := lazy.Repository().BlobObject(id); err == nil {
+		t.Fatalf("blob %s was cloned; want partial clone", id)
+	}
+
+	rd, err := lazy.OpenBlob(id)
+	if err != nil {
+		t.Fatalf("OpenBlob(%s): %v", id, err)
+	}
+	content, err := ioutil.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := string(content), "hello\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGitCacheReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src", "project")
+	refDir := filepath.Join(dir, "mirror")
+	mirror := filepath.Join(refDir, src+".git")
+	cmd := exec.Command("/bin/sh", "-euxc",
+		strings.Join([]string{
+			"mkdir -p " + src,
+			"cd " + src,
+			"git init",
+			"echo hello > file",
+			"git add file",
+			"git commit -m msg file",
+			"git clone --mirror " + src + " " + mirror,
+		}, " && "))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%s: %v", cmd.Args, err)
+	}
+
+	cache, err := newGitCache(filepath.Join(dir, "cache"), Options{ReferenceDir: refDir})
+	if err != nil {
+		t.Fatalf("newGitCache: %v", err)
+	}
+
+	url := "file://" + src
+	if got := cache.referencePath(url); got != mirror {
+		t.Fatalf("referencePath(%s): got %q, want %q", url, got, mirror)
+	}
+	if got := cache.referencePath("https://host/other"); got != "" {
+		t.Errorf("referencePath for unknown repo: got %q", got)
+	}
+
+	if _, err := cache.Open(url); err != nil {
+		t.Fatalf("Open(%s): %v", url, err)
+	}
+
+	p, err := cache.gitPath(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(p, "objects", "info", "alternates")); !os.IsNotExist(err) {
+		t.Errorf("clone still uses alternates after --dissociate: %v", err)
+	}
+}
+
+func TestLazyRepoStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := newGitCache(dir, Options{})
+	if err != nil {
+		t.Fatalf("newGitCache(%s): %v", dir, err)
+	}
+
+	url := "file://" + filepath.Join(dir, "missing")
+	lazy := newLazyRepo(url, cache)
+	if s := lazy.Status(); s.State != CloneNotStarted {
+		t.Fatalf("got %#v, want not started", s)
+	}
+
+	wait := func() CloneStatus {
+		for i := 0; i < 100; i++ {
+			if s := lazy.Status(); s.State != CloneRunning {
+				return s
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("clone still running")
+		return CloneStatus{}
+	}
+
+	lazy.Clone()
+	s := wait()
+	if s.State != CloneFailed || s.Error == "" || s.Attempts != 1 || s.RetryAfter == nil {
+		t.Fatalf("got %#v, want failed clone", s)
+	}
+
+	// Within the backoff, the clone is not retried.
+	lazy.Clone()
+	if s := lazy.Status(); s.State != CloneFailed || s.Attempts != 1 {
+		t.Errorf("got %#v, want no retry", s)
+	}
+
+	// After the backoff, it is.
+	lazy.repoMu.Lock()
+	past := time.Now().Add(-time.Second)
+	lazy.status.RetryAfter = &past
+	lazy.repoMu.Unlock()
+
+	testRepo, err := initTest()
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	defer testRepo.Cleanup()
+	lazy.repoMu.Lock()
+	lazy.url = "file://" + testRepo.dir
+	lazy.repoMu.Unlock()
+
+	lazy.Clone()
+	if s := wait(); s.State != CloneDone || s.Attempts != 2 || s.Error != "" || s.RetryAfter != nil {
+		t.Errorf("got %#v, want successful clone", s)
+	}
+	if lazy.Repository() == nil {
+		t.Errorf("Repository() is nil after clone")
+	}
+}
+
+func TestGitCommandCredentials(t *testing.T) {
+	c := &gitCache{
+		sshCommand:       "ssh -i key",
+		credentialHelper: "store",
+		protocolOverrides: map[string]string{
+			"https://host/": "persistent-https://host/",
+		},
+	}
+	cmd := c.gitCommand("fetch", "origin")
+	want := []string{"git",
+		"-c", "credential.helper=store",
+		"-c", "url.persistent-https://host/.insteadOf=https://host/",
+		"fetch", "origin"}
+	if strings.Join(cmd.Args, " ") != strings.Join(want, " ") {
+		t.Errorf("got args %q, want %q", cmd.Args, want)
+	}
+
+	env := strings.Join(cmd.Env, "\n")
+	for _, v := range []string{"GIT_SSH_COMMAND=ssh -i key", "GIT_TERMINAL_PROMPT=0"} {
+		if !strings.Contains(env, v) {
+			t.Errorf("environment lacks %s", v)
+		}
+	}
+}
+
+func TestGitPathSSH(t *testing.T) {
+	c := &gitCache{dir: "/cache"}
+	for in, want := range map[string]string{
+		"ssh://user@host:29418/platform/build": "/cache/host/platform/build.git",
+		"git@host:platform/build":              "/cache/host/platform/build.git",
+		"persistent-https://host/a/b":          "/cache/host/a/b.git",
+	} {
+		got, err := c.gitPath(in)
+		if err != nil {
+			t.Errorf("gitPath(%s): %v", in, err)
+		} else if got != want {
+			t.Errorf("gitPath(%s): got %s, want %s", in, got, want)
+		}
+	}
+}
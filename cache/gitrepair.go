@@ -0,0 +1,153 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// quarantineDirName is the directory below the git cache where broken
+// repositories are moved, so they can be inspected.
+const quarantineDirName = "slothfs-quarantine"
+
+// quarantineTimeFormat is the format of the time appended to the
+// name of a quarantined repository.
+const quarantineTimeFormat = "20060102T150405.000000000"
+
+// partialSuffix is appended to the directory of a repository while
+// it is being cloned.
+const partialSuffix = ".partial"
+
+// corruptGitOutput matches the messages with which git fails on a
+// broken repository, as opposed to network or server errors.
+var corruptGitOutput = regexp.MustCompile(`bad object|is corrupt|is empty|unable to read|inflate:|not a git repository|did not send all necessary objects`)
+
+// fsck checks the repository in dir with git fsck.
+func (c *gitCache) fsck(dir string) error {
+	cmd := c.gitCommand("--git-dir="+dir, "fsck", "--connectivity-only", "--no-dangling", "--no-progress")
+	// Don't fetch missing objects of partial clones.
+	cmd.Env = append(cmd.Env, "GIT_NO_LAZY_FETCH=1")
+	var errOut bytes.Buffer
+	cmd.Stderr = &errOut
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v (%s)", cmd.Args, err, strings.TrimSpace(errOut.String()))
+	}
+	return nil
+}
+
+// repair checks the repository in dir, which failed with cause, and
+// moves it to the quarantine directory if it is broken, so it is
+// cloned afresh when it is next needed. It returns whether the
+// repository was moved. A repository that passes the check is not
+// checked again for the life of the cache.
+func (c *gitCache) repair(dir string, cause error) bool {
+	c.repairMu.Lock()
+	defer c.repairMu.Unlock()
+	if c.checked[dir] {
+		return false
+	}
+
+	if _, err := os.Lstat(dir); err != nil {
+		return false
+	}
+	err := c.fsck(dir)
+	if err == nil {
+		log.Printf("%s: %v, but git fsck finds no problems", dir, cause)
+		c.checked[dir] = true
+		return false
+	}
+
+	dest, qErr := c.quarantine(dir)
+	if qErr != nil {
+		log.Printf("%s is corrupt (%v), and quarantine failed: %v", dir, err, qErr)
+		c.checked[dir] = true
+		return false
+	}
+	c.quarantined++
+	log.Printf("%s is corrupt (%v; %v); moved it to %s", dir, cause, err, dest)
+	return true
+}
+
+// quarantine moves the repository in dir to the quarantine
+// directory, and returns its new location.
+func (c *gitCache) quarantine(dir string) (string, error) {
+	rel, err := filepath.Rel(c.dir, dir)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(c.quarantineDir, rel+"."+time.Now().Format(quarantineTimeFormat))
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return "", err
+	}
+	return dest, os.Rename(dir, dest)
+}
+
+// Quarantined returns the number of broken repositories that were
+// moved out of the way since the cache was opened.
+func (c *gitCache) Quarantined() int {
+	c.repairMu.Lock()
+	defer c.repairMu.Unlock()
+	return c.quarantined
+}
+
+// quarantineTime returns when the quarantined repository with the
+// given directory name was moved.
+func quarantineTime(name string) (time.Time, bool) {
+	n := len(name) - len(quarantineTimeFormat)
+	if n < 1 || name[n-1] != '.' {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(quarantineTimeFormat, name[n:], time.Local)
+	return t, err == nil
+}
+
+// gcQuarantine removes the repositories that were quarantined before
+// cutoff.
+func (c *gitCache) gcQuarantine(cutoff time.Time, u *DirUsage) error {
+	return filepath.Walk(c.quarantineDir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == c.quarantineDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		t, ok := quarantineTime(fi.Name())
+		if !ok {
+			return nil
+		}
+		if t.Before(cutoff) {
+			du, err := dirUsage(p)
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			u.Files += du.Files
+			u.Bytes += du.Bytes
+		}
+		return filepath.SkipDir
+	})
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LayoutVersion is the version of the on-disk layout of the cache
+// directory written by this package.
+const LayoutVersion = 1
+
+// layoutFile holds the layout version, relative to the cache root.
+const layoutFile = "layout-version"
+
+// migrations[i] converts a cache directory from layout version i to
+// version i+1.
+var migrations = []func(dir string) error{
+	// Version 0 is the unversioned layout: git/, blobs/ and tree/.
+	// Version 1 is the same, with a version marker.
+	func(dir string) error { return nil },
+}
+
+// ReadLayoutVersion returns the layout version of the cache
+// directory. Caches created before versioning was introduced have
+// version 0.
+func ReadLayoutVersion(dir string) (int, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, layoutFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", layoutFile, err)
+	}
+	return v, nil
+}
+
+func writeLayoutVersion(dir string, v int) error {
+	f, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, layoutFile))
+}
+
+// Migrate converts the cache directory to the current layout
+// version. It should not run while a file system uses the cache.
+func Migrate(dir string) error {
+	v, err := ReadLayoutVersion(dir)
+	if err != nil {
+		return err
+	}
+	if v > LayoutVersion {
+		return fmt.Errorf("cache %s has layout version %d; this binary only supports up to %d", dir, v, LayoutVersion)
+	}
+
+	for ; v < LayoutVersion; v++ {
+		if err := migrations[v](dir); err != nil {
+			return fmt.Errorf("migrate %s to version %d: %v", dir, v+1, err)
+		}
+		if err := writeLayoutVersion(dir, v+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLayout verifies that the cache directory can be used with
+// this version of the package. Unversioned caches are stamped with
+// the current version.
+func checkLayout(dir string) error {
+	v, err := ReadLayoutVersion(dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case v == LayoutVersion:
+		return nil
+	case v == 0:
+		return Migrate(dir)
+	case v < LayoutVersion:
+		return fmt.Errorf("cache %s has layout version %d, want %d; run 'slothfs-admin migrate'", dir, v, LayoutVersion)
+	default:
+		return fmt.Errorf("cache %s has layout version %d; this binary only supports up to %d", dir, v, LayoutVersion)
+	}
+}
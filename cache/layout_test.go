@@ -0,0 +1,58 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if v, err := ReadLayoutVersion(dir); err != nil || v != 0 {
+		t.Fatalf("ReadLayoutVersion on unversioned cache: got %d, %v", v, err)
+	}
+
+	if _, err := NewCache(dir, Options{FetchFrequency: -1}); err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if v, err := ReadLayoutVersion(dir); err != nil || v != LayoutVersion {
+		t.Fatalf("ReadLayoutVersion after NewCache: got %d, %v, want %d", v, err, LayoutVersion)
+	}
+
+	if err := writeLayoutVersion(dir, LayoutVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCache(dir, Options{FetchFrequency: -1}); err == nil {
+		t.Errorf("NewCache succeeded on newer layout")
+	}
+	if err := Migrate(dir); err == nil {
+		t.Errorf("Migrate succeeded on newer layout")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, layoutFile), []byte("bogus"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadLayoutVersion(dir); err == nil {
+		t.Errorf("ReadLayoutVersion succeeded on bogus content")
+	}
+}
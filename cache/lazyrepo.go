@@ -15,10 +15,17 @@
 package cache
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 )
 
 // LazyRepo represents a git repository that might be fetched on
@@ -27,16 +34,60 @@ type LazyRepo struct {
 	url   string
 	cache *gitCache
 
+	// origin is the URL of the repository. Unlike url, it is
+	// kept after cloning.
+	origin string
+
 	repoMu  sync.Mutex
 	cloning bool
 	repo    *git.Repository
+	status  CloneStatus
+}
+
+// States of a clone, for CloneStatus.
+const (
+	CloneNotStarted = "not started"
+	CloneRunning    = "cloning"
+	CloneDone       = "done"
+	CloneFailed     = "failed"
+)
+
+// CloneStatus describes the clone of a LazyRepo.
+type CloneStatus struct {
+	URL   string
+	State string
+
+	// Progress is the last progress message from git while
+	// cloning.
+	Progress string `json:",omitempty"`
+
+	// Error is the error of the last failed clone.
+	Error string `json:",omitempty"`
+
+	// Attempts counts the clones that were started.
+	Attempts int
+
+	// RetryAfter is when a failed clone may be retried.
+	RetryAfter *time.Time `json:",omitempty"`
 }
 
+// Backoff for retrying failed clones. It doubles with each failure,
+// up to maxCloneBackoff.
+var (
+	cloneBackoff    = time.Minute
+	maxCloneBackoff = time.Hour
+)
+
 func newLazyRepo(url string, cache *gitCache) *LazyRepo {
 	r := &LazyRepo{
-		url:   url,
-		cache: cache,
-		repo:  cache.OpenLocal(url),
+		url:    url,
+		cache:  cache,
+		origin: url,
+		repo:   cache.OpenLocal(url),
+	}
+	r.status = CloneStatus{URL: url, State: CloneNotStarted}
+	if r.repo != nil {
+		r.status.State = CloneDone
 	}
 
 	return r
@@ -48,6 +99,21 @@ func NewLazyRepo(url string, cache *Cache) *LazyRepo {
 	return newLazyRepo(url, cache.Git)
 }
 
+// NewLocalRepo returns a repository for the git repository in dir,
+// which may be bare. It is used in place, rather than cloned into
+// the cache.
+func NewLocalRepo(dir string) (*LazyRepo, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, fmt.Errorf("PlainOpen(%s): %v", dir, err)
+	}
+	return &LazyRepo{
+		origin: dir,
+		repo:   repo,
+		status: CloneStatus{URL: dir, State: CloneDone},
+	}, nil
+}
+
 // Repository returns a git.Repository for this repo, or nil if it
 // wasn't loaded. This method is safe for concurrent use from
 // multiple goroutines. The return value must not be Free'd since it
@@ -58,34 +124,100 @@ func (r *LazyRepo) Repository() *git.Repository {
 	return r.repo
 }
 
+// OpenBlob returns a reader for a blob from the local clone. For
+// partial clones, missing blobs are fetched using git.
+func (r *LazyRepo) OpenBlob(id plumbing.Hash) (io.ReadCloser, error) {
+	repo := r.Repository()
+	if repo == nil {
+		return nil, fmt.Errorf("%s: not cloned", r.origin)
+	}
+
+	blob, err := repo.BlobObject(id)
+	if err == plumbing.ErrObjectNotFound && r.cache != nil && r.cache.cloneFilter != "" {
+		content, err := r.cache.catBlob(r.origin, id)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blob.Reader()
+}
+
+// Status returns the state of the clone. This method is safe for
+// concurrent use from multiple goroutines.
+func (r *LazyRepo) Status() CloneStatus {
+	r.repoMu.Lock()
+	defer r.repoMu.Unlock()
+	return r.status
+}
+
+// cloneProgress records the progress messages of git in the status.
+type cloneProgress LazyRepo
+
+func (p *cloneProgress) Write(b []byte) (int, error) {
+	// git uses \r to overwrite progress lines.
+	lines := strings.FieldsFunc(string(b), func(r rune) bool { return r == '\r' || r == '\n' })
+	if len(lines) > 0 {
+		p.repoMu.Lock()
+		p.status.Progress = strings.TrimSpace(lines[len(lines)-1])
+		p.repoMu.Unlock()
+	}
+	return len(b), nil
+}
+
 // runClone initiates a clone. It makes sure that only one clone
 // process runs at any time.
 func (r *LazyRepo) runClone() {
-	repo, err := r.cache.Open(r.url)
+	repo, err := r.cache.open(r.url, (*cloneProgress)(r))
 
 	r.repoMu.Lock()
 	defer r.repoMu.Unlock()
-	r.url = ""
 	r.cloning = false
 	r.repo = repo
 
 	if err != nil {
-		log.Printf("runClone: %v", err)
+		backoff := cloneBackoff << uint(r.status.Attempts-1)
+		if backoff > maxCloneBackoff || backoff <= 0 {
+			backoff = maxCloneBackoff
+		}
+		retry := time.Now().Add(backoff)
+		r.status.State = CloneFailed
+		r.status.Error = err.Error()
+		r.status.RetryAfter = &retry
+		log.Printf("runClone(%s): %v; retrying after %s", r.url, err, backoff)
+		return
 	}
+
+	r.url = ""
+	r.status.State = CloneDone
+	r.status.Error = ""
+	r.status.RetryAfter = nil
 }
 
-// Clone schedules the repository to be cloned.  This method is safe
-// for concurrent use from multiple goroutines.
-func (r *LazyRepo) Clone() {
+// Clone schedules the repository to be cloned, and returns whether
+// a clone was started. If an earlier clone failed, it is only
+// retried after a backoff period. This method is safe for concurrent
+// use from multiple goroutines.
+func (r *LazyRepo) Clone() bool {
 	r.repoMu.Lock()
 	defer r.repoMu.Unlock()
 	if r.url == "" || r.repo != nil {
-		return
+		return false
 	}
 
 	if r.cloning {
-		return
+		return false
+	}
+	if r.status.RetryAfter != nil && time.Now().Before(*r.status.RetryAfter) {
+		return false
 	}
 	r.cloning = true
+	r.status.State = CloneRunning
+	r.status.Progress = ""
+	r.status.Attempts++
 	go r.runClone()
+	return true
 }
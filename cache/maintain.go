@@ -0,0 +1,338 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/google/slothfs/gitiles"
+)
+
+// DirUsage is a number of files and the disk space they take.
+type DirUsage struct {
+	Files int64
+	Bytes int64
+}
+
+func (u *DirUsage) add(fi os.FileInfo) {
+	u.Files++
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		u.Bytes += int64(st.Blocks) * 512
+	} else {
+		u.Bytes += fi.Size()
+	}
+}
+
+// dirUsage returns the usage of the files below dir. A missing
+// directory uses nothing.
+func dirUsage(dir string) (DirUsage, error) {
+	var u DirUsage
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			u.add(fi)
+		}
+		return nil
+	})
+	return u, err
+}
+
+// RepoUsage is the disk usage of a git clone.
+type RepoUsage struct {
+	Dir string
+	DirUsage
+}
+
+// Usage describes the disk space used by the parts of the cache.
+type Usage struct {
+	Blobs    DirUsage
+	Trees    DirUsage
+	Archives DirUsage
+	Repos    []RepoUsage
+
+	// Quarantine holds the broken repositories that were moved
+	// out of the way.
+	Quarantine DirUsage
+}
+
+// Usage returns the disk usage of the cache. It does not include
+// the caches of routes.
+func (c *Cache) Usage() (*Usage, error) {
+	var u Usage
+	var err error
+	if u.Blobs, err = dirUsage(c.Blob.dir); err != nil {
+		return nil, err
+	}
+	if u.Trees, err = dirUsage(c.Tree.dir); err != nil {
+		return nil, err
+	}
+	if u.Archives, err = dirUsage(filepath.Join(c.root, "archives")); err != nil {
+		return nil, err
+	}
+	if u.Quarantine, err = dirUsage(c.Git.quarantineDir); err != nil {
+		return nil, err
+	}
+
+	dirs, err := c.Git.repoDirs()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		du, err := dirUsage(d)
+		if err != nil {
+			return nil, err
+		}
+		u.Repos = append(u.Repos, RepoUsage{d, du})
+	}
+	return &u, nil
+}
+
+// walkEntries calls fn for the entries of a directory laid out like
+// the CAS, with the ID of each entry. Other files and directories
+// directly in dir, such as temporary files, are passed with an empty
+// ID.
+func walkEntries(dir string, fn func(id, path string, fi os.FileInfo) error) error {
+	shards, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		p := filepath.Join(dir, shard.Name())
+		if !shard.IsDir() || len(shard.Name()) != 3 {
+			if err := fn("", p, shard); err != nil {
+				return err
+			}
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := fn(shard.Name()+e.Name(), filepath.Join(p, e.Name()), e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lastUse returns when the file was last read or written. With
+// the common relatime mount option, the access time is updated at
+// most once a day.
+func lastUse(fi os.FileInfo) time.Time {
+	t := fi.ModTime()
+	if at, ok := accessTime(fi); ok && at.After(t) {
+		t = at
+	}
+	return t
+}
+
+// GCResult describes what GC removed.
+type GCResult struct {
+	Blobs    DirUsage
+	Trees    DirUsage
+	Archives DirUsage
+
+	// TreeMeta are the metadata files of removed trees.
+	TreeMeta DirUsage
+
+	// Quarantine are the files of quarantined repositories.
+	Quarantine DirUsage
+
+	// Temp are temporary files left behind by crashes.
+	Temp DirUsage
+}
+
+// gcDir removes the entries of dir, and the unused temporary files
+// in it, that were last used before cutoff.
+func gcDir(dir string, cutoff time.Time, entries, temp *DirUsage) error {
+	return walkEntries(dir, func(id, p string, fi os.FileInfo) error {
+		if id == "" && !strings.HasPrefix(fi.Name(), "tmp") {
+			return nil
+		}
+		if !lastUse(fi).Before(cutoff) {
+			return nil
+		}
+
+		u := entries
+		if id == "" {
+			u = temp
+		}
+		du, err := dirUsage(p)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+		u.Files += du.Files
+		u.Bytes += du.Bytes
+		return nil
+	})
+}
+
+// GC removes blobs and trees that were last used before cutoff, and
+// temporary files and quarantined repositories older than that.
+// Unpacked archives are removed along with their blob. It is safe to
+// run while the cache is in use: removed data is fetched again when it
+// is needed. Routes are not collected.
+func (c *Cache) GC(cutoff time.Time) (*GCResult, error) {
+	var r GCResult
+	if err := gcDir(c.Blob.dir, cutoff, &r.Blobs, &r.Temp); err != nil {
+		return nil, err
+	}
+	if err := gcDir(c.Tree.dir, cutoff, &r.Trees, &r.Temp); err != nil {
+		return nil, err
+	}
+	if err := c.Tree.gcMeta(&r.TreeMeta); err != nil {
+		return nil, err
+	}
+	if err := c.Git.gcQuarantine(cutoff, &r.Quarantine); err != nil {
+		return nil, err
+	}
+
+	// Archives are unpacked into a directory named for the blob.
+	archives := filepath.Join(c.root, "archives")
+	entries, err := ioutil.ReadDir(archives)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		u := &r.Archives
+		if strings.HasPrefix(e.Name(), "tmp") {
+			if !e.ModTime().Before(cutoff) {
+				continue
+			}
+			u = &r.Temp
+		} else if id, err := parseID(e.Name()); err != nil {
+			continue
+		} else if _, ok := c.Blob.Size(*id); ok {
+			continue
+		}
+
+		p := filepath.Join(archives, e.Name())
+		du, err := dirUsage(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return nil, err
+		}
+		u.Files += du.Files
+		u.Bytes += du.Bytes
+	}
+	return &r, nil
+}
+
+// VerifyResult describes the outcome of Verify.
+type VerifyResult struct {
+	// Blobs and Trees are the number of entries checked.
+	Blobs int
+	Trees int
+
+	// The IDs of corrupt entries.
+	CorruptBlobs []string
+	CorruptTrees []string
+}
+
+// verifyBlob checks the blob at p against id.
+func (c *Cache) verifyBlob(id plumbing.Hash, p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return c.Blob.Verify(id, f)
+}
+
+// verifyTree checks that the tree at p can be parsed, and is valid.
+func verifyTree(p string) bool {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return false
+	}
+	var t gitiles.Tree
+	if err := json.Unmarshal(content, &t); err != nil {
+		return false
+	}
+	return t.Check() == nil
+}
+
+// Verify checks all blobs against their IDs, and checks that all
+// trees are valid. Trees are stored under both commit and tree IDs,
+// so their IDs are not checked. If remove is set, corrupt entries
+// are deleted, so they are fetched again when needed.
+func (c *Cache) Verify(remove bool) (*VerifyResult, error) {
+	var r VerifyResult
+	if err := walkEntries(c.Blob.dir, func(s, p string, fi os.FileInfo) error {
+		if s == "" {
+			return nil
+		}
+		r.Blobs++
+		id, err := parseID(s)
+		ok := err == nil
+		if ok {
+			if ok, err = c.verifyBlob(*id, p); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			r.CorruptBlobs = append(r.CorruptBlobs, s)
+			if remove {
+				return os.Remove(p)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("blobs: %v", err)
+	}
+
+	if err := walkEntries(c.Tree.dir, func(s, p string, fi os.FileInfo) error {
+		if s == "" {
+			return nil
+		}
+		r.Trees++
+		if _, err := parseID(s); err == nil && verifyTree(p) {
+			return nil
+		}
+		r.CorruptTrees = append(r.CorruptTrees, s)
+		if remove {
+			return os.Remove(p)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("trees: %v", err)
+	}
+	return &r, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/google/slothfs/gitiles"
+)
+
+// storeBlob stores data in the cache, and sets its times to t.
+func storeBlob(t *testing.T, c *Cache, data []byte, tm time.Time) plumbing.Hash {
+	id := plumbing.ComputeHash(plumbing.BlobObject, data)
+	if _, err := c.Blob.Write(id, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := os.Chtimes(c.Blob.path(id), tm, tm); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestCacheGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	oldID := storeBlob(t, c, []byte("old"), old)
+	newID := storeBlob(t, c, []byte("new"), now)
+
+	tmp := filepath.Join(c.Blob.dir, "tmp123")
+	if err := ioutil.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tmp, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "archives", oldID.String())
+	if err := os.MkdirAll(archive, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(archive, "file"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tm := range []time.Time{old, now} {
+		q := filepath.Join(c.Git.quarantineDir, "host", "repo.git."+tm.Format(quarantineTimeFormat))
+		if err := os.MkdirAll(q, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(q, "HEAD"), []byte("ref: refs/heads/master\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := c.Usage()
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if before.Blobs.Files != 3 || before.Archives.Files != 1 || before.Quarantine.Files != 2 {
+		t.Errorf("Usage before: got %+v", before)
+	}
+
+	r, err := c.GC(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if r.Blobs.Files != 1 || r.Temp.Files != 1 || r.Archives.Files != 1 || r.Quarantine.Files != 1 {
+		t.Errorf("GC: got %+v", r)
+	}
+	if _, ok := c.Blob.Size(oldID); ok {
+		t.Errorf("old blob survived GC")
+	}
+	if _, ok := c.Blob.Size(newID); !ok {
+		t.Errorf("new blob was removed")
+	}
+
+	after, err := c.Usage()
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if after.Blobs.Files != 1 || after.Archives.Files != 0 || after.Quarantine.Files != 1 {
+		t.Errorf("Usage after: got %+v", after)
+	}
+}
+
+func TestCacheVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	now := time.Now()
+	good := storeBlob(t, c, []byte("good"), now)
+	bad := storeBlob(t, c, []byte("bad"), now)
+	if err := os.Chmod(c.Blob.path(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.Blob.path(bad), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	treeID := plumbing.ComputeHash(plumbing.TreeObject, []byte("tree"))
+	if err := c.Tree.AddWithMeta(&treeID, &gitiles.Tree{
+		ID: treeID.String(),
+		Entries: []gitiles.TreeEntry{
+			{Mode: 0100644, Type: "blob", ID: good.String(), Name: "file"},
+		},
+	}, TreeMeta{Repo: "platform/build"}); err != nil {
+		t.Fatalf("Tree.AddWithMeta: %v", err)
+	}
+	badTree := plumbing.ComputeHash(plumbing.TreeObject, []byte("bad"))
+	if err := os.MkdirAll(filepath.Dir(c.Tree.path(&badTree)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.Tree.path(&badTree), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, remove := range []bool{false, true} {
+		r, err := c.Verify(remove)
+		if err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+		if r.Blobs != 2 || r.Trees != 2 ||
+			len(r.CorruptBlobs) != 1 || r.CorruptBlobs[0] != bad.String() ||
+			len(r.CorruptTrees) != 1 || r.CorruptTrees[0] != badTree.String() {
+			t.Errorf("Verify(%v): got %+v", remove, r)
+		}
+	}
+
+	r, err := c.Verify(false)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if r.Blobs != 1 || r.Trees != 1 || len(r.CorruptBlobs) != 0 || len(r.CorruptTrees) != 0 {
+		t.Errorf("Verify after removal: got %+v", r)
+	}
+}
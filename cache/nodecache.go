@@ -0,0 +1,189 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// NodeKey identifies file content that can be served by a single
+// inode. The full git mode is part of the key, so a symlink never
+// shares an inode with a file that has the link target as content.
+type NodeKey struct {
+	ID   plumbing.Hash
+	Mode uint32
+}
+
+// NodeCacheStats counts how often inode numbers are shared.
+type NodeCacheStats struct {
+	// Nodes is the number of inode numbers handed out since the
+	// cache was opened.
+	Nodes int
+
+	// Hits is the number of lookups for content that already had
+	// an inode number handed out.
+	Hits int64
+
+	// Misses is the number of lookups for new content.
+	Misses int64
+}
+
+// firstIno is the first inode number handed out. Inode 1 is the root
+// of a FUSE mount, and go-fuse numbers other nodes from 1<<63.
+const firstIno = 2
+
+// NodeCache assigns inode numbers to file content. In a FUSE mount,
+// nodes added with the same inode number are the same inode, so a
+// blob that appears in multiple checkouts, revisions or repositories
+// takes up kernel page cache only once, and is moved from the FUSE
+// process into the kernel only once. Mounts in one process that use
+// the same Cache get the same numbers for the same content. It is
+// safe for concurrent use from multiple goroutines.
+type NodeCache struct {
+	mu     sync.Mutex
+	inos   map[NodeKey]uint64
+	used   map[NodeKey]bool
+	next   uint64
+	hits   int64
+	misses int64
+
+	// f, if set, is where new inode numbers are appended.
+	f *os.File
+}
+
+// NewNodeCache returns a NodeCache that keeps inode numbers in memory
+// only.
+func NewNodeCache() *NodeCache {
+	return &NodeCache{
+		inos: map[NodeKey]uint64{},
+		used: map[NodeKey]bool{},
+		next: firstIno,
+	}
+}
+
+// NodeCachePath returns the location of the persisted inode numbers
+// for the cache in the given directory.
+func NodeCachePath(dir string) string {
+	return filepath.Join(dir, "inodes")
+}
+
+// OpenNodeCache returns a NodeCache that stores the inode numbers it
+// hands out in the file at path, so content keeps its inode number
+// across restarts. Tools that record inode numbers, such as the git
+// index, then don't see files as changed after a remount.
+func OpenNodeCache(path string) (*NodeCache, error) {
+	c := NewNodeCache()
+	if err := c.load(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.f = f
+	return c, nil
+}
+
+// load reads "ID MODE INO" lines. Malformed lines, eg. from a crash
+// during a write, are skipped. If processes sharing the file handed
+// out the same number twice, the first entry wins, and the other
+// content gets a new number.
+func (c *NodeCache) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	taken := map[uint64]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || len(fields[0]) != 40 {
+			continue
+		}
+		mode, err := strconv.ParseUint(fields[1], 8, 32)
+		if err != nil {
+			continue
+		}
+		ino, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil || ino < firstIno || ino >= 1<<63 || taken[ino] {
+			continue
+		}
+
+		k := NodeKey{plumbing.NewHash(fields[0]), uint32(mode)}
+		if _, ok := c.inos[k]; ok {
+			continue
+		}
+		c.inos[k] = ino
+		taken[ino] = true
+		if ino >= c.next {
+			c.next = ino + 1
+		}
+	}
+	return scanner.Err()
+}
+
+// Ino returns the inode number for the blob id with the given git
+// mode.
+func (c *NodeCache) Ino(id plumbing.Hash, mode uint32) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := NodeKey{id, mode}
+	if c.used[k] {
+		c.hits++
+	} else {
+		c.misses++
+		c.used[k] = true
+	}
+
+	ino, ok := c.inos[k]
+	if ok {
+		return ino
+	}
+
+	ino = c.next
+	c.next++
+	c.inos[k] = ino
+	if c.f != nil {
+		if _, err := fmt.Fprintf(c.f, "%s %o %d\n", id, mode, ino); err != nil {
+			log.Printf("NodeCache: %v", err)
+		}
+	}
+	return ino
+}
+
+// Stats returns the sharing statistics since the cache was opened.
+func (c *NodeCache) Stats() NodeCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return NodeCacheStats{
+		Nodes:  len(c.used),
+		Hits:   c.hits,
+		Misses: c.misses,
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestNodeCacheMode(t *testing.T) {
+	c := NewNodeCache()
+	id := plumbing.ComputeHash(plumbing.BlobObject, []byte("target"))
+
+	exec := c.Ino(id, 0100755)
+	if got := c.Ino(id, 0100755); got != exec {
+		t.Errorf("Ino(0100755): got %d, want %d", got, exec)
+	}
+	if got := c.Ino(id, 0120000); got == exec {
+		t.Errorf("Ino(0120000): symlink shares inode with executable file")
+	}
+	if got := c.Ino(id, 0100644); got == exec {
+		t.Errorf("Ino(0100644): non-executable file shares inode with executable file")
+	}
+
+	want := NodeCacheStats{Nodes: 3, Hits: 1, Misses: 3}
+	if got := c.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+}
+
+func TestNodeCachePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "inodes")
+	c, err := OpenNodeCache(path)
+	if err != nil {
+		t.Fatalf("OpenNodeCache: %v", err)
+	}
+	a := plumbing.ComputeHash(plumbing.BlobObject, []byte("a"))
+	b := plumbing.ComputeHash(plumbing.BlobObject, []byte("b"))
+	inoA := c.Ino(a, 0100644)
+	inoB := c.Ino(b, 0100644)
+
+	// A truncated line, and a number that is already taken.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := plumbing.ComputeHash(plumbing.BlobObject, []byte("other"))
+	if _, err := f.WriteString(other.String() + " 100644 " + "2\n" + a.String()[:10]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	c, err = OpenNodeCache(path)
+	if err != nil {
+		t.Fatalf("OpenNodeCache: %v", err)
+	}
+	if got := c.Ino(b, 0100644); got != inoB {
+		t.Errorf("Ino(b) after reopen: got %d, want %d", got, inoB)
+	}
+	if got := c.Ino(a, 0100644); got != inoA {
+		t.Errorf("Ino(a) after reopen: got %d, want %d", got, inoA)
+	}
+	if got := c.Ino(other, 0100644); got == inoA || got == inoB {
+		t.Errorf("Ino(other) = %d, shares a number with other content", got)
+	}
+	if got := c.Stats().Hits; got != 0 {
+		t.Errorf("got %d hits after reopen, want 0", got)
+	}
+}
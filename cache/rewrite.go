@@ -0,0 +1,67 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// URLRewrite replaces the part of a git URL matching Pattern with
+// Replacement, eg. to clone from a mirror instead of the host
+// named in the manifest.
+type URLRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+type urlRewriteEntry struct {
+	Pattern     string
+	Replacement string
+}
+
+// ReadURLRewrites reads a JSON file containing a list of
+// {"Pattern": REGEXP, "Replacement": STRING} entries.
+func ReadURLRewrites(contents []byte) ([]URLRewrite, error) {
+	var entries []urlRewriteEntry
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return nil, err
+	}
+
+	var result []URLRewrite
+	for _, e := range entries {
+		if e.Pattern == "" {
+			return nil, fmt.Errorf("must set Pattern")
+		}
+		re, err := regexp.Compile(e.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, URLRewrite{re, e.Replacement})
+	}
+	return result, nil
+}
+
+// RewriteURL applies the first matching rule to the URL. Replacement
+// may refer to submatches as in regexp.Regexp.ReplaceAllString.
+func RewriteURL(rules []URLRewrite, u string) string {
+	for _, r := range rules {
+		if r.Pattern.MatchString(u) {
+			return r.Pattern.ReplaceAllString(u, r.Replacement)
+		}
+	}
+	return u
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import "testing"
+
+func TestRewriteURL(t *testing.T) {
+	rules, err := ReadURLRewrites([]byte(`[
+ {"Pattern": "^https://android.googlesource.com/", "Replacement": "http://mirror.corp/aosp/"},
+ {"Pattern": "^https://([a-z]+).googlesource.com/", "Replacement": "http://mirror.corp/$1/"}]`))
+	if err != nil {
+		t.Fatalf("ReadURLRewrites: %v", err)
+	}
+
+	for in, want := range map[string]string{
+		"https://android.googlesource.com/platform/art": "http://mirror.corp/aosp/platform/art",
+		"https://gerrit.googlesource.com/gitiles":       "http://mirror.corp/gerrit/gitiles",
+		"https://github.com/google/slothfs":             "https://github.com/google/slothfs",
+	} {
+		if got := RewriteURL(rules, in); got != want {
+			t.Errorf("RewriteURL(%q): got %q, want %q", in, got, want)
+		}
+	}
+
+	if _, err := ReadURLRewrites([]byte(`[{"Replacement": "x"}]`)); err == nil {
+		t.Errorf("ReadURLRewrites succeeded without pattern")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// Route stores the data for repositories whose URL matches Pattern
+// in a separate cache under Dir, eg. to put large prebuilt
+// repositories on a big, slow disk.
+type Route struct {
+	Pattern *regexp.Regexp
+	Dir     string
+}
+
+type routeEntry struct {
+	Pattern string
+	Dir     string
+}
+
+// ReadRoutes reads a JSON file containing a list of
+// {"Pattern": REGEXP, "Dir": DIRECTORY} entries.
+func ReadRoutes(contents []byte) ([]Route, error) {
+	var entries []routeEntry
+	if err := json.Unmarshal(contents, &entries); err != nil {
+		return nil, err
+	}
+
+	var result []Route
+	for _, e := range entries {
+		if e.Pattern == "" || e.Dir == "" {
+			return nil, fmt.Errorf("must set Pattern and Dir")
+		}
+		re, err := regexp.Compile(e.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, Route{re, e.Dir})
+	}
+	return result, nil
+}
+
+type routedCache struct {
+	pattern *regexp.Regexp
+	cache   *Cache
+}
+
+// ForRepo returns the cache for the repository with the given URL:
+// the cache of the first matching route, or c itself if no route
+// matches.
+func (c *Cache) ForRepo(url string) *Cache {
+	for _, r := range c.routes {
+		if r.pattern.MatchString(url) {
+			return r.cache
+		}
+	}
+	return c
+}
+
+// Roots returns the directories of c and of all its routes.
+func (c *Cache) Roots() []string {
+	roots := []string{c.root}
+	for _, r := range c.routes {
+		roots = append(roots, r.cache.root)
+	}
+	return roots
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	routes, err := ReadRoutes([]byte(`[{"Pattern": "/prebuilts/", "Dir": "` + filepath.Join(dir, "big") + `"}]`))
+	if err != nil {
+		t.Fatalf("ReadRoutes: %v", err)
+	}
+	c, err := NewCache(filepath.Join(dir, "main"), Options{Routes: routes})
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	if got := c.ForRepo("https://host/platform/build"); got != c {
+		t.Errorf("ForRepo(platform/build) got %s, want main cache", got.Root())
+	}
+	big := c.ForRepo("https://host/platform/prebuilts/clang")
+	if want := filepath.Join(dir, "big"); big.Root() != want {
+		t.Fatalf("ForRepo(prebuilts) got %s, want %s", big.Root(), want)
+	}
+	if big.Fetches != c.Fetches {
+		t.Errorf("route has its own fetch log")
+	}
+
+	data := []byte("hello")
+	id := plumbing.ComputeHash(plumbing.BlobObject, data)
+	if _, err := big.Blob.Write(id, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, ok := c.Blob.Open(id); ok {
+		t.Errorf("blob for routed repo found in main cache")
+	}
+	if err := c.CheckWritable(); err != nil {
+		t.Errorf("CheckWritable: %v", err)
+	}
+
+	if _, err := ReadRoutes([]byte(`[{"Pattern": "x"}]`)); err == nil {
+		t.Errorf("ReadRoutes succeeded without Dir")
+	}
+}
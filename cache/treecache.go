@@ -92,32 +92,39 @@ func (c *TreeCache) Add(id *plumbing.Hash, tree *gitiles.Tree) error {
 }
 
 func (c *TreeCache) add(id *plumbing.Hash, tree *gitiles.Tree) error {
+	return c.writeJSON(c.path(id), tree)
+}
+
+// writeJSON atomically writes v as JSON to p.
+func (c *TreeCache) writeJSON(p string, v interface{}) error {
 	f, err := ioutil.TempFile(c.dir, "tmp")
 	if err != nil {
 		return err
 	}
 
-	content, err := json.MarshalIndent(tree, "", " ")
-	if err != nil {
-		return err
+	content, err := json.MarshalIndent(v, "", " ")
+	if err == nil {
+		_, err = f.Write(content)
 	}
-	if _, err := f.Write(content); err != nil {
-		return err
+	if err == nil {
+		err = f.Sync()
 	}
-
-	if err := f.Close(); err != nil {
-		return err
-
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
 
-	dir := filepath.Dir(c.path(id))
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
+	dir := filepath.Dir(p)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
 	}
-	if err := os.Rename(f.Name(), c.path(id)); err != nil {
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
 		return err
 	}
-	return nil
+	return syncDir(dir)
 }
 
 // GetTree loads the Tree from an on-disk Git repository.
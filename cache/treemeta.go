@@ -0,0 +1,142 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/slothfs/gitiles"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// treeMetaDir is the directory within the tree cache that holds
+// TreeMeta records, laid out like the trees themselves. Its name is
+// not 3 characters long, so walkEntries does not mistake it for a
+// shard.
+const treeMetaDir = "meta"
+
+// TreeMeta records where a cached tree came from.
+type TreeMeta struct {
+	// Repo is the clone URL or name of the repository.
+	Repo string
+
+	// Revision is the commit or tree that was asked for.
+	Revision string
+
+	// Fetched is when the tree was added to the cache.
+	Fetched time.Time
+}
+
+// TreeInfo describes a tree in the cache. The TreeMeta fields are
+// empty for trees that were added without metadata.
+type TreeInfo struct {
+	ID      string
+	Bytes   int64
+	LastUse time.Time
+	TreeMeta
+}
+
+func (c *TreeCache) metaPath(id *plumbing.Hash) string {
+	str := id.String()
+	return filepath.Join(c.dir, treeMetaDir, str[:3], str[3:])
+}
+
+// AddWithMeta adds a tree to the cache, like Add, and records meta
+// for it. If Fetched is zero, it is set to the current time.
+func (c *TreeCache) AddWithMeta(id *plumbing.Hash, tree *gitiles.Tree, meta TreeMeta) error {
+	if err := c.Add(id, tree); err != nil {
+		return err
+	}
+	if meta.Fetched.IsZero() {
+		meta.Fetched = time.Now()
+	}
+	ids := []*plumbing.Hash{id}
+	if id.String() != tree.ID {
+		treeID, err := parseID(tree.ID)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, treeID)
+	}
+	for _, id := range ids {
+		if err := c.writeJSON(c.metaPath(id), &meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Meta returns the metadata recorded for a tree.
+func (c *TreeCache) Meta(id *plumbing.Hash) (*TreeMeta, error) {
+	content, err := ioutil.ReadFile(c.metaPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var meta TreeMeta
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.metaPath(id), err)
+	}
+	return &meta, nil
+}
+
+// List returns all trees in the cache, sorted by ID.
+func (c *TreeCache) List() ([]*TreeInfo, error) {
+	var infos []*TreeInfo
+	if err := walkEntries(c.dir, func(s, p string, fi os.FileInfo) error {
+		id, err := parseID(s)
+		if err != nil {
+			return nil
+		}
+		info := &TreeInfo{
+			ID:      s,
+			Bytes:   fi.Size(),
+			LastUse: lastUse(fi),
+		}
+		if meta, err := c.Meta(id); err == nil {
+			info.TreeMeta = *meta
+		}
+		infos = append(infos, info)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// gcMeta removes the metadata of trees that are no longer cached.
+func (c *TreeCache) gcMeta(u *DirUsage) error {
+	return walkEntries(filepath.Join(c.dir, treeMetaDir), func(s, p string, fi os.FileInfo) error {
+		id, err := parseID(s)
+		if err != nil {
+			return nil
+		}
+		if _, err := os.Stat(c.path(id)); !os.IsNotExist(err) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		u.Files++
+		u.Bytes += fi.Size()
+		return nil
+	})
+}
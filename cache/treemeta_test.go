@@ -0,0 +1,95 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/slothfs/gitiles"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestTreeMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewCache(dir, Options{Offline: true})
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	commitID := plumbing.ComputeHash(plumbing.CommitObject, []byte("commit"))
+	treeID := plumbing.ComputeHash(plumbing.TreeObject, []byte("tree"))
+	fetched := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	meta := TreeMeta{Repo: "https://host/platform/build", Revision: commitID.String(), Fetched: fetched}
+	if err := c.Tree.AddWithMeta(&commitID, &gitiles.Tree{ID: treeID.String()}, meta); err != nil {
+		t.Fatalf("AddWithMeta: %v", err)
+	}
+	plainID := plumbing.ComputeHash(plumbing.TreeObject, []byte("plain"))
+	if err := c.Tree.Add(&plainID, &gitiles.Tree{ID: plainID.String()}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	for _, id := range []plumbing.Hash{commitID, treeID} {
+		got, err := c.Tree.Meta(&id)
+		if err != nil {
+			t.Fatalf("Meta(%s): %v", id, err)
+		}
+		if !got.Fetched.Equal(fetched) || got.Repo != meta.Repo || got.Revision != meta.Revision {
+			t.Errorf("Meta(%s): got %+v, want %+v", id, got, meta)
+		}
+	}
+	if _, err := c.Tree.Meta(&plainID); err == nil {
+		t.Errorf("Meta(%s) succeeded for tree without metadata", plainID)
+	}
+
+	infos, err := c.Tree.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	withMeta := 0
+	for _, info := range infos {
+		if info.Repo != "" {
+			withMeta++
+		}
+	}
+	if len(infos) != 3 || withMeta != 2 {
+		t.Errorf("List: got %d trees, %d with metadata, want 3 and 2", len(infos), withMeta)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(c.Tree.path(&commitID), old, old); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.GC(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if r.Trees.Files != 1 || r.TreeMeta.Files != 1 {
+		t.Errorf("GC: got %d trees and %d metadata files removed, want 1 and 1", r.Trees.Files, r.TreeMeta.Files)
+	}
+	if _, err := c.Tree.Meta(&commitID); err == nil {
+		t.Errorf("metadata of collected tree %s survived GC", commitID)
+	}
+	if _, err := c.Tree.Meta(&treeID); err != nil {
+		t.Errorf("Meta(%s) after GC: %v", treeID, err)
+	}
+}
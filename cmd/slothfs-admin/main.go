@@ -0,0 +1,407 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-admin performs maintenance on the SlothFS cache.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/config"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: slothfs-admin [-cache DIR] [-json] COMMAND
+
+Commands:
+  version   print the layout version of the cache
+  migrate   convert the cache to the current layout version
+  fetches   summarize the network fetches per repository
+  export DIR
+            hardlink the blobs whose IDs are read from stdin into DIR
+  stats     print the disk usage of blobs, trees, archives and repositories
+  trees [REPO]
+            list the cached trees, with the repository and revision
+            they were fetched for; with REPO, only those whose
+            repository contains REPO
+  gc        remove blobs and trees that were not used within -max_age
+  verify    check blobs against their IDs, and that trees are valid;
+            with -repair, remove corrupt entries
+  prefetch URL...
+            clone the repositories, or fetch them if they were cloned
+  evict-repo URL...
+            remove the clones of the repositories
+
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// jsonOutput is set by the -json flag.
+var jsonOutput bool
+
+// printJSON prints v as JSON.
+func printJSON(v interface{}) error {
+	content, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(content, '\n'))
+	return err
+}
+
+// openCache opens the cache for maintenance. Unless network is set,
+// the cache is offline.
+func openCache(dir string, network bool) (*cache.Cache, error) {
+	return cache.NewCache(dir, cache.Options{
+		Offline: !network,
+
+		// Don't fetch all repositories in the background.
+		FetchFrequency: -1,
+	})
+}
+
+// printStats prints the disk usage of the cache.
+func printStats(cacheDir string) error {
+	c, err := openCache(cacheDir, false)
+	if err != nil {
+		return err
+	}
+	u, err := c.Usage()
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(u)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "PART\tFILES\tBYTES\n")
+	fmt.Fprintf(w, "blobs\t%d\t%d\n", u.Blobs.Files, u.Blobs.Bytes)
+	fmt.Fprintf(w, "trees\t%d\t%d\n", u.Trees.Files, u.Trees.Bytes)
+	fmt.Fprintf(w, "archives\t%d\t%d\n", u.Archives.Files, u.Archives.Bytes)
+	fmt.Fprintf(w, "quarantine\t%d\t%d\n", u.Quarantine.Files, u.Quarantine.Bytes)
+	for _, r := range u.Repos {
+		rel, err := filepath.Rel(c.Root(), r.Dir)
+		if err != nil {
+			rel = r.Dir
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", rel, r.Files, r.Bytes)
+	}
+	return w.Flush()
+}
+
+// printTrees lists the cached trees whose repository contains repo.
+func printTrees(cacheDir, repo string) error {
+	c, err := openCache(cacheDir, false)
+	if err != nil {
+		return err
+	}
+	infos, err := c.Tree.List()
+	if err != nil {
+		return err
+	}
+	var selected []*cache.TreeInfo
+	for _, info := range infos {
+		if repo == "" || strings.Contains(info.Repo, repo) {
+			selected = append(selected, info)
+		}
+	}
+	if jsonOutput {
+		return printJSON(selected)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "ID\tBYTES\tLAST USE\tFETCHED\tREPO\tREVISION\n")
+	for _, info := range selected {
+		fetched := "-"
+		if !info.Fetched.IsZero() {
+			fetched = info.Fetched.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", info.ID, info.Bytes,
+			info.LastUse.Format(time.RFC3339), fetched, info.Repo, info.Revision)
+	}
+	return w.Flush()
+}
+
+// gc removes cache entries that were not used within maxAge.
+func gc(cacheDir string, maxAge time.Duration) error {
+	c, err := openCache(cacheDir, false)
+	if err != nil {
+		return err
+	}
+	r, err := c.GC(time.Now().Add(-maxAge))
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(r)
+	}
+	log.Printf("removed %d blobs (%d bytes), %d trees (%d bytes), %d tree metadata files (%d bytes), %d archive files (%d bytes), %d quarantined repository files (%d bytes), %d temporary files (%d bytes)",
+		r.Blobs.Files, r.Blobs.Bytes, r.Trees.Files, r.Trees.Bytes, r.TreeMeta.Files, r.TreeMeta.Bytes,
+		r.Archives.Files, r.Archives.Bytes, r.Quarantine.Files, r.Quarantine.Bytes, r.Temp.Files, r.Temp.Bytes)
+	return nil
+}
+
+// verify checks the blobs and trees of the cache. It fails if there
+// are corrupt entries that were not removed.
+func verify(cacheDir string, repair bool) error {
+	c, err := openCache(cacheDir, false)
+	if err != nil {
+		return err
+	}
+	r, err := c.Verify(repair)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		if err := printJSON(r); err != nil {
+			return err
+		}
+	} else {
+		for _, id := range r.CorruptBlobs {
+			fmt.Printf("blob %s\n", id)
+		}
+		for _, id := range r.CorruptTrees {
+			fmt.Printf("tree %s\n", id)
+		}
+		log.Printf("checked %d blobs and %d trees, %d corrupt", r.Blobs, r.Trees,
+			len(r.CorruptBlobs)+len(r.CorruptTrees))
+	}
+	if !repair && len(r.CorruptBlobs)+len(r.CorruptTrees) > 0 {
+		return fmt.Errorf("cache has corrupt entries; use -repair to remove them")
+	}
+	return nil
+}
+
+// repoResult is the JSON output for prefetch and evict-repo.
+type repoResult struct {
+	URL   string
+	Dir   string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// forRepos runs fn for each URL, and reports the results. It fails
+// if any of the calls failed.
+func forRepos(urls []string, fn func(url string) (string, error)) error {
+	var results []repoResult
+	failed := 0
+	for _, u := range urls {
+		dir, err := fn(u)
+		r := repoResult{URL: u, Dir: dir}
+		if err != nil {
+			r.Error = err.Error()
+			failed++
+		}
+		results = append(results, r)
+		if !jsonOutput {
+			if err != nil {
+				log.Printf("%s: %v", u, err)
+			} else if dir != "" {
+				fmt.Println(dir)
+			}
+		}
+	}
+	if jsonOutput {
+		if err := printJSON(results); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repositories failed", failed, len(urls))
+	}
+	return nil
+}
+
+// printFetches prints the fetch statistics per repository, with the
+// largest download volume first.
+func printFetches(logFile string) error {
+	f, err := os.Open(logFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, err := cache.ReadFetchLog(f)
+	if err != nil {
+		return err
+	}
+
+	stats := cache.AggregateFetches(records)
+	if jsonOutput {
+		return printJSON(stats)
+	}
+	var repos []string
+	for k := range stats {
+		repos = append(repos, k)
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return stats[repos[i]].Bytes > stats[repos[j]].Bytes
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "REPO\tFETCHES\tERRORS\tBYTES\tAVG LATENCY\n")
+	for _, r := range repos {
+		st := stats[r]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%v\n", r, st.Count, st.Errors, st.Bytes,
+			st.Latency/time.Duration(st.Count))
+	}
+	return w.Flush()
+}
+
+// exportBlobs hardlinks the blobs listed on stdin into dir.
+func exportBlobs(cacheDir, dir string) error {
+	c, err := openCache(cacheDir, false)
+	if err != nil {
+		return err
+	}
+
+	var ids []plumbing.Hash
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		b, err := hex.DecodeString(line)
+		if err != nil || len(b) != 20 {
+			return fmt.Errorf("invalid blob ID %q", line)
+		}
+		var id plumbing.Hash
+		copy(id[:], b)
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	missing, err := c.Blob.Export(dir, ids)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		var ms []string
+		for _, id := range missing {
+			ms = append(ms, id.String())
+		}
+		return printJSON(struct {
+			Exported int
+			Missing  []string
+		}{len(ids) - len(missing), ms})
+	}
+	for _, id := range missing {
+		fmt.Println(id.String())
+	}
+	log.Printf("exported %d blobs to %s, %d not in cache", len(ids)-len(missing), dir, len(missing))
+	return nil
+}
+
+func main() {
+	cacheDir := flag.String("cache", filepath.Join(os.Getenv("HOME"), ".cache", "slothfs"), "cache dir")
+	maxAge := flag.Duration("max_age", 30*24*time.Hour, "For gc, remove entries that were not used for this long.")
+	repair := flag.Bool("repair", false, "For verify, remove corrupt entries, so they are fetched again.")
+	flag.BoolVar(&jsonOutput, "json", false, "Print results as JSON.")
+	flag.Usage = usage
+	config.Parse()
+
+	if len(flag.Args()) < 1 {
+		usage()
+	}
+
+	switch flag.Arg(0) {
+	case "version":
+		v, err := cache.ReadLayoutVersion(*cacheDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jsonOutput {
+			err = printJSON(struct{ Version, Current int }{v, cache.LayoutVersion})
+		} else {
+			fmt.Printf("%d (current: %d)\n", v, cache.LayoutVersion)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "migrate":
+		before, err := cache.ReadLayoutVersion(*cacheDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := cache.Migrate(*cacheDir); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("migrated %s from layout version %d to %d", *cacheDir, before, cache.LayoutVersion)
+	case "fetches":
+		if err := printFetches(cache.FetchLogPath(*cacheDir)); err != nil {
+			log.Fatal(err)
+		}
+	case "export":
+		if len(flag.Args()) != 2 {
+			usage()
+		}
+		if err := exportBlobs(*cacheDir, flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+	case "stats":
+		if err := printStats(*cacheDir); err != nil {
+			log.Fatal(err)
+		}
+	case "trees":
+		if len(flag.Args()) > 2 {
+			usage()
+		}
+		if err := printTrees(*cacheDir, flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+	case "gc":
+		if err := gc(*cacheDir, *maxAge); err != nil {
+			log.Fatal(err)
+		}
+	case "verify":
+		if err := verify(*cacheDir, *repair); err != nil {
+			log.Fatal(err)
+		}
+	case "prefetch", "evict-repo":
+		if len(flag.Args()) < 2 {
+			usage()
+		}
+		c, err := openCache(*cacheDir, flag.Arg(0) == "prefetch")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fn := c.Git.Remove
+		if flag.Arg(0) == "prefetch" {
+			fn = func(u string) (string, error) { return "", c.Git.Update(u) }
+		}
+		if err := forRepos(flag.Args()[1:], fn); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		usage()
+	}
+}
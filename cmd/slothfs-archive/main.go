@@ -0,0 +1,346 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-archive writes the workspace described by an expanded
+// manifest as a tar file, using the SlothFS cache and Gitiles. It
+// does not need FUSE. The output is deterministic: entries are
+// sorted, and timestamps and owners are fixed.
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/manifest"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// archiveEntry is a single file in the workspace.
+type archiveEntry struct {
+	// path within the workspace.
+	path string
+	mode int
+	id   plumbing.Hash
+
+	// for symlinks created by linkfile.
+	target string
+
+	// where to fetch the blob from, if it is not cached.
+	repo     *gitiles.RepoService
+	revision string
+	repoPath string
+}
+
+type archiver struct {
+	cache   *cache.Cache
+	service *gitiles.Service
+	mtime   time.Time
+	tw      *tar.Writer
+
+	// directories already written.
+	dirs map[string]bool
+}
+
+func parseID(s string) (*plumbing.Hash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 20 {
+		return nil, fmt.Errorf("revision %q is not a SHA1; the manifest must be expanded", s)
+	}
+
+	var h plumbing.Hash
+	copy(h[:], b)
+	return &h, nil
+}
+
+// getTree returns the recursive tree for a project revision, from
+// the cache if possible.
+func (a *archiver) getTree(repo *gitiles.RepoService, revision string) (*gitiles.Tree, error) {
+	id, err := parseID(revision)
+	if err != nil {
+		return nil, err
+	}
+	if tree, err := a.cache.Tree.Get(id); err == nil {
+		return tree, nil
+	}
+
+	tree, err := repo.GetTree(revision, "", true)
+	if err != nil {
+		return nil, fmt.Errorf("GetTree(%s, %s): %v", repo.Name, revision, err)
+	}
+	meta := cache.TreeMeta{Repo: repo.Name, Revision: revision}
+	if err := a.cache.Tree.AddWithMeta(id, tree, meta); err != nil {
+		log.Printf("TreeCache.Add(%s): %v", id, err)
+	}
+	return tree, nil
+}
+
+// entries returns all files of the manifest, sorted by path.
+func (a *archiver) entries(mf *manifest.Manifest) ([]*archiveEntry, error) {
+	byPath := map[string]*archiveEntry{}
+	for _, p := range mf.Project {
+		repo := a.service.NewRepoService(p.Name)
+		revision := mf.ProjectRevision(&p)
+		tree, err := a.getTree(repo, revision)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range tree.Entries {
+			if e.Type != "blob" {
+				continue
+			}
+			id, err := parseID(e.ID)
+			if err != nil {
+				return nil, err
+			}
+			name := path.Join(p.GetPath(), e.Name)
+			byPath[name] = &archiveEntry{
+				path:     name,
+				mode:     e.Mode,
+				id:       *id,
+				repo:     repo,
+				revision: revision,
+				repoPath: e.Name,
+			}
+		}
+	}
+
+	for _, p := range mf.Project {
+		for _, c := range p.Copyfile {
+			src, ok := byPath[path.Join(p.GetPath(), c.Src)]
+			if !ok {
+				log.Printf("copyfile %s: source %s not found", c.Dest, c.Src)
+				continue
+			}
+			copied := *src
+			copied.path = c.Dest
+			byPath[c.Dest] = &copied
+		}
+		for _, l := range p.Linkfile {
+			target, err := filepath.Rel(path.Dir(l.Dest), path.Join(p.GetPath(), l.Src))
+			if err != nil {
+				return nil, err
+			}
+			byPath[l.Dest] = &archiveEntry{
+				path:   l.Dest,
+				mode:   0120000,
+				target: filepath.ToSlash(target),
+			}
+		}
+	}
+
+	var result []*archiveEntry
+	for _, e := range byPath {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].path < result[j].path })
+	return result, nil
+}
+
+// open returns the blob from the cache, fetching it from Gitiles
+// first if necessary.
+func (a *archiver) open(e *archiveEntry) (*os.File, error) {
+	if f, ok := a.cache.Blob.Open(e.id); ok {
+		return f, nil
+	}
+
+	rd, err := e.repo.GetBlobStream(e.revision, e.repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("GetBlobStream(%s, %s): %v", e.repo.Name, e.repoPath, err)
+	}
+	defer rd.Close()
+	if _, err := a.cache.Blob.Write(e.id, rd); err != nil {
+		return nil, fmt.Errorf("CAS.Write(%s): %v", e.id, err)
+	}
+	f, ok := a.cache.Blob.Open(e.id)
+	if !ok {
+		return nil, fmt.Errorf("blob %s missing after fetch", e.id)
+	}
+	return f, nil
+}
+
+// writeDir writes headers for dir and its parents, if necessary.
+func (a *archiver) writeDir(dir string) error {
+	if dir == "." || dir == "/" || a.dirs[dir] {
+		return nil
+	}
+	if err := a.writeDir(path.Dir(dir)); err != nil {
+		return err
+	}
+	a.dirs[dir] = true
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir + "/",
+		Mode:     0755,
+		ModTime:  a.mtime,
+	})
+}
+
+func (a *archiver) write(e *archiveEntry) error {
+	if err := a.writeDir(path.Dir(e.path)); err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:    e.path,
+		ModTime: a.mtime,
+	}
+	if e.mode&0170000 == 0120000 {
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Mode = 0777
+		hdr.Linkname = e.target
+		if hdr.Linkname == "" {
+			f, err := a.open(e)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			hdr.Linkname = string(data)
+		}
+		return a.tw.WriteHeader(hdr)
+	}
+
+	f, err := a.open(e)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Mode = 0644
+	if e.mode&0111 != 0 {
+		hdr.Mode = 0755
+	}
+	hdr.Size = fi.Size()
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, f)
+	return err
+}
+
+func main() {
+	cacheDir := flag.String("cache", filepath.Join(os.Getenv("HOME"), ".cache", "slothfs"), "cache dir")
+	output := flag.String("o", "", "output file. If it ends in .gz, the output is compressed. Default is stdout.")
+	compress := flag.Bool("gzip", false, "compress the output with gzip.")
+	mtime := flag.Int64("mtime", 0, "modification time (seconds since the epoch) for all entries.")
+	include := flag.String("include", "", "only archive projects whose path matches this regexp.")
+	exclude := flag.String("exclude", "", "do not archive projects whose path matches this regexp.")
+	gitilesOptions := gitiles.DefineFlags()
+	config.Parse()
+
+	if len(flag.Args()) != 1 {
+		log.Fatal("usage: slothfs-archive [-o OUT.tar] EXPANDED-MANIFEST")
+	}
+
+	mf, err := manifest.ParseFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("ParseFile: %v", err)
+	}
+	mf.Filter()
+
+	var includeRE, excludeRE *regexp.Regexp
+	if *include != "" {
+		if includeRE, err = regexp.Compile(*include); err != nil {
+			log.Fatalf("-include: %v", err)
+		}
+	}
+	if *exclude != "" {
+		if excludeRE, err = regexp.Compile(*exclude); err != nil {
+			log.Fatalf("-exclude: %v", err)
+		}
+	}
+	mf.FilterPaths(includeRE, excludeRE)
+
+	c, err := cache.NewCache(*cacheDir, cache.Options{})
+	if err != nil {
+		log.Fatalf("NewCache: %v", err)
+	}
+
+	service, err := gitiles.NewService(*gitilesOptions)
+	if err != nil {
+		log.Fatalf("NewService: %v", err)
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out = f
+		if strings.HasSuffix(*output, ".gz") || strings.HasSuffix(*output, ".tgz") {
+			*compress = true
+		}
+	}
+
+	var zw *gzip.Writer
+	w := io.Writer(out)
+	if *compress {
+		zw = gzip.NewWriter(out)
+		w = zw
+	}
+
+	a := &archiver{
+		cache:   c,
+		service: service,
+		mtime:   time.Unix(*mtime, 0),
+		tw:      tar.NewWriter(w),
+		dirs:    map[string]bool{},
+	}
+
+	entries, err := a.entries(mf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := a.write(e); err != nil {
+			log.Fatalf("%s: %v", e.path, err)
+		}
+	}
+	if err := a.tw.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
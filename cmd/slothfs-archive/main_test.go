@@ -0,0 +1,144 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/manifest"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := cache.NewCache(dir, cache.Options{Offline: true})
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	// Everything is in the cache, so Gitiles is never asked.
+	service, err := gitiles.NewService(gitiles.Options{Address: "http://localhost:0"})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+
+	blobs := map[string]string{}
+	tree := &gitiles.Tree{ID: "58d9fdae2c26d82e04f3fcafc4358b99109f0e70"}
+	for _, f := range []struct {
+		name, content string
+		mode          int
+	}{
+		{"file", "content\n", 0100644},
+		{"bin/tool", "#!/bin/sh\n", 0100755},
+		{"link", "file", 0120000},
+	} {
+		id := plumbing.ComputeHash(plumbing.BlobObject, []byte(f.content))
+		if _, err := c.Blob.Write(id, bytes.NewBufferString(f.content)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		blobs[f.name] = f.content
+		tree.Entries = append(tree.Entries, gitiles.TreeEntry{Mode: f.mode, Type: "blob", ID: id.String(), Name: f.name})
+	}
+	const revision = "ce34badf691d36e8048b63f89d1a86ee5fa4325c"
+	commit := plumbing.NewHash(revision)
+	if err := c.Tree.Add(&commit, tree); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	mf, err := manifest.Parse([]byte(`<manifest>
+<project name="platform/p" path="dir/p" revision="` + revision + `">
+  <copyfile src="file" dest="copy"/>
+  <linkfile src="file" dest="top"/>
+</project>
+</manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	var buf bytes.Buffer
+	a := &archiver{
+		cache:   c,
+		service: service,
+		mtime:   time.Unix(1, 0),
+		tw:      tar.NewWriter(&buf),
+		dirs:    map[string]bool{},
+	}
+	entries, err := a.entries(mf)
+	if err != nil {
+		t.Fatalf("entries: %v", err)
+	}
+	for _, e := range entries {
+		if err := a.write(e); err != nil {
+			t.Fatalf("write(%s): %v", e.path, err)
+		}
+	}
+	if err := a.tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	type entry struct {
+		Name     string
+		Type     byte
+		Mode     int64
+		Linkname string
+		Content  string
+	}
+	var got []entry
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !hdr.ModTime.Equal(time.Unix(1, 0)) {
+			t.Errorf("%s: got mtime %v", hdr.Name, hdr.ModTime)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		got = append(got, entry{hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Linkname, string(content)})
+	}
+
+	want := []entry{
+		{"copy", tar.TypeReg, 0644, "", blobs["file"]},
+		{"dir/", tar.TypeDir, 0755, "", ""},
+		{"dir/p/", tar.TypeDir, 0755, "", ""},
+		{"dir/p/bin/", tar.TypeDir, 0755, "", ""},
+		{"dir/p/bin/tool", tar.TypeReg, 0755, "", blobs["bin/tool"]},
+		{"dir/p/file", tar.TypeReg, 0644, "", blobs["file"]},
+		{"dir/p/link", tar.TypeSymlink, 0777, "file", ""},
+		{"top", tar.TypeSymlink, 0777, "dir/p/file", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got entries %v, want %v", got, want)
+	}
+}
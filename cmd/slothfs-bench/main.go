@@ -0,0 +1,109 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-bench compares a SlothFS workspace with a regular checkout.
+// It times mounting and syncing with the given commands, and replays
+// a list of file reads, eg. recorded with -track_access during a
+// build, against both trees.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/slothfs/bench"
+	"github.com/google/slothfs/config"
+)
+
+func main() {
+	traceFile := flag.String("trace", "", "File listing the paths to read, one per line, eg. a copy of .slothfs/accessed.")
+	slothfsDir := flag.String("slothfs", "", "Directory of the SlothFS workspace.")
+	mountCmd := flag.String("slothfs_mount", "", "Shell command that mounts SlothFS; it is timed, and unmounted at the end. Use an empty -cache for a cold mount.")
+	mountPoint := flag.String("mount_point", "", "Where -slothfs_mount mounts SlothFS. Defaults to -slothfs.")
+	mountTimeout := flag.Duration("mount_timeout", 5*time.Minute, "Give up if -slothfs_mount has not mounted after this long.")
+	slothfsSync := flag.String("slothfs_sync", "", "Shell command that syncs the SlothFS checkout, eg. a slothfs-populate invocation.")
+	checkoutDir := flag.String("checkout", "", "Directory of the regular checkout.")
+	checkoutSync := flag.String("checkout_sync", "", "Shell command that syncs the regular checkout, eg. 'repo sync'.")
+	asJSON := flag.Bool("json", false, "Print the results as JSON.")
+	config.Parse()
+
+	if *traceFile == "" || (*slothfsDir == "" && *checkoutDir == "") {
+		log.Fatal("usage: slothfs-bench -trace FILE [-slothfs DIR] [-checkout DIR]")
+	}
+
+	f, err := os.Open(*traceFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	paths, err := bench.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("ReadTrace(%s): %v", *traceFile, err)
+	}
+
+	var results []*bench.Result
+	if *slothfsDir != "" {
+		r := &bench.Result{Name: "slothfs"}
+		stop := func() error { return nil }
+		if *mountCmd != "" {
+			mnt := *mountPoint
+			if mnt == "" {
+				mnt = *slothfsDir
+			}
+			r.Mount, stop, err = bench.TimeMount(*mountCmd, mnt, *mountTimeout)
+			if err != nil {
+				log.Fatalf("TimeMount: %v", err)
+			}
+		}
+		if *slothfsSync != "" {
+			r.Sync, err = bench.TimeCommand(*slothfsSync)
+		}
+		if err == nil {
+			r.Reads = bench.Replay(*slothfsDir, paths)
+		}
+		if err := stop(); err != nil {
+			log.Printf("unmount: %v", err)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		results = append(results, r)
+	}
+
+	if *checkoutDir != "" {
+		r := &bench.Result{Name: "checkout"}
+		if *checkoutSync != "" {
+			if r.Sync, err = bench.TimeCommand(*checkoutSync); err != nil {
+				log.Fatal(err)
+			}
+		}
+		r.Reads = bench.Replay(*checkoutDir, paths)
+		results = append(results, r)
+	}
+
+	if *asJSON {
+		content, err := json.MarshalIndent(results, "", " ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(append(content, '\n'))
+		return
+	}
+	if err := bench.WriteReport(os.Stdout, results); err != nil {
+		log.Fatal(err)
+	}
+}
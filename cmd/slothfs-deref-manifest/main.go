@@ -0,0 +1,167 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-deref-manifest fills in the revision of each project of a
+// manifest, so it can be used to configure a workspace.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/manifest"
+	"github.com/google/slothfs/populate"
+)
+
+// derefProject is a project in the JSON output.
+type derefProject struct {
+	Name     string
+	Path     string
+	Revision string
+
+	// Branch is the branch the revision was resolved from. It
+	// is empty for revisions that were pinned in the input.
+	Branch   string `json:",omitempty"`
+	CloneURL string `json:",omitempty"`
+}
+
+// derefResult is the JSON output.
+type derefResult struct {
+	// Source is where the manifest came from: a file, stdin, or
+	// REPO@COMMIT.
+	Source     string
+	ResolvedAt time.Time
+	Projects   []derefProject
+}
+
+// commitRE matches revisions that are commit SHA1s rather than branches.
+var commitRE = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// readManifest reads a manifest file, or stdin for "-".
+func readManifest(name string) (*manifest.Manifest, error) {
+	if name != "-" {
+		return manifest.ParseFile(name)
+	}
+	content, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Parse(content)
+}
+
+func main() {
+	repo := flag.String("repo", "platform/manifest", "Fetch default.xml from this manifest repository.")
+	branch := flag.String("branch", "master", "Fetch the manifest at this branch, tag or commit of -repo.")
+	input := flag.String("manifest", "", "Read the manifest from this file, or - for stdin, instead of fetching it.")
+	format := flag.String("format", "xml", "Output format: xml, or json with the branch each revision was resolved from.")
+	extraRevisions := flag.String("extra_revisions", "", "Comma-separated PATH@REVISION pairs; also serve the project at PATH at REVISION, as PATH@REVISION.")
+	gitilesOptions := gitiles.DefineFlags()
+	config.Parse()
+
+	if *format != "xml" && *format != "json" {
+		log.Fatalf("-format must be xml or json, got %q", *format)
+	}
+
+	service, err := gitiles.NewService(*gitilesOptions)
+	if err != nil {
+		log.Fatalf("NewService: %v", err)
+	}
+
+	var mf *manifest.Manifest
+	var source string
+	if *input != "" {
+		source = *input
+		if source == "-" {
+			source = "stdin"
+		}
+		if mf, err = readManifest(*input); err != nil {
+			log.Fatalf("reading manifest %s: %v", source, err)
+		}
+	} else {
+		// Resolve the revision first, so the source names the
+		// commit that was read.
+		commit, err := service.NewRepoService(*repo).GetCommit(*branch)
+		if err != nil {
+			log.Fatalf("GetCommit(%s, %s): %v", *repo, *branch, err)
+		}
+		if mf, err = populate.FetchManifest(service, *repo, commit.Commit); err != nil {
+			log.Fatalf("FetchManifest: %v", err)
+		}
+		source = fmt.Sprintf("%s@%s", *repo, commit.Commit)
+	}
+	mf.Filter()
+
+	if *extraRevisions != "" {
+		for _, pair := range strings.Split(*extraRevisions, ",") {
+			i := strings.LastIndex(pair, "@")
+			if i < 0 {
+				log.Fatalf("-extra_revisions: %q is not PATH@REVISION", pair)
+			}
+			if err := mf.AddExtraRevision(pair[:i], pair[i+1:]); err != nil {
+				log.Fatalf("-extra_revisions: %v", err)
+			}
+		}
+	}
+
+	// Remember the branches, as DerefManifest replaces them with
+	// commits. Expand the extra revisions first, so their projects
+	// are included; DerefManifest would do so too.
+	if err := mf.ExpandRevisions(); err != nil {
+		log.Fatalf("ExpandRevisions: %v", err)
+	}
+	branches := map[string]string{}
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		if rev := mf.ProjectRevision(p); !commitRE.MatchString(rev) {
+			branches[p.GetPath()] = rev
+		}
+	}
+
+	resolvedAt := time.Now()
+	if err := populate.DerefManifest(service, mf); err != nil {
+		log.Fatalf("DerefManifest: %v", err)
+	}
+
+	var content []byte
+	if *format == "json" {
+		result := derefResult{Source: source, ResolvedAt: resolvedAt}
+		for i := range mf.Project {
+			p := &mf.Project[i]
+			dp := derefProject{
+				Name:     p.Name,
+				Path:     p.GetPath(),
+				Revision: mf.ProjectRevision(p),
+				CloneURL: p.CloneURL,
+				Branch:   branches[p.GetPath()],
+			}
+			result.Projects = append(result.Projects, dp)
+		}
+		content, err = json.MarshalIndent(result, "", " ")
+	} else {
+		content, err = mf.MarshalXML()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(content, '\n'))
+}
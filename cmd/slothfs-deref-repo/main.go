@@ -0,0 +1,104 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-deref-repo prints the manifest of a checkout made by the
+// repo tool, with each project pinned to the commit repo last synced,
+// so a SlothFS workspace can be compared with the checkout.
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/manifest"
+	"github.com/google/slothfs/populate"
+)
+
+// repoProject is a project in the JSON output.
+type repoProject struct {
+	Name     string
+	Path     string
+	Revision string
+
+	// Local work, with -local_status. It is nil for projects that
+	// are not checked out.
+	Local *populate.LocalWork `json:",omitempty"`
+}
+
+// annotate adds the local work to p as XML attributes.
+func annotate(p *manifest.Project, w *populate.LocalWork) {
+	if w.Dirty {
+		p.ExtraAttrs = append(p.ExtraAttrs, xml.Attr{Name: xml.Name{Local: "slothfs-dirty"}, Value: "true"})
+	}
+	if len(w.LocalCommits) > 0 {
+		p.ExtraAttrs = append(p.ExtraAttrs,
+			xml.Attr{Name: xml.Name{Local: "slothfs-local-commits"}, Value: strconv.Itoa(len(w.LocalCommits))})
+	}
+}
+
+func main() {
+	format := flag.String("format", "xml", "Output format: xml or json.")
+	localStatus := flag.Bool("local_status", false, "Annotate each project with uncommitted changes and commits that are not on the synced revision. This reads the status of every checkout, so it is slow.")
+	config.Parse()
+
+	if *format != "xml" && *format != "json" {
+		log.Fatalf("-format must be xml or json, got %q", *format)
+	}
+	if len(flag.Args()) != 1 {
+		log.Fatal("usage: slothfs-deref-repo [-format xml|json] [-local_status] REPO-CHECKOUT")
+	}
+	dir := flag.Arg(0)
+
+	mf, err := populate.ReadRepoManifest(dir)
+	if err != nil {
+		log.Fatalf("ReadRepoManifest: %v", err)
+	}
+
+	var projects []repoProject
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		rp := repoProject{
+			Name:     p.Name,
+			Path:     p.GetPath(),
+			Revision: mf.ProjectRevision(p),
+		}
+		if *localStatus {
+			w, err := populate.RepoLocalWork(dir, mf, p)
+			if err != nil {
+				log.Fatalf("RepoLocalWork: %v", err)
+			}
+			if w != nil {
+				rp.Local = w
+				annotate(p, w)
+			}
+		}
+		projects = append(projects, rp)
+	}
+
+	var content []byte
+	if *format == "json" {
+		content, err = json.MarshalIndent(projects, "", " ")
+	} else {
+		content, err = mf.MarshalXML()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(content, '\n'))
+}
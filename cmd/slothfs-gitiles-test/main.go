@@ -25,13 +25,14 @@ import (
 	"os"
 	"sync"
 
+	"github.com/google/slothfs/config"
 	"github.com/google/slothfs/gitiles"
 )
 
 func main() {
 	tap := flag.Bool("tap", false, "Tap traffic exchanged with $http_proxy")
 	gitilesOptions := gitiles.DefineFlags()
-	flag.Parse()
+	config.Parse()
 
 	if *tap {
 		tapTraffic()
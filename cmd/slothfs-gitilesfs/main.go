@@ -16,24 +16,56 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
-	"time"
+	"regexp"
+	"strings"
 
 	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/config"
 	"github.com/google/slothfs/fs"
 	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/trace"
 	fusefs "github.com/hanwen/go-fuse/fs"
 )
 
 func main() {
 	repo := flag.String("repo", "", "Set the repository name.")
 	debug := flag.Bool("debug", false, "Print FUSE debug info.")
+	offline := flag.Bool("offline", false, "Serve data from local caches only; never access the network.")
+	gitAttributes := flag.Bool("gitattributes", false, "Honor export-ignore and eol from .gitattributes files.")
+	cloneFilter := flag.String("clone_filter", "", "Make partial clones with this filter, eg. blob:none.")
+	referenceDir := flag.String("reference", "", "Directory with git mirrors to use as reference for clones.")
+	urlRewrite := flag.String("url_rewrite", "", "JSON file with rules for rewriting clone URLs.")
+	cacheRoutes := flag.String("cache_routes", "", "JSON file with rules for storing repositories in other cache directories.")
+	sshCommand := flag.String("git_ssh_command", "", "Use this as GIT_SSH_COMMAND for cloning ssh:// URLs.")
+	credentialHelper := flag.String("credential_helper", "", "Use this git credential helper for cloning https URLs.")
+	protocolOverride := flag.String("protocol_override", "", "Comma-separated FROM=TO URL prefix pairs; git clones TO instead of FROM, eg. https://host/=persistent-https://host/.")
+	trackAccess := flag.Bool("track_access", false, "List files that were read in .slothfs/accessed.")
+	caseInsensitive := flag.Bool("case_insensitive", false, "Look up file names ignoring case.")
+	verifyReads := flag.Bool("verify_reads", false, "Check blobs against their SHA1 when first read, to detect cache corruption.")
+	metricsAddr := flag.String("metrics_addr", "", "If set, serve HTTP endpoints, such as the health status at /healthz, on this address, eg. localhost:8080.")
+	strict := flag.Bool("strict_readonly", false, "Reject all changes except setting modification times with EROFS, and log them.")
+	readOnlyModes := flag.Bool("read_only_modes", false, "Report directories as 0555 and files as 0444 (0555 if executable).")
+	mtimeAllow := flag.String("mtime_allow", "", "With -strict_readonly, only allow setting modification times of paths matching this regexp.")
+	expandArchives := flag.String("expand_archives", "", "Also serve .zip, .tar, .tar.gz and .tgz files whose path matches this regexp unpacked, in a directory named like the archive with .d appended.")
+	lazyTrees := flag.Bool("lazy_trees", false, "Fetch trees one directory at a time, when the directory is first used, instead of all at once.")
+	commitTimes := flag.Bool("commit_times", false, "Report the time of the last commit touching a file as its modification time, instead of a fixed time.")
+	readAhead := flag.Int("read_ahead", 1<<20, "Read this many bytes ahead when a file is read sequentially without file handles. 0 disables readahead.")
+	fetchFrequency := flag.Duration("fetch_frequency", 0, "Run git fetch on the cached repositories this often. 0 means every 12 hours, and negative never.")
+	maxFetches := flag.Int("max_fetches", cache.DefaultMaxFetches, "Run at most this many network fetches (files and trees from Gitiles, git clones and fetches) at the same time. 0 means no limit.")
+	persistInodes := flag.Bool("persist_inodes", false, "Keep inode numbers of files in the cache directory, so they survive remounts.")
+	overlay := flag.String("overlay", "", "Comma-separated PATH=DIR pairs; serve host directory or file DIR read-only at PATH.")
 	cacheDir := flag.String("cache", filepath.Join(os.Getenv("HOME"), ".cache", "slothfs"),
 		"Set directory for file system cache.")
+	traceEndpoint := flag.String("trace_endpoint", "", "Send OpenTelemetry spans for reads to this OTLP/HTTP collector, eg. http://localhost:4318.")
 	gitilesOptions := gitiles.DefineFlags()
-	flag.Parse()
+	timeouts := fs.DefineTimeoutFlags()
+	mountFlags := fs.DefineMountFlags()
+	cfg := config.Parse()
 
 	if *cacheDir == "" {
 		log.Fatal("must set --cache")
@@ -42,8 +74,92 @@ func main() {
 		log.Fatal("usage: main -repo REPO MOUNT-POINT")
 	}
 
+	var rewrites []cache.URLRewrite
+	if *urlRewrite != "" {
+		content, err := ioutil.ReadFile(*urlRewrite)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rewrites, err = cache.ReadURLRewrites(content); err != nil {
+			log.Fatalf("ReadURLRewrites(%s): %v", *urlRewrite, err)
+		}
+	}
+
+	var routes []cache.Route
+	if *cacheRoutes != "" {
+		content, err := ioutil.ReadFile(*cacheRoutes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if routes, err = cache.ReadRoutes(content); err != nil {
+			log.Fatalf("ReadRoutes(%s): %v", *cacheRoutes, err)
+		}
+	}
+
+	var cloneOptions []fs.CloneOption
+	if len(cfg.Clone) > 0 {
+		var err error
+		if _, cloneOptions, err = fs.ReadConfig(cfg.Clone); err != nil {
+			log.Fatalf("clone rules: %v", err)
+		}
+	}
+
+	overlays := map[string]string{}
+	if *overlay != "" {
+		for _, pair := range strings.Split(*overlay, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				log.Fatalf("-overlay: %q is not PATH=DIR", pair)
+			}
+			overlays[kv[0]] = kv[1]
+		}
+	}
+
+	if *traceEndpoint != "" {
+		trace.SetEndpoint(*traceEndpoint, "slothfs-gitilesfs")
+	}
+
+	var mtimeRE *regexp.Regexp
+	if *mtimeAllow != "" {
+		var err error
+		if mtimeRE, err = regexp.Compile(*mtimeAllow); err != nil {
+			log.Fatalf("-mtime_allow: %v", err)
+		}
+	}
+
+	var archiveRE *regexp.Regexp
+	if *expandArchives != "" {
+		var err error
+		if archiveRE, err = regexp.Compile(*expandArchives); err != nil {
+			log.Fatalf("-expand_archives: %v", err)
+		}
+	}
+
+	overrides := map[string]string{}
+	if *protocolOverride != "" {
+		for _, pair := range strings.Split(*protocolOverride, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				log.Fatalf("-protocol_override: %q is not FROM=TO", pair)
+			}
+			overrides[kv[0]] = kv[1]
+		}
+	}
+
 	mntDir := flag.Arg(0)
-	cache, err := cache.NewCache(*cacheDir, cache.Options{})
+	cache, err := cache.NewCache(*cacheDir, cache.Options{
+		Offline:           *offline,
+		CloneFilter:       *cloneFilter,
+		ReferenceDir:      *referenceDir,
+		URLRewrites:       rewrites,
+		GitSSHCommand:     *sshCommand,
+		CredentialHelper:  *credentialHelper,
+		ProtocolOverrides: overrides,
+		Routes:            routes,
+		PersistInodes:     *persistInodes,
+		MaxFetches:        *maxFetches,
+		FetchFrequency:    *fetchFrequency,
+	})
 	if err != nil {
 		log.Fatalf("NewCache: %v", err)
 	}
@@ -54,23 +170,53 @@ func main() {
 	}
 
 	repoService := service.NewRepoService(*repo)
-	project, err := repoService.Get()
+	opts := fs.GitilesOptions{
+		Offline:         *offline,
+		CloneOption:     cloneOptions,
+		GitAttributes:   *gitAttributes,
+		TrackAccess:     *trackAccess,
+		CaseInsensitive: *caseInsensitive,
+		LocalOverlay:    overlays,
+		VerifyReads:     *verifyReads,
+		StrictReadOnly:  *strict,
+		ReadOnlyModes:   *readOnlyModes,
+		MtimeAllow:      mtimeRE,
+		ExpandArchives:  archiveRE,
+		LazyTrees:       *lazyTrees,
+		CommitTimes:     *commitTimes,
+		ReadAhead:       *readAhead,
+		Mount:           *mountFlags,
+	}
+	opts.CloneURL, err = fs.CloneURL(service, *repo, *offline)
 	if err != nil {
-		log.Fatalf("GetProject(%s): %v", *repo, err)
+		log.Fatal(err)
 	}
 
-	opts := fs.GitilesOptions{
-		CloneURL: project.CloneURL,
+	if *metricsAddr != "" {
+		http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+			h := fs.CheckHealth(cache, repoService, *offline)
+			content, err := h.JSON()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if !h.Ready {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			w.Write(content)
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddr, nil))
+		}()
 	}
 
 	root := fs.NewGitilesConfigFSRoot(cache, repoService, &opts)
-	h := time.Hour
-	fuseOpts := &fusefs.Options{
-		EntryTimeout:    &h,
-		NegativeTimeout: &h,
-		AttrTimeout:     &h,
-	}
+	fuseOpts := timeouts.MountOptions()
 	fuseOpts.Debug = *debug
+	if err := opts.Mount.Apply(fuseOpts); err != nil {
+		log.Fatal(err)
+	}
 
 	server, err := fusefs.Mount(mntDir, root, fuseOpts)
 	if err != nil {
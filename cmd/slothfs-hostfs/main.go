@@ -19,11 +19,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/config"
 	"github.com/google/slothfs/fs"
 	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/trace"
 	fusefs "github.com/hanwen/go-fuse/fs"
 )
 
@@ -31,8 +32,16 @@ func main() {
 	debug := flag.Bool("debug", false, "Print FUSE debug info.")
 	cacheDir := flag.String("cache", filepath.Join(os.Getenv("HOME"), ".cache", "slothfs"),
 		"Set directory for file system cache.")
+	prefix := flag.String("prefix", "", "Only serve the projects whose name starts with this prefix, eg. platform/.")
+	fetchFrequency := flag.Duration("fetch_frequency", 0, "Run git fetch on the cached repositories this often. 0 means every 12 hours, and negative never.")
+	maxFetches := flag.Int("max_fetches", cache.DefaultMaxFetches, "Run at most this many network fetches (files and trees from Gitiles, git clones and fetches) at the same time. 0 means no limit.")
+	persistInodes := flag.Bool("persist_inodes", false, "Keep inode numbers of files in the cache directory, so they survive remounts.")
+	offline := flag.Bool("offline", false, "Serve data from local caches only; never access the network. The list of projects is read from -gitiles_cache_dir.")
+	traceEndpoint := flag.String("trace_endpoint", "", "Send OpenTelemetry spans for reads to this OTLP/HTTP collector, eg. http://localhost:4318.")
 	gitilesOptions := gitiles.DefineFlags()
-	flag.Parse()
+	timeouts := fs.DefineTimeoutFlags()
+	mountFlags := fs.DefineMountFlags()
+	cfg := config.Parse()
 
 	if *cacheDir == "" {
 		log.Fatal("must set --cache")
@@ -41,29 +50,44 @@ func main() {
 		log.Fatal("usage: main MOUNT-POINT")
 	}
 
+	if *traceEndpoint != "" {
+		trace.SetEndpoint(*traceEndpoint, "slothfs-hostfs")
+	}
+
 	mntDir := flag.Arg(0)
-	cache, err := cache.NewCache(*cacheDir, cache.Options{})
+	cache, err := cache.NewCache(*cacheDir, cache.Options{
+		Offline:        *offline,
+		PersistInodes:  *persistInodes,
+		MaxFetches:     *maxFetches,
+		FetchFrequency: *fetchFrequency,
+	})
 	if err != nil {
 		log.Fatalf("NewCache: %v", err)
 	}
 
+	gitilesOptions.Offline = *offline
 	service, err := gitiles.NewService(*gitilesOptions)
 	if err != nil {
 		log.Fatalf("NewService: %v", err)
 	}
 
-	root, err := fs.NewHostFS(cache, service, nil)
+	opts := fs.GitilesOptions{Offline: *offline}
+	if len(cfg.Clone) > 0 {
+		if _, opts.CloneOption, err = fs.ReadConfig(cfg.Clone); err != nil {
+			log.Fatalf("clone rules: %v", err)
+		}
+	}
+
+	root, err := fs.NewHostFS(cache, service, &opts, *prefix)
 	if err != nil {
 		log.Fatalf("NewService: %v", err)
 	}
 
-	h := time.Hour
-	fuseOpts := &fusefs.Options{
-		EntryTimeout:    &h,
-		NegativeTimeout: &h,
-		AttrTimeout:     &h,
-	}
+	fuseOpts := timeouts.MountOptions()
 	fuseOpts.Debug = *debug
+	if err := mountFlags.Apply(fuseOpts); err != nil {
+		log.Fatal(err)
+	}
 	server, err := fusefs.Mount(mntDir, root, fuseOpts)
 	if err != nil {
 		log.Fatalf("MountFileSystem: %v", err)
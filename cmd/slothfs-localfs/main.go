@@ -0,0 +1,85 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-localfs serves a revision of a local git repository, eg. a
+// mirror, read-only over FUSE, without Gitiles.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/fs"
+	fusefs "github.com/hanwen/go-fuse/fs"
+)
+
+func main() {
+	revision := flag.String("revision", "HEAD", "Serve the tree of this branch, tag or commit.")
+	debug := flag.Bool("debug", false, "Print FUSE debug info.")
+	gitAttributes := flag.Bool("gitattributes", false, "Honor export-ignore and eol from .gitattributes files.")
+	caseInsensitive := flag.Bool("case_insensitive", false, "Look up file names ignoring case.")
+	trackAccess := flag.Bool("track_access", false, "List files that were read in .slothfs/accessed.")
+	readAhead := flag.Int("read_ahead", 1<<20, "Read this many bytes ahead when a file is read sequentially without file handles. 0 disables readahead.")
+	cacheDir := flag.String("cache", filepath.Join(os.Getenv("HOME"), ".cache", "slothfs"),
+		"Set directory for file system cache.")
+	timeouts := fs.DefineTimeoutFlags()
+	mountFlags := fs.DefineMountFlags()
+	config.Parse()
+
+	if *cacheDir == "" {
+		log.Fatal("must set --cache")
+	}
+	if len(flag.Args()) != 2 {
+		log.Fatal("usage: slothfs-localfs [-revision REV] REPO-DIR MOUNT-POINT")
+	}
+	repoDir, mntDir := flag.Arg(0), flag.Arg(1)
+
+	repo, err := cache.NewLocalRepo(repoDir)
+	if err != nil {
+		log.Fatalf("NewLocalRepo: %v", err)
+	}
+
+	cache, err := cache.NewCache(*cacheDir, cache.Options{Offline: true})
+	if err != nil {
+		log.Fatalf("NewCache: %v", err)
+	}
+
+	opts := fs.GitilesOptions{
+		GitAttributes:   *gitAttributes,
+		CaseInsensitive: *caseInsensitive,
+		TrackAccess:     *trackAccess,
+		ReadAhead:       *readAhead,
+		Mount:           *mountFlags,
+	}
+	root, err := fs.NewLocalRoot(cache, repo, *revision, opts)
+	if err != nil {
+		log.Fatalf("NewLocalRoot: %v", err)
+	}
+
+	fuseOpts := timeouts.MountOptions()
+	fuseOpts.Debug = *debug
+	if err := opts.Mount.Apply(fuseOpts); err != nil {
+		log.Fatal(err)
+	}
+	server, err := fusefs.Mount(mntDir, root, fuseOpts)
+	if err != nil {
+		log.Fatalf("MountFileSystem: %v", err)
+	}
+	log.Printf("Started local git fs FUSE on %s", mntDir)
+	server.Serve()
+}
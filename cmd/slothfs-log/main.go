@@ -0,0 +1,106 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-log prints the history of a file in a SlothFS mount, using
+// the Gitiles log API, so no local clone is necessary.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/gitiles"
+)
+
+// findRepoRoot finds the root of the repository containing path, and
+// returns the repository name, its revision and the path relative
+// to the root.
+func findRepoRoot(path string) (name, revision, rel string, err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	for dir := path; ; dir = filepath.Dir(dir) {
+		meta := filepath.Join(dir, ".slothfs")
+		nameBytes, nameErr := ioutil.ReadFile(filepath.Join(meta, "name"))
+		revBytes, revErr := ioutil.ReadFile(filepath.Join(meta, "revision"))
+		if nameErr == nil && revErr == nil {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return "", "", "", err
+			}
+			if rel == "." {
+				rel = ""
+			}
+			return string(nameBytes), string(revBytes), filepath.ToSlash(rel), nil
+		}
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return "", "", "", fmt.Errorf("%s is not inside a SlothFS repository", path)
+}
+
+func printCommit(c *gitiles.Commit, oneline bool) {
+	if oneline {
+		subject := strings.SplitN(c.Message, "\n", 2)[0]
+		fmt.Printf("%s %s\n", c.Commit, subject)
+		return
+	}
+
+	fmt.Printf("commit %s\n", c.Commit)
+	fmt.Printf("Author: %s <%s>\n", c.Author.Name, c.Author.Email)
+	fmt.Printf("Date:   %s\n\n", c.Author.Time)
+	for _, l := range strings.Split(strings.TrimRight(c.Message, "\n"), "\n") {
+		fmt.Printf("    %s\n", l)
+	}
+	fmt.Println()
+}
+
+func main() {
+	limit := flag.Int("n", 0, "Limit the number of commits to print. 0 means no limit.")
+	oneline := flag.Bool("oneline", false, "Print one line per commit.")
+	gitilesOptions := gitiles.DefineFlags()
+	config.Parse()
+
+	if len(flag.Args()) != 1 {
+		log.Fatal("usage: slothfs-log [options] PATH")
+	}
+
+	name, revision, rel, err := findRepoRoot(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	service, err := gitiles.NewService(*gitilesOptions)
+	if err != nil {
+		log.Fatalf("NewService: %v", err)
+	}
+
+	commits, err := service.NewRepoService(name).Log(revision, rel, *limit)
+	if err != nil {
+		log.Fatalf("Log(%s, %s): %v", revision, rel, err)
+	}
+
+	for i := range commits {
+		printCommit(&commits[i], *oneline)
+	}
+}
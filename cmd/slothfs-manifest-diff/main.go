@@ -0,0 +1,66 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-manifest-diff prints the differences between two
+// manifests, eg. two expanded manifests of successive releases.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/manifest"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "print the differences as JSON.")
+	config.Parse()
+
+	if len(flag.Args()) != 2 {
+		log.Fatal("usage: slothfs-manifest-diff [-json] OLD-MANIFEST NEW-MANIFEST")
+	}
+
+	a, err := manifest.ParseFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("ParseFile(%s): %v", flag.Arg(0), err)
+	}
+	b, err := manifest.ParseFile(flag.Arg(1))
+	if err != nil {
+		log.Fatalf("ParseFile(%s): %v", flag.Arg(1), err)
+	}
+
+	d := manifest.Diff(a, b)
+	if *asJSON {
+		content, err := json.MarshalIndent(d, "", " ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(append(content, '\n'))
+		return
+	}
+
+	for _, p := range d.Removed {
+		fmt.Printf("- %s %s %s\n", p.GetPath(), p.Name, a.ProjectRevision(&p))
+	}
+	for _, p := range d.Added {
+		fmt.Printf("+ %s %s %s\n", p.GetPath(), p.Name, b.ProjectRevision(&p))
+	}
+	for _, c := range d.Changed {
+		fmt.Printf("M %s %s %s..%s\n", c.Path, c.Name, c.OldRevision, c.NewRevision)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-materialize copies a SlothFS workspace into a plain
+// directory, for tools that can't cope with FUSE or symlinks.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/populate"
+)
+
+func main() {
+	cacheDir := flag.String("cache", filepath.Join(os.Getenv("HOME"), ".cache", "slothfs"),
+		"Set the directory holding the filesystem cache. Content found there is not read through the mount.")
+	config.Parse()
+
+	if len(flag.Args()) != 2 {
+		log.Fatal("usage: slothfs-materialize [-cache DIR] WORKSPACE DEST")
+	}
+
+	var opts populate.MaterializeOptions
+	blobDir := filepath.Join(*cacheDir, "blobs")
+	if _, err := os.Stat(blobDir); *cacheDir != "" && err == nil {
+		blobs, err := cache.NewCAS(blobDir)
+		if err != nil {
+			log.Fatalf("NewCAS: %v", err)
+		}
+		opts.Blobs = blobs
+	}
+
+	stats, err := populate.Materialize(flag.Arg(0), flag.Arg(1), opts)
+	if err != nil {
+		log.Fatalf("Materialize: %v", err)
+	}
+	log.Printf("copied %d files (%d bytes) and %d symlinks in %d directories; %d from the cache, %d reflinked, %d skipped",
+		stats.Files, stats.Bytes, stats.Symlinks, stats.Dirs, stats.Cached, stats.Reflinked, stats.Skipped)
+}
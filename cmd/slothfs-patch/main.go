@@ -0,0 +1,66 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-patch applies the changes of a commit to a tree mounted by
+// slothfs-gitilesfs, writing the patched files to a directory that
+// can be served with -overlay.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/populate"
+)
+
+func main() {
+	repo := flag.String("repo", "", "Set the repository name.")
+	gitilesOptions := gitiles.DefineFlags()
+	config.Parse()
+
+	if *repo == "" || len(flag.Args()) != 3 {
+		log.Fatal("usage: slothfs-patch -repo REPO REVISION TREE DIR")
+	}
+	revision, tree, dir := flag.Arg(0), flag.Arg(1), flag.Arg(2)
+
+	service, err := gitiles.NewService(*gitilesOptions)
+	if err != nil {
+		log.Fatalf("NewService: %v", err)
+	}
+
+	patch, err := service.NewRepoService(*repo).GetPatch(revision)
+	if err != nil {
+		log.Fatalf("GetPatch(%s): %v", revision, err)
+	}
+
+	overlay, deleted, err := populate.ApplyPatch(patch, tree, dir)
+	if err != nil {
+		log.Fatalf("ApplyPatch: %v", err)
+	}
+	for _, d := range deleted {
+		log.Printf("%s is deleted by %s, but still shown in the overlay", d, revision)
+	}
+
+	var pairs []string
+	for p, f := range overlay {
+		pairs = append(pairs, p+"="+f)
+	}
+	sort.Strings(pairs)
+	fmt.Println(strings.Join(pairs, ","))
+}
@@ -16,7 +16,9 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -24,7 +26,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/config"
 	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/manifest"
 	"github.com/google/slothfs/populate"
 )
 
@@ -48,18 +53,62 @@ func findSlothFSMount() string {
 	return ""
 }
 
-// syncManifest fetches a manifest file, and configures a workspace
-// for it.
-func syncManifest(opts *gitiles.Options, mountPoint, repo, branch string) (string, error) {
+// syncManifest fetches a manifest file at the given branch, tag or
+// commit, and configures a workspace for it. The workspace name
+// records the manifest commit.
+func syncManifest(opts *gitiles.Options, mountPoint, repo, revision string, lookup func(string) (string, bool)) (string, error) {
 	service, err := gitiles.NewService(*opts)
 	if err != nil {
 		return "", err
 	}
 
-	mf, err := populate.FetchManifest(service, repo, branch)
+	// Resolve the revision first, so the manifest and the
+	// workspace name agree even if the branch moves.
+	commit, err := service.NewRepoService(repo).GetCommit(revision)
+	if err != nil {
+		return "", fmt.Errorf("GetCommit(%s, %s): %v", repo, revision, err)
+	}
+
+	mf, err := populate.FetchManifest(service, repo, commit.Commit)
+	if err != nil {
+		return "", err
+	}
+	if err := mf.Expand(lookup); err != nil {
+		return "", err
+	}
+
+	mf.Filter()
+
+	// Keep the branches, so -outdated can check the workspace later.
+	populate.RecordUpstream(mf)
+	if err := populate.DerefManifest(service, mf); err != nil {
+		return "", err
+	}
+
+	suffix := ""
+	if len(commit.Commit) >= 12 {
+		suffix = commit.Commit[:12]
+	}
+
+	log.Printf("fetched manifest %s at %s (%s)", repo, revision, commit.Commit)
+	return configureWorkspace(mountPoint, mf, suffix)
+}
+
+// initFromRepo configures a workspace for the projects of a checkout
+// made by the repo tool, at the revisions repo last synced.
+func initFromRepo(opts *gitiles.Options, mountPoint, repoCheckout string, lookup func(string) (string, bool)) (string, error) {
+	service, err := gitiles.NewService(*opts)
+	if err != nil {
+		return "", err
+	}
+
+	mf, err := populate.ReadRepoManifest(repoCheckout)
 	if err != nil {
 		return "", err
 	}
+	if err := mf.Expand(lookup); err != nil {
+		return "", err
+	}
 
 	mf.Filter()
 
@@ -67,6 +116,15 @@ func syncManifest(opts *gitiles.Options, mountPoint, repo, branch string) (strin
 		return "", err
 	}
 
+	log.Printf("read manifest of %s with %d projects", repoCheckout, len(mf.Project))
+	return configureWorkspace(mountPoint, mf, "repo")
+}
+
+// configureWorkspace writes the manifest to a file, and links it
+// into the config directory of the mount. The workspace name is a
+// timestamp, followed by the suffix if given. It returns the
+// directory of the new workspace.
+func configureWorkspace(mountPoint string, mf *manifest.Manifest, suffix string) (string, error) {
 	xml, err := ioutil.TempFile("", "")
 	if err != nil {
 		return "", err
@@ -80,9 +138,8 @@ func syncManifest(opts *gitiles.Options, mountPoint, repo, branch string) (strin
 		return "", err
 	}
 
-	name := strings.Replace(time.Now().Format("S"+time.RFC3339), ":", "_", -1)
-
-	log.Printf("fetched manifest; configuring workspace %s", name)
+	name := populate.WorkspaceName(time.Now(), suffix)
+	log.Printf("configuring workspace %s", name)
 	if err := os.Symlink(xml.Name(), filepath.Join(mountPoint, "config", name)); err != nil {
 		return "", err
 	}
@@ -90,14 +147,135 @@ func syncManifest(opts *gitiles.Options, mountPoint, repo, branch string) (strin
 	return filepath.Join(mountPoint, name), nil
 }
 
+// removeStaleWorkspaces removes the synced workspaces of the mount
+// that the retention policy drops, keeping those that a checkout may
+// still use.
+func removeStaleWorkspaces(mountPoint, checkouts string, r populate.Retention) error {
+	inUse, err := populate.WorkspacesInUse(checkouts, mountPoint)
+	if err != nil {
+		return err
+	}
+
+	removed, err := populate.RemoveStaleWorkspaces(mountPoint, r, inUse, time.Now())
+	for _, name := range removed {
+		log.Printf("removed workspace %s", name)
+	}
+	return err
+}
+
+// checkDrift compares the workspace manifest with the upstream
+// branches, and writes the outdated projects to the given file.
+func checkDrift(opts *gitiles.Options, workspace, outFile string) error {
+	service, err := gitiles.NewService(*opts)
+	if err != nil {
+		return err
+	}
+
+	mf, err := manifest.ParseFile(filepath.Join(workspace, ".slothfs", "manifest.xml"))
+	if err != nil {
+		return err
+	}
+
+	drift, err := populate.CheckDrift(service, mf)
+	if err != nil {
+		return err
+	}
+	if drift == nil {
+		drift = []populate.Drift{}
+	}
+
+	content, err := json.MarshalIndent(drift, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(outFile, content, 0644); err != nil {
+		return err
+	}
+
+	log.Printf("%d of %d projects differ from their upstream branch", len(drift), len(mf.Project))
+	return nil
+}
+
+// printStatus prints the state of the projects of the RO workspace
+// ro in the R/W checkout dir. If ro is empty, it is the workspace
+// below mount that dir links to.
+func printStatus(ro, mount, dir string, asJSON bool) error {
+	if ro == "" {
+		if mount == "" {
+			mount = findSlothFSMount()
+			if mount == "" {
+				return fmt.Errorf("could not autodetect mount point. Pass -ro or -mount option")
+			}
+		}
+		var err error
+		if ro, err = populate.LinkedWorkspace(mount, dir); err != nil {
+			return err
+		}
+	}
+
+	status, err := populate.Status(ro, dir)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		content, err := json.MarshalIndent(status, "", " ")
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(append(content, '\n'))
+		return nil
+	}
+
+	fmt.Printf("workspace %s\n", ro)
+	for _, s := range status {
+		fmt.Println(s)
+		for _, l := range s.Local {
+			fmt.Printf("  %s\n", l)
+		}
+	}
+	return nil
+}
+
+// summary is printed with -json.
+type summary struct {
+	Workspace       string
+	Fingerprint     string `json:",omitempty"`
+	Added           int
+	Changed         int
+	Removed         int
+	Touched         int
+	Conflicts       []string
+	DurationSeconds float64
+}
+
+// Exit codes for -detailed_exitcode. Errors exit with 1.
+const (
+	exitUnchanged = 0
+	exitChanged   = 2
+)
+
 func main() {
+	start := time.Now()
 	gitilesOptions := gitiles.DefineFlags()
 	newROWorkspace := flag.String("ro", "", "Set path to slothfs-repofs mount.")
 	mount := flag.String("mount", "", "Set slothfs mountpoint for -sync option. Autodetected if empty.")
 	sync := flag.Bool("sync", false, "Sync checkout to latest manifest version.")
 	syncBranch := flag.String("sync_branch", "master", "Use this branch for -sync.")
+	syncRevision := flag.String("sync_revision", "", "Use this manifest commit SHA1 or tag for -sync, instead of -sync_branch.")
 	syncRepo := flag.String("sync_repo", "platform/manifest", "Use this repo for -sync.")
-	flag.Parse()
+	initRepo := flag.String("init_from_repo", "", "Configure the workspace from the manifest and synced revisions of this repo checkout.")
+	manifestVars := flag.String("manifest_vars", "", "JSON file with values for ${NAME} variables in the manifest for -sync and -init_from_repo. Variables not in the file are taken from the environment.")
+	outdated := flag.String("outdated", "", "Write projects whose revision differs from the head of their upstream branch to this file as JSON.")
+	asJSON := flag.Bool("json", false, "Print a summary of the changes as JSON.")
+	status := flag.Bool("status", false, "Print for each project whether it is linked to the workspace, checked out locally, or mixed, instead of populating. With -json, print it as JSON.")
+	detailedExit := flag.Bool("detailed_exitcode", false, "Exit with 0 if no files were added, changed or removed, 2 if some were, and 1 on errors.")
+	linkMode := flag.String("link_mode", populate.LinkSymlink, "How to put workspace files into the checkout: symlink, hardlink (to the blob cache) or reflink.")
+	cacheDir := flag.String("cache", filepath.Join(os.Getenv("HOME"), ".cache", "slothfs"),
+		"Set the slothfs cache directory, whose blobs are used for -link_mode=hardlink and reflink.")
+	keepWorkspaces := flag.Int("keep_workspaces", 0, "After -sync or -init_from_repo, remove all but this many of the newest synced workspaces. 0 means keep all.")
+	maxWorkspaceAge := flag.Duration("max_workspace_age", 0, "After -sync or -init_from_repo, remove synced workspaces older than this, eg. 720h. 0 means no limit.")
+	config.Parse()
 
 	dir := "."
 	if len(flag.Args()) == 1 {
@@ -106,7 +284,18 @@ func main() {
 		log.Fatal("too many arguments.")
 	}
 
-	if *sync {
+	if *status {
+		if err := printStatus(*newROWorkspace, *mount, dir, *asJSON); err != nil {
+			log.Fatalf("status: %v", err)
+		}
+		return
+	}
+
+	if *sync && *initRepo != "" {
+		log.Fatal("-sync and -init_from_repo are mutually exclusive.")
+	}
+
+	if *sync || *initRepo != "" {
 		if *mount == "" {
 			*mount = findSlothFSMount()
 			if *mount == "" {
@@ -115,26 +304,77 @@ func main() {
 		}
 
 		var err error
-		*newROWorkspace, err = syncManifest(gitilesOptions, *mount, *syncRepo, *syncBranch)
-		if err != nil {
-			log.Fatalf("syncManifest: %v", err)
+		vars := map[string]string{}
+		if *manifestVars != "" {
+			content, err := ioutil.ReadFile(*manifestVars)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if vars, err = manifest.ReadVars(content); err != nil {
+				log.Fatalf("ReadVars(%s): %v", *manifestVars, err)
+			}
+		}
+		lookup := func(name string) (string, bool) {
+			if v, ok := vars[name]; ok {
+				return v, true
+			}
+			return os.LookupEnv(name)
+		}
+
+		if *initRepo != "" {
+			*newROWorkspace, err = initFromRepo(gitilesOptions, *mount, *initRepo, lookup)
+			if err != nil {
+				log.Fatalf("initFromRepo: %v", err)
+			}
+		} else {
+			revision := *syncBranch
+			if *syncRevision != "" {
+				revision = *syncRevision
+			}
+
+			*newROWorkspace, err = syncManifest(gitilesOptions, *mount, *syncRepo, revision, lookup)
+			if err != nil {
+				log.Fatalf("syncManifest: %v", err)
+			}
 		}
 	}
 
 	if *newROWorkspace == "" {
-		log.Fatalf("no readonly checkout given. Specify -ro DIR or -sync.")
+		log.Fatalf("no readonly checkout given. Specify -ro DIR, -sync or -init_from_repo.")
+	}
+
+	if *outdated != "" {
+		if err := checkDrift(gitilesOptions, *newROWorkspace, *outdated); err != nil {
+			log.Fatalf("checkDrift: %v", err)
+		}
 	}
 
-	log.Printf("creating symlinks to %s", *newROWorkspace)
+	checkoutOpts := populate.CheckoutOptions{LinkMode: *linkMode}
+	if *linkMode != populate.LinkSymlink {
+		blobDir := filepath.Join(*cacheDir, "blobs")
+		if _, err := os.Stat(blobDir); err == nil {
+			blobs, err := cache.NewCAS(blobDir)
+			if err != nil {
+				log.Fatalf("NewCAS: %v", err)
+			}
+			checkoutOpts.Blobs = blobs
+		}
+	}
+
+	log.Printf("populating from %s (%s mode)", *newROWorkspace, *linkMode)
 
-	added, changed, err := populate.Checkout(*newROWorkspace, dir)
+	result, err := populate.CheckoutWithOptions(*newROWorkspace, dir, checkoutOpts)
 	if err != nil {
 		log.Fatalf("populate.Checkout: %v", err)
 	}
+	added, changed := result.Added, result.Changed
+	for _, c := range result.Conflicts {
+		log.Printf("conflict: local %s is in the way of the workspace", c)
+	}
 
+	n := 0
 	if len(changed) > 0 {
 		now := time.Now()
-		n := 0
 		for _, slice := range [][]string{added, changed} {
 			for _, c := range slice {
 				err := os.Chtimes(c, now, now)
@@ -155,4 +395,47 @@ func main() {
 	} else {
 		log.Printf("no files were changed, %d were added; assuming fresh checkout.", len(added))
 	}
+
+	checkouts := filepath.Join(*cacheDir, populate.CheckoutsFile)
+	if err := populate.RegisterCheckout(checkouts, dir); err != nil {
+		log.Printf("RegisterCheckout: %v", err)
+	}
+
+	if (*sync || *initRepo != "") && (*keepWorkspaces > 0 || *maxWorkspaceAge > 0) {
+		if err := removeStaleWorkspaces(*mount, checkouts, populate.Retention{
+			Keep:   *keepWorkspaces,
+			MaxAge: *maxWorkspaceAge,
+		}); err != nil {
+			log.Printf("removeStaleWorkspaces: %v", err)
+		}
+	}
+
+	if *asJSON {
+		// Only workspaces made from a manifest have one.
+		fingerprint := ""
+		if mf, err := manifest.ParseFile(filepath.Join(*newROWorkspace, ".slothfs", "manifest.xml")); err == nil {
+			fingerprint = mf.Fingerprint()
+		}
+		content, err := json.MarshalIndent(summary{
+			Workspace:       *newROWorkspace,
+			Fingerprint:     fingerprint,
+			Added:           len(added),
+			Changed:         len(changed),
+			Removed:         len(result.Removed),
+			Touched:         n,
+			Conflicts:       result.Conflicts,
+			DurationSeconds: time.Since(start).Seconds(),
+		}, "", " ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(append(content, '\n'))
+	}
+
+	if *detailedExit {
+		if len(added)+len(changed)+len(result.Removed) > 0 {
+			os.Exit(exitChanged)
+		}
+		os.Exit(exitUnchanged)
+	}
 }
@@ -0,0 +1,60 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// slothfs-verify checks that a R/W checkout populated by
+// slothfs-populate is consistent with its SlothFS workspace.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/slothfs/config"
+	"github.com/google/slothfs/populate"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "fix missing, dangling and misdirected symlinks.")
+	checkSHA1 := flag.Bool("sha1", false, "check that the content served by the mount hashes to the SHA1s of the manifest trees. This reads every file, so it is slow.")
+	config.Parse()
+
+	if len(flag.Args()) != 2 {
+		log.Fatal("usage: slothfs-verify [-repair] [-sha1] RO-WORKSPACE RW-CHECKOUT")
+	}
+
+	problems, err := populate.Verify(flag.Arg(0), flag.Arg(1), populate.VerifyOptions{
+		Repair:    *repair,
+		CheckSHA1: *checkSHA1,
+	})
+	if err != nil {
+		log.Fatalf("Verify: %v", err)
+	}
+
+	unfixed := 0
+	for _, p := range problems {
+		if p.Repaired {
+			fmt.Printf("%s (repaired)\n", p)
+			continue
+		}
+		unfixed++
+		fmt.Printf("%s\n  to fix: %s\n", p, p.Suggestion())
+	}
+
+	if unfixed > 0 {
+		log.Printf("%d problems, %d repaired", len(problems), len(problems)-unfixed)
+		os.Exit(1)
+	}
+}
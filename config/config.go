@@ -0,0 +1,129 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config reads the configuration file shared by the slothfs
+// commands. It sets defaults for their command line flags, so eg. the
+// Gitiles address and cache directory need not be passed to each
+// command.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config holds the contents of the configuration file.
+type Config struct {
+	// Flags maps flag names, eg. gitiles_url, to their values. The
+	// values may be strings, numbers or booleans.
+	Flags map[string]interface{}
+
+	// Clone holds the clone rules, in the format of clone.json.
+	Clone json.RawMessage
+}
+
+// DefaultPath returns the default location of the configuration
+// file.
+func DefaultPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".config", "slothfs", "config.json")
+}
+
+// Read parses a configuration file.
+func Read(content []byte) (*Config, error) {
+	var c Config
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Load reads the configuration file at path. A missing file yields an
+// empty configuration.
+func Load(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := Read(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// flagValue formats a JSON value as a flag value. A leading ~/ in
+// strings is replaced by the home directory.
+func flagValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "~/") {
+			v = filepath.Join(os.Getenv("HOME"), v[2:])
+		}
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// Apply sets the flags of fs that were not given on the command line
+// to their values in the configuration. Flags that fs doesn't define
+// are ignored, as they may be meant for other commands.
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for name, v := range c.Flags {
+		if given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		val, err := flagValue(v)
+		if err != nil {
+			return fmt.Errorf("flag %s: %v", name, err)
+		}
+		if err := fs.Set(name, val); err != nil {
+			return fmt.Errorf("flag %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Parse parses the command line flags like flag.Parse, and then
+// applies the configuration file given by -config_file. It returns
+// the configuration, eg. for the clone rules.
+func Parse() *Config {
+	path := flag.String("config_file", DefaultPath(), "Read defaults for flags and clone rules from this JSON file.")
+	flag.Parse()
+
+	c, err := Load(*path)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if err := c.Apply(flag.CommandLine); err != nil {
+		log.Fatalf("config %s: %v", *path, err)
+	}
+	return c
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	c, err := Read([]byte(`{
+  "flags": {
+    "gitiles_url": "https://gerrit.example.com",
+    "cache": "~/slothfs-cache",
+    "gitiles_qps": 2.5,
+    "fetch_frequency": "1h",
+    "allow_other": true,
+    "unknown": "ignored"
+  },
+  "clone": [{"File": ".*\\.mk$", "Clone": false}]
+}`))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	url := fs.String("gitiles_url", "https://android.googlesource.com", "")
+	cache := fs.String("cache", "", "")
+	qps := fs.Float64("gitiles_qps", 4, "")
+	freq := fs.Duration("fetch_frequency", 0, "")
+	allowOther := fs.Bool("allow_other", false, "")
+	if err := fs.Parse([]string{"-gitiles_qps", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Apply(fs); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	if *url != "https://gerrit.example.com" {
+		t.Errorf("got gitiles_url %q", *url)
+	}
+	if want := filepath.Join(os.Getenv("HOME"), "slothfs-cache"); *cache != want {
+		t.Errorf("got cache %q, want %q", *cache, want)
+	}
+	if *qps != 1 {
+		t.Errorf("command line flag was overridden: got gitiles_qps %v, want 1", *qps)
+	}
+	if *freq != time.Hour {
+		t.Errorf("got fetch_frequency %v, want 1h", *freq)
+	}
+	if !*allowOther {
+		t.Errorf("allow_other not set")
+	}
+	if len(c.Clone) == 0 {
+		t.Errorf("clone rules missing")
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("cache", "", "")
+	c.Flags = map[string]interface{}{"cache": []interface{}{"a"}}
+	if err := c.Apply(fs); err == nil {
+		t.Errorf("Apply succeeded for list value")
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	c, err := Load(filepath.Join(os.TempDir(), "does-not-exist", "config.json"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(c.Flags) != 0 || len(c.Clone) != 0 {
+		t.Errorf("got %v, want empty config", c)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cookie
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chromeV10Key is the key that Chrome on Linux uses for "v10"
+// encrypted values, which it writes if no keyring is available. It
+// is PBKDF2-SHA1 of "peanuts" with salt "saltysalt" and one
+// iteration, which comes down to a single HMAC.
+var chromeV10Key = func() []byte {
+	mac := hmac.New(sha1.New, []byte("peanuts"))
+	mac.Write([]byte("saltysalt\x00\x00\x00\x01"))
+	return mac.Sum(nil)[:16]
+}()
+
+// chromeEpoch is the zero of Chrome's microsecond timestamps,
+// 1601-01-01, in Unix seconds.
+const chromeEpoch = -11644473600
+
+// domainMatch returns whether a cookie for domain is sent to host. As
+// in browser databases, a leading "." marks a cookie that is also
+// sent to subdomains; other cookies are only sent to the host itself.
+func domainMatch(host, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(domain)
+	if !strings.HasPrefix(domain, ".") {
+		return host == domain
+	}
+	domain = domain[1:]
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// ReadBrowserCookies reads cookies from a Firefox (cookies.sqlite)
+// or Chrome (Cookies) database, using the sqlite3 command. Only
+// cookies that are sent to one of the given hosts are returned;
+// without hosts, all cookies are. Chrome values encrypted with a key
+// from the system keyring can't be read; they are skipped, and
+// logged.
+func ReadBrowserCookies(path string, hosts []string) ([]*http.Cookie, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var cs []*http.Cookie
+	if cols, err := db.columns("moz_cookies"); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	} else if len(cols) > 0 {
+		cs, err = readFirefox(db)
+	} else {
+		cs, err = readChrome(db)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if len(hosts) == 0 {
+		return cs, nil
+	}
+	var result []*http.Cookie
+	for _, c := range cs {
+		for _, h := range hosts {
+			if domainMatch(h, c.Domain) {
+				result = append(result, c)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func rowString(row map[string][]byte, col string) string {
+	return string(row[col])
+}
+
+func rowInt(row map[string][]byte, col string) int64 {
+	s := string(row[col])
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return int64(f)
+}
+
+// readFirefox reads the moz_cookies table.
+func readFirefox(db *sqliteDB) ([]*http.Cookie, error) {
+	rows, err := db.rows("moz_cookies")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*http.Cookie
+	for _, row := range rows {
+		exp := rowInt(row, "expiry")
+		if exp > 1e11 {
+			// Newer versions store milliseconds.
+			exp /= 1000
+		}
+		result = append(result, &http.Cookie{
+			Domain:   rowString(row, "host"),
+			Path:     rowString(row, "path"),
+			Name:     rowString(row, "name"),
+			Value:    rowString(row, "value"),
+			Expires:  time.Unix(exp, 0),
+			Secure:   rowInt(row, "isSecure") != 0,
+			HttpOnly: rowInt(row, "isHttpOnly") != 0,
+		})
+	}
+	return result, nil
+}
+
+// readChrome reads the cookies table of a Chrome profile.
+func readChrome(db *sqliteDB) ([]*http.Cookie, error) {
+	rows, err := db.rows("cookies")
+	if err != nil {
+		return nil, err
+	}
+
+	// Since version 24, encrypted values start with the SHA256
+	// of the domain.
+	var version int64
+	if cols, err := db.columns("meta"); err == nil && len(cols) > 0 {
+		meta, err := db.rows("meta")
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range meta {
+			if rowString(row, "key") == "version" {
+				version = rowInt(row, "value")
+			}
+		}
+	}
+
+	var result []*http.Cookie
+	keyring := map[string]int{}
+	for _, row := range rows {
+		c := &http.Cookie{
+			Domain:   rowString(row, "host_key"),
+			Path:     rowString(row, "path"),
+			Name:     rowString(row, "name"),
+			Value:    rowString(row, "value"),
+			Secure:   rowInt(row, "is_secure") != 0 || rowInt(row, "secure") != 0,
+			HttpOnly: rowInt(row, "is_httponly") != 0 || rowInt(row, "httponly") != 0,
+		}
+		if exp := rowInt(row, "expires_utc"); exp != 0 {
+			c.Expires = time.Unix(chromeEpoch+exp/1e6, exp%1e6*1e3)
+		}
+		if enc := row["encrypted_value"]; len(enc) > 0 {
+			if !bytes.HasPrefix(enc, []byte("v10")) {
+				keyring[c.Domain]++
+				continue
+			}
+			val, err := decryptChrome(enc)
+			if err != nil {
+				log.Printf("cookie %s for %s: %v", c.Name, c.Domain, err)
+				continue
+			}
+			if version >= 24 {
+				if len(val) < 32 {
+					log.Printf("cookie %s for %s: value too short", c.Name, c.Domain)
+					continue
+				}
+				val = val[32:]
+			}
+			c.Value = string(val)
+		}
+		result = append(result, c)
+	}
+	for domain, n := range keyring {
+		log.Printf("skipped %d cookies for %s: Chrome encrypted them with a key from the system keyring, which slothfs can't read. Export them to a cookie file instead.", n, domain)
+	}
+	return result, nil
+}
+
+// decryptChrome decrypts a "v10" encrypted Chrome cookie value.
+func decryptChrome(enc []byte) ([]byte, error) {
+	if !strings.HasPrefix(string(enc), "v10") {
+		prefix := enc
+		if len(prefix) > 3 {
+			prefix = prefix[:3]
+		}
+		return nil, fmt.Errorf("unsupported encryption %q", prefix)
+	}
+	enc = enc[3:]
+	if len(enc) == 0 || len(enc)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted value has length %d", len(enc))
+	}
+
+	block, err := aes.NewCipher(chromeV10Key)
+	if err != nil {
+		return nil, err
+	}
+	iv := []byte(strings.Repeat(" ", aes.BlockSize))
+	out := make([]byte, len(enc))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, enc)
+
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, fmt.Errorf("bad padding")
+	}
+	return out[:len(out)-pad], nil
+}
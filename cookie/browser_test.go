@@ -0,0 +1,195 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cookie
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sqlite runs SQL statements on a new database, skipping the test if
+// there is no sqlite3 binary.
+func sqlite(t *testing.T, path, sql string) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	cmd := exec.Command("sqlite3", path)
+	cmd.Stdin = strings.NewReader(sql)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sqlite3: %v, out: %s", err, out)
+	}
+}
+
+const firefoxSchema = `PRAGMA page_size=512;
+CREATE TABLE moz_cookies (id INTEGER PRIMARY KEY, originAttributes TEXT NOT NULL DEFAULT '', name TEXT, value TEXT, host TEXT, path TEXT, expiry INTEGER, lastAccessed INTEGER, creationTime INTEGER, isSecure INTEGER, isHttpOnly INTEGER, inBrowserElement INTEGER DEFAULT 0, sameSite INTEGER DEFAULT 0, rawSameSite INTEGER DEFAULT 0, schemeMap INTEGER DEFAULT 0, CONSTRAINT moz_uniqueid UNIQUE (name, host, path, originAttributes));
+`
+
+func TestReadFirefoxCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Enough rows for interior b-tree pages, and a value that
+	// needs overflow pages.
+	long := strings.Repeat("x", 2000)
+	sql := firefoxSchema + fmt.Sprintf(`INSERT INTO moz_cookies (name, value, host, path, expiry, isSecure, isHttpOnly) VALUES ('o', '%s', '.googlesource.com', '/', 2147483647, 1, 0);
+INSERT INTO moz_cookies (name, value, host, path, expiry, isSecure, isHttpOnly) VALUES ('SID', 'abc', 'android.googlesource.com', '/a', 2147483647000, 0, 1);
+WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < 300)
+INSERT INTO moz_cookies (name, value, host, path, expiry, isSecure, isHttpOnly) SELECT 'c' || i, 'v', 'example.com', '/', 2147483647, 0, 0 FROM n;
+`, long)
+	path := filepath.Join(dir, "cookies.sqlite")
+	sqlite(t, path, sql)
+
+	all, err := ReadBrowserCookies(path, nil)
+	if err != nil {
+		t.Fatalf("ReadBrowserCookies: %v", err)
+	}
+	if len(all) != 302 {
+		t.Errorf("got %d cookies, want 302", len(all))
+	}
+
+	cs, err := ReadBrowserCookies(path, []string{"android.googlesource.com"})
+	if err != nil {
+		t.Fatalf("ReadBrowserCookies: %v", err)
+	}
+	if len(cs) != 2 {
+		t.Fatalf("got %d cookies, want 2", len(cs))
+	}
+	if c := cs[0]; c.Name != "o" || c.Value != long || c.Domain != ".googlesource.com" || !c.Secure || c.HttpOnly || c.Expires.Unix() != 2147483647 {
+		t.Errorf("got %#v", c)
+	}
+	if c := cs[1]; c.Name != "SID" || c.Value != "abc" || c.Path != "/a" || c.Secure || !c.HttpOnly || c.Expires.Unix() != 2147483647 {
+		t.Errorf("got %#v", c)
+	}
+
+	jar, err := NewJar(path, "android.googlesource.com")
+	if err != nil {
+		t.Fatalf("NewJar: %v", err)
+	}
+	got := jar.Cookies(&url.URL{Scheme: "https", Host: "android.googlesource.com", Path: "/a/"})
+	if len(got) != 2 {
+		t.Errorf("got cookies %v, want o and SID", got)
+	}
+}
+
+// encryptChrome encrypts a value like Chrome does for version 24
+// databases.
+func encryptChrome(host, value string) []byte {
+	sum := sha256.Sum256([]byte(host))
+	plain := append(sum[:], value...)
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	plain = append(plain, bytes.Repeat([]byte{byte(pad)}, pad)...)
+
+	block, _ := aes.NewCipher(chromeV10Key)
+	out := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, bytes.Repeat([]byte(" "), aes.BlockSize)).CryptBlocks(out, plain)
+	return append([]byte("v10"), out...)
+}
+
+func TestReadChromeCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "Cookies")
+	sqlite(t, path, fmt.Sprintf(`CREATE TABLE meta(key LONGVARCHAR NOT NULL UNIQUE PRIMARY KEY, value LONGVARCHAR);
+INSERT INTO meta VALUES ('version', '24');
+CREATE TABLE cookies(creation_utc INTEGER NOT NULL, host_key TEXT NOT NULL, top_frame_site_key TEXT NOT NULL, name TEXT NOT NULL, value TEXT NOT NULL, encrypted_value BLOB NOT NULL, path TEXT NOT NULL, expires_utc INTEGER NOT NULL, is_secure INTEGER NOT NULL, is_httponly INTEGER NOT NULL, UNIQUE (host_key, top_frame_site_key, name, path));
+INSERT INTO cookies VALUES (0, '.googlesource.com', '', 'o', '', X'%x', '/', 13253932800000000, 1, 1);
+INSERT INTO cookies VALUES (0, '.googlesource.com', '', 'plain', 'text', X'', '/', 0, 0, 0);
+INSERT INTO cookies VALUES (0, '.googlesource.com', '', 'keyring', '', X'763131000102', '/', 0, 0, 0);
+`, encryptChrome(".googlesource.com", "secret")))
+
+	cs, err := ReadBrowserCookies(path, []string{"android.googlesource.com"})
+	if err != nil {
+		t.Fatalf("ReadBrowserCookies: %v", err)
+	}
+	if len(cs) != 2 {
+		t.Fatalf("got %d cookies, want 2", len(cs))
+	}
+
+	wantExp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	if c := cs[0]; c.Name != "o" || c.Value != "secret" || !c.Secure || !c.HttpOnly || !c.Expires.Equal(wantExp) {
+		t.Errorf("got %#v, want o=secret expiring %v", c, wantExp)
+	}
+	if c := cs[1]; c.Name != "plain" || c.Value != "text" || !c.Expires.IsZero() {
+		t.Errorf("got %#v, want plain=text session cookie", c)
+	}
+}
+
+func TestSQLiteWAL(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not found")
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cookies.sqlite")
+	sqlite(t, path, firefoxSchema+`PRAGMA journal_mode=WAL;
+INSERT INTO moz_cookies (name, value, host, path, expiry, isSecure, isHttpOnly) VALUES ('o', 'old', 'googlesource.com', '/', 2147483647, 1, 0);`)
+
+	// Like a browser, keep the database open, so the update stays
+	// in the write-ahead log.
+	cmd := exec.Command("sqlite3", path)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		in.Close()
+		cmd.Wait()
+	}()
+	fmt.Fprintln(in, "PRAGMA wal_autocheckpoint=0; UPDATE moz_cookies SET value = 'new'; SELECT 'done';")
+	if _, err := bufio.NewReader(out).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path + "-wal"); err != nil || fi.Size() == 0 {
+		t.Fatalf("no write-ahead log: %v", err)
+	}
+
+	cs, err := ReadBrowserCookies(path, nil)
+	if err != nil {
+		t.Fatalf("ReadBrowserCookies: %v", err)
+	}
+	if len(cs) != 1 || cs[0].Value != "new" {
+		t.Errorf("got %v, want o=new", cs)
+	}
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// cookie parses curl cookie jar files.
+// cookie parses curl cookie jar files and browser cookie databases.
 package cookie
 
 import (
@@ -27,12 +27,15 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
 // ParseCookieJar parses a cURL/Mozilla/Netscape cookie jar text file.
+// The Domain of cookies that are also sent to subdomains starts with
+// ".", as in browser databases.
 func ParseCookieJar(r io.Reader) ([]*http.Cookie, error) {
 	var result []*http.Cookie
 	scanner := bufio.NewScanner(r)
@@ -57,19 +60,27 @@ func ParseCookieJar(r io.Reader) ([]*http.Cookie, error) {
 			return nil, fmt.Errorf("got %d fields in line %q, want 6 or 7", len(fields), line)
 		}
 
-		exp, err := strconv.ParseInt(fields[4], 10, 64)
+		exp, err := strconv.ParseInt(strings.TrimSpace(fields[4]), 10, 64)
 		if err != nil {
 			return nil, err
 		}
 
+		domain := strings.TrimPrefix(strings.TrimSpace(fields[0]), ".")
+		if strings.TrimSpace(fields[1]) == "TRUE" {
+			domain = "." + domain
+		}
+
 		c := http.Cookie{
-			Domain:   strings.TrimSpace(fields[0]),
+			Domain:   domain,
 			Name:     strings.TrimSpace(fields[5]),
 			Path:     strings.TrimSpace(fields[2]),
-			Expires:  time.Unix(exp, 0),
-			Secure:   fields[3] == "TRUE",
+			Secure:   strings.TrimSpace(fields[3]) == "TRUE",
 			HttpOnly: httpOnly,
 		}
+		// An expiry of 0 marks a session cookie.
+		if exp != 0 {
+			c.Expires = time.Unix(exp, 0)
+		}
 		if len(fields) == 7 {
 			c.Value = strings.TrimSpace(fields[6])
 		}
@@ -80,83 +91,267 @@ func ParseCookieJar(r io.Reader) ([]*http.Cookie, error) {
 	return result, nil
 }
 
-// WatchJar starts watching the given path for changes, and loads new
-// data from the file whenever it is available.
-func WatchJar(jar http.CookieJar, path string) error {
-	w, err := fsnotify.NewWatcher()
+// Jar is a cookie jar whose cookies come from a cookie file or a
+// browser database. Cookies set by servers are kept separately, so
+// they survive reloading the file.
+type Jar struct {
+	path  string
+	hosts []string
+
+	// now is the clock for expiry checks; it is replaced in
+	// tests.
+	now func() time.Time
+
+	// server holds cookies set in responses.
+	server http.CookieJar
+
+	mu      sync.Mutex
+	state   jarState
+	cookies []*http.Cookie
+
+	// Hosts for which we logged that all cookies expired, since
+	// the last load.
+	expiredLogged map[string]bool
+
+	// If set, called with the cookies whenever they are loaded.
+	onLoad func([]*http.Cookie)
+}
+
+var _ = (http.CookieJar)((*Jar)(nil))
+
+// jarState identifies a version of the jar file, so we can tell
+// whether it changed. Files that are renamed into place may have the
+// same modification time as the one they replace, so we also compare
+// the file identity and size. Browsers write to the write-ahead log
+// of their database before updating the database itself, so it
+// counts too.
+type jarState struct {
+	fi  os.FileInfo
+	wal os.FileInfo
+}
+
+func statJar(path string) (jarState, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return jarState{}, err
+	}
+	st := jarState{fi: fi}
+	if wal, err := os.Stat(path + "-wal"); err == nil {
+		st.wal = wal
+	}
+	return st, nil
+}
+
+func sameVersion(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+func (s jarState) equal(o jarState) bool {
+	return sameVersion(s.fi, o.fi) && sameVersion(s.wal, o.wal)
+}
+
+// readJar reads cookies from a cookie jar file or browser database.
+func readJar(path string, hosts []string) ([]*http.Cookie, error) {
+	if ok, err := isSQLite(path); err != nil {
+		return nil, err
+	} else if ok {
+		return ReadBrowserCookies(path, hosts)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseCookieJar(f)
+}
+
+// load reads the file, replacing the cookies from the previous
+// version. Cookies that were removed from the file are no longer
+// sent.
+func (j *Jar) load() error {
+	st, err := statJar(j.path)
+	if err != nil {
+		return err
+	}
+	cs, err := readJar(j.path, j.hosts)
 	if err != nil {
 		return err
 	}
 
-	// We watch the dir, so we catch creation + rename events too.
-	if err := w.Add(filepath.Dir(path)); err != nil {
+	j.mu.Lock()
+	j.state = st
+	j.cookies = cs
+	j.expiredLogged = map[string]bool{}
+	j.mu.Unlock()
+
+	if j.onLoad != nil {
+		j.onLoad(cs)
+	}
+	return nil
+}
+
+// reloadIfChanged loads the file if it differs from the version
+// that was loaded last.
+func (j *Jar) reloadIfChanged() {
+	st, err := statJar(j.path)
+	if os.IsNotExist(err) {
+		// Probably in the middle of being replaced.
+		return
+	}
+	if err != nil {
+		log.Printf("Stat(%s): %v", j.path, err)
+		return
+	}
+
+	j.mu.Lock()
+	same := st.equal(j.state)
+	j.mu.Unlock()
+	if same {
+		return
+	}
+	if err := j.load(); err != nil {
+		log.Printf("loading cookies from %s: %v", j.path, err)
+	}
+}
+
+// Watch starts watching the file for changes, and loads new data
+// from it whenever it is modified or replaced. We watch the
+// directory, so we catch files that are created or renamed into
+// place. In case events are missed, the file is also checked every
+// minute.
+func (j *Jar) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(j.path)); err != nil {
+		w.Close()
 		return err
 	}
 
 	go func() {
-		var lastMod time.Time
+		ticker := time.NewTicker(time.Minute)
 		for {
 			select {
 			case <-w.Events:
-				fi, err := os.Stat(path)
-				if os.IsNotExist(err) {
-					continue
-				}
-
-				if err != nil {
-					log.Printf("Stat(%s): %v", path, err)
-					continue
-				}
-				if fi.ModTime().Equal(lastMod) {
-					continue
-				}
-				lastMod = fi.ModTime()
-				if err := updateJar(jar, path); err != nil {
-					log.Printf("updateJar(%s): %v", path, err)
-				}
-
-			case <-w.Errors:
-				log.Printf("notify (%s):  %v", path, err)
+			case <-ticker.C:
+			case err := <-w.Errors:
+				log.Printf("notify (%s): %v", j.path, err)
+				continue
 			}
+			j.reloadIfChanged()
 		}
 	}()
 	return nil
 }
 
-// updateJar reads the path into the jar.
-func updateJar(jar http.CookieJar, path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+// WatchJar starts watching the given path for changes, and loads new
+// data from the file into jar whenever it is available. The hosts are
+// as for NewJar.
+//
+// Deprecated: use the Watch method of the Jar returned by NewJar.
+func WatchJar(jar http.CookieJar, path string, hosts ...string) error {
+	if j, ok := jar.(*Jar); ok && j.path == path {
+		return j.Watch()
 	}
-	defer f.Close()
 
-	cs, err := ParseCookieJar(f)
+	j, err := NewJar(path, hosts...)
 	if err != nil {
 		return err
 	}
+	j.onLoad = func(cs []*http.Cookie) {
+		for _, c := range cs {
+			jar.SetCookies(&url.URL{
+				Scheme: "http",
+				Host:   strings.TrimPrefix(c.Domain, "."),
+			}, []*http.Cookie{c})
+		}
+	}
+	j.onLoad(j.cookies)
+	return j.Watch()
+}
+
+// matches returns whether c should be sent with a request to u.
+func matches(c *http.Cookie, u *url.URL) bool {
+	if c.Secure && u.Scheme != "https" {
+		return false
+	}
+	if !domainMatch(u.Hostname(), c.Domain) {
+		return false
+	}
 
-	for _, c := range cs {
-		jar.SetCookies(&url.URL{
-			Scheme: "http",
-			Host:   c.Domain,
-		}, []*http.Cookie{c})
+	p, cp := u.Path, c.Path
+	if p == "" {
+		p = "/"
 	}
+	if cp == "" {
+		cp = "/"
+	}
+	return p == cp || strings.HasPrefix(p, cp) && (strings.HasSuffix(cp, "/") || p[len(cp)] == '/')
+}
 
-	return nil
+// Cookies implements http.CookieJar. Cookies from the file that
+// have expired are not sent; if that leaves none for the host, this
+// is logged once.
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	now := j.now()
+
+	var result []*http.Cookie
+	names := map[string]bool{}
+	j.mu.Lock()
+	expired := 0
+	for _, c := range j.cookies {
+		if !matches(c, u) {
+			continue
+		}
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			expired++
+			continue
+		}
+		names[c.Name] = true
+		result = append(result, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	if host := u.Hostname(); expired > 0 && len(result) == 0 && !j.expiredLogged[host] {
+		j.expiredLogged[host] = true
+		log.Printf("all %d cookies for %s in %s have expired", expired, host, j.path)
+	}
+	j.mu.Unlock()
+
+	for _, c := range j.server.Cookies(u) {
+		if !names[c.Name] {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// SetCookies implements http.CookieJar.
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.server.SetCookies(u, cookies)
 }
 
 // NewJar reads cookies in the Mozilla/Netscape cookie file format,
-// and returns them as a CookieJar
-func NewJar(path string) (http.CookieJar, error) {
-	jar, err := cookiejar.New(nil)
+// or from a Chrome or Firefox cookie database, and returns them as a
+// CookieJar. If hosts are given, only cookies for those hosts are
+// read from browser databases, which hold cookies for every site.
+func NewJar(path string, hosts ...string) (*Jar, error) {
+	server, err := cookiejar.New(nil)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := updateJar(jar, path); err != nil {
+	j := &Jar{
+		path:   path,
+		hosts:  hosts,
+		now:    time.Now,
+		server: server,
+	}
+	if err := j.load(); err != nil {
 		return nil, err
 	}
-
-	return jar, nil
+	return j, nil
 }
@@ -16,7 +16,13 @@ package cookie
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -85,3 +91,142 @@ func TestSpaceDomain(t *testing.T) {
 		t.Errorf("got diff %s", diff)
 	}
 }
+
+func TestParseSessionCookie(t *testing.T) {
+	got, err := ParseCookieJar(bytes.NewBufferString(".example.com\tTRUE\t/\tFALSE\t0\tname\tvalue"))
+	if err != nil {
+		t.Fatalf("ParseCookieJar: %v", err)
+	}
+	if len(got) != 1 || !got[0].Expires.IsZero() {
+		t.Errorf("got %v, want a session cookie", got)
+	}
+}
+
+func cookieNames(cs []*http.Cookie) string {
+	var names []string
+	for _, c := range cs {
+		names = append(names, c.Name+"="+c.Value)
+	}
+	return fmt.Sprint(names)
+}
+
+func TestJarCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jar")
+	content := `.example.com	TRUE	/	TRUE	2000	secure	1
+.example.com	TRUE	/a	FALSE	1000	short	2
+host.example.com	FALSE	/	FALSE	0	session	3
+other.com	FALSE	/	FALSE	2000	other	4
+example.com	TRUE	/	FALSE	0	nodot	6
+example.com	FALSE	/	FALSE	0	hostonly	7
+`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jar, err := NewJar(path)
+	if err != nil {
+		t.Fatalf("NewJar: %v", err)
+	}
+	now := time.Unix(500, 0)
+	jar.now = func() time.Time { return now }
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{"https://host.example.com/a/b", "[secure=1 short=2 session=3 nodot=6]"},
+		{"http://host.example.com/a", "[short=2 session=3 nodot=6]"},
+		{"https://host.example.com/ab", "[secure=1 session=3 nodot=6]"},
+		{"https://example.com/", "[secure=1 nodot=6 hostonly=7]"},
+		{"https://sub.other.com/", "[]"},
+		{"https://other.com/", "[other=4]"},
+	} {
+		u, _ := url.Parse(tc.url)
+		if got := cookieNames(jar.Cookies(u)); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.url, got, tc.want)
+		}
+	}
+
+	// Expiry is checked at request time.
+	now = time.Unix(1500, 0)
+	u, _ := url.Parse("https://host.example.com/a/b")
+	if got, want := cookieNames(jar.Cookies(u)), "[secure=1 session=3 nodot=6]"; got != want {
+		t.Errorf("after expiry: got %s, want %s", got, want)
+	}
+
+	// Cookies set by servers are sent along.
+	jar.SetCookies(u, []*http.Cookie{{Name: "server", Value: "5"}})
+	if got, want := cookieNames(jar.Cookies(u)), "[secure=1 session=3 nodot=6 server=5]"; got != want {
+		t.Errorf("with server cookie: got %s, want %s", got, want)
+	}
+}
+
+func TestJarReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jar")
+	mtime := time.Unix(1e9, 0)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(path, "example.com\tTRUE\t/\tFALSE\t0\told\tx\n")
+
+	jar, err := NewJar(path)
+	if err != nil {
+		t.Fatalf("NewJar: %v", err)
+	}
+
+	// Replace the file by renaming a new one with the same size
+	// and modification time over it.
+	tmp := path + ".tmp"
+	write(tmp, "example.com\tTRUE\t/\tFALSE\t0\tnew\ty\n")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	jar.reloadIfChanged()
+
+	u, _ := url.Parse("http://example.com/")
+	if got, want := cookieNames(jar.Cookies(u)), "[new=y]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWatchJar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "jar")
+	if err := ioutil.WriteFile(path, []byte(".example.com\tTRUE\t/\tFALSE\t0\tname\tvalue\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WatchJar(jar, path); err != nil {
+		t.Fatalf("WatchJar: %v", err)
+	}
+	u, _ := url.Parse("http://host.example.com/")
+	if got, want := cookieNames(jar.Cookies(u)), "[name=value]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
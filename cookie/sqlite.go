@@ -0,0 +1,176 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cookie
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const sqliteMagic = "SQLite format 3\x00"
+
+// isSQLite returns whether the file at path is an SQLite database.
+func isSQLite(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var magic [len(sqliteMagic)]byte
+	n, _ := f.Read(magic[:])
+	return string(magic[:n]) == sqliteMagic, nil
+}
+
+// sqliteDB reads tables of an SQLite database with the sqlite3
+// command.
+//
+// Browsers keep their database open and locked, so we query a
+// private copy of the database and its write-ahead log. SQLite then
+// applies the committed transactions of the log itself.
+type sqliteDB struct {
+	dir  string
+	path string
+}
+
+// openSQLite copies the database at path, and its write-ahead log if
+// there is one. The copy must be removed with Close.
+func openSQLite(path string) (*sqliteDB, error) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, fmt.Errorf("reading browser cookie databases needs the sqlite3 command: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "slothfs-cookies")
+	if err != nil {
+		return nil, err
+	}
+	db := &sqliteDB{dir: dir, path: filepath.Join(dir, "db")}
+	for _, suffix := range []string{"", "-wal"} {
+		content, err := ioutil.ReadFile(path + suffix)
+		if suffix != "" && os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = ioutil.WriteFile(db.path+suffix, content, 0600)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Close removes the copy of the database.
+func (db *sqliteDB) Close() error {
+	return os.RemoveAll(db.dir)
+}
+
+// Separators for the output of sqlite3. Since all values are
+// printed in hex, they can't occur in the values.
+const (
+	sqliteColSep = "\x1f"
+	sqliteRowSep = "\x1e"
+)
+
+// query runs a SELECT statement whose columns are all hex(...)
+// expressions, and returns the decoded values.
+func (db *sqliteDB) query(sql string) ([][][]byte, error) {
+	cmd := exec.Command("sqlite3", "-batch", "-noheader",
+		"-separator", sqliteColSep, "-newline", sqliteRowSep, db.path, sql)
+	var errOut bytes.Buffer
+	cmd.Stderr = &errOut
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3: %v: %s", err, strings.TrimSpace(errOut.String()))
+	}
+
+	var rows [][][]byte
+	for _, line := range strings.Split(string(out), sqliteRowSep) {
+		if line == "" {
+			continue
+		}
+		var row [][]byte
+		for _, f := range strings.Split(line, sqliteColSep) {
+			v, err := hex.DecodeString(f)
+			if err != nil {
+				return nil, fmt.Errorf("sqlite3: bad output %q", f)
+			}
+			row = append(row, v)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// quoteIdent quotes an SQL identifier.
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// columns returns the column names of a table. It returns none if
+// there is no such table.
+func (db *sqliteDB) columns(table string) ([]string, error) {
+	rows, err := db.query(fmt.Sprintf("SELECT hex(name) FROM pragma_table_info('%s');",
+		strings.Replace(table, "'", "''", -1)))
+	if err != nil {
+		return nil, err
+	}
+	var cols []string
+	for _, r := range rows {
+		cols = append(cols, string(r[0]))
+	}
+	return cols, nil
+}
+
+// rows returns all rows of a table, as maps from column name to the
+// value as text or blob. NULL values are empty.
+func (db *sqliteDB) rows(table string) ([]map[string][]byte, error) {
+	cols, err := db.columns(table)
+	if err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("no table %s", table)
+	}
+
+	var exprs []string
+	for _, c := range cols {
+		exprs = append(exprs, "hex("+quoteIdent(c)+")")
+	}
+	rows, err := db.query(fmt.Sprintf("SELECT %s FROM %s;", strings.Join(exprs, ", "), quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []map[string][]byte
+	for _, r := range rows {
+		if len(r) != len(cols) {
+			return nil, fmt.Errorf("table %s: got %d columns, want %d", table, len(r), len(cols))
+		}
+		m := map[string][]byte{}
+		for i, c := range cols {
+			m[c] = r[i]
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Bits of the mask passed to access(2).
+const (
+	accessRead  = 4
+	accessWrite = 2
+	accessExec  = 1
+)
+
+// dirMode returns the mode for directories of the tree.
+func (o *GitilesOptions) dirMode() uint32 {
+	if o.ReadOnlyModes {
+		return syscall.S_IFDIR | 0555
+	}
+	return syscall.S_IFDIR | 0755
+}
+
+// fileMode returns the mode for a file with the given git mode.
+func (o *GitilesOptions) fileMode(mode uint32) uint32 {
+	if !o.ReadOnlyModes || mode&syscall.S_IFMT != syscall.S_IFREG {
+		return mode
+	}
+	if mode&0111 != 0 {
+		return syscall.S_IFREG | 0555
+	}
+	return syscall.S_IFREG | 0444
+}
+
+// checkAccess answers access(2) for a node of the tree, whose mode
+// is given. Nothing can be written, and only directories and
+// executables can be executed.
+func checkAccess(mode, mask uint32) syscall.Errno {
+	if mask&accessWrite != 0 {
+		return syscall.EROFS
+	}
+	if mask&accessExec != 0 && mode&0111 == 0 {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+var _ = (fs.NodeAccesser)((*gitilesNode)(nil))
+
+func (n *gitilesNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return checkAccess(n.root.opts.fileMode(n.mode), mask)
+}
+
+var _ = (fs.NodeGetattrer)((*treeDir)(nil))
+
+func (d *treeDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = d.root.opts.dirMode()
+	return 0
+}
+
+var _ = (fs.NodeAccesser)((*treeDir)(nil))
+
+func (d *treeDir) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return checkAccess(d.root.opts.dirMode(), mask)
+}
+
+var _ = (fs.NodeGetattrer)((*caseFoldDir)(nil))
+
+func (d *caseFoldDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = d.root.opts.dirMode()
+	return 0
+}
+
+var _ = (fs.NodeAccesser)((*caseFoldDir)(nil))
+
+func (d *caseFoldDir) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return checkAccess(d.root.opts.dirMode(), mask)
+}
+
+var _ = (fs.NodeGetattrer)((*lazyDir)(nil))
+
+func (d *lazyDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	// Don't fetch the tree for stat(2).
+	out.Mode = d.root.opts.dirMode()
+	return 0
+}
+
+var _ = (fs.NodeAccesser)((*lazyDir)(nil))
+
+func (d *lazyDir) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return checkAccess(d.root.opts.dirMode(), mask)
+}
+
+var _ = (fs.NodeGetattrer)((*gitilesRoot)(nil))
+
+func (r *gitilesRoot) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = r.opts.dirMode()
+	return 0
+}
+
+var _ = (fs.NodeAccesser)((*gitilesRoot)(nil))
+
+func (r *gitilesRoot) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return checkAccess(r.opts.dirMode(), mask)
+}
+
+var _ = (fs.NodeAccesser)((*archiveDir)(nil))
+
+func (d *archiveDir) Access(ctx context.Context, mask uint32) syscall.Errno {
+	return checkAccess(d.file.root.opts.dirMode(), mask)
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/google/slothfs/gitiles"
+	fusefs "github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestReadOnlyModes(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	const blobID = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+	tree := &gitiles.Tree{
+		Entries: []gitiles.TreeEntry{
+			{Mode: 0100644, Type: "blob", ID: blobID, Name: "dir/file"},
+			{Mode: 0100755, Type: "blob", ID: blobID, Name: "dir/script"},
+		},
+	}
+
+	ctx := context.Background()
+	for _, ro := range []bool{false, true} {
+		opts := GitilesRevisionOptions{}
+		opts.ReadOnlyModes = ro
+		root := NewGitilesRoot(fix.cache, tree, nil, opts)
+		fusefs.NewNodeFS(root, &fusefs.Options{})
+
+		dir := root.GetChild("dir")
+		file := dir.GetChild("file").Operations().(*gitilesNode)
+		script := dir.GetChild("script").Operations().(*gitilesNode)
+
+		wantDir, wantFile, wantScript := uint32(0755), uint32(0644), uint32(0755)
+		if ro {
+			wantDir, wantFile, wantScript = 0555, 0444, 0555
+		}
+		for name, tc := range map[string]struct {
+			node fusefs.NodeGetattrer
+			want uint32
+		}{
+			"root":   {root, syscall.S_IFDIR | wantDir},
+			"dir":    {dir.Operations().(fusefs.NodeGetattrer), syscall.S_IFDIR | wantDir},
+			"file":   {file, syscall.S_IFREG | wantFile},
+			"script": {script, syscall.S_IFREG | wantScript},
+		} {
+			var out fuse.AttrOut
+			if errno := tc.node.Getattr(ctx, nil, &out); errno != 0 {
+				t.Fatalf("Getattr(%s): %v", name, errno)
+			}
+			if out.Mode != tc.want {
+				t.Errorf("read-only %v: %s: got mode %o, want %o", ro, name, out.Mode, tc.want)
+			}
+		}
+
+		for _, tc := range []struct {
+			node fusefs.NodeAccesser
+			mask uint32
+			want syscall.Errno
+		}{
+			{dir.Operations().(fusefs.NodeAccesser), accessExec, 0},
+			{dir.Operations().(fusefs.NodeAccesser), accessWrite, syscall.EROFS},
+			{file, accessRead, 0},
+			{file, accessExec, syscall.EACCES},
+			{file, accessWrite, syscall.EROFS},
+			{script, accessExec, 0},
+		} {
+			if got := tc.node.Access(ctx, tc.mask); got != tc.want {
+				t.Errorf("read-only %v: Access(%v, %d): got %v, want %v", ro, tc.node, tc.mask, got, tc.want)
+			}
+		}
+	}
+}
@@ -15,11 +15,100 @@
 package fs
 
 import (
+	"flag"
+	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/google/slothfs/manifest"
+	"github.com/hanwen/go-fuse/fs"
 )
 
+// Timeouts controls how long the kernel caches lookups and
+// attributes. Since the file system is read-only, long timeouts are
+// safe and avoid kernel roundtrips.
+type Timeouts struct {
+	Entry    time.Duration
+	Attr     time.Duration
+	Negative time.Duration
+}
+
+// DefaultTimeouts are the timeouts used if none are configured.
+var DefaultTimeouts = Timeouts{
+	Entry:    time.Hour,
+	Attr:     time.Hour,
+	Negative: time.Hour,
+}
+
+var timeoutFlags = DefaultTimeouts
+
+// DefineTimeoutFlags sets up command line flags for the kernel cache
+// timeouts, and returns the struct in which the values are put.
+func DefineTimeoutFlags() *Timeouts {
+	flag.DurationVar(&timeoutFlags.Entry, "entry_timeout", DefaultTimeouts.Entry, "Set how long the kernel caches name lookups.")
+	flag.DurationVar(&timeoutFlags.Attr, "attr_timeout", DefaultTimeouts.Attr, "Set how long the kernel caches file attributes.")
+	flag.DurationVar(&timeoutFlags.Negative, "negative_timeout", DefaultTimeouts.Negative, "Set how long the kernel caches failed lookups.")
+	return &timeoutFlags
+}
+
+// MountOptions returns FUSE mount options using these timeouts.
+func (t Timeouts) MountOptions() *fs.Options {
+	entry, attr, negative := t.Entry, t.Attr, t.Negative
+	return &fs.Options{
+		EntryTimeout:    &entry,
+		AttrTimeout:     &attr,
+		NegativeTimeout: &negative,
+	}
+}
+
+// MountFlags holds FUSE mount options that control who may access
+// the mount, and how it shows up in /proc/mounts.
+type MountFlags struct {
+	// AllowOther lets all users access the mount. It needs
+	// user_allow_other in /etc/fuse.conf.
+	AllowOther bool
+
+	// AllowRoot lets root access the mount, besides the user
+	// that mounted it. It cannot be combined with AllowOther.
+	AllowRoot bool
+
+	// FsName is the source column in /proc/mounts.
+	FsName string
+
+	// Name is the subtype; the mount type is "fuse." + Name.
+	Name string
+}
+
+var mountFlags MountFlags
+
+// DefineMountFlags sets up command line flags for FUSE mount
+// options, and returns the struct in which the values are put.
+func DefineMountFlags() *MountFlags {
+	flag.BoolVar(&mountFlags.AllowOther, "allow_other", false, "Let all users access the mount; needs user_allow_other in /etc/fuse.conf.")
+	flag.BoolVar(&mountFlags.AllowRoot, "allow_root", false, "Let root access the mount too.")
+	flag.StringVar(&mountFlags.FsName, "fsname", "slothfs", "Set the file system source shown in /proc/mounts.")
+	flag.StringVar(&mountFlags.Name, "subtype", "slothfs", "Set the file system subtype; the mount type is fuse.SUBTYPE.")
+	return &mountFlags
+}
+
+// Apply sets the mount options in o.
+func (m MountFlags) Apply(o *fs.Options) error {
+	if m.AllowOther && m.AllowRoot {
+		return fmt.Errorf("allow_other and allow_root are mutually exclusive")
+	}
+	o.AllowOther = m.AllowOther
+	if m.AllowRoot {
+		o.MountOptions.Options = append(o.MountOptions.Options, "allow_root")
+	}
+	if m.FsName != "" {
+		o.FsName = m.FsName
+	}
+	if m.Name != "" {
+		o.Name = m.Name
+	}
+	return nil
+}
+
 // CloneOption configures for which files we should trigger a git clone.
 type CloneOption struct {
 	RE    *regexp.Regexp
@@ -41,6 +130,83 @@ type GitilesOptions struct {
 
 	// List of filename options. We use the first matching option
 	CloneOption []CloneOption
+
+	// If set, honor the export-ignore and eol attributes from
+	// .gitattributes files, so the tree looks like the output
+	// of git-archive or a checkout.
+	GitAttributes bool
+
+	// If set, record which files are read, and list them in
+	// .slothfs/accessed. This can be used to derive clone and
+	// prefetch configurations for a build.
+	TrackAccess bool
+
+	// If set, names are looked up ignoring case. Directory
+	// listings still show the names as they are in the tree.
+	CaseInsensitive bool
+
+	// If set, check the content of each blob against its SHA1
+	// when it is first read, and fetch it again if the cache is
+	// corrupt.
+	VerifyReads bool
+
+	// LocalOverlay maps paths in the tree to directories or files
+	// on the host. Each is served read-only at its path, hiding
+	// whatever the tree has there. This can be used for generated
+	// files, projects that are not in Gitiles, or files patched
+	// with ApplyPatch from the populate package.
+	LocalOverlay map[string]string
+
+	// If set, reject all changes except setting the modification
+	// time with EROFS, and log them. By default, other attribute
+	// changes fail with ENOTSUP.
+	StrictReadOnly bool
+
+	// If set, only files whose path in the tree matches may have
+	// their modification time changed in StrictReadOnly mode.
+	MtimeAllow *regexp.Regexp
+
+	// If set, archives (.zip, .tar, .tar.gz and .tgz) whose path
+	// in the tree matches are also served unpacked, as a directory
+	// named like the archive with ".d" appended. The archive is
+	// fetched and unpacked into the cache when the directory is
+	// first used.
+	ExpandArchives *regexp.Regexp
+
+	// If set, trees are fetched from Gitiles one directory at a
+	// time, when the directory is first used, rather than
+	// recursively when the tree is mounted. Each directory is
+	// cached under its own tree ID, so a failed fetch only loses
+	// that directory. With GitAttributes, only the .gitattributes
+	// file at the top of the tree is honored.
+	LazyTrees bool
+
+	// If set, directories are reported with mode 0555, and files
+	// with 0444, or 0555 if they are executable, to show that the
+	// tree is read-only. By default, directories have mode 0755,
+	// and files the mode they have in git.
+	ReadOnlyModes bool
+
+	// If set, files report the time of the last commit that
+	// touched them as their modification time, instead of a
+	// fixed time, so builds that go by timestamps see what
+	// changed. The time is looked up in the background when the
+	// file is first stat'ed, and stored in the cache; until then,
+	// the file has the time of the revision. Identical blobs then
+	// don't share a node, as their times differ.
+	CommitTimes bool
+
+	// ReadAhead is the number of bytes to read ahead when a file
+	// is read sequentially without file handles. 0 disables
+	// readahead.
+	ReadAhead int
+
+	// If set, never access the network. Data is only served from
+	// the blob and tree caches and local git clones.
+	Offline bool
+
+	// FUSE options for the mount.
+	Mount MountFlags
 }
 
 // ManifestOptions holds options for a Manifest file system.
@@ -0,0 +1,41 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fs"
+)
+
+func TestMountFlagsApply(t *testing.T) {
+	o := DefaultTimeouts.MountOptions()
+	m := MountFlags{AllowRoot: true, FsName: "src", Name: "sub"}
+	if err := m.Apply(o); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if o.AllowOther || o.FsName != "src" || o.Name != "sub" {
+		t.Errorf("got %+v", o.MountOptions)
+	}
+	if want := []string{"allow_root"}; !reflect.DeepEqual(o.MountOptions.Options, want) {
+		t.Errorf("got options %v, want %v", o.MountOptions.Options, want)
+	}
+
+	m = MountFlags{AllowOther: true, AllowRoot: true}
+	if err := m.Apply(&fs.Options{}); err == nil {
+		t.Errorf("Apply with allow_other and allow_root succeeded")
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// archiveDirSuffix is appended to the name of an archive for the
+// directory holding its contents.
+const archiveDirSuffix = ".d"
+
+// isArchive returns whether we know how to unpack a file with this
+// name.
+func isArchive(name string) bool {
+	for _, s := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveDir serves the contents of an archive blob as a read-only
+// directory. The blob is fetched and unpacked into the cache when the
+// directory is first listed or looked into.
+type archiveDir struct {
+	hostNode
+
+	name string
+	file *gitilesNode
+
+	// Guards path. A failed unpack is retried on the next use.
+	mu sync.Mutex
+}
+
+func (d *archiveDir) unpack(ctx context.Context) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.path != "" {
+		return 0
+	}
+	if err := d.unpackLocked(ctx); err != nil {
+		log.Printf("unpack %s: %v", d.name, err)
+		return syscall.EIO
+	}
+	return 0
+}
+
+func (d *archiveDir) unpackLocked(ctx context.Context) error {
+	r := d.file.root
+	dest := filepath.Join(r.cache.Root(), "archives", d.file.id.String())
+	if _, err := os.Stat(dest); err == nil {
+		d.path = dest
+		return nil
+	}
+
+	f, err := r.openFile(ctx, d.file.id, d.file.clone, "archive")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dest), "tmp")
+	if err != nil {
+		return err
+	}
+	if err := unpackArchive(d.name, f, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		// Another mount may have unpacked it meanwhile.
+		os.RemoveAll(tmp)
+		if _, statErr := os.Stat(dest); statErr != nil {
+			return err
+		}
+	}
+	d.path = dest
+	return nil
+}
+
+var _ = (fs.NodeGetattrer)((*archiveDir)(nil))
+
+func (d *archiveDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	// Don't fetch the archive for stat(2).
+	out.Mode = d.file.root.opts.dirMode()
+	d.file.mtimeMu.Lock()
+	t := d.file.mtime
+	d.file.mtimeMu.Unlock()
+	out.SetTimes(nil, &t, nil)
+	return 0
+}
+
+var _ = (fs.NodeLookuper)((*archiveDir)(nil))
+
+func (d *archiveDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := d.unpack(ctx); errno != 0 {
+		return nil, errno
+	}
+	return d.hostNode.Lookup(ctx, name, out)
+}
+
+var _ = (fs.NodeReaddirer)((*archiveDir)(nil))
+
+func (d *archiveDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if errno := d.unpack(ctx); errno != 0 {
+		return nil, errno
+	}
+	return d.hostNode.Readdir(ctx)
+}
+
+// Limits on what an archive may unpack to, so a small archive can't
+// fill the cache. They are variables so tests can lower them.
+var (
+	maxArchiveEntries       = 1000000
+	maxArchiveBytes   int64 = 16 << 30
+)
+
+// unpackArchive unpacks the archive f, of the type given by its
+// name, into the directory dest. Entries may not escape dest;
+// symlinks are created last, so no entry is written through one.
+func unpackArchive(name string, f *os.File, dest string) error {
+	u := &unpacker{
+		dest:    dest,
+		entries: maxArchiveEntries,
+		bytes:   maxArchiveBytes,
+	}
+	var err error
+	if strings.HasSuffix(name, ".zip") {
+		err = u.unzip(f)
+	} else {
+		var r io.Reader = f
+		if strings.HasSuffix(name, "gz") {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			r = zr
+		}
+		err = u.untar(r)
+	}
+	if err != nil {
+		return err
+	}
+	return u.finish()
+}
+
+type unpacker struct {
+	dest     string
+	symlinks map[string]string
+
+	// The number of entries and file bytes still allowed.
+	entries int
+	bytes   int64
+}
+
+// path returns the destination for an archive entry. It counts the
+// entry against the limit.
+func (u *unpacker) path(name string) (string, error) {
+	if u.entries <= 0 {
+		return "", fmt.Errorf("more than %d entries", maxArchiveEntries)
+	}
+	u.entries--
+
+	rel := strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/")
+	if rel == "" || rel == "." {
+		return u.dest, nil
+	}
+	if filepath.Clean(rel) != rel || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("invalid entry name %q", name)
+	}
+	return filepath.Join(u.dest, rel), nil
+}
+
+func (u *unpacker) file(name string, mode os.FileMode, r io.Reader) error {
+	p, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if mode&0111 != 0 {
+		perm = 0755
+	}
+	out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.LimitReader(r, u.bytes+1))
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if n > u.bytes {
+		out.Close()
+		return fmt.Errorf("more than %d bytes", maxArchiveBytes)
+	}
+	u.bytes -= n
+	return out.Close()
+}
+
+func (u *unpacker) dir(name string) error {
+	p, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, 0755)
+}
+
+func (u *unpacker) symlink(name, target string) error {
+	p, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if u.symlinks == nil {
+		u.symlinks = map[string]string{}
+	}
+	u.symlinks[p] = target
+	return nil
+}
+
+// finish creates the symlinks. A link below another link would be
+// created through it, so such archives are refused.
+func (u *unpacker) finish() error {
+	var paths []string
+	for p := range u.symlinks {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		for dir := filepath.Dir(p); len(dir) > len(u.dest); dir = filepath.Dir(dir) {
+			if _, ok := u.symlinks[dir]; ok {
+				return fmt.Errorf("symlink %q lies below symlink %q", p, dir)
+			}
+		}
+	}
+	for _, p := range paths {
+		target := u.symlinks[p]
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *unpacker) untar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = u.dir(hdr.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = u.file(hdr.Name, os.FileMode(hdr.Mode), tr)
+		case tar.TypeSymlink:
+			err = u.symlink(hdr.Name, hdr.Linkname)
+		default:
+			// Hard links, devices and the like are left out.
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (u *unpacker) unzip(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = u.dir(zf.Name)
+		case mode&os.ModeSymlink != 0:
+			err = u.zipSymlink(zf)
+		case mode.IsRegular():
+			err = u.zipFile(zf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *unpacker) zipFile(zf *zip.File) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return u.file(zf.Name, zf.Mode(), r)
+}
+
+func (u *unpacker) zipSymlink(zf *zip.File) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	target, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+	if err != nil {
+		return err
+	}
+	return u.symlink(zf.Name, string(target))
+}
@@ -0,0 +1,222 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"github.com/google/slothfs/gitiles"
+	fusefs "github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func writeTarGz(t *testing.T, hdrs []*tar.Header) *os.File {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, h := range hdrs {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg && h.Size > 0 {
+			if _, err := tw.Write([]byte(h.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestUnpackTarGz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := func(name string, size int64) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0755, Size: size}
+	}
+	f := writeTarGz(t, []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		reg("./bin/tool", int64(len("./bin/tool"))),
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "bin/tool"},
+	})
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	dest := filepath.Join(dir, "out")
+	if err := unpackArchive("sdk.tar.gz", f, dest); err != nil {
+		t.Fatalf("unpackArchive: %v", err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dest, "link")); err != nil || string(content) != "./bin/tool" {
+		t.Errorf("link: got %q, %v", content, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dest, "bin/tool")); err != nil || fi.Mode()&0111 == 0 {
+		t.Errorf("bin/tool: got %v, %v, want executable", fi, err)
+	}
+
+	for _, hdrs := range [][]*tar.Header{
+		{reg("../escape", 0)},
+		{reg("/etc/escape", 0)},
+		// The file would be written through the symlink, if
+		// symlinks were created as they come.
+		{{Name: "up", Typeflag: tar.TypeSymlink, Linkname: ".."}, reg("up/escape", 0)},
+		// The second link would be created through the first.
+		{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: dir},
+			{Name: "a/escape", Typeflag: tar.TypeSymlink, Linkname: "x"},
+		},
+	} {
+		f := writeTarGz(t, hdrs)
+		dest := filepath.Join(dir, "bad")
+		unpackArchive("bad.tgz", f, dest)
+		f.Close()
+		os.Remove(f.Name())
+		if _, err := os.Lstat(filepath.Join(dir, "escape")); err == nil {
+			t.Errorf("%s escaped the destination", hdrs[len(hdrs)-1].Name)
+		}
+		os.RemoveAll(dest)
+	}
+}
+
+func TestUnpackLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(entries int, bytes int64) {
+		maxArchiveEntries, maxArchiveBytes = entries, bytes
+	}(maxArchiveEntries, maxArchiveBytes)
+	maxArchiveEntries, maxArchiveBytes = 2, 10
+
+	reg := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(name))}
+	}
+	for i, tc := range []struct {
+		hdrs []*tar.Header
+		ok   bool
+	}{
+		{hdrs: []*tar.Header{reg("a"), reg("b")}, ok: true},
+		{hdrs: []*tar.Header{reg("a"), reg("b"), reg("c")}},
+		{hdrs: []*tar.Header{reg("01234567890")}},
+		{hdrs: []*tar.Header{reg("012345"), reg("67890")}},
+	} {
+		f := writeTarGz(t, tc.hdrs)
+		dest := filepath.Join(dir, "out")
+		err := unpackArchive("a.tgz", f, dest)
+		f.Close()
+		os.Remove(f.Name())
+		os.RemoveAll(dest)
+		if (err == nil) != tc.ok {
+			t.Errorf("%d: got %v, want ok=%v", i, err, tc.ok)
+		}
+	}
+}
+
+func TestArchiveDir(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("lib/libsdk.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("ELF"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	id := plumbing.ComputeHash(plumbing.BlobObject, buf.Bytes())
+
+	size := buf.Len()
+	tree := &gitiles.Tree{
+		Entries: []gitiles.TreeEntry{
+			{Mode: 0100644, Type: "blob", ID: id.String(), Name: "prebuilts/sdk.zip", Size: &size},
+			{Mode: 0100644, Type: "blob", ID: id.String(), Name: "other/sdk.zip", Size: &size},
+		},
+	}
+	root := NewGitilesRoot(fix.cache, tree, nil, GitilesRevisionOptions{
+		GitilesOptions: GitilesOptions{
+			Offline:        true,
+			ExpandArchives: regexp.MustCompile("^prebuilts/"),
+		},
+	})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	if root.GetChild("other").GetChild("sdk.zip.d") != nil {
+		t.Errorf("other/sdk.zip was expanded")
+	}
+	ch := root.GetChild("prebuilts").GetChild("sdk.zip.d")
+	if ch == nil {
+		t.Fatal("prebuilts/sdk.zip.d not found")
+	}
+
+	// The blob is not available offline yet. The failure is not
+	// remembered, so the lookup works once the blob is cached.
+	ctx := context.Background()
+	var out fuse.EntryOut
+	if _, errno := ch.Operations().(fusefs.NodeLookuper).Lookup(ctx, "lib", &out); errno != syscall.EIO {
+		t.Fatalf("Lookup(lib) without blob: got %v, want EIO", errno)
+	}
+	if _, err := fix.cache.Blob.Write(id, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	lib, errno := ch.Operations().(fusefs.NodeLookuper).Lookup(ctx, "lib", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(lib): %v", errno)
+	}
+	so, errno := lib.Operations().(fusefs.NodeLookuper).Lookup(ctx, "libsdk.so", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(libsdk.so): %v", errno)
+	}
+	if out.Mode&syscall.S_IFREG == 0 || out.Size != 3 {
+		t.Errorf("libsdk.so: got %v", &out.Attr)
+	}
+	if content, err := ioutil.ReadFile(so.Operations().(*hostNode).path); err != nil || string(content) != "ELF" {
+		t.Errorf("libsdk.so: got %q, %v", content, err)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// blobFile is the file handle for a blob in the cache. Reads return
+// the file descriptor rather than data, so go-fuse can splice the
+// content from the cache file to the kernel without copying it
+// through the daemon. Holding on to the os.File keeps it from being
+// closed by the garbage collector while the handle is open.
+type blobFile struct {
+	f *os.File
+}
+
+func newBlobFile(f *os.File) *blobFile {
+	return &blobFile{f: f}
+}
+
+var _ = (fs.FileReader)((*blobFile)(nil))
+
+func (b *blobFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return fuse.ReadResultFd(b.f.Fd(), off, len(dest)), 0
+}
+
+var _ = (fs.FileReleaser)((*blobFile)(nil))
+
+func (b *blobFile) Release(ctx context.Context) syscall.Errno {
+	return fs.ToErrno(b.f.Close())
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func newBlobTestFile(tb testing.TB, size int) *os.File {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := f.Write(bytes.Repeat([]byte("0123456789abcdef"), size/16)); err != nil {
+		tb.Fatal(err)
+	}
+	return f
+}
+
+func TestBlobFile(t *testing.T) {
+	f := newBlobTestFile(t, 4096)
+	defer os.Remove(f.Name())
+
+	b := newBlobFile(f)
+	f = nil
+	// The handle keeps the file open, even if nothing else
+	// refers to it.
+	runtime.GC()
+	runtime.GC()
+
+	ctx := context.Background()
+	dest := make([]byte, 16)
+	res, errno := b.Read(ctx, dest, 32)
+	if errno != 0 {
+		t.Fatalf("Read: %v", errno)
+	}
+	data, status := res.Bytes(dest)
+	if !status.Ok() || string(data) != "0123456789abcdef" {
+		t.Errorf("Read: got %q, %v", data, status)
+	}
+
+	if errno := b.Release(ctx); errno != 0 {
+		t.Errorf("Release: %v", errno)
+	}
+}
+
+// The benchmarks read a 64 MiB blob in 128 KiB chunks, the largest
+// FUSE read. Outside a mount, the file descriptor result is read
+// with pread; on a mount, go-fuse splices it instead.
+const (
+	benchBlobSize  = 64 << 20
+	benchReadSize  = 128 << 10
+	benchReadAhead = 1 << 20
+)
+
+func BenchmarkBlobFileRead(b *testing.B) {
+	f := newBlobTestFile(b, benchBlobSize)
+	defer os.Remove(f.Name())
+	bf := newBlobFile(f)
+	defer bf.Release(context.Background())
+
+	ctx := context.Background()
+	dest := make([]byte, benchReadSize)
+	b.SetBytes(benchBlobSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for off := int64(0); off < benchBlobSize; off += benchReadSize {
+			res, _ := bf.Read(ctx, dest, off)
+			res.Bytes(dest)
+			res.Done()
+		}
+	}
+}
+
+func BenchmarkHandleLessRead(b *testing.B) {
+	f := newBlobTestFile(b, benchBlobSize)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cache := newOpenFileCache(1, benchReadAhead)
+	open := func() (*os.File, error) { return os.Open(f.Name()) }
+	var id plumbing.Hash
+
+	dest := make([]byte, benchReadSize)
+	b.SetBytes(benchBlobSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for off := int64(0); off < benchBlobSize; off += benchReadSize {
+			if _, err := cache.readAt(id, open, dest, off); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
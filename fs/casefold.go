@@ -0,0 +1,151 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// caseFoldIndex resolves names in a directory case-insensitively.
+// When a lookup succeeds with a different case, FUSE adds the name
+// used as an alias for the canonical entry, so the index snapshots
+// the canonical names before any alias can be added.
+type caseFoldIndex struct {
+	once      sync.Once
+	canonical []string
+	folded    map[string]string
+}
+
+func (c *caseFoldIndex) init(n *fs.Inode) {
+	c.once.Do(func() {
+		c.folded = map[string]string{}
+		for name := range n.Children() {
+			c.canonical = append(c.canonical, name)
+		}
+		sort.Strings(c.canonical)
+		for _, name := range c.canonical {
+			k := strings.ToLower(name)
+			if _, ok := c.folded[k]; !ok {
+				c.folded[k] = name
+			}
+		}
+	})
+}
+
+// lookup finds the child of n with the given name. If fold is set
+// and there is no exact match, the name is compared ignoring case.
+func (c *caseFoldIndex) lookup(ctx context.Context, n *fs.Inode, name string, fold bool, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ch := n.GetChild(name)
+	if ch == nil && fold {
+		c.init(n)
+		if canonical, ok := c.folded[strings.ToLower(name)]; ok {
+			ch = n.GetChild(canonical)
+		}
+	}
+	if ch == nil {
+		return nil, syscall.ENOENT
+	}
+
+	entryAttr(ctx, ch, out)
+	return ch, 0
+}
+
+// readdir lists the children of n. If fold is set, aliases added by
+// case-insensitive lookups are left out.
+func (c *caseFoldIndex) readdir(n *fs.Inode, fold bool) (fs.DirStream, syscall.Errno) {
+	children := n.Children()
+	var names []string
+	if fold {
+		c.init(n)
+		names = c.canonical
+	} else {
+		for name := range children {
+			names = append(names, name)
+		}
+	}
+
+	var r []fuse.DirEntry
+	for _, name := range names {
+		ch := children[name]
+		if ch == nil {
+			continue
+		}
+		r = append(r, fuse.DirEntry{
+			Mode: ch.Mode(),
+			Name: name,
+			Ino:  ch.StableAttr().Ino,
+		})
+	}
+	return fs.NewListDirStream(r), 0
+}
+
+// canonicalChildren returns the children of n, leaving out aliases
+// added by case-insensitive lookups. Lazy directories are not
+// populated.
+func canonicalChildren(n *fs.Inode) map[string]*fs.Inode {
+	var index *caseFoldIndex
+	switch d := n.Operations().(type) {
+	case *caseFoldDir:
+		index = &d.index
+	case *lazyDir:
+		if d.root.opts.CaseInsensitive {
+			index = &d.index
+		}
+	case *gitilesRoot:
+		if d.opts.CaseInsensitive {
+			index = &d.caseFold
+		}
+	}
+
+	children := n.Children()
+	if index == nil {
+		return children
+	}
+	index.init(n)
+	r := map[string]*fs.Inode{}
+	for _, name := range index.canonical {
+		if ch := children[name]; ch != nil {
+			r[name] = ch
+		}
+	}
+	return r
+}
+
+// caseFoldDir is a directory that resolves names case-insensitively.
+type caseFoldDir struct {
+	fs.Inode
+
+	root  *gitilesRoot
+	index caseFoldIndex
+}
+
+var _ = (fs.NodeLookuper)((*caseFoldDir)(nil))
+
+func (d *caseFoldDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return d.index.lookup(ctx, &d.Inode, name, true, out)
+}
+
+var _ = (fs.NodeReaddirer)((*caseFoldDir)(nil))
+
+func (d *caseFoldDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return d.index.readdir(&d.Inode, true)
+}
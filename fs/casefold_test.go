@@ -0,0 +1,62 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestCaseFoldDir(t *testing.T) {
+	ctx := context.Background()
+	root := &caseFoldDir{}
+	fs.NewNodeFS(root, &fs.Options{})
+
+	makefile := root.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: syscall.S_IFREG})
+	root.AddChild("Makefile", makefile, false)
+	readme := root.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: syscall.S_IFREG})
+	root.AddChild("README", readme, false)
+
+	var out fuse.EntryOut
+	if ch, errno := root.Lookup(ctx, "makefile", &out); errno != 0 || ch != makefile {
+		t.Fatalf("Lookup(makefile): %v, %v, want Makefile", ch, errno)
+	}
+	if ch, errno := root.Lookup(ctx, "README", &out); errno != 0 || ch != readme {
+		t.Fatalf("Lookup(README): %v, %v", ch, errno)
+	}
+	if _, errno := root.Lookup(ctx, "LICENSE", &out); errno != syscall.ENOENT {
+		t.Fatalf("Lookup(LICENSE): %v, want ENOENT", errno)
+	}
+
+	// This is what FUSE does after a successful lookup.
+	root.AddChild("makefile", makefile, false)
+
+	stream, errno := root.Readdir(ctx)
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	var names []string
+	for stream.HasNext() {
+		e, _ := stream.Next()
+		names = append(names, e.Name)
+	}
+	if len(names) != 2 || names[0] != "Makefile" || names[1] != "README" {
+		t.Errorf("got names %v, want [Makefile README]", names)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// cloneTrigger records the reads of a file that asked for the
+// repository to be cloned. It is reported in
+// .slothfs/clone-triggers.json, to help tune the clone options.
+type cloneTrigger struct {
+	Path string
+
+	// Pattern is the clone option that selected the file, or
+	// empty if no option matched and all files clone.
+	Pattern string `json:",omitempty"`
+
+	// Reads is the number of reads that asked for a clone.
+	Reads int
+
+	// Started is set if one of them started a clone, rather than
+	// finding one running or backing off after a failure.
+	Started bool
+
+	First time.Time
+	Last  time.Time
+}
+
+// cloneOption returns whether reading the file at path p should
+// clone the repository, and the pattern of the clone option that
+// decided it, if any.
+func (r *gitilesRoot) cloneOption(p string) (bool, string) {
+	if r.opts.CloneURL == "" {
+		return false, ""
+	}
+	for _, e := range r.opts.CloneOption {
+		if e.RE.MatchString(p) {
+			return e.Clone, e.RE.String()
+		}
+	}
+	return true, ""
+}
+
+// recordCloneTrigger notes that reading the blob asked for a clone.
+func (r *gitilesRoot) recordCloneTrigger(id plumbing.Hash, started bool) {
+	r.triggersMu.Lock()
+	defer r.triggersMu.Unlock()
+
+	p := r.blobPath(id)
+	now := time.Now()
+	t := r.triggers[p]
+	if t == nil {
+		_, pattern := r.cloneOption(p)
+		t = &cloneTrigger{Path: p, Pattern: pattern, First: now}
+		r.triggers[p] = t
+	}
+	t.Reads++
+	t.Started = t.Started || started
+	t.Last = now
+}
+
+// cloneTriggers returns the files that asked for a clone as JSON,
+// those that started one first, and then by path.
+func (r *gitilesRoot) cloneTriggers() ([]byte, error) {
+	r.triggersMu.Lock()
+	result := []cloneTrigger{}
+	for _, t := range r.triggers {
+		result = append(result, *t)
+	}
+	r.triggersMu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Started != result[j].Started {
+			return result[i].Started
+		}
+		return result[i].Path < result[j].Path
+	})
+	return json.MarshalIndent(result, "", " ")
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/google/slothfs/gitiles"
+	fusefs "github.com/hanwen/go-fuse/fs"
+)
+
+func TestCloneTriggers(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	const (
+		bigID   = "787d767f94fd634ed29cd69ec9f93bab2b25f5d4"
+		otherID = "0123456789012345678901234567890123456789"
+	)
+	tree := &gitiles.Tree{
+		ID: "58d9fdae2c26d82e04f3fcafc4358b99109f0e70",
+		Entries: []gitiles.TreeEntry{
+			{Mode: 0100644, Type: "blob", ID: bigID, Name: "big/blob.bin"},
+			{Mode: 0100644, Type: "blob", ID: otherID, Name: "README"},
+		},
+	}
+	root := NewGitilesRoot(fix.cache, tree, nil, GitilesRevisionOptions{
+		GitilesOptions: GitilesOptions{
+			CloneURL: "https://host/repo",
+			CloneOption: []CloneOption{
+				{RE: regexp.MustCompile(`\.mk$`), Clone: false},
+				{RE: regexp.MustCompile(`^big/`), Clone: true},
+			},
+		},
+	})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	for p, want := range map[string]bool{"a/b.mk": false, "big/x": true, "README": true} {
+		if got, _ := root.cloneOption(p); got != want {
+			t.Errorf("cloneOption(%s): got %v, want %v", p, got, want)
+		}
+	}
+
+	root.recordCloneTrigger(plumbing.NewHash(otherID), false)
+	root.recordCloneTrigger(plumbing.NewHash(bigID), true)
+	root.recordCloneTrigger(plumbing.NewHash(bigID), false)
+
+	content, err := root.cloneTriggers()
+	if err != nil {
+		t.Fatalf("cloneTriggers: %v", err)
+	}
+	var got []cloneTrigger
+	if err := json.Unmarshal(content, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d triggers, want 2: %s", len(got), content)
+	}
+	if g := got[0]; g.Path != "big/blob.bin" || g.Pattern != "^big/" || g.Reads != 2 || !g.Started {
+		t.Errorf("got first trigger %+v", g)
+	}
+	if g := got[1]; g.Path != "README" || g.Pattern != "" || g.Reads != 1 || g.Started {
+		t.Errorf("got second trigger %+v", g)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// dynamicNode is a read-only file whose content is computed each
+// time it is opened. Since the size is not known in advance, it uses
+// direct I/O.
+type dynamicNode struct {
+	fs.Inode
+
+	content func() ([]byte, error)
+}
+
+// newDynamicNode returns a node whose content is generated by the
+// given function.
+func newDynamicNode(content func() ([]byte, error)) *dynamicNode {
+	return &dynamicNode{content: content}
+}
+
+var _ = (fs.NodeGetattrer)((*dynamicNode)(nil))
+
+func (n *dynamicNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFREG | 0444
+	if h, ok := fh.(*dynamicHandle); ok {
+		out.Size = uint64(len(h.data))
+	}
+	t := time.Now()
+	out.SetTimes(nil, &t, nil)
+	return 0
+}
+
+var _ = (fs.NodeOpener)((*dynamicNode)(nil))
+
+func (n *dynamicNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_RDWR|syscall.O_WRONLY) != 0 {
+		return nil, 0, syscall.EPERM
+	}
+
+	data, err := n.content()
+	if err != nil {
+		log.Printf("dynamic content for %s: %v", n.Path(nil), err)
+		return nil, 0, syscall.EIO
+	}
+	return &dynamicHandle{data: data}, fuse.FOPEN_DIRECT_IO, 0
+}
+
+// dynamicHandle holds the content of a dynamicNode, as computed when
+// it was opened.
+type dynamicHandle struct {
+	data []byte
+}
+
+var _ = (fs.FileReader)((*dynamicHandle)(nil))
+
+func (h *dynamicHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if off >= int64(len(h.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(h.data)) {
+		end = int64(len(h.data))
+	}
+	return fuse.ReadResultData(h.data[off:end]), 0
+}
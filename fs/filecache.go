@@ -0,0 +1,170 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// errFileClosed is returned by cachedFile.readAt if the file was
+// evicted from the cache concurrently.
+var errFileClosed = errors.New("file was evicted")
+
+// cachedFile is an open blob file, with a buffer for reading ahead
+// on sequential access.
+type cachedFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	buf    []byte
+	bufOff int64
+
+	// end of the last read, to detect sequential access.
+	next int64
+}
+
+// readAt reads from the file. If the read continues where the last
+// one stopped, window bytes are read into a buffer, so subsequent
+// small reads do not need a system call.
+func (c *cachedFile) readAt(dest []byte, off int64, window int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return 0, errFileClosed
+	}
+
+	if off >= c.bufOff && off+int64(len(dest)) <= c.bufOff+int64(len(c.buf)) {
+		n := copy(dest, c.buf[off-c.bufOff:])
+		c.next = off + int64(n)
+		return n, nil
+	}
+
+	if window > len(dest) && off == c.next {
+		if cap(c.buf) < window {
+			c.buf = make([]byte, window)
+		}
+		n, err := c.f.ReadAt(c.buf[:window], off)
+		if err != nil && err != io.EOF {
+			c.buf = c.buf[:0]
+			return 0, err
+		}
+		c.buf = c.buf[:n]
+		c.bufOff = off
+		n = copy(dest, c.buf)
+		c.next = off + int64(n)
+		return n, nil
+	}
+
+	n, err := c.f.ReadAt(dest, off)
+	if err == io.EOF {
+		err = nil
+	}
+	c.next = off + int64(n)
+	return n, err
+}
+
+func (c *cachedFile) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+		c.buf = nil
+	}
+}
+
+// openFileCache keeps a bounded number of blob files open, so
+// handle-less reads don't have to open the file for each read.
+type openFileCache struct {
+	// maximum number of open files.
+	max int
+
+	// size of the readahead buffer, or 0 to disable readahead.
+	window int
+
+	mu    sync.Mutex
+	lru   *list.List
+	files map[plumbing.Hash]*list.Element
+}
+
+type openFileEntry struct {
+	id   plumbing.Hash
+	file *cachedFile
+}
+
+func newOpenFileCache(max, window int) *openFileCache {
+	return &openFileCache{
+		max:    max,
+		window: window,
+		lru:    list.New(),
+		files:  map[plumbing.Hash]*list.Element{},
+	}
+}
+
+// get returns the open file for the ID, calling open if it is not
+// in the cache.
+func (c *openFileCache) get(id plumbing.Hash, open func() (*os.File, error)) (*cachedFile, error) {
+	c.mu.Lock()
+	if e, ok := c.files[id]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*openFileEntry).file, nil
+	}
+	c.mu.Unlock()
+
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.files[id]; ok {
+		// Someone else opened it in the meantime.
+		f.Close()
+		c.lru.MoveToFront(e)
+		return e.Value.(*openFileEntry).file, nil
+	}
+
+	cf := &cachedFile{f: f}
+	c.files[id] = c.lru.PushFront(&openFileEntry{id, cf})
+	for c.lru.Len() > c.max {
+		last := c.lru.Back()
+		entry := last.Value.(*openFileEntry)
+		c.lru.Remove(last)
+		delete(c.files, entry.id)
+		entry.file.close()
+	}
+	return cf, nil
+}
+
+// readAt reads from the blob with the given ID.
+func (c *openFileCache) readAt(id plumbing.Hash, open func() (*os.File, error), dest []byte, off int64) (int, error) {
+	for {
+		f, err := c.get(id, open)
+		if err != nil {
+			return 0, err
+		}
+		n, err := f.readAt(dest, off, c.window)
+		if err != errFileClosed {
+			return n, err
+		}
+	}
+}
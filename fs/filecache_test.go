@@ -0,0 +1,88 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestOpenFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var ids []plumbing.Hash
+	contents := map[plumbing.Hash][]byte{}
+	for i := 0; i < 3; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 1000+i)
+		id := plumbing.ComputeHash(plumbing.BlobObject, data)
+		if err := ioutil.WriteFile(filepath.Join(dir, id.String()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		contents[id] = data
+	}
+
+	opens := 0
+	c := newOpenFileCache(2, 256)
+	read := func(id plumbing.Hash, off int64, sz int) []byte {
+		dest := make([]byte, sz)
+		n, err := c.readAt(id, func() (*os.File, error) {
+			opens++
+			return os.Open(filepath.Join(dir, id.String()))
+		}, dest, off)
+		if err != nil {
+			t.Fatalf("readAt(%s, %d): %v", id, off, err)
+		}
+		return dest[:n]
+	}
+
+	// Sequential reads, which should go through the readahead
+	// buffer, and past EOF.
+	var got []byte
+	for off := int64(0); ; off += 100 {
+		data := read(ids[0], off, 100)
+		if len(data) == 0 {
+			break
+		}
+		got = append(got, data...)
+	}
+	if !bytes.Equal(got, contents[ids[0]]) {
+		t.Errorf("sequential read: got %d bytes, want %d", len(got), len(contents[ids[0]]))
+	}
+	if opens != 1 {
+		t.Errorf("got %d opens, want 1", opens)
+	}
+
+	// Random access.
+	if got := read(ids[1], 500, 10); !bytes.Equal(got, contents[ids[1]][500:510]) {
+		t.Errorf("random read: got %q", got)
+	}
+
+	// Evicts ids[0].
+	read(ids[2], 0, 10)
+	read(ids[0], 0, 10)
+	if opens != 4 {
+		t.Errorf("got %d opens, want 4", opens)
+	}
+}
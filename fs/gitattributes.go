@@ -0,0 +1,189 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Attribute states, as described in gitattributes(5).
+const (
+	attrSet   = "set"
+	attrUnset = "unset"
+)
+
+// attrRule is a single line of a .gitattributes file.
+type attrRule struct {
+	// dir is the directory holding the .gitattributes file, "" for
+	// the top of the repository.
+	dir     string
+	pattern string
+
+	// attrs maps attribute names to attrSet, attrUnset or a
+	// value. An empty string makes the attribute unspecified.
+	attrs map[string]string
+}
+
+// gitAttributes holds the rules from all .gitattributes files in a
+// tree. It supports the subset of gitattributes(5) that is relevant
+// for serving files: patterns are matched with path.Match, and "**"
+// is not supported.
+type gitAttributes struct {
+	// rules are ordered by increasing precedence.
+	rules []attrRule
+}
+
+// parseGitAttributes parses the contents of the .gitattributes file
+// in the directory dir.
+func parseGitAttributes(dir string, content []byte) []attrRule {
+	var rules []attrRule
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		r := attrRule{
+			dir:     dir,
+			pattern: fields[0],
+			attrs:   map[string]string{},
+		}
+		for _, a := range fields[1:] {
+			switch {
+			case a == "binary":
+				// binary is a builtin macro for -diff -merge -text.
+				r.attrs["diff"] = attrUnset
+				r.attrs["merge"] = attrUnset
+				r.attrs["text"] = attrUnset
+			case strings.HasPrefix(a, "-"):
+				r.attrs[a[1:]] = attrUnset
+			case strings.HasPrefix(a, "!"):
+				r.attrs[a[1:]] = ""
+			case strings.Contains(a, "="):
+				kv := strings.SplitN(a, "=", 2)
+				r.attrs[kv[0]] = kv[1]
+			default:
+				r.attrs[a] = attrSet
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// newGitAttributes combines the rules of .gitattributes files,
+// keyed by the directory containing them.
+func newGitAttributes(files map[string][]byte) *gitAttributes {
+	var dirs []string
+	for d := range files {
+		dirs = append(dirs, d)
+	}
+
+	// Deeper files take precedence.
+	sort.Slice(dirs, func(i, j int) bool {
+		di, dj := depth(dirs[i]), depth(dirs[j])
+		if di != dj {
+			return di < dj
+		}
+		return dirs[i] < dirs[j]
+	})
+
+	a := &gitAttributes{}
+	for _, d := range dirs {
+		a.rules = append(a.rules, parseGitAttributes(d, files[d])...)
+	}
+	return a
+}
+
+func depth(dir string) int {
+	if dir == "" {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// matches returns true if the rule applies to the file at path p.
+func (r *attrRule) matches(p string) bool {
+	rel := p
+	if r.dir != "" {
+		if !strings.HasPrefix(p, r.dir+"/") {
+			return false
+		}
+		rel = p[len(r.dir)+1:]
+	}
+
+	if !strings.Contains(r.pattern, "/") {
+		ok, _ := path.Match(r.pattern, path.Base(rel))
+		return ok
+	}
+
+	ok, _ := path.Match(strings.TrimPrefix(r.pattern, "/"), rel)
+	return ok
+}
+
+// get returns the state of the attribute for the given path.
+func (a *gitAttributes) get(p, attr string) string {
+	result := ""
+	for i := range a.rules {
+		r := &a.rules[i]
+		v, ok := r.attrs[attr]
+		if !ok || !r.matches(p) {
+			continue
+		}
+		result = v
+	}
+	return result
+}
+
+// exportIgnored returns whether the path or any of its parent
+// directories has the export-ignore attribute.
+func (a *gitAttributes) exportIgnored(p string) bool {
+	for p != "." && p != "" {
+		if a.get(p, "export-ignore") == attrSet {
+			return true
+		}
+		p = path.Dir(p)
+	}
+	return false
+}
+
+// crlf returns whether the file should be checked out with CRLF
+// line endings.
+func (a *gitAttributes) crlf(p string) bool {
+	return a.get(p, "eol") == "crlf" && a.get(p, "text") != attrUnset
+}
+
+// toCRLF converts LF line endings to CRLF. Like git, it leaves content
+// that looks binary and existing CRLF line endings alone.
+func toCRLF(data []byte) []byte {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) + bytes.Count(data, []byte{'\n'}))
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import "testing"
+
+func TestGitAttributes(t *testing.T) {
+	attrs := newGitAttributes(map[string][]byte{
+		"": []byte(`# comment
+*.bat eol=crlf
+*.png binary
+/docs export-ignore
+tests/*.golden export-ignore
+`),
+		"sub": []byte(`*.bat -text
+`),
+	})
+
+	for _, tc := range []struct {
+		path          string
+		ignored, crlf bool
+	}{
+		{path: "run.bat", crlf: true},
+		{path: "dir/run.bat", crlf: true},
+		{path: "sub/run.bat"},
+		{path: "icon.png"},
+		{path: "docs/manual.md", ignored: true},
+		{path: "src/docs/manual.md"},
+		{path: "tests/a.golden", ignored: true},
+		{path: "tests/a.go"},
+	} {
+		if got := attrs.exportIgnored(tc.path); got != tc.ignored {
+			t.Errorf("exportIgnored(%q): got %v, want %v", tc.path, got, tc.ignored)
+		}
+		if got := attrs.crlf(tc.path); got != tc.crlf {
+			t.Errorf("crlf(%q): got %v, want %v", tc.path, got, tc.crlf)
+		}
+	}
+}
+
+func TestToCRLF(t *testing.T) {
+	for in, want := range map[string]string{
+		"a\nb\n":     "a\r\nb\r\n",
+		"a\r\nb\n":   "a\r\nb\r\n",
+		"\n":         "\r\n",
+		"bin\x00\n":  "bin\x00\n",
+		"no newline": "no newline",
+	} {
+		if got := string(toCRLF([]byte(in))); got != want {
+			t.Errorf("toCRLF(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
@@ -17,9 +17,13 @@ package fs
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
 
@@ -35,6 +39,14 @@ type gitilesConfigFSRoot struct {
 	cache   *cache.Cache
 	service *gitiles.RepoService
 	options GitilesOptions
+
+	// The project, if this is a directory of a host file system.
+	project *gitiles.Project
+
+	// Cached listing for refsDir.
+	refsMu   sync.Mutex
+	refs     map[string]string
+	refsTime time.Time
 }
 
 func parseID(s string) (*plumbing.Hash, error) {
@@ -51,26 +63,19 @@ func parseID(s string) (*plumbing.Hash, error) {
 var _ = (fs.NodeLookuper)((*gitilesConfigFSRoot)(nil))
 
 func (r *gitilesConfigFSRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	id, err := parseID(name)
-	if err != nil {
-		return nil, syscall.ENOENT
-	}
-
 	if ch := r.GetChild(name); ch != nil {
 		return ch, 0
 	}
 
-	tree, err := r.cache.Tree.Get(id)
+	id, err := parseID(name)
 	if err != nil {
-		tree, err = r.service.GetTree(id.String(), "/", true)
-		if err != nil {
-			log.Printf("GetTree(%s): %v", id, err)
-			return nil, syscall.EIO
-		}
+		return nil, syscall.ENOENT
+	}
 
-		if err := r.cache.Tree.Add(id, tree); err != nil {
-			log.Printf("TreeCache.Add(%s): %v", id, err)
-		}
+	tree, err := loadTree(r.cache, r.service, &r.options, id, !r.options.LazyTrees, "lookup")
+	if err != nil {
+		log.Printf("loadTree(%s): %v", id, err)
+		return nil, errnoFor(err)
 	}
 
 	gro := GitilesRevisionOptions{
@@ -86,6 +91,155 @@ func (r *gitilesConfigFSRoot) Lookup(ctx context.Context, name string, out *fuse
 	return ch, 0
 }
 
+var _ = (fs.NodeStatfser)((*gitilesConfigFSRoot)(nil))
+
+func (r *gitilesConfigFSRoot) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return cacheStatfs(r.cache, 0, out)
+}
+
+var _ = (fs.NodeOnAdder)((*gitilesConfigFSRoot)(nil))
+
+func (r *gitilesConfigFSRoot) OnAdd(ctx context.Context) {
+	slothfsNode := r.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: syscall.S_IFDIR})
+	r.AddChild(".slothfs", slothfsNode, false)
+
+	refsFile := r.NewPersistentInode(ctx, newDynamicNode(r.refsJSON), fs.StableAttr{Mode: syscall.S_IFREG})
+	slothfsNode.AddChild("refs.json", refsFile, false)
+
+	healthFile := r.NewPersistentInode(ctx, newDynamicNode(func() ([]byte, error) {
+		return CheckHealth(r.cache, r.service, r.options.Offline).JSON()
+	}), fs.StableAttr{Mode: syscall.S_IFREG})
+	slothfsNode.AddChild("health", healthFile, false)
+
+	refsNode := r.NewPersistentInode(ctx, &refsDir{root: r}, fs.StableAttr{Mode: syscall.S_IFDIR})
+	r.AddChild("refs", refsNode, false)
+
+	if r.project != nil {
+		r.addProjectFiles(ctx)
+	}
+}
+
+// refsJSON lists the branches and tags of the repository with their
+// commits, so users can find out which revisions to look up.
+func (r *gitilesConfigFSRoot) refsJSON() ([]byte, error) {
+	refs, err := r.refIDs()
+	if err != nil {
+		return nil, err
+	}
+	listing := map[string]map[string]string{
+		"branches": {},
+		"tags":     {},
+	}
+	for name, id := range refs {
+		if strings.HasPrefix(name, "heads/") {
+			listing["branches"][strings.TrimPrefix(name, "heads/")] = id
+		} else if strings.HasPrefix(name, "tags/") {
+			listing["tags"][strings.TrimPrefix(name, "tags/")] = id
+		}
+	}
+	return json.MarshalIndent(listing, "", " ")
+}
+
+// hasSubtrees returns whether the tree lists directories as
+// entries, ie. whether it was fetched non-recursively.
+func hasSubtrees(tree *gitiles.Tree) bool {
+	for _, e := range tree.Entries {
+		if e.Type == "tree" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTree returns a tree from the tree cache, the local git clone
+// or Gitiles, in that order. If recursive is set, trees that were
+// cached non-recursively are fetched again; otherwise, Gitiles is
+// asked only for the top directory. Fetched trees are added to the
+// cache.
+func loadTree(c *cache.Cache, service *gitiles.RepoService, opts *GitilesOptions, id *plumbing.Hash, recursive bool, trigger string) (*gitiles.Tree, error) {
+	tree, err := c.Tree.Get(id)
+	if err == nil {
+		if err = tree.Check(); err != nil {
+			log.Printf("cached tree %s: %v", id, err)
+		} else if recursive && hasSubtrees(tree) {
+			err = fmt.Errorf("cached tree %s is not recursive", id)
+		}
+	}
+	if err == nil {
+		return tree, nil
+	}
+
+	tree, err = fetchTree(c, service, opts, id, recursive, trigger)
+	if err == nil {
+		err = tree.Check()
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := cache.TreeMeta{
+		Repo:     opts.CloneURL,
+		Revision: id.String(),
+	}
+	if meta.Repo == "" && service != nil {
+		meta.Repo = service.Name
+	}
+	if err := c.Tree.AddWithMeta(id, tree, meta); err != nil {
+		log.Printf("TreeCache.Add(%s): %v", id, err)
+	}
+	return tree, nil
+}
+
+// fetchTree loads a tree from the local git clone if available, and
+// from Gitiles otherwise.
+func fetchTree(c *cache.Cache, service *gitiles.RepoService, opts *GitilesOptions, id *plumbing.Hash, recursive bool, trigger string) (*gitiles.Tree, error) {
+	if opts.CloneURL != "" {
+		if repo := c.Git.OpenLocal(opts.CloneURL); repo != nil {
+			if tree, err := cache.GetTree(repo, id); err == nil {
+				return tree, nil
+			}
+		}
+	}
+
+	if opts.Offline {
+		return nil, fmt.Errorf("offline: tree %s is not cached locally", id)
+	}
+	if service == nil {
+		return nil, fmt.Errorf("tree %s is not cached locally", id)
+	}
+	if err := c.Queue.Acquire(context.Background(), service.Name); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	tree, err := service.GetTree(id.String(), "/", recursive)
+	c.Queue.Release()
+	rec := cache.FetchRecord{
+		Kind:    "tree",
+		Repo:    service.Name,
+		ID:      id.String(),
+		Latency: time.Since(start),
+		Trigger: trigger,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	c.Fetches.Record(rec)
+	return tree, err
+}
+
+// CloneURL returns the URL to clone the repository repo from. If
+// offline, Gitiles can't be asked, so it returns the repository URL
+// on the Gitiles host, which is usually the clone URL.
+func CloneURL(service *gitiles.Service, repo string, offline bool) (string, error) {
+	if offline {
+		return strings.TrimSuffix(service.Addr(), "/") + "/" + repo, nil
+	}
+	project, err := service.NewRepoService(repo).Get()
+	if err != nil {
+		return "", fmt.Errorf("GetProject(%s): %v", repo, err)
+	}
+	return project.CloneURL, nil
+}
+
 // NewGitilesConfigFSRoot returns a root node for a filesystem that lazily
 // instantiates a repository if you access any subdirectory named by a
 // 40-byte hex SHA1.
@@ -97,7 +251,7 @@ func NewGitilesConfigFSRoot(c *cache.Cache, service *gitiles.RepoService, option
 	// a periodic removal of all subtrees trees. Since the FS is
 	// read-only that should cause no ill effects.
 	return &gitilesConfigFSRoot{
-		cache:   c,
+		cache:   c.ForRepo(options.CloneURL),
 		service: service,
 		options: *options,
 	}
@@ -15,14 +15,17 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -30,10 +33,10 @@ import (
 	"time"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	"gopkg.in/src-d/go-git.v4/plumbing/object"
 
 	"github.com/google/slothfs/cache"
 	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/trace"
 	"github.com/hanwen/go-fuse/fs"
 	"github.com/hanwen/go-fuse/fuse"
 )
@@ -43,8 +46,6 @@ import (
 type gitilesRoot struct {
 	fs.Inode
 
-	nodeCache *nodeCache
-
 	cache   *cache.Cache
 	service *gitiles.RepoService
 	tree    *gitiles.Tree
@@ -52,13 +53,55 @@ type gitilesRoot struct {
 
 	handleLessIO bool
 
-	// OID => path
-	shaMap map[plumbing.Hash]string
+	// Open files for handle-less I/O.
+	openFiles *openFileCache
+
+	// For case-insensitive lookups in the root directory.
+	caseFold caseFoldIndex
+
+	// The root tree ID, and with LazyTrees, the recursive tree
+	// for the metadata files, once fetched.
+	treeID        string
+	fullTreeMu    sync.Mutex
+	recursiveTree *gitiles.Tree
+
+	// Nodes that are shared within this root only, see addEntries.
+	nodesMu sync.Mutex
+	nodes   map[cache.NodeKey]*fs.Inode
+
+	// OID => path. Lazy directories add to it during lookups.
+	shaMapMu sync.Mutex
+	shaMap   map[plumbing.Hash]string
 
 	lazyRepo *cache.LazyRepo
 
 	fetchingCond *sync.Cond
 	fetching     map[plumbing.Hash]bool
+
+	// Blobs whose checksum was verified, if VerifyReads is set.
+	verifiedMu sync.Mutex
+	verified   map[plumbing.Hash]struct{}
+
+	// Attributes from .gitattributes, if GitAttributes is set.
+	attrs *gitAttributes
+
+	// Commit metadata for .slothfs/commit.json, once fetched.
+	commitMu   sync.Mutex
+	commitInfo *gitiles.Commit
+	commitJSON []byte
+
+	// With CommitTimes, the times of the last commits touching
+	// files, by path, once loaded from the cache. Times that were
+	// looked up since are saved shortly after, in batches.
+	timesMu     sync.Mutex
+	times       map[string]time.Time
+	newTimes    map[string]time.Time
+	timesCommit *plumbing.Hash
+	timesSaveMu sync.Mutex
+
+	// Reads that asked for a clone, by path.
+	triggersMu sync.Mutex
+	triggers   map[string]*cloneTrigger
 }
 
 // gitilesNode represents a read-only blob in the FUSE filesystem.
@@ -76,12 +119,30 @@ type gitilesNode struct {
 	// if set, clone the repo on reading this file.
 	clone bool
 
+	// If set, the modification time may be changed in
+	// StrictReadOnly mode.
+	mtimeAllowed bool
+
+	// if set, serve the blob with CRLF line endings. The converted
+	// content is stored in the blob cache under convertedID,
+	// which also determines the size.
+	crlf        bool
+	convertedMu sync.Mutex
+	convertedID *plumbing.Hash
+
 	// The timestamp is writable; protect it with a mutex.
-	mtimeMu sync.Mutex
-	mtime   time.Time
+	// mtimeFinal is set once mtime needs no CommitTimes lookup,
+	// and mtimeLookup once that lookup was started.
+	mtimeMu     sync.Mutex
+	mtime       time.Time
+	mtimeFinal  bool
+	mtimeLookup bool
 
 	// This is to verify that FOPEN_KEEP_CACHE is working as expected.
 	readCount uint32
+
+	// Set to 1 when the node is opened or read.
+	accessed uint32
 }
 
 var _ = (fs.NodeReadlinker)((*gitilesNode)(nil))
@@ -92,22 +153,152 @@ func (n *gitilesNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 
 var _ = (fs.NodeGetattrer)((*gitilesNode)(nil))
 
+// Getattr never fetches the blob. Until a file with line ending
+// conversion is opened, it reports the unconverted size with a zero
+// timeout, so the kernel asks again once the converted size is known.
 func (n *gitilesNode) Getattr(ctx context.Context, h fs.FileHandle, out *fuse.AttrOut) (code syscall.Errno) {
-	out.Size = uint64(n.size)
-	out.Mode = n.mode
+	n.resolveMtime()
+	if !n.lookupAttr(&out.Attr) {
+		out.SetTimeout(0)
+	}
+	return 0
+}
+
+// mtimeResolved returns whether the modification time is final.
+func (n *gitilesNode) mtimeResolved() bool {
+	if !n.root.opts.CommitTimes {
+		return true
+	}
+	n.mtimeMu.Lock()
+	defer n.mtimeMu.Unlock()
+	return n.mtimeFinal
+}
+
+// resolveMtime sets the modification time to the time of the last
+// commit touching the file, if CommitTimes is set. Times that are not
+// in the cache are looked up in the background; until then, the file
+// has the time of the revision. Failures are logged, and leave the
+// time of the revision, or the fixed time.
+func (n *gitilesNode) resolveMtime() {
+	if n.mtimeResolved() {
+		return
+	}
+
+	r := n.root
+	if r.service == nil || r.opts.Revision == "" || r.opts.Offline {
+		n.setMtime(time.Time{})
+		return
+	}
+	p := n.Path(r.EmbeddedInode())
+	if t, ok := r.commitTime(p); ok {
+		n.setMtime(t)
+		return
+	}
+
+	n.mtimeMu.Lock()
+	start := !n.mtimeLookup && !n.mtimeFinal
+	n.mtimeLookup = true
+	n.mtimeMu.Unlock()
+	if !start {
+		return
+	}
+
+	if c, err := r.revisionCommit(); err == nil {
+		if t, err := c.Committer.ParseTime(); err == nil {
+			n.mtimeMu.Lock()
+			if !n.mtimeFinal {
+				n.mtime = t
+			}
+			n.mtimeMu.Unlock()
+		}
+	}
+	go n.lookupMtime(p)
+}
+
+// lookupMtime looks up the time of the last commit touching the file
+// at p in the Gitiles log.
+func (n *gitilesNode) lookupMtime(p string) {
+	r := n.root
+	var t time.Time
+	err := r.cache.Queue.Acquire(context.Background(), r.service.Name)
+	if err == nil {
+		var l *gitiles.Log
+		l, err = r.service.LogPage(r.opts.Revision, p, "", 1)
+		r.cache.Queue.Release()
+		if err == nil && len(l.Log) == 0 {
+			err = fmt.Errorf("no commits at %s", r.opts.Revision)
+		}
+		if err == nil {
+			t, err = l.Log[0].Committer.ParseTime()
+		}
+	}
+	if err != nil {
+		log.Printf("commit time of %s: %v", p, err)
+	} else {
+		r.addCommitTime(p, t)
+	}
+	n.setMtime(t)
+}
+
+// setMtime makes t the final modification time, unless it is zero
+// or the time was set already.
+func (n *gitilesNode) setMtime(t time.Time) {
+	n.mtimeMu.Lock()
+	defer n.mtimeMu.Unlock()
+	if !n.mtimeFinal && !t.IsZero() {
+		n.mtime = t
+	}
+	n.mtimeFinal = true
+}
+
+// lookupAttr fills in the attributes for LOOKUP and READDIRPLUS from
+// the tree metadata, so listing a directory never fetches blobs. It
+// returns false if the size is not known yet, because it depends on
+// line ending conversion, or if the commit time was not looked up yet.
+func (n *gitilesNode) lookupAttr(out *fuse.Attr) bool {
+	mtimeExact := n.mtimeResolved()
+	if !n.crlf {
+		n.fillAttr(n.id, n.size, out)
+		return mtimeExact
+	}
+
+	n.convertedMu.Lock()
+	id, size, exact := n.id, n.size, n.convertedID != nil
+	if exact {
+		id = *n.convertedID
+	}
+	n.convertedMu.Unlock()
+	n.fillAttr(id, size, out)
+	return exact && mtimeExact
+}
+
+func (n *gitilesNode) fillAttr(id plumbing.Hash, size int64, out *fuse.Attr) {
+	out.Size = uint64(size)
+	out.Mode = n.root.opts.fileMode(n.mode)
+
+	// Report the blocks used in the local cache, so du(1) shows
+	// how much of the tree was actually downloaded.
+	out.Blksize = blockSize
+	if n.mode&syscall.S_IFMT == syscall.S_IFREG {
+		blocks, _ := n.root.cache.Blob.Blocks(id)
+		out.Blocks = uint64(blocks)
+	}
 
 	n.mtimeMu.Lock()
 	t := n.mtime
 	n.mtimeMu.Unlock()
 
 	out.SetTimes(nil, &t, nil)
-	return 0
 }
 
 var _ = (fs.NodeSetattrer)((*gitilesNode)(nil))
 
 func (n *gitilesNode) Setattr(ctx context.Context, h fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (code syscall.Errno) {
-	if 0 != in.Valid&(fuse.FATTR_MODE|
+	if n.root.opts.StrictReadOnly {
+		if errno := n.checkStrictSetattr(in); errno != 0 {
+			return errno
+		}
+	} else if 0 != in.Valid&(fuse.FATTR_MODE|
 		fuse.FATTR_UID|
 		fuse.FATTR_GID|
 		fuse.FATTR_SIZE|
@@ -118,6 +309,7 @@ func (n *gitilesNode) Setattr(ctx context.Context, h fs.FileHandle, in *fuse.Set
 	if mt, ok := in.GetMTime(); ok {
 		n.mtimeMu.Lock()
 		n.mtime = mt
+		n.mtimeFinal = true
 		n.mtimeMu.Unlock()
 
 		return n.Getattr(ctx, h, out)
@@ -125,40 +317,96 @@ func (n *gitilesNode) Setattr(ctx context.Context, h fs.FileHandle, in *fuse.Set
 	return 0
 }
 
+// touchAttrs are the attributes that touch(1) sets. With futimens(3),
+// the file handle is passed along too.
+const touchAttrs = fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW | fuse.FATTR_ATIME | fuse.FATTR_ATIME_NOW | fuse.FATTR_FH
+
+// checkStrictSetattr returns EROFS unless the change sets the
+// modification time of a file allowed by MtimeAllow. Whether it is
+// allowed was decided from the path the node was added at, as a
+// shared node has no single path.
+func (n *gitilesNode) checkStrictSetattr(in *fuse.SetAttrIn) syscall.Errno {
+	if in.Valid&^touchAttrs != 0 || in.Valid&(fuse.FATTR_MTIME|fuse.FATTR_MTIME_NOW) == 0 {
+		log.Printf("blob %s: rejecting setattr (valid %#x) on read-only file system", n.id, in.Valid)
+		return syscall.EROFS
+	}
+	if !n.mtimeAllowed {
+		log.Printf("blob %s: rejecting mtime change outside the allowed paths", n.id)
+		return syscall.EROFS
+	}
+	return 0
+}
+
 const xattrName = "user.gitsha1"
 
+// convertedXattrName holds the SHA1 of the content served for files
+// with line ending conversion, which differs from the blob ID.
+const convertedXattrName = "user.slothfs.convertedsha1"
+
+// blockSize is the preferred I/O size reported to stat(2).
+const blockSize = 4096
+
 var _ = (fs.NodeGetxattrer)((*gitilesNode)(nil))
 
 func (n *gitilesNode) Getxattr(ctx context.Context, attribute string, dest []byte) (uint32, syscall.Errno) {
-	if attribute != xattrName {
-		return 0, syscall.ENODATA
+	switch {
+	case attribute == xattrName:
+		sz := copy(dest, n.id.String())
+		return uint32(sz), 0
+	case attribute == convertedXattrName && n.crlf:
+		id, _, err := n.blobInfo(ctx)
+		if err != nil {
+			log.Printf("blobInfo(%s): %v", n.id, err)
+			return 0, syscall.EIO
+		}
+		sz := copy(dest, id.String())
+		return uint32(sz), 0
 	}
-	sz := copy(dest, n.id.String())
-	return uint32(sz), 0
+	return 0, syscall.ENODATA
 }
 
 var _ = (fs.NodeListxattrer)((*gitilesNode)(nil))
 
 func (n *gitilesNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
-	sz := copy(dest, xattrName)
-	dest[sz] = 0
-	return uint32(sz + 1), 0
+	names := xattrName + "\x00"
+	if n.crlf {
+		names += convertedXattrName + "\x00"
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), 0
 }
 
 var _ = (fs.NodeOpener)((*gitilesNode)(nil))
 
 func (n *gitilesNode) Open(ctx context.Context, flags uint32) (h fs.FileHandle, fuseFlags uint32, code syscall.Errno) {
+	if n.root.opts.StrictReadOnly && flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		log.Printf("blob %s: rejecting open for writing on read-only file system", n.id)
+		return nil, 0, syscall.EROFS
+	}
 	if n.root.handleLessIO {
 		// We say ENOSYS so FUSE on Linux uses handle-less I/O.
 		return nil, 0, syscall.ENOSYS
 	}
+	n.recordAccess()
 
-	f, err := n.root.openFile(n.id, n.clone)
+	ctx, span := trace.Start(ctx, "fuse.Open")
+	span.SetAttr("path", n.root.blobPath(n.id))
+	id, _, err := n.blobInfo(ctx)
+	if err != nil {
+		span.End(err)
+		return nil, 0, fs.ToErrno(err)
+	}
+	f, err := n.root.openFile(ctx, id, n.clone, "open")
+	span.End(err)
 	if err != nil {
 		return nil, 0, fs.ToErrno(err)
 	}
 
-	return fs.NewLoopbackFile(int(f.Fd())), fuse.FOPEN_KEEP_CACHE, 0
+	// Keeping the page cache is safe: the inode number is derived
+	// from the blob ID, so an inode never gets other content.
+	return newBlobFile(f), fuse.FOPEN_KEEP_CACHE, 0
 }
 
 var _ = (fs.NodeReader)((*gitilesNode)(nil))
@@ -169,51 +417,347 @@ func (n *gitilesNode) Read(ctx context.Context, file fs.FileHandle, dest []byte,
 	}
 
 	if n.root.handleLessIO {
-		return n.handleLessRead(file, dest, off)
+		n.recordAccess()
+		return n.handleLessRead(ctx, file, dest, off)
 	}
 
 	return file.(fs.FileReader).Read(ctx, dest, off)
 }
 
-func (n *gitilesNode) handleLessRead(file fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	// TODO(hanwen): for large files this is not efficient. Should
-	// have a cache of open file handles.
-	f, err := n.root.openFile(n.id, n.clone)
+func (n *gitilesNode) handleLessRead(ctx context.Context, file fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	ctx, span := trace.Start(ctx, "fuse.Read")
+	span.SetAttr("path", n.root.blobPath(n.id))
+	id, _, err := n.blobInfo(ctx)
 	if err != nil {
+		span.End(err)
 		return nil, fs.ToErrno(err)
 	}
 
-	m, err := f.ReadAt(dest, off)
-	if err == io.EOF {
-		err = nil
+	m, err := n.root.openFiles.readAt(id, func() (*os.File, error) {
+		return n.root.openFile(ctx, id, n.clone, "read")
+	}, dest, off)
+	span.End(err)
+	return fuse.ReadResultData(dest[:m]), fs.ToErrno(err)
+}
+
+// blobInfo returns the ID of the blob to serve for this node, and its
+// size. For nodes with line ending conversion, the size is only known
+// after fetching the content, so this may be expensive.
+func (n *gitilesNode) blobInfo(ctx context.Context) (plumbing.Hash, int64, error) {
+	if !n.crlf {
+		return n.id, n.size, nil
 	}
+
+	n.convertedMu.Lock()
+	defer n.convertedMu.Unlock()
+	if n.convertedID != nil {
+		return *n.convertedID, n.size, nil
+	}
+
+	f, err := n.root.openFile(ctx, n.id, n.clone, "crlf")
+	if err != nil {
+		return n.id, 0, err
+	}
+	data, err := ioutil.ReadAll(f)
 	f.Close()
-	return fuse.ReadResultData(dest[:m]), fs.ToErrno(err)
+	if err != nil {
+		return n.id, 0, err
+	}
+
+	converted := toCRLF(data)
+	id := plumbing.ComputeHash(plumbing.BlobObject, converted)
+	if f, ok := n.root.cache.Blob.Open(id); ok {
+		f.Close()
+	} else if _, err := n.root.cache.Blob.Write(id, bytes.NewReader(converted)); err != nil {
+		return n.id, 0, err
+	}
+
+	n.convertedID = &id
+	n.size = int64(len(converted))
+	return id, n.size, nil
 }
 
 // openFile returns a file handle for the given blob. If `clone` is
 // given, we may try a clone of the git repository
-func (r *gitilesRoot) openFile(id plumbing.Hash, clone bool) (*os.File, error) {
+// openFile opens the blob, fetching it if necessary. The trigger
+// describes why the blob is needed, for the fetch log.
+func (r *gitilesRoot) openFile(ctx context.Context, id plumbing.Hash, clone bool, trigger string) (*os.File, error) {
+	_, span := trace.Start(ctx, "cache.Blob.Open")
+	span.SetAttr("blob", id.String())
 	f, ok := r.cache.Blob.Open(id)
+	span.SetAttr("hit", ok)
+	span.End(nil)
+	if ok && !r.checkBlob(id, f) {
+		f.Close()
+		if err := r.cache.Blob.Remove(id); err != nil {
+			log.Printf("Remove(%s): %v", id.String(), err)
+		}
+		ok = false
+	}
 	if ok {
 		return f, nil
 	}
 
-	f, err := r.fetchFile(id, clone)
+	f, err := r.fetchFile(ctx, id, clone, trigger)
 	if err != nil {
 		log.Printf("fetchFile(%s): %v", id.String(), err)
-		return nil, syscall.ESPIPE
+		return nil, errnoFor(err)
+	}
+	if !r.checkBlob(id, f) {
+		f.Close()
+		return nil, syscall.EIO
 	}
 
 	return f, nil
 }
 
-func (r *gitilesRoot) fetchFile(id plumbing.Hash, clone bool) (*os.File, error) {
+// checkBlob returns false if VerifyReads is set, and the content of
+// f does not match the blob ID. Each blob is checked only once.
+func (r *gitilesRoot) checkBlob(id plumbing.Hash, f *os.File) bool {
+	if !r.opts.VerifyReads {
+		return true
+	}
+	r.verifiedMu.Lock()
+	_, done := r.verified[id]
+	r.verifiedMu.Unlock()
+	if done {
+		return true
+	}
+
+	ok, err := r.cache.Blob.Verify(id, f)
+	if err != nil {
+		log.Printf("Verify(%s): %v", id.String(), err)
+		return false
+	}
+	if !ok {
+		log.Printf("blob %s (%s): checksum mismatch in cache", id.String(), r.blobPath(id))
+		return false
+	}
+
+	r.verifiedMu.Lock()
+	r.verified[id] = struct{}{}
+	r.verifiedMu.Unlock()
+	return true
+}
+
+// recordAccess notes that the node was read. The node may be shared
+// with other roots, so this is recorded on the node rather than in a
+// root that tracks access.
+func (n *gitilesNode) recordAccess() {
+	atomic.StoreUint32(&n.accessed, 1)
+}
+
+// revisionCommit returns the Gitiles metadata of the revision. It
+// is fetched on first use; failures are retried on the next call.
+func (r *gitilesRoot) revisionCommit() (*gitiles.Commit, error) {
+	r.commitMu.Lock()
+	defer r.commitMu.Unlock()
+	if r.commitInfo != nil {
+		return r.commitInfo, nil
+	}
+
+	c, err := r.service.GetCommit(r.opts.Revision)
+	if err != nil {
+		return nil, fmt.Errorf("GetCommit(%s): %w", r.opts.Revision, err)
+	}
+	r.commitInfo = c
+	return c, nil
+}
+
+// commit returns the Gitiles metadata of the revision as JSON.
+func (r *gitilesRoot) commit() ([]byte, error) {
+	c, err := r.revisionCommit()
+	if err != nil {
+		return nil, err
+	}
+
+	r.commitMu.Lock()
+	defer r.commitMu.Unlock()
+	if r.commitJSON != nil {
+		return r.commitJSON, nil
+	}
+	content, err := json.MarshalIndent(c, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	r.commitJSON = content
+	return content, nil
+}
+
+// commitTimesSaveDelay is how long commit times that were looked up
+// are collected before they are saved to the cache.
+var commitTimesSaveDelay = time.Second
+
+// commitTime returns the time of the last commit touching the file at
+// p, if it is known. On first use, it loads the times recorded in the
+// cache for the revision.
+func (r *gitilesRoot) commitTime(p string) (time.Time, bool) {
+	r.timesMu.Lock()
+	loaded := r.times != nil
+	r.timesMu.Unlock()
+	if !loaded {
+		r.loadCommitTimes()
+	}
+
+	r.timesMu.Lock()
+	defer r.timesMu.Unlock()
+	t, ok := r.times[p]
+	return t, ok
+}
+
+// loadCommitTimes reads the times recorded in the cache for the commit
+// of the revision. Without the commit, the times are not stored.
+func (r *gitilesRoot) loadCommitTimes() {
+	var commit *plumbing.Hash
+	times := map[string]time.Time{}
+	if c, err := r.revisionCommit(); err != nil {
+		log.Printf("commit times: %v", err)
+	} else if commit, err = parseID(c.Commit); err != nil {
+		log.Printf("commit times: %v", err)
+	} else if times, err = r.cache.Tree.CommitTimes(commit); err != nil {
+		log.Printf("CommitTimes(%s): %v", commit, err)
+		times = map[string]time.Time{}
+	}
+
+	r.timesMu.Lock()
+	defer r.timesMu.Unlock()
+	if r.times == nil {
+		r.times = times
+		r.timesCommit = commit
+	}
+}
+
+// addCommitTime records the time of the last commit touching the file
+// at p, and schedules saving it to the cache.
+func (r *gitilesRoot) addCommitTime(p string, t time.Time) {
+	r.timesMu.Lock()
+	defer r.timesMu.Unlock()
+	if r.times == nil || r.timesCommit == nil {
+		return
+	}
+	r.times[p] = t
+	if r.newTimes == nil {
+		r.newTimes = map[string]time.Time{}
+		time.AfterFunc(commitTimesSaveDelay, r.saveCommitTimes)
+	}
+	r.newTimes[p] = t
+}
+
+// saveCommitTimes adds the times that were looked up to the cache.
+func (r *gitilesRoot) saveCommitTimes() {
+	r.timesSaveMu.Lock()
+	defer r.timesSaveMu.Unlock()
+
+	r.timesMu.Lock()
+	times := r.newTimes
+	r.newTimes = nil
+	r.timesMu.Unlock()
+
+	if err := r.cache.Tree.AddCommitTimes(r.timesCommit, times); err != nil {
+		log.Printf("AddCommitTimes(%s): %v", r.timesCommit, err)
+	}
+}
+
+// localNode returns the node for n's blob and mode in this root,
+// creating it if needed.
+func (r *gitilesRoot) localNode(ctx context.Context, parent *fs.Inode, n *gitilesNode, attr fs.StableAttr) *fs.Inode {
+	key := cache.NodeKey{ID: n.id, Mode: n.mode}
+	r.nodesMu.Lock()
+	defer r.nodesMu.Unlock()
+	if ch := r.nodes[key]; ch != nil {
+		return ch
+	}
+	ch := parent.NewPersistentInode(ctx, n, attr)
+	r.nodes[key] = ch
+	return ch
+}
+
+// accessedPaths returns the sorted list of paths that were read, one
+// per line. Since identical blobs in a tree share nodes, all paths of
+// a node that was read are included.
+func (r *gitilesRoot) accessedPaths() ([]byte, error) {
+	var paths []string
+	var walk func(dir string, n *fs.Inode)
+	walk = func(dir string, n *fs.Inode) {
+		for name, ch := range n.Children() {
+			p := filepath.Join(dir, name)
+			if gn, ok := ch.Operations().(*gitilesNode); ok {
+				if atomic.LoadUint32(&gn.accessed) != 0 {
+					paths = append(paths, p)
+				}
+			} else if ch.IsDir() && name != ".slothfs" {
+				walk(p, ch)
+			}
+		}
+	}
+	walk("", r.EmbeddedInode())
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, p := range paths {
+		fmt.Fprintln(&buf, p)
+	}
+	return buf.Bytes(), nil
+}
+
+var _ = (fs.NodeStatfser)((*gitilesRoot)(nil))
+
+func (r *gitilesRoot) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	var used uint64
+	for _, e := range r.tree.Entries {
+		if e.Size != nil {
+			used += uint64(*e.Size)
+		}
+	}
+	return cacheStatfs(r.cache, used, out)
+}
+
+// cacheStatfs fills out with the free space of the file system
+// holding the cache. If used is nonzero, the total size is adjusted
+// so used bytes are reported as in use, so df(1) shows the size of
+// the tree next to the space available for fetching it.
+func cacheStatfs(c *cache.Cache, used uint64, out *fuse.StatfsOut) syscall.Errno {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(c.Root(), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStatfsT(&st)
+	if used > 0 && out.Bsize > 0 {
+		out.Bfree = out.Bavail
+		out.Blocks = out.Bavail + (used+uint64(out.Bsize)-1)/uint64(out.Bsize)
+	}
+	return 0
+}
+
+// errnoFor maps an error from fetching data to an errno.
+func errnoFor(err error) syscall.Errno {
+	var httpErr *gitiles.HTTPError
+	if !errors.As(err, &httpErr) {
+		return syscall.EIO
+	}
+
+	switch {
+	case httpErr.NotFound():
+		return syscall.ENOENT
+	case httpErr.Unauthorized():
+		return syscall.EACCES
+	case httpErr.Temporary():
+		return syscall.EAGAIN
+	}
+	return syscall.EIO
+}
+
+func (r *gitilesRoot) fetchFile(ctx context.Context, id plumbing.Hash, clone bool, trigger string) (*os.File, error) {
 	r.fetchingCond.L.Lock()
 	defer r.fetchingCond.L.Unlock()
 
-	for r.fetching[id] {
-		r.fetchingCond.Wait()
+	if r.fetching[id] {
+		// Another request is fetching the blob.
+		_, span := trace.Start(ctx, "fetch.Wait")
+		for r.fetching[id] {
+			r.fetchingCond.Wait()
+		}
+		span.End(nil)
 	}
 
 	f, ok := r.cache.Blob.Open(id)
@@ -224,7 +768,7 @@ func (r *gitilesRoot) fetchFile(id plumbing.Hash, clone bool) (*os.File, error)
 	r.fetching[id] = true
 	defer func() { delete(r.fetching, id) }()
 	r.fetchingCond.L.Unlock()
-	err := r.fetchFileExpensive(id, clone)
+	err := r.fetchFileExpensive(ctx, id, clone, trigger)
 	r.fetchingCond.L.Lock()
 	r.fetchingCond.Broadcast()
 
@@ -239,46 +783,66 @@ func (r *gitilesRoot) fetchFile(id plumbing.Hash, clone bool) (*os.File, error)
 	return nil, err
 }
 
-func readBlob(blob *object.Blob) ([]byte, error) {
-	r, err := blob.Reader()
-	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
-
-	return ioutil.ReadAll(r)
-}
-
-func (r *gitilesRoot) fetchFileExpensive(id plumbing.Hash, clone bool) error {
+func (r *gitilesRoot) fetchFileExpensive(ctx context.Context, id plumbing.Hash, clone bool, trigger string) error {
 	repo := r.lazyRepo.Repository()
-	if clone && repo == nil {
-		r.lazyRepo.Clone()
+	if clone && repo == nil && !r.opts.Offline {
+		r.recordCloneTrigger(id, r.lazyRepo.Clone())
 	}
 
-	var content []byte
 	if repo != nil {
-		blob, err := repo.BlobObject(id)
+		_, span := trace.Start(ctx, "git.OpenBlob")
+		rd, err := r.lazyRepo.OpenBlob(id)
 		if err == nil {
-			content, err = readBlob(blob)
-			if err != nil {
-				content = nil
-			}
+			_, err = r.cache.Blob.Write(id, rd)
+			rd.Close()
+		}
+		span.End(err)
+		if err == nil {
+			return nil
 		}
 	}
 
-	if content == nil {
-		path := r.shaMap[id]
-
-		var err error
-		content, err = r.service.GetBlob(r.opts.Revision, path)
-		if err != nil {
-			return fmt.Errorf("GetBlob(%s, %s): %v", r.opts.Revision, path, err)
-		}
+	path := r.blobPath(id)
+	if r.opts.Offline {
+		return fmt.Errorf("offline: blob %s (%s) is not cached locally", id.String(), path)
 	}
 
-	if err := r.cache.Blob.Write(id, content); err != nil {
+	_, qspan := trace.Start(ctx, "fetch.Queue")
+	err := r.cache.Queue.Acquire(ctx, r.service.Name)
+	qspan.End(err)
+	if err != nil {
 		return err
 	}
+	defer r.cache.Queue.Release()
+
+	_, span := trace.Start(ctx, "gitiles.GetBlobStream")
+	span.SetAttr("repo", r.service.Name)
+	span.SetAttr("path", path)
+	start := time.Now()
+	var n int64
+	rd, err := r.service.GetBlobStream(r.opts.Revision, path)
+	if err == nil {
+		n, err = r.cache.Blob.Write(id, rd)
+		rd.Close()
+	}
+	span.SetAttr("bytes", n)
+	span.End(err)
+	rec := cache.FetchRecord{
+		Kind:    "blob",
+		Repo:    r.service.Name,
+		Path:    path,
+		ID:      id.String(),
+		Bytes:   int(n),
+		Latency: time.Since(start),
+		Trigger: trigger,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	r.cache.Fetches.Record(rec)
+	if err != nil {
+		return fmt.Errorf("GetBlobStream(%s, %s): %w", r.opts.Revision, path, err)
+	}
 	return nil
 }
 
@@ -299,10 +863,47 @@ func (n *dataNode) Getattr(ctx context.Context, file fs.FileHandle, out *fuse.At
 	return 0
 }
 
-var _ = (fs.NodeOpener)((*gitilesNode)(nil))
+var _ = (fs.NodeOpener)((*dataNode)(nil))
 
-func (n *dataNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, syscall.Errno) {
-	return fs.MemRegularFile{Data: n.data}, 0
+func (n *dataNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+var _ = (fs.NodeReader)((*dataNode)(nil))
+
+func (n *dataNode) Read(ctx context.Context, file fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if off >= int64(len(n.data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(n.data)) {
+		end = int64(len(n.data))
+	}
+	return fuse.ReadResultData(n.data[off:end]), 0
+}
+
+// errorNode stands in for a tree entry that can't be served, eg.
+// because it has a malformed ID. It shows up in directory listings,
+// but can't be opened.
+type errorNode struct {
+	fs.Inode
+	err error
+}
+
+var _ = (fs.NodeGetattrer)((*errorNode)(nil))
+
+func (n *errorNode) Getattr(ctx context.Context, file fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFREG
+	t := time.Unix(1, 0)
+	out.SetTimes(nil, &t, nil)
+	return 0
+}
+
+var _ = (fs.NodeOpener)((*errorNode)(nil))
+
+func (n *errorNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	log.Printf("Open: %v", n.err)
+	return nil, 0, syscall.EIO
 }
 
 var _ = (fs.NodeGetxattrer)((*gitilesNode)(nil))
@@ -311,11 +912,15 @@ func (n *dataNode) GetXAttr(ctx context.Context, attribute string) (data []byte,
 	return nil, syscall.ENODATA
 }
 
+// maxOpenFiles is the number of blob files kept open for handle-less
+// I/O.
+const maxOpenFiles = 64
+
 // NewGitilesRoot returns the root node for a file system.
 func NewGitilesRoot(c *cache.Cache, tree *gitiles.Tree, service *gitiles.RepoService, options GitilesRevisionOptions) *gitilesRoot {
+	c = c.ForRepo(options.CloneURL)
 	r := &gitilesRoot{
 		service:      service,
-		nodeCache:    newNodeCache(),
 		cache:        c,
 		shaMap:       map[plumbing.Hash]string{},
 		tree:         tree,
@@ -323,11 +928,27 @@ func NewGitilesRoot(c *cache.Cache, tree *gitiles.Tree, service *gitiles.RepoSer
 		lazyRepo:     cache.NewLazyRepo(options.CloneURL, c),
 		fetchingCond: sync.NewCond(&sync.Mutex{}),
 		fetching:     map[plumbing.Hash]bool{},
+		verified:     map[plumbing.Hash]struct{}{},
+		nodes:        map[cache.NodeKey]*fs.Inode{},
+		triggers:     map[string]*cloneTrigger{},
+		openFiles:    newOpenFileCache(maxOpenFiles, options.ReadAhead),
 	}
 
 	return r
 }
 
+var _ = (fs.NodeLookuper)((*gitilesRoot)(nil))
+
+func (r *gitilesRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	return r.caseFold.lookup(ctx, &r.Inode, name, r.opts.CaseInsensitive, out)
+}
+
+var _ = (fs.NodeReaddirer)((*gitilesRoot)(nil))
+
+func (r *gitilesRoot) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return r.caseFold.readdir(&r.Inode, r.opts.CaseInsensitive)
+}
+
 var _ = (fs.NodeGetxattrer)((*gitilesRoot)(nil))
 
 func (r *gitilesRoot) Getxattr(ctx context.Context, attribute string, data []byte) (sz uint32, code syscall.Errno) {
@@ -335,93 +956,292 @@ func (r *gitilesRoot) Getxattr(ctx context.Context, attribute string, data []byt
 }
 
 func (r *gitilesRoot) pathTo(dir string) *fs.Inode {
-	p := &r.Inode
+	return r.pathFrom(&r.Inode, dir)
+}
+
+// pathFrom returns the directory at the relative path dir below p,
+// creating directories as needed. Lazy directories on the way are
+// populated first, so their entries don't get lost.
+func (r *gitilesRoot) pathFrom(p *fs.Inode, dir string) *fs.Inode {
 	for _, c := range strings.Split(dir, "/") {
 		if len(c) == 0 {
 			continue
 		}
 		ch := p.GetChild(c)
 		if ch == nil {
+			var dir fs.InodeEmbedder = &treeDir{root: r}
+			if r.opts.CaseInsensitive {
+				dir = &caseFoldDir{root: r}
+			}
 			ch = p.NewPersistentInode(context.Background(),
-				&fs.Inode{},
+				dir,
 				fs.StableAttr{Mode: syscall.S_IFDIR})
 			p.AddChild(c, ch, true)
+		} else if d, ok := ch.Operations().(*lazyDir); ok {
+			d.populate(context.Background())
 		}
 		p = ch
 	}
 	return p
 }
 
-var _ = (fs.NodeOnAdder)((*gitilesRoot)(nil))
+// addOverlays grafts the host directories and files of the
+// LocalOverlay option into the tree.
+func (r *gitilesRoot) addOverlays(ctx context.Context) {
+	var paths []string
+	for p := range r.opts.LocalOverlay {
+		paths = append(paths, p)
+	}
+	// Parents sort before their children.
+	sort.Strings(paths)
+
+	var added []string
+outer:
+	for _, p := range paths {
+		hostDir := r.opts.LocalOverlay[p]
+		clean := strings.Trim(filepath.Clean(p), "/")
+		if clean == "" || clean == "." || strings.HasPrefix(clean, "../") || clean == ".." {
+			log.Printf("overlay %s: invalid path", p)
+			continue
+		}
+		for _, a := range added {
+			if strings.HasPrefix(clean, a+"/") {
+				log.Printf("overlay %s: inside overlay %s", p, a)
+				continue outer
+			}
+		}
+		fi, err := os.Stat(hostDir)
+		if err != nil || !(fi.IsDir() || fi.Mode().IsRegular()) {
+			log.Printf("overlay %s: %s is not a directory or file", p, hostDir)
+			continue
+		}
+		mode := uint32(syscall.S_IFREG)
+		if fi.IsDir() {
+			mode = syscall.S_IFDIR
+		}
 
-func (r *gitilesRoot) OnAdd(ctx context.Context) {
+		dir, base := filepath.Split(clean)
+		parent := r.pathTo(dir)
+		ch := parent.NewPersistentInode(ctx, &hostNode{path: hostDir},
+			fs.StableAttr{Mode: mode})
+		parent.AddChild(base, ch, true)
+		added = append(added, clean)
+	}
+}
+
+// blobPath returns the path of a file with the given blob ID.
+func (r *gitilesRoot) blobPath(id plumbing.Hash) string {
+	r.shaMapMu.Lock()
+	defer r.shaMapMu.Unlock()
+	return r.shaMap[id]
+}
+
+// setBlobPath records p as the path of blob id, unless the blob
+// already has one.
+func (r *gitilesRoot) setBlobPath(id plumbing.Hash, p string) {
+	r.shaMapMu.Lock()
+	defer r.shaMapMu.Unlock()
+	if _, ok := r.shaMap[id]; !ok {
+		r.shaMap[id] = p
+	}
+}
+
+// loadGitAttributes reads all .gitattributes files in the tree. The
+// files are fetched concurrently, so mounting waits for the slowest
+// fetch rather than for all of them in turn.
+func (r *gitilesRoot) loadGitAttributes() *gitAttributes {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	files := map[string][]byte{}
 	for _, e := range r.tree.Entries {
+		if e.Type != "blob" || filepath.Base(e.Name) != ".gitattributes" {
+			continue
+		}
+		id, err := parseID(e.ID)
+		if err != nil {
+			continue
+		}
+
+		r.setBlobPath(*id, e.Name)
+		wg.Add(1)
+		go func(name string, id plumbing.Hash) {
+			defer wg.Done()
+			f, err := r.openFile(context.Background(), id, false, "gitattributes")
+			if err != nil {
+				log.Printf("openFile(%s): %v", name, err)
+				return
+			}
+			content, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				log.Printf("ReadAll(%s): %v", name, err)
+				return
+			}
+
+			dir := filepath.Dir(name)
+			if dir == "." {
+				dir = ""
+			}
+			mu.Lock()
+			files[dir] = content
+			mu.Unlock()
+		}(e.Name, *id)
+	}
+	wg.Wait()
+	return newGitAttributes(files)
+}
+
+// exportTree returns tree without the entries that have the
+// export-ignore attribute, for the listings in .slothfs.
+func (r *gitilesRoot) exportTree(tree *gitiles.Tree) *gitiles.Tree {
+	if r.attrs == nil {
+		return tree
+	}
+	result := &gitiles.Tree{ID: tree.ID}
+	for _, e := range tree.Entries {
+		if !r.attrs.exportIgnored(e.Name) {
+			result.Entries = append(result.Entries, e)
+		}
+	}
+	return result
+}
+
+// addErrorNode adds an errorNode for the invalid tree entry name
+// below dir.
+func (r *gitilesRoot) addErrorNode(ctx context.Context, dir *fs.Inode, name string, err error) {
+	log.Printf("%s: %v", name, err)
+	parentDir, base := filepath.Split(name)
+	parent := r.pathFrom(dir, parentDir)
+	ch := parent.NewPersistentInode(ctx, &errorNode{err: fmt.Errorf("%s: %w", name, err)}, fs.StableAttr{Mode: syscall.S_IFREG})
+	parent.AddChild(base, ch, true)
+}
+
+// addEntries adds tree entries below dir, which is at path prefix
+// in the tree. The entry names are relative to dir.
+func (r *gitilesRoot) addEntries(ctx context.Context, dir *fs.Inode, prefix string, entries []gitiles.TreeEntry, attrs *gitAttributes) {
+	// Archive directories to add, and their names relative to dir.
+	var archives []*archiveDir
+	var archiveNames []string
+	for _, e := range entries {
+		p := path.Join(prefix, e.Name)
+		if attrs != nil && attrs.exportIgnored(p) {
+			continue
+		}
 		if e.Type == "commit" {
 			// TODO(hanwen): support submodules.  For now,
 			// we pretend we are plain git, which also
 			// leaves an empty directory in the place of a submodule.
-			r.pathTo(e.Name)
+			r.pathFrom(dir, e.Name)
+			continue
+		}
+		if e.Type == "tree" {
+			r.addLazyDir(ctx, dir, prefix, e)
 			continue
 		}
 		if e.Type != "blob" {
-			log.Panicf("unexpected object type %s", e.Type)
+			r.addErrorNode(ctx, dir, e.Name, fmt.Errorf("unexpected object type %s", e.Type))
+			continue
 		}
-
-		p := e.Name
-		dir, base := filepath.Split(p)
-
-		parent := r.pathTo(dir)
 		id, err := parseID(e.ID)
 		if err != nil {
-			return
+			r.addErrorNode(ctx, dir, e.Name, err)
+			continue
 		}
 
-		// Determine if file should trigger a clone.
-		clone := r.opts.CloneURL != ""
-		if clone {
-			for _, e := range r.opts.CloneOption {
-				if e.RE.MatchString(p) {
-					clone = e.Clone
-					break
-				}
-			}
+		parentDir, base := filepath.Split(e.Name)
+		parent := r.pathFrom(dir, parentDir)
+
+		clone, _ := r.cloneOption(p)
+
+		// Nodes with line ending conversion are not shared, as
+		// their content differs from the blob.
+		crlf := attrs != nil && e.Target == nil && attrs.crlf(p)
+
+		// Nodes whose modification time may be set in strict
+		// mode are not shared either, so the paths that may not
+		// be touched don't change with them.
+		re := r.opts.MtimeAllow
+		mtimeAllowed := re == nil || re.MatchString(p)
+
+		n := &gitilesNode{
+			id:           *id,
+			mode:         uint32(e.Mode),
+			clone:        clone,
+			mtimeAllowed: mtimeAllowed,
+			crlf:         crlf,
+			root:         r,
+			// Ninja uses mtime == 0 as "doesn't exist"
+			// flag, (see ninja/files/src/graph.h:66), so
+			// use a nonzero timestamp here.
+			mtime: time.Unix(1, 0),
+		}
+		if e.Size != nil {
+			n.size = int64(*e.Size)
 		}
 
-		xbit := e.Mode&0111 != 0
-		n := r.nodeCache.get(id, xbit)
-		if n == nil {
-			n = &gitilesNode{
-				id:    *id,
-				mode:  uint32(e.Mode),
-				clone: clone,
-				root:  r,
-				// Ninja uses mtime == 0 as "doesn't exist"
-				// flag, (see ninja/files/src/graph.h:66), so
-				// use a nonzero timestamp here.
-				mtime: time.Unix(1, 0),
-			}
-			if e.Size != nil {
-				n.size = int64(*e.Size)
-			}
+		attr := fs.StableAttr{Mode: syscall.S_IFREG}
+		if e.Target != nil {
+			n.linkTarget = []byte(*e.Target)
+			n.size = int64(len(n.linkTarget))
+			attr.Mode = syscall.S_IFLNK
+		}
 
-			mode := uint32(syscall.S_IFREG)
-			if e.Target != nil {
-				n.linkTarget = []byte(*e.Target)
-				n.size = int64(len(n.linkTarget))
-				mode = syscall.S_IFLNK
-			}
+		// Identical blobs share a node. A node that uses its root
+		// for nothing but fetching its content by blob ID is shared
+		// across the revisions and repositories of this mount: go-fuse
+		// returns the existing node for an inode number that is
+		// already in use. Nodes that trigger clones or record
+		// accesses are shared within this root only, so these go to
+		// the tree the file was read through.
+		var ch *fs.Inode
+		switch {
+		case crlf || r.opts.CommitTimes || (r.opts.StrictReadOnly && re != nil && mtimeAllowed):
+			ch = parent.NewPersistentInode(ctx, n, attr)
+		case clone || r.opts.TrackAccess:
+			ch = r.localNode(ctx, parent, n, attr)
+		default:
+			attr.Ino = r.cache.Nodes.Ino(*id, uint32(e.Mode))
+			ch = parent.NewPersistentInode(ctx, n, attr)
+		}
+		if shared, ok := ch.Operations().(*gitilesNode); ok {
+			n = shared
+		}
+		parent.AddChild(base, ch, true)
+
+		r.setBlobPath(*id, p)
 
-			r.shaMap[*id] = p
+		if re := r.opts.ExpandArchives; re != nil && e.Target == nil && isArchive(base) && re.MatchString(p) {
+			archives = append(archives, &archiveDir{name: p, file: n})
+			archiveNames = append(archiveNames, e.Name)
+		}
+	}
 
-			ch := parent.NewPersistentInode(ctx, n, fs.StableAttr{Mode: mode})
-			parent.AddChild(base, ch, true)
-			r.nodeCache.add(n)
-		} else {
-			parent.AddChild(base, n.EmbeddedInode(), true)
+	// Add the archive directories last, so they don't hide entries
+	// of the tree.
+	for i, a := range archives {
+		parentDir, base := filepath.Split(archiveNames[i])
+		parent := r.pathFrom(dir, parentDir)
+		name := base + archiveDirSuffix
+		if parent.GetChild(name) != nil {
+			continue
 		}
+		ch := parent.NewPersistentInode(ctx, a, fs.StableAttr{Mode: syscall.S_IFDIR})
+		parent.AddChild(name, ch, false)
+	}
+}
+
+var _ = (fs.NodeOnAdder)((*gitilesRoot)(nil))
 
+func (r *gitilesRoot) OnAdd(ctx context.Context) {
+	if r.opts.GitAttributes {
+		r.attrs = r.loadGitAttributes()
 	}
 
+	r.treeID = r.tree.ID
+	r.addEntries(ctx, &r.Inode, "", r.tree.Entries, r.attrs)
+
+	r.addOverlays(ctx)
+
 	slothfsNode := r.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: syscall.S_IFDIR})
 	r.AddChild(".slothfs", slothfsNode, true)
 	idFile := r.NewPersistentInode(ctx, &fs.MemRegularFile{
@@ -429,14 +1249,68 @@ func (r *gitilesRoot) OnAdd(ctx context.Context) {
 
 	slothfsNode.AddChild("treeID", idFile, false)
 
-	treeContent, err := json.MarshalIndent(r.tree, "", " ")
-	if err != nil {
-		log.Panicf("json.Marshal: %v", err)
+	if r.opts.Revision != "" {
+		revFile := r.NewPersistentInode(ctx, &fs.MemRegularFile{
+			Data: []byte(r.opts.Revision)}, fs.StableAttr{Mode: syscall.S_IFREG})
+		slothfsNode.AddChild("revision", revFile, false)
+	}
+	if r.service != nil {
+		nameFile := r.NewPersistentInode(ctx, &fs.MemRegularFile{
+			Data: []byte(r.service.Name)}, fs.StableAttr{Mode: syscall.S_IFREG})
+		slothfsNode.AddChild("name", nameFile, false)
+	}
+	if r.opts.Revision != "" && r.service != nil && !r.opts.Offline {
+		commitFile := r.NewPersistentInode(ctx, newDynamicNode(r.commit),
+			fs.StableAttr{Mode: syscall.S_IFREG})
+		slothfsNode.AddChild("commit.json", commitFile, false)
 	}
-	jsonFile := r.NewPersistentInode(ctx, &fs.MemRegularFile{
-		Data: treeContent}, fs.StableAttr{Mode: syscall.S_IFREG})
 
-	slothfsNode.AddChild("tree.json", jsonFile, false)
+	if r.opts.TrackAccess {
+		accessedFile := r.NewPersistentInode(ctx, newDynamicNode(r.accessedPaths),
+			fs.StableAttr{Mode: syscall.S_IFREG})
+		slothfsNode.AddChild("accessed", accessedFile, false)
+	}
+
+	treesDir := r.NewPersistentInode(ctx, newSubtreeDir(r), fs.StableAttr{Mode: syscall.S_IFDIR})
+	slothfsNode.AddChild("trees", treesDir, false)
+
+	nodeCacheFile := r.NewPersistentInode(ctx, newDynamicNode(func() ([]byte, error) {
+		return json.MarshalIndent(r.cache.Nodes.Stats(), "", " ")
+	}), fs.StableAttr{Mode: syscall.S_IFREG})
+	slothfsNode.AddChild("nodecache.json", nodeCacheFile, false)
+
+	triggersFile := r.NewPersistentInode(ctx, newDynamicNode(r.cloneTriggers),
+		fs.StableAttr{Mode: syscall.S_IFREG})
+	slothfsNode.AddChild("clone-triggers.json", triggersFile, false)
+
+	clonesFile := r.NewPersistentInode(ctx, newDynamicNode(func() ([]byte, error) {
+		return json.MarshalIndent([]cache.CloneStatus{r.lazyRepo.Status()}, "", " ")
+	}), fs.StableAttr{Mode: syscall.S_IFREG})
+	slothfsNode.AddChild("clones.json", clonesFile, false)
+
+	sha1sFile := r.NewPersistentInode(ctx, newDynamicNode(newSubtreeDir(r).sha1List),
+		fs.StableAttr{Mode: syscall.S_IFREG})
+	slothfsNode.AddChild("sha1s.txt", sha1sFile, false)
+
+	// With LazyTrees, r.tree only has the top level, so list the
+	// recursive tree, fetched when tree.json is first read.
+	var jsonFile fs.InodeEmbedder
+	if r.opts.LazyTrees {
+		jsonFile = newDynamicNode(func() ([]byte, error) {
+			tree, err := r.fullTree()
+			if err != nil {
+				return nil, err
+			}
+			return json.MarshalIndent(tree, "", " ")
+		})
+	} else {
+		treeContent, err := json.MarshalIndent(r.exportTree(r.tree), "", " ")
+		if err != nil {
+			log.Printf("json.Marshal: %v", err)
+		}
+		jsonFile = &fs.MemRegularFile{Data: treeContent}
+	}
+	slothfsNode.AddChild("tree.json", r.NewPersistentInode(ctx, jsonFile, fs.StableAttr{Mode: syscall.S_IFREG}), false)
 
 	// We don't need the tree data anymore.
 	r.tree = nil
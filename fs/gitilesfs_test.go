@@ -16,7 +16,9 @@ package fs
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -33,8 +35,13 @@ import (
 	"testing"
 	"time"
 
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/google/slothfs/cache"
 	"github.com/google/slothfs/gitiles"
 	"github.com/google/slothfs/manifest"
+	fusefs "github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
 )
 
 const fuseDebug = false
@@ -102,6 +109,20 @@ var testGitiles = map[string]string{
   }
 }
 `,
+	"/platform/build/kati/+refs/refs/heads?format=JSON": `)]}'
+{"master": {"value": "ce34badf691d36e8048b63f89d1a86ee5fa4325c"},
+ "release/v1": {"value": "ce34badf691d36e8048b63f89d1a86ee5fa4325c"}}`,
+	"/platform/build/kati/+refs/refs/tags?format=JSON": `)]}'
+{"v1": {"value": "1111111111111111111111111111111111111111", "peeled": "ce34badf691d36e8048b63f89d1a86ee5fa4325c"}}`,
+	"/platform/build/kati?format=JSON": `)]}'
+{
+  "name": "platform/build/kati",
+  "clone_url": "https://android.googlesource.com/platform/build/kati",
+  "description": "Description."
+}
+`,
+	"/platform/build/kati/+log/ce34badf691d36e8048b63f89d1a86ee5fa4325c/AUTHORS?format=JSON&n=1": `)]}'
+{"log": [{"commit": "ce34badf691d36e8048b63f89d1a86ee5fa4325c", "committer": {"name": "Shinichiro Hamaji", "time": "Mon Sep 12 14:55:27 2016 +0900"}}]}`,
 	"/platform/build/kati/+/master?format=JSON": `)]}'
 {
   "commit": "ce34badf691d36e8048b63f89d1a86ee5fa4325c",
@@ -122,6 +143,19 @@ var testGitiles = map[string]string{
   },
   "message": "Merge remote-tracking branch \u0027aosp/upstream\u0027\n\nTwo bug fixes. becba50 is actually for a long lived bug, but\nwas found by recent endif/endef checks. Without 706c27f, you\ncannot debug ckati binary on Mac.\n\nbecba50 [C++] Strip a trailing \\r\n706c27f Handle EINTR on read\n\nBug: 28087626\nChange-Id: Ic0c24873a49be96afc83078b6a41960bce444d57\n",
   "tree_diff": []
+}`,
+	"/platform/build/kati/+/5c6a9a56a4b66a3e67e0dd3c2b9ee6d67d5bd0a1/?format=JSON&long=1": `)]}'
+{
+  "id": "5c6a9a56a4b66a3e67e0dd3c2b9ee6d67d5bd0a1",
+  "entries": [
+    {
+      "mode": 33188,
+      "type": "blob",
+      "id": "bdea84459e8c5266251248e593c8ba226a535ad2",
+      "name": "addprefix.mk",
+      "size": 38
+    }
+  ]
 }`,
 	"/platform/build/kati/+/ce34badf691d36e8048b63f89d1a86ee5fa4325c/?format=JSON&long=1&recursive=1": `)]}'
 {
@@ -315,6 +349,60 @@ func TestGitilesFSSharedNodes(t *testing.T) {
 	}
 }
 
+func TestSharedNodesAcrossRoots(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatal("newTestFixture", err)
+	}
+	defer fix.cleanup()
+
+	const blobID = "787d767f94fd634ed29cd69ec9f93bab2b25f5d4"
+	top := &fusefs.Inode{}
+	fusefs.NewNodeFS(top, &fusefs.Options{})
+	ctx := context.Background()
+	newRoot := func(dir string, opts GitilesRevisionOptions, names ...string) *gitilesRoot {
+		tree := &gitiles.Tree{ID: "58d9fdae2c26d82e04f3fcafc4358b99109f0e70"}
+		for _, n := range names {
+			tree.Entries = append(tree.Entries, gitiles.TreeEntry{Mode: 0100644, Type: "blob", ID: blobID, Name: n})
+		}
+		r := NewGitilesRoot(fix.cache, tree, nil, opts)
+		top.AddChild(dir, top.NewPersistentInode(ctx, r, fusefs.StableAttr{Mode: syscall.S_IFDIR}), false)
+		return r
+	}
+
+	a, b := newRoot("a", GitilesRevisionOptions{}, "AUTHORS"), newRoot("b", GitilesRevisionOptions{}, "CREDITS")
+	ch1 := a.GetChild("AUTHORS")
+	ch2 := b.GetChild("CREDITS")
+	if ch1 == nil || ch2 == nil {
+		t.Fatalf("got nodes %v, %v", ch1, ch2)
+	}
+	if ch1 != ch2 {
+		t.Error("equal blobs in different roots did not share inodes.")
+	}
+	if got := fix.cache.Nodes.Stats().Hits; got != 1 {
+		t.Errorf("got %d node cache hits, want 1", got)
+	}
+
+	// Nodes that record accesses belong to their root, so reads
+	// are attributed to the tree they go through.
+	var tracked GitilesRevisionOptions
+	tracked.TrackAccess = true
+	c := newRoot("c", tracked, "AUTHORS", "CREDITS")
+	ch3, ch4 := c.GetChild("AUTHORS"), c.GetChild("CREDITS")
+	if ch3 == nil || ch4 == nil {
+		t.Fatalf("got nodes %v, %v", ch3, ch4)
+	}
+	if ch3 == ch1 {
+		t.Error("node with access tracking shared with another root.")
+	}
+	if ch3 != ch4 {
+		t.Error("equal blobs in one root did not share inodes.")
+	}
+	if got := ch3.Operations().(*gitilesNode).root; got != c {
+		t.Errorf("node has root %p, want %p", got, c)
+	}
+}
+
 func TestGitilesFSTreeID(t *testing.T) {
 	fix, err := newTestFixture()
 	if err != nil {
@@ -602,7 +690,7 @@ func TestGitilesHostFS(t *testing.T) {
 	}
 	defer fix.cleanup()
 
-	if fs, err := NewHostFS(fix.cache, fix.service, nil); err != nil {
+	if fs, err := NewHostFS(fix.cache, fix.service, &GitilesOptions{}, ""); err != nil {
 		t.Fatalf("NewHostFS: %v", err)
 	} else if err := fix.mount(fs); err != nil {
 		t.Fatalf("mount: %v", err)
@@ -617,3 +705,489 @@ func TestGitilesHostFS(t *testing.T) {
 		t.Errorf("blob for %s differs", fn)
 	}
 }
+
+func TestGitilesHostFSProjectFiles(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatal("newTestFixture", err)
+	}
+	defer fix.cleanup()
+
+	root, err := NewHostFS(fix.cache, fix.service, &GitilesOptions{}, "")
+	if err != nil {
+		t.Fatalf("NewHostFS: %v", err)
+	}
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	dir := root.EmbeddedInode()
+	for _, c := range strings.Split("platform/build/kati", "/") {
+		if dir = dir.GetChild(c); dir == nil {
+			t.Fatalf("%s not found", c)
+		}
+	}
+
+	ctx := context.Background()
+	for name, want := range map[string]string{
+		"CLONE_URL": "https://android.googlesource.com/platform/build/kati\n",
+		"DESCRIPTION": `Description.
+
+Branches:
+  master ce34badf691d36e8048b63f89d1a86ee5fa4325c
+  release/v1 ce34badf691d36e8048b63f89d1a86ee5fa4325c
+
+Tags:
+  v1 ce34badf691d36e8048b63f89d1a86ee5fa4325c
+`,
+	} {
+		ch := dir.GetChild(name)
+		if ch == nil {
+			t.Errorf("%s not found", name)
+			continue
+		}
+		var got []byte
+		switch n := ch.Operations().(type) {
+		case *dataNode:
+			got = n.data
+		case *dynamicNode:
+			fh, _, errno := n.Open(ctx, syscall.O_RDONLY)
+			if errno != 0 {
+				t.Fatalf("Open(%s): %v", name, errno)
+			}
+			got = fh.(*dynamicHandle).data
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCacheStatfs(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	var out fuse.StatfsOut
+	if code := cacheStatfs(fix.cache, 0, &out); code != 0 {
+		t.Fatalf("cacheStatfs: %v", code)
+	}
+	if out.Bsize == 0 || out.Blocks == 0 {
+		t.Fatalf("got empty statfs %#v", out)
+	}
+
+	used := uint64(1 << 20)
+	if code := cacheStatfs(fix.cache, used, &out); code != 0 {
+		t.Fatalf("cacheStatfs: %v", code)
+	}
+	if got := (out.Blocks - out.Bfree) * uint64(out.Bsize); got < used || got >= used+uint64(out.Bsize) {
+		t.Errorf("got %d bytes used, want %d", got, used)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	repoService := fix.service.NewRepoService("platform/build/kati")
+	if h := CheckHealth(fix.cache, repoService, false); !h.Ready || !h.CacheWritable || !h.GitilesReachable {
+		t.Errorf("got %#v, want ready", h)
+	}
+
+	missing := fix.service.NewRepoService("missing")
+	if h := CheckHealth(fix.cache, missing, false); h.Ready || h.GitilesError == "" {
+		t.Errorf("got %#v, want Gitiles error", h)
+	}
+	if h := CheckHealth(fix.cache, missing, true); !h.Ready || h.GitilesReachable {
+		t.Errorf("offline: got %#v, want ready without contacting Gitiles", h)
+	}
+
+	// With one request per 100s, the first check uses up the
+	// limit, and the second goes by its outcome.
+	slow, err := gitiles.NewService(gitiles.Options{
+		Address:      fmt.Sprintf("http://%s", fix.testServer.addr),
+		SustainedQPS: 0.01,
+		BurstQPS:     1,
+	})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	repoService = slow.NewRepoService("platform/build/kati")
+	if h := CheckHealth(fix.cache, repoService, false); !h.Ready || h.RateLimited {
+		t.Errorf("got %#v, want ready", h)
+	}
+	if h := CheckHealth(fix.cache, repoService, false); !h.Ready || !h.RateLimited || !h.GitilesReachable {
+		t.Errorf("rate limited: got %#v, want ready", h)
+	}
+}
+
+func TestGitilesFSVerifyReads(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatal("newTestFixture", err)
+	}
+	defer fix.cleanup()
+
+	repoService := fix.service.NewRepoService("platform/build/kati")
+	treeResp, err := repoService.GetTree("ce34badf691d36e8048b63f89d1a86ee5fa4325c", "", true)
+	if err != nil {
+		t.Fatal("Tree:", err)
+	}
+
+	options := GitilesRevisionOptions{
+		Revision: "ce34badf691d36e8048b63f89d1a86ee5fa4325c",
+	}
+	options.VerifyReads = true
+	root := NewGitilesRoot(fix.cache, treeResp, repoService, options)
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	id := plumbing.NewHash("787d767f94fd634ed29cd69ec9f93bab2b25f5d4")
+	if _, err := fix.cache.Blob.Write(id, strings.NewReader("corrupt")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	f, err := root.openFile(context.Background(), id, false, "open")
+	if err != nil {
+		t.Fatalf("openFile: %v", err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, testBlob) {
+		t.Errorf("got %q, want %q", got, testBlob)
+	}
+}
+
+func TestGitilesFSStrictReadOnly(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatal("newTestFixture", err)
+	}
+	defer fix.cleanup()
+
+	repoService := fix.service.NewRepoService("platform/build/kati")
+	treeResp, err := repoService.GetTree("ce34badf691d36e8048b63f89d1a86ee5fa4325c", "", true)
+	if err != nil {
+		t.Fatal("Tree:", err)
+	}
+
+	options := GitilesRevisionOptions{
+		Revision: "ce34badf691d36e8048b63f89d1a86ee5fa4325c",
+	}
+	options.StrictReadOnly = true
+	options.MtimeAllow = regexp.MustCompile(`\.mk$`)
+	root := NewGitilesRoot(fix.cache, treeResp, repoService, options)
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	node := func(p string) *gitilesNode {
+		n := root.EmbeddedInode()
+		for _, c := range strings.Split(p, "/") {
+			n = n.GetChild(c)
+			if n == nil {
+				t.Fatalf("%s not found", p)
+			}
+		}
+		return n.Operations().(*gitilesNode)
+	}
+
+	ctx := context.Background()
+	mtime := func(n *gitilesNode) syscall.Errno {
+		in := &fuse.SetAttrIn{}
+		in.Valid = fuse.FATTR_MTIME | fuse.FATTR_ATIME
+		in.Mtime = 1000
+		in.Atime = 1000
+		var out fuse.AttrOut
+		return n.Setattr(ctx, nil, in, &out)
+	}
+
+	if errno := mtime(node("testcase/addprefix.mk")); errno != 0 {
+		t.Errorf("touch testcase/addprefix.mk: %v", errno)
+	}
+	if errno := mtime(node("AUTHORS")); errno != syscall.EROFS {
+		t.Errorf("touch AUTHORS: got %v, want EROFS", errno)
+	}
+
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE
+	in.Mode = 0777
+	var out fuse.AttrOut
+	if errno := node("testcase/addprefix.mk").Setattr(ctx, nil, in, &out); errno != syscall.EROFS {
+		t.Errorf("chmod: got %v, want EROFS", errno)
+	}
+
+	if _, _, errno := node("AUTHORS").Open(ctx, syscall.O_WRONLY); errno != syscall.EROFS {
+		t.Errorf("Open(O_WRONLY): got %v, want EROFS", errno)
+	}
+}
+
+func TestStrictReadOnlySharedBlob(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatal("newTestFixture", err)
+	}
+	defer fix.cleanup()
+
+	// Both files have the same blob.
+	size := 0
+	tree := &gitiles.Tree{
+		Entries: []gitiles.TreeEntry{
+			{Mode: 0100644, Type: "blob", ID: "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", Name: "empty.mk", Size: &size},
+			{Mode: 0100644, Type: "blob", ID: "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", Name: "empty.txt", Size: &size},
+		},
+	}
+	options := GitilesRevisionOptions{}
+	options.Offline = true
+	options.StrictReadOnly = true
+	options.MtimeAllow = regexp.MustCompile(`\.mk$`)
+	root := NewGitilesRoot(fix.cache, tree, nil, options)
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	ctx := context.Background()
+	mk := root.GetChild("empty.mk").Operations().(*gitilesNode)
+	txt := root.GetChild("empty.txt").Operations().(*gitilesNode)
+
+	// As set by futimens(3) with UTIME_NOW.
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW | fuse.FATTR_ATIME | fuse.FATTR_ATIME_NOW | fuse.FATTR_FH
+	var out fuse.AttrOut
+	if errno := txt.Setattr(ctx, nil, in, &out); errno != syscall.EROFS {
+		t.Errorf("touch empty.txt: got %v, want EROFS", errno)
+	}
+	if errno := mk.Setattr(ctx, nil, in, &out); errno != 0 {
+		t.Errorf("touch empty.mk: %v", errno)
+	}
+
+	out = fuse.AttrOut{}
+	txt.Getattr(ctx, nil, &out)
+	if out.Mtime != 1 {
+		t.Errorf("empty.txt: got mtime %d, want 1", out.Mtime)
+	}
+}
+
+func TestGitilesFSCommitTimes(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatal("newTestFixture", err)
+	}
+	defer fix.cleanup()
+
+	const revision = "ce34badf691d36e8048b63f89d1a86ee5fa4325c"
+	commitURL := "/platform/build/kati/+/" + revision + "?format=JSON"
+	testGitiles[commitURL] = `)]}'
+{"commit": "` + revision + `", "committer": {"name": "A", "time": "Tue Sep 13 10:00:00 2016 +0000"}}`
+	defer delete(testGitiles, commitURL)
+	defer func(d time.Duration) { commitTimesSaveDelay = d }(commitTimesSaveDelay)
+	commitTimesSaveDelay = time.Millisecond
+
+	repoService := fix.service.NewRepoService("platform/build/kati")
+	treeResp, err := repoService.GetTree(revision, "", true)
+	if err != nil {
+		t.Fatal("Tree:", err)
+	}
+
+	options := GitilesRevisionOptions{Revision: revision}
+	options.CommitTimes = true
+	newRoot := func() *gitilesRoot {
+		root := NewGitilesRoot(fix.cache, treeResp, repoService, options)
+		fusefs.NewNodeFS(root, &fusefs.Options{})
+		return root
+	}
+	root := newRoot()
+
+	authors := root.GetChild("AUTHORS").Operations().(*gitilesNode)
+	authors2 := root.GetChild("AUTHORS2").Operations().(*gitilesNode)
+	if authors == authors2 {
+		t.Fatal("identical blobs share a node")
+	}
+
+	var attr fuse.Attr
+	if authors.lookupAttr(&attr) {
+		t.Error("lookupAttr is exact before the commit time is known")
+	}
+
+	// The lookups run in the background, and AUTHORS2 has no log,
+	// so it keeps the time of the revision.
+	ctx := context.Background()
+	wait := func(n *gitilesNode) {
+		for deadline := time.Now().Add(5 * time.Second); !n.mtimeResolved(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("commit time was not resolved")
+			}
+		}
+	}
+	authorsTime := time.Date(2016, 9, 12, 5, 55, 27, 0, time.UTC)
+	for n, want := range map[*gitilesNode]time.Time{
+		authors:  authorsTime,
+		authors2: time.Date(2016, 9, 13, 10, 0, 0, 0, time.UTC),
+	} {
+		var out fuse.AttrOut
+		if errno := n.Getattr(ctx, nil, &out); errno != 0 {
+			t.Fatalf("Getattr: %v", errno)
+		}
+		wait(n)
+		if errno := n.Getattr(ctx, nil, &out); errno != 0 {
+			t.Fatalf("Getattr: %v", errno)
+		}
+		if got := time.Unix(int64(out.Mtime), 0); !got.Equal(want) {
+			t.Errorf("got mtime %v, want %v", got, want)
+		}
+		if !n.lookupAttr(&attr) {
+			t.Error("lookupAttr is not exact after Getattr")
+		}
+	}
+
+	// The time is stored in the cache, so another mount of the
+	// revision doesn't look it up again.
+	id, _ := parseID(revision)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if times, err := fix.cache.Tree.CommitTimes(id); err == nil && times["AUTHORS"].Equal(authorsTime) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("commit time was not stored")
+		}
+	}
+	authors = newRoot().GetChild("AUTHORS").Operations().(*gitilesNode)
+	var out fuse.AttrOut
+	if errno := authors.Getattr(ctx, nil, &out); errno != 0 {
+		t.Fatalf("Getattr: %v", errno)
+	}
+	if got := time.Unix(int64(out.Mtime), 0); !got.Equal(authorsTime) || !authors.mtimeResolved() {
+		t.Errorf("got mtime %v, resolved %v, want %v", got, authors.mtimeResolved(), authorsTime)
+	}
+
+	fix.testServer.mu.Lock()
+	defer fix.testServer.mu.Unlock()
+	if got := fix.testServer.requests["/platform/build/kati/+log/"+revision+"/AUTHORS"]; got != 1 {
+		t.Errorf("got %d log requests, want 1", got)
+	}
+}
+
+func TestGitilesFSMalformedTree(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	ctx := context.Background()
+	const blobID = "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"
+	tree := &gitiles.Tree{
+		Entries: []gitiles.TreeEntry{
+			{Mode: 0100644, Type: "blob", ID: "xyz", Name: "badid"},
+			{Mode: 0100644, Type: "tag", ID: blobID, Name: "badtype"},
+			{Mode: 0100644, Type: "blob", ID: blobID, Name: "file"},
+		},
+	}
+
+	root := NewGitilesRoot(fix.cache, tree, nil, GitilesRevisionOptions{})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	for _, name := range []string{"badid", "badtype"} {
+		ch := root.GetChild(name)
+		if ch == nil {
+			t.Errorf("child %s: not found", name)
+			continue
+		}
+		if _, ok := ch.Operations().(*errorNode); !ok {
+			t.Errorf("child %s: got %T, want *errorNode", name, ch.Operations())
+			continue
+		}
+		if _, _, errno := ch.Operations().(fusefs.NodeOpener).Open(ctx, 0); errno != syscall.EIO {
+			t.Errorf("Open(%s): got %v, want EIO", name, errno)
+		}
+	}
+	if ch := root.GetChild("file"); ch == nil {
+		t.Errorf("child file: not found")
+	}
+
+	id := plumbing.NewHash("abcd1234abcd1234abcd1234abcd1234abcd1234")
+	tree = &gitiles.Tree{
+		ID:      id.String(),
+		Entries: []gitiles.TreeEntry{{Mode: 0100644, Type: "blob", ID: blobID, Name: "../escape"}},
+	}
+	if err := fix.cache.Tree.Add(&id, tree); err != nil {
+		t.Fatalf("Tree.Add: %v", err)
+	}
+	configRoot := NewGitilesConfigFSRoot(fix.cache, fix.service.NewRepoService("platform/build/kati"), &GitilesOptions{Offline: true})
+	fusefs.NewNodeFS(configRoot, &fusefs.Options{})
+
+	var out fuse.EntryOut
+	if _, errno := configRoot.(fusefs.NodeLookuper).Lookup(ctx, id.String(), &out); errno != syscall.EIO {
+		t.Errorf("Lookup(malformed tree): got %v, want EIO", errno)
+	}
+}
+
+func TestGitilesFSCommitJSON(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	repoService := fix.service.NewRepoService("platform/build/kati")
+	tree := &gitiles.Tree{ID: "58d9fdae2c26d82e04f3fcafc4358b99109f0e70"}
+	root := NewGitilesRoot(fix.cache, tree, repoService, GitilesRevisionOptions{Revision: "master"})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	ch := root.GetChild(".slothfs").GetChild("commit.json")
+	if ch == nil {
+		t.Fatal("no .slothfs/commit.json")
+	}
+	fh, _, errno := ch.Operations().(fusefs.NodeOpener).Open(context.Background(), syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open: %v", errno)
+	}
+
+	var got gitiles.Commit
+	if err := json.Unmarshal(fh.(*dynamicHandle).data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got.Commit != "ce34badf691d36e8048b63f89d1a86ee5fa4325c" || len(got.Parents) != 2 || got.Author.Name != "Shinichiro Hamaji" {
+		t.Errorf("got %#v", got)
+	}
+
+	offline := NewGitilesRoot(fix.cache, tree, repoService, GitilesRevisionOptions{
+		Revision:       "master",
+		GitilesOptions: GitilesOptions{Offline: true},
+	})
+	fusefs.NewNodeFS(offline, &fusefs.Options{})
+	if offline.GetChild(".slothfs").GetChild("commit.json") != nil {
+		t.Error("offline root has commit.json")
+	}
+}
+
+func TestFetchTreeQueued(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatal("newTestFixture", err)
+	}
+	defer fix.cleanup()
+
+	fix.cache.Queue = cache.NewFetchQueue(1)
+	repoService := fix.service.NewRepoService("platform/build/kati")
+	if err := fix.cache.Queue.Acquire(context.Background(), "other"); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	id := plumbing.NewHash("ce34badf691d36e8048b63f89d1a86ee5fa4325c")
+	done := make(chan error, 1)
+	go func() {
+		_, err := fetchTree(fix.cache, repoService, &GitilesOptions{}, &id, true, "test")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("fetchTree did not wait for the queue: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fix.cache.Queue.Release()
+	if err := <-done; err != nil {
+		t.Fatalf("fetchTree: %v", err)
+	}
+}
@@ -15,6 +15,7 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"path/filepath"
@@ -25,15 +26,18 @@ import (
 	"github.com/google/slothfs/cache"
 	"github.com/google/slothfs/gitiles"
 	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
 )
 
 type hostFS struct {
 	fs.Inode
 
-	cache        *cache.Cache
-	service      *gitiles.Service
-	projects     map[string]*gitiles.Project
-	cloneOptions []CloneOption
+	cache    *cache.Cache
+	service  *gitiles.Service
+	projects map[string]*gitiles.Project
+
+	// options are passed on to the projects.
+	options GitilesOptions
 }
 
 func parents(projMap map[string]*gitiles.Project) map[string]struct{} {
@@ -48,8 +52,16 @@ func parents(projMap map[string]*gitiles.Project) map[string]struct{} {
 	return dirs
 }
 
-func NewHostFS(cache *cache.Cache, service *gitiles.Service, cloneOptions []CloneOption) (*hostFS, error) {
-	projMap, err := service.List(nil)
+// NewHostFS returns the root node for a file system that serves the
+// projects of a Gitiles host whose name starts with prefix. The
+// options apply to all projects; CloneURL and LocalOverlay, which
+// are about one repository, must not be set. Offline, the list of
+// projects must be in the JSON cache of the service.
+func NewHostFS(cache *cache.Cache, service *gitiles.Service, options *GitilesOptions, prefix string) (*hostFS, error) {
+	if options.CloneURL != "" || options.LocalOverlay != nil {
+		return nil, fmt.Errorf("CloneURL and LocalOverlay are not supported for a host")
+	}
+	projMap, err := service.ListProjects(gitiles.ListOptions{Prefix: prefix})
 	if err != nil {
 		return nil, err
 	}
@@ -62,10 +74,10 @@ func NewHostFS(cache *cache.Cache, service *gitiles.Service, cloneOptions []Clon
 	}
 
 	return &hostFS{
-		projects:     projMap,
-		cloneOptions: cloneOptions,
-		service:      service,
-		cache:        cache,
+		projects: projMap,
+		options:  *options,
+		service:  service,
+		cache:    cache,
 	}, nil
 }
 
@@ -116,11 +128,65 @@ func (h *hostFS) OnAdd(ctx context.Context) {
 	}
 }
 
+var _ = (fs.NodeStatfser)((*hostFS)(nil))
+
+func (h *hostFS) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return cacheStatfs(h.cache, 0, out)
+}
+
 func (h *hostFS) newProjectNode(parent *fs.Inode, proj *gitiles.Project) fs.InodeEmbedder {
 	repoService := h.service.NewRepoService(proj.Name)
-	opts := GitilesOptions{
-		CloneURL:    proj.CloneURL,
-		CloneOption: h.cloneOptions,
+	opts := h.options
+	opts.CloneURL = proj.CloneURL
+	root := NewGitilesConfigFSRoot(h.cache, repoService, &opts).(*gitilesConfigFSRoot)
+	root.project = proj
+	return root
+}
+
+// addProjectFiles adds the DESCRIPTION and CLONE_URL files to the
+// directory of a project, so users browsing the host can tell what
+// the projects are.
+func (r *gitilesConfigFSRoot) addProjectFiles(ctx context.Context) {
+	desc := r.NewPersistentInode(ctx, newDynamicNode(r.description), fs.StableAttr{Mode: syscall.S_IFREG})
+	r.AddChild("DESCRIPTION", desc, false)
+
+	url := r.NewPersistentInode(ctx, &dataNode{data: []byte(r.project.CloneURL + "\n")}, fs.StableAttr{Mode: syscall.S_IFREG})
+	r.AddChild("CLONE_URL", url, false)
+}
+
+// description returns the description of the project, followed by
+// its branches and tags unless we are offline. The refs listing is
+// shared with the refs directory.
+func (r *gitilesConfigFSRoot) description() ([]byte, error) {
+	var buf bytes.Buffer
+	if d := strings.TrimSpace(r.project.Description); d != "" {
+		fmt.Fprintf(&buf, "%s\n", d)
+	} else {
+		fmt.Fprintf(&buf, "%s\n", r.project.Name)
+	}
+	if r.options.Offline {
+		return buf.Bytes(), nil
+	}
+
+	refs, err := r.refIDs()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for nm := range refs {
+		names = append(names, nm)
+	}
+	sort.Strings(names)
+	for _, kind := range []struct{ title, prefix string }{{"Branches", "heads/"}, {"Tags", "tags/"}} {
+		title := "\n" + kind.title + ":\n"
+		for _, nm := range names {
+			if !strings.HasPrefix(nm, kind.prefix) {
+				continue
+			}
+			buf.WriteString(title)
+			title = ""
+			fmt.Fprintf(&buf, "  %s %s\n", strings.TrimPrefix(nm, kind.prefix), refs[nm])
+		}
 	}
-	return NewGitilesConfigFSRoot(h.cache, repoService, &opts)
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,93 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/gitiles"
+)
+
+// Health is the result of a live check of the services a mount
+// depends on.
+type Health struct {
+	// Ready is set if the mount can serve files that are not
+	// cached yet.
+	Ready bool
+
+	CacheWritable bool
+	CacheError    string `json:",omitempty"`
+
+	Offline          bool
+	GitilesReachable bool
+	GitilesError     string `json:",omitempty"`
+
+	// RateLimited is set if requests to Gitiles are being
+	// delayed by the rate limiter. Gitiles is then not asked, and
+	// GitilesReachable is the outcome of the last request. It
+	// doesn't affect Ready.
+	RateLimited bool
+
+	// QuarantinedRepos is the number of corrupt git clones that
+	// were moved out of the way since the mount started.
+	QuarantinedRepos int `json:",omitempty"`
+}
+
+// CheckHealth checks that the cache is writable and that Gitiles can
+// be reached. When offline, Gitiles is not contacted.
+func CheckHealth(c *cache.Cache, service *gitiles.RepoService, offline bool) *Health {
+	h := &Health{
+		Offline:          offline,
+		QuarantinedRepos: c.Git.Quarantined(),
+	}
+	if err := c.CheckWritable(); err != nil {
+		h.CacheError = err.Error()
+	} else {
+		h.CacheWritable = true
+	}
+
+	if offline {
+		h.Ready = h.CacheWritable
+		return h
+	}
+
+	h.RateLimited = service.Saturated()
+	var err error
+	if h.RateLimited {
+		// Don't make things worse by adding to the queue; a busy
+		// mount is not an unhealthy one. Go by the last request
+		// instead.
+		var requested bool
+		if requested, err = service.LastRequest(); !requested {
+			err = fmt.Errorf("not checked: rate limit reached")
+		}
+	} else {
+		_, err = service.Get()
+	}
+	if err != nil {
+		h.GitilesError = err.Error()
+	} else {
+		h.GitilesReachable = true
+	}
+	h.Ready = h.CacheWritable && h.GitilesReachable
+	return h
+}
+
+// JSON returns the health status as indented JSON.
+func (h *Health) JSON() ([]byte, error) {
+	return json.MarshalIndent(h, "", " ")
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// hostNode serves a file or directory from the host file system,
+// read-only.
+type hostNode struct {
+	fs.Inode
+
+	path string
+}
+
+var _ = (fs.NodeGetattrer)((*hostNode)(nil))
+
+func (n *hostNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(n.path, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStat(&st)
+	return 0
+}
+
+var _ = (fs.NodeLookuper)((*hostNode)(nil))
+
+func (n *hostNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	p := filepath.Join(n.path, name)
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	out.Attr.FromStat(&st)
+	return n.NewInode(ctx, &hostNode{path: p}, fs.StableAttr{Mode: st.Mode}), 0
+}
+
+var _ = (fs.NodeReaddirer)((*hostNode)(nil))
+
+func (n *hostNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return fs.NewLoopbackDirStream(n.path)
+}
+
+var _ = (fs.NodeReadlinker)((*hostNode)(nil))
+
+func (n *hostNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := os.Readlink(n.path)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return []byte(target), 0
+}
+
+var _ = (fs.NodeOpener)((*hostNode)(nil))
+
+func (n *hostNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	fd, err := syscall.Open(n.path, int(flags), 0)
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	return fs.NewLoopbackFile(fd), 0, 0
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestGitilesFSOverlay(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatal("newTestFixture", err)
+	}
+	defer fix.cleanup()
+
+	hostDir := filepath.Join(fix.dir, "overlay")
+	if err := os.MkdirAll(filepath.Join(hostDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(hostDir, "sub", "file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repoService := fix.service.NewRepoService("platform/build/kati")
+	treeResp, err := repoService.GetTree("ce34badf691d36e8048b63f89d1a86ee5fa4325c", "", true)
+	if err != nil {
+		t.Fatal("Tree:", err)
+	}
+
+	options := GitilesRevisionOptions{}
+	options.LocalOverlay = map[string]string{
+		"testcase":        hostDir,
+		"testcase/nested": hostDir,
+		"out/gen":         hostDir,
+		"Android.bp":      filepath.Join(hostDir, "sub", "file"),
+	}
+	root := NewGitilesRoot(fix.cache, treeResp, repoService, options)
+	fs.NewNodeFS(root, &fs.Options{})
+
+	ctx := context.Background()
+	testcase := root.GetChild("testcase")
+	if testcase == nil {
+		t.Fatal("testcase missing")
+	}
+	if testcase.GetChild("addprefix.mk") != nil {
+		t.Errorf("overlay did not hide the tree contents")
+	}
+	if root.GetChild("out").GetChild("gen") == nil {
+		t.Errorf("out/gen missing")
+	}
+
+	if bp, ok := root.GetChild("Android.bp").Operations().(*hostNode); !ok || bp.path != filepath.Join(hostDir, "sub", "file") {
+		t.Errorf("file overlay: Android.bp is served from the tree")
+	} else if root.GetChild("Android.bp").Mode() != syscall.S_IFREG {
+		t.Errorf("file overlay: got mode %o", root.GetChild("Android.bp").Mode())
+	}
+
+	host := testcase.Operations().(*hostNode)
+	var out fuse.EntryOut
+	sub, errno := host.Lookup(ctx, "sub", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(sub): %v", errno)
+	}
+	file, errno := sub.Operations().(*hostNode).Lookup(ctx, "file", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(file): %v", errno)
+	}
+	if out.Size != 5 {
+		t.Errorf("got size %d, want 5", out.Size)
+	}
+	if _, errno := host.Lookup(ctx, "nested", &out); errno != syscall.ENOENT {
+		t.Errorf("nested overlay: got %v, want ENOENT", errno)
+	}
+
+	opener := file.Operations().(fs.NodeOpener)
+	if _, _, errno := opener.Open(ctx, syscall.O_WRONLY); errno != syscall.EROFS {
+		t.Errorf("Open(O_WRONLY): got %v, want EROFS", errno)
+	}
+	fh, _, errno := opener.Open(ctx, syscall.O_RDONLY)
+	if errno != 0 {
+		t.Fatalf("Open: %v", errno)
+	}
+	defer fh.(fs.FileReleaser).Release(ctx)
+	res, errno := fh.(fs.FileReader).Read(ctx, make([]byte, 10), 0)
+	if errno != 0 {
+		t.Fatalf("Read: %v", errno)
+	}
+	if data, _ := res.Bytes(make([]byte, 10)); string(data) != "hello" {
+		t.Errorf("got %q, want %q", data, "hello")
+	}
+}
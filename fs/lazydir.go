@@ -0,0 +1,110 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"log"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/google/slothfs/gitiles"
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// lazyDir is a directory whose entries are fetched when it is first
+// used. It stands in for the tree entries of a non-recursive tree,
+// as used with the LazyTrees option.
+type lazyDir struct {
+	fs.Inode
+
+	root *gitilesRoot
+
+	// The tree ID, and the path of the directory in the tree.
+	id   plumbing.Hash
+	name string
+
+	mu   sync.Mutex
+	done bool
+
+	// For case-insensitive lookups.
+	index caseFoldIndex
+}
+
+// addLazyDir adds a lazyDir for a tree entry below dir, which is at
+// path prefix in the tree.
+func (r *gitilesRoot) addLazyDir(ctx context.Context, dir *fs.Inode, prefix string, e gitiles.TreeEntry) {
+	id, err := parseID(e.ID)
+	if err != nil {
+		log.Printf("%s: %v", e.Name, err)
+		return
+	}
+	parentDir, base := filepath.Split(e.Name)
+	parent := r.pathFrom(dir, parentDir)
+	if parent.GetChild(base) != nil {
+		return
+	}
+
+	d := &lazyDir{
+		root: r,
+		id:   *id,
+		name: path.Join(prefix, e.Name),
+	}
+	ch := parent.NewPersistentInode(ctx, d, fs.StableAttr{Mode: syscall.S_IFDIR})
+	parent.AddChild(base, ch, false)
+}
+
+// populate adds the entries of the directory, fetching its tree if
+// necessary. A failed fetch is retried on the next use.
+func (d *lazyDir) populate(ctx context.Context) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.done {
+		return 0
+	}
+
+	r := d.root
+	tree, err := loadTree(r.cache, r.service, &r.opts.GitilesOptions, &d.id, false, "lazy")
+	if err != nil {
+		log.Printf("loadTree(%s, %s): %v", d.name, d.id, err)
+		return errnoFor(err)
+	}
+	r.addEntries(ctx, &d.Inode, d.name, tree.Entries, r.attrs)
+	d.done = true
+	return 0
+}
+
+var _ = (fs.NodeLookuper)((*lazyDir)(nil))
+
+func (d *lazyDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := d.populate(ctx); errno != 0 {
+		return nil, errno
+	}
+	return d.index.lookup(ctx, &d.Inode, name, d.root.opts.CaseInsensitive, out)
+}
+
+var _ = (fs.NodeReaddirer)((*lazyDir)(nil))
+
+func (d *lazyDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if errno := d.populate(ctx); errno != 0 {
+		return nil, errno
+	}
+	return d.index.readdir(&d.Inode, d.root.opts.CaseInsensitive)
+}
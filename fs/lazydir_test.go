@@ -0,0 +1,170 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/google/slothfs/gitiles"
+	fusefs "github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestLazyTrees(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	ctx := context.Background()
+	const (
+		blobID    = "787d767f94fd634ed29cd69ec9f93bab2b25f5d4"
+		fetchedID = "5c6a9a56a4b66a3e67e0dd3c2b9ee6d67d5bd0a1"
+		cachedID  = "0123456789012345678901234567890123456789"
+		missingID = "abcdefabcdefabcdefabcdefabcdefabcdefabcd"
+	)
+	cached := plumbing.NewHash(cachedID)
+	if err := fix.cache.Tree.Add(&cached, &gitiles.Tree{
+		ID:      cachedID,
+		Entries: []gitiles.TreeEntry{{Mode: 0100644, Type: "blob", ID: blobID, Name: "c.mk"}},
+	}); err != nil {
+		t.Fatalf("Tree.Add: %v", err)
+	}
+
+	tree := &gitiles.Tree{
+		ID: "58d9fdae2c26d82e04f3fcafc4358b99109f0e70",
+		Entries: []gitiles.TreeEntry{
+			{Mode: 0100644, Type: "blob", ID: blobID, Name: "AUTHORS"},
+			{Mode: 040000, Type: "tree", ID: fetchedID, Name: "testcase"},
+			{Mode: 040000, Type: "tree", ID: cachedID, Name: "cached"},
+			{Mode: 040000, Type: "tree", ID: missingID, Name: "missing"},
+		},
+	}
+	repoService := fix.service.NewRepoService("platform/build/kati")
+	root := NewGitilesRoot(fix.cache, tree, repoService, GitilesRevisionOptions{
+		GitilesOptions: GitilesOptions{LazyTrees: true},
+	})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	lookup := func(dir, name string) syscall.Errno {
+		ch := root.GetChild(dir)
+		if ch == nil {
+			t.Fatalf("no directory %s", dir)
+		}
+		var out fuse.EntryOut
+		_, errno := ch.Operations().(fusefs.NodeLookuper).Lookup(ctx, name, &out)
+		return errno
+	}
+
+	if n := len(root.GetChild("testcase").Children()); n != 0 {
+		t.Errorf("testcase has %d entries before use", n)
+	}
+	if errno := lookup("testcase", "addprefix.mk"); errno != 0 {
+		t.Errorf("Lookup(testcase/addprefix.mk): %v", errno)
+	}
+	const subtreeURL = "/platform/build/kati/+/" + fetchedID + "/"
+	if got := fix.testServer.requests[subtreeURL]; got != 1 {
+		t.Errorf("got %d fetches of %s, want 1", got, subtreeURL)
+	}
+	fetched := plumbing.NewHash(fetchedID)
+	if _, err := fix.cache.Tree.Get(&fetched); err != nil {
+		t.Errorf("subtree not cached: %v", err)
+	}
+
+	if errno := lookup("cached", "c.mk"); errno != 0 {
+		t.Errorf("Lookup(cached/c.mk): %v", errno)
+	}
+	if errno := lookup("missing", "x"); errno == 0 {
+		t.Errorf("Lookup(missing/x) succeeded")
+	}
+	if root.GetChild("missing").Operations().(*lazyDir).done {
+		t.Errorf("failed fetch is not retried")
+	}
+
+	// The listings of .slothfs come from the recursive tree,
+	// without populating the lazy directories, and report fetch
+	// errors.
+	trees := root.GetChild(".slothfs").GetChild("trees").Operations().(*subtreeDir)
+	if _, err := trees.treeJSON(); err == nil {
+		t.Errorf("treeJSON succeeded without the recursive tree")
+	}
+	if root.GetChild("missing").Operations().(*lazyDir).done {
+		t.Errorf("treeJSON populated a lazy directory")
+	}
+
+	recursiveURL := "/platform/build/kati/+/" + tree.ID + "/?format=JSON&long=1&recursive=1"
+	testGitiles[recursiveURL] = `)]}'
+{"id": "` + tree.ID + `", "entries": [
+  {"mode": 33188, "type": "blob", "id": "` + blobID + `", "name": "AUTHORS", "size": 1},
+  {"mode": 33188, "type": "blob", "id": "` + blobID + `", "name": "missing/deep/x.mk", "size": 1},
+  {"mode": 33188, "type": "blob", "id": "` + blobID + `", "name": "testcase/addprefix.mk", "size": 1}
+]}`
+	defer delete(testGitiles, recursiveURL)
+
+	listing, err := trees.treeJSON()
+	if err != nil {
+		t.Fatalf("treeJSON: %v", err)
+	}
+	for _, want := range []string{`"testcase/addprefix.mk"`, `"missing/deep/x.mk"`} {
+		if !strings.Contains(string(listing), want) {
+			t.Errorf("tree.json lacks %s", want)
+		}
+	}
+	var out fuse.EntryOut
+	sub, errno := trees.Lookup(ctx, "missing", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(trees/missing): %v", errno)
+	}
+	sha1s, err := sub.Operations().(*subtreeDir).sha1List()
+	if want := "deep/x.mk\t" + blobID + "\n"; err != nil || string(sha1s) != want {
+		t.Errorf("got sha1s %q, %v, want %q", sha1s, err, want)
+	}
+	if root.GetChild("missing").Operations().(*lazyDir).done {
+		t.Errorf("listing populated a lazy directory")
+	}
+}
+
+func TestLoadTreeRecursive(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	id := plumbing.NewHash("58d9fdae2c26d82e04f3fcafc4358b99109f0e70")
+	shallow := &gitiles.Tree{
+		ID: id.String(),
+		Entries: []gitiles.TreeEntry{
+			{Mode: 040000, Type: "tree", ID: "5c6a9a56a4b66a3e67e0dd3c2b9ee6d67d5bd0a1", Name: "testcase"},
+		},
+	}
+	if err := fix.cache.Tree.Add(&id, shallow); err != nil {
+		t.Fatalf("Tree.Add: %v", err)
+	}
+
+	opts := &GitilesOptions{Offline: true}
+	if _, err := loadTree(fix.cache, nil, opts, &id, false, "test"); err != nil {
+		t.Errorf("loadTree(non-recursive): %v", err)
+	}
+	if _, err := loadTree(fix.cache, nil, opts, &id, true, "test"); err == nil {
+		t.Errorf("loadTree(recursive) returned a cached non-recursive tree")
+	}
+}
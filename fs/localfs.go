@@ -0,0 +1,56 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/google/slothfs/cache"
+)
+
+// NewLocalRoot returns the root node for a file system serving the
+// tree of a revision of a local git repository, eg. a mirror, without
+// Gitiles. Blobs are read from the repository, and stored in the blob
+// cache of c when first read, like blobs from a clone.
+func NewLocalRoot(c *cache.Cache, repo *cache.LazyRepo, revision string, options GitilesOptions) (*gitilesRoot, error) {
+	if revision == "" {
+		revision = "HEAD"
+	}
+	gitRepo := repo.Repository()
+	id, err := gitRepo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, fmt.Errorf("ResolveRevision(%s): %v", revision, err)
+	}
+	commit, err := gitRepo.CommitObject(*id)
+	if err != nil {
+		return nil, fmt.Errorf("CommitObject(%s): %v", id, err)
+	}
+	tree, err := cache.GetTree(gitRepo, &commit.TreeHash)
+	if err != nil {
+		return nil, fmt.Errorf("GetTree(%s): %v", commit.TreeHash, err)
+	}
+
+	// Never fall back to Gitiles or clone.
+	options.Offline = true
+	options.CloneURL = ""
+	r := NewGitilesRoot(c, tree, nil, GitilesRevisionOptions{
+		Revision:       id.String(),
+		GitilesOptions: options,
+	})
+	r.lazyRepo = repo
+	return r, nil
+}
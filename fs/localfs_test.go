@@ -0,0 +1,98 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/google/slothfs/cache"
+	fusefs "github.com/hanwen/go-fuse/fs"
+)
+
+func TestLocalRoot(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	dir := filepath.Join(fix.dir, "repo")
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("PlainInit: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub/file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("Worktree: %v", err)
+	}
+	if _, err := wt.Add("sub/file"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	commit, err := wt.Commit("msg", &git.CommitOptions{
+		Author: &object.Signature{Name: "t", Email: "t@t", When: time.Unix(1, 0)},
+	})
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	local, err := cache.NewLocalRepo(dir)
+	if err != nil {
+		t.Fatalf("NewLocalRepo: %v", err)
+	}
+	root, err := NewLocalRoot(fix.cache, local, "", GitilesOptions{})
+	if err != nil {
+		t.Fatalf("NewLocalRoot: %v", err)
+	}
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	if root.opts.Revision != commit.String() {
+		t.Errorf("got revision %s, want %s", root.opts.Revision, commit)
+	}
+	ch := root.GetChild("sub").GetChild("file")
+	if ch == nil {
+		t.Fatalf("sub/file not found")
+	}
+	n := ch.Operations().(*gitilesNode)
+	if n.size != 5 {
+		t.Errorf("got size %d, want 5", n.size)
+	}
+
+	f, err := root.openFile(context.Background(), n.id, n.clone, "test")
+	if err != nil {
+		t.Fatalf("openFile: %v", err)
+	}
+	content, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(content) != "hello" {
+		t.Errorf("got %q, %v, want hello", content, err)
+	}
+	if got := fix.testServer.requests; len(got) != 0 {
+		t.Errorf("got requests to Gitiles: %v", got)
+	}
+}
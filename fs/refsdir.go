@@ -0,0 +1,186 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// refsRefresh is how long the ref listing of refsDir is used before
+// it is fetched again.
+var refsRefresh = time.Minute
+
+// refsDir lists the branches and tags of a repository as symlinks to
+// the directory for their commit, eg. refs/heads/master ->
+// ../../<SHA1>. Ref names with slashes become subdirectories.
+type refsDir struct {
+	fs.Inode
+
+	root *gitilesConfigFSRoot
+
+	// prefix of the ref names below this directory, eg. "heads/".
+	prefix string
+}
+
+// refIDs returns the commits of all branches and tags, keyed by
+// name relative to refs/, eg. "heads/master". It refreshes the
+// listing if it is older than refsRefresh.
+func (r *gitilesConfigFSRoot) refIDs() (map[string]string, error) {
+	if r.options.Offline {
+		return nil, fmt.Errorf("offline: cannot list refs")
+	}
+
+	r.refsMu.Lock()
+	defer r.refsMu.Unlock()
+	if r.refs != nil && time.Since(r.refsTime) < refsRefresh {
+		return r.refs, nil
+	}
+
+	refs := map[string]string{}
+	for _, kind := range []string{"heads", "tags"} {
+		data, err := r.service.Refs("refs/" + kind)
+		if err != nil {
+			if r.refs != nil {
+				log.Printf("Refs(%s): %v; using old listing", kind, err)
+				return r.refs, nil
+			}
+			return nil, err
+		}
+		for name, d := range data {
+			if d.Target != "" {
+				// Symbolic ref; the target is listed too.
+				continue
+			}
+			id := d.Value
+			if d.Peeled != "" {
+				id = d.Peeled
+			}
+			refs[kind+"/"+name] = id
+		}
+	}
+	if changed := changedRefs(r.refs, refs); len(changed) > 0 {
+		// We may be called from a lookup in the refs
+		// directory, and the kernel can't invalidate entries
+		// of a directory while it looks something up in it.
+		go r.invalidateRefs(changed)
+	}
+	r.refs = refs
+	r.refsTime = time.Now()
+	return refs, nil
+}
+
+// changedRefs returns the names in prev that point to another
+// commit in cur, or are gone, sorted.
+func changedRefs(prev, cur map[string]string) []string {
+	var changed []string
+	for name, id := range prev {
+		if cur[name] != id {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// invalidateRefs makes the kernel forget the symlinks for the given
+// refs, so it doesn't serve an old commit until the entry times out.
+func (r *gitilesConfigFSRoot) invalidateRefs(names []string) {
+	for _, name := range names {
+		components := strings.Split(name, "/")
+		dir := r.GetChild("refs")
+		for _, c := range components[:len(components)-1] {
+			if dir == nil {
+				break
+			}
+			dir = dir.GetChild(c)
+		}
+		base := components[len(components)-1]
+		if dir == nil || dir.GetChild(base) == nil {
+			// The kernel never looked it up.
+			continue
+		}
+		if errno := dir.NotifyEntry(base); errno != 0 && errno != syscall.ENOENT {
+			log.Printf("NotifyEntry(refs/%s): %v", name, errno)
+		}
+	}
+}
+
+var _ = (fs.NodeLookuper)((*refsDir)(nil))
+
+func (d *refsDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	refs, err := d.root.refIDs()
+	if err != nil {
+		log.Printf("refIDs: %v", err)
+		return nil, errnoFor(err)
+	}
+
+	out.SetEntryTimeout(refsRefresh)
+	out.SetAttrTimeout(refsRefresh)
+
+	full := d.prefix + name
+	if id, ok := refs[full]; ok {
+		// The link is in refs/<full>, so we go up to the root
+		// once for refs/ and once for each directory in full.
+		target := strings.Repeat("../", strings.Count(full, "/")+1) + id
+		out.Mode = syscall.S_IFLNK | 0777
+		return d.NewInode(ctx, &fs.MemSymlink{Data: []byte(target)}, fs.StableAttr{Mode: syscall.S_IFLNK}), 0
+	}
+	for ref := range refs {
+		if strings.HasPrefix(ref, full+"/") {
+			out.Mode = syscall.S_IFDIR | 0755
+			return d.NewInode(ctx, &refsDir{root: d.root, prefix: full + "/"}, fs.StableAttr{Mode: syscall.S_IFDIR}), 0
+		}
+	}
+	return nil, syscall.ENOENT
+}
+
+var _ = (fs.NodeReaddirer)((*refsDir)(nil))
+
+func (d *refsDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	refs, err := d.root.refIDs()
+	if err != nil {
+		log.Printf("refIDs: %v", err)
+		return nil, errnoFor(err)
+	}
+
+	entries := map[string]uint32{}
+	for ref := range refs {
+		if !strings.HasPrefix(ref, d.prefix) {
+			continue
+		}
+		name := ref[len(d.prefix):]
+		if i := strings.Index(name, "/"); i >= 0 {
+			entries[name[:i]] = syscall.S_IFDIR
+		} else if _, ok := entries[name]; !ok {
+			entries[name] = syscall.S_IFLNK
+		}
+	}
+
+	var r []fuse.DirEntry
+	for name, mode := range entries {
+		r = append(r, fuse.DirEntry{Name: name, Mode: mode})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return fs.NewListDirStream(r), 0
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"syscall"
+	"testing"
+
+	fusefs "github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestRefsDir(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	ctx := context.Background()
+	root := NewGitilesConfigFSRoot(fix.cache, fix.service.NewRepoService("platform/build/kati"), &GitilesOptions{})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	refs := root.EmbeddedInode().GetChild("refs")
+	if refs == nil {
+		t.Fatal("no refs directory")
+	}
+
+	lookup := func(dir *fusefs.Inode, names ...string) *fusefs.Inode {
+		for _, name := range names {
+			var out fuse.EntryOut
+			ch, errno := dir.Operations().(fusefs.NodeLookuper).Lookup(ctx, name, &out)
+			if errno != 0 {
+				t.Fatalf("Lookup(%s): %v", name, errno)
+			}
+			dir = ch
+		}
+		return dir
+	}
+	readlink := func(n *fusefs.Inode) string {
+		target, errno := n.Operations().(fusefs.NodeReadlinker).Readlink(ctx)
+		if errno != 0 {
+			t.Fatalf("Readlink: %v", errno)
+		}
+		return string(target)
+	}
+
+	if got, want := readlink(lookup(refs, "heads", "master")), "../../ce34badf691d36e8048b63f89d1a86ee5fa4325c"; got != want {
+		t.Errorf("heads/master: got %q, want %q", got, want)
+	}
+	if got, want := readlink(lookup(refs, "heads", "release", "v1")), "../../../ce34badf691d36e8048b63f89d1a86ee5fa4325c"; got != want {
+		t.Errorf("heads/release/v1: got %q, want %q", got, want)
+	}
+	if got, want := readlink(lookup(refs, "tags", "v1")), "../../ce34badf691d36e8048b63f89d1a86ee5fa4325c"; got != want {
+		t.Errorf("tags/v1: got %q, want the peeled commit %q", got, want)
+	}
+
+	heads := lookup(refs, "heads")
+	stream, errno := heads.Operations().(fusefs.NodeReaddirer).Readdir(ctx)
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	var got []fuse.DirEntry
+	for stream.HasNext() {
+		e, _ := stream.Next()
+		got = append(got, e)
+	}
+	if len(got) != 2 || got[0].Name != "master" || got[0].Mode != syscall.S_IFLNK ||
+		got[1].Name != "release" || got[1].Mode != syscall.S_IFDIR {
+		t.Errorf("got entries %v, want master link and release dir", got)
+	}
+
+	var out fuse.EntryOut
+	if _, errno := refs.Operations().(fusefs.NodeLookuper).Lookup(ctx, "notes", &out); errno != syscall.ENOENT {
+		t.Errorf("Lookup(notes): %v, want ENOENT", errno)
+	}
+
+	content, err := root.(*gitilesConfigFSRoot).refsJSON()
+	if err != nil {
+		t.Fatalf("refsJSON: %v", err)
+	}
+	var listing map[string]map[string]string
+	if err := json.Unmarshal(content, &listing); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	const commit = "ce34badf691d36e8048b63f89d1a86ee5fa4325c"
+	want := map[string]map[string]string{
+		"branches": {"master": commit, "release/v1": commit},
+		"tags":     {"v1": commit},
+	}
+	if !reflect.DeepEqual(listing, want) {
+		t.Errorf("refs.json: got %v, want %v", listing, want)
+	}
+}
+
+func TestRefsDirError(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	// Offline, the refs can't be listed.
+	ctx := context.Background()
+	root := NewGitilesConfigFSRoot(fix.cache, fix.service.NewRepoService("platform/build/kati"), &GitilesOptions{Offline: true})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	refs := root.EmbeddedInode().GetChild("refs")
+	if refs == nil {
+		t.Fatal("no refs directory")
+	}
+	if _, errno := refs.Operations().(fusefs.NodeReaddirer).Readdir(ctx); errno != syscall.EIO {
+		t.Errorf("Readdir: got %v, want EIO", errno)
+	}
+	var out fuse.EntryOut
+	if _, errno := refs.Operations().(fusefs.NodeLookuper).Lookup(ctx, "heads", &out); errno != syscall.EIO {
+		t.Errorf("Lookup(heads): got %v, want EIO", errno)
+	}
+}
+
+func TestChangedRefs(t *testing.T) {
+	old := map[string]string{"heads/master": "a", "heads/dev": "b", "tags/v1": "c"}
+	cur := map[string]string{"heads/master": "a", "heads/dev": "d", "tags/v2": "c"}
+	if got, want := changedRefs(old, cur), []string{"heads/dev", "tags/v1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := changedRefs(nil, cur); got != nil {
+		t.Errorf("first listing: got %v, want nothing", got)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/google/slothfs/gitiles"
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// subtreeFile is the name of the listing in each directory of
+// .slothfs/trees.
+const subtreeFile = "tree.json"
+
+// subtreeDir mirrors a directory of the tree under .slothfs/trees.
+// It holds a tree.json listing all blobs below the directory, in the
+// format of .slothfs/tree.json, and a subtreeDir for each
+// subdirectory. Tools can read the listing in one go rather than
+// stat'ing every file through FUSE.
+type subtreeDir struct {
+	fs.Inode
+
+	// The mirrored directory. With LazyTrees, dir is nil, and the
+	// listings are made from the recursive tree of root at path
+	// prefix instead, so reading them doesn't populate every lazy
+	// directory.
+	dir    *fs.Inode
+	root   *gitilesRoot
+	prefix string
+}
+
+// newSubtreeDir returns the subtreeDir for the root of r.
+func newSubtreeDir(r *gitilesRoot) *subtreeDir {
+	if r.opts.LazyTrees {
+		return &subtreeDir{root: r}
+	}
+	return &subtreeDir{dir: &r.Inode}
+}
+
+// relName returns name relative to the directory prefix, if it is
+// below it.
+func relName(name, prefix string) (string, bool) {
+	if prefix == "" {
+		return name, true
+	}
+	if !strings.HasPrefix(name, prefix+"/") {
+		return "", false
+	}
+	return name[len(prefix)+1:], true
+}
+
+// subdirs returns the names of the directories below the mirrored
+// directory, and in non-lazy mode, their inodes.
+func (d *subtreeDir) subdirs() (map[string]*fs.Inode, error) {
+	r := map[string]*fs.Inode{}
+	if d.dir == nil {
+		tree, err := d.root.fullTree()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range tree.Entries {
+			if rel, ok := relName(e.Name, d.prefix); ok {
+				if i := strings.Index(rel, "/"); i > 0 {
+					r[rel[:i]] = nil
+				}
+			}
+		}
+		return r, nil
+	}
+
+	for name, ch := range canonicalChildren(d.dir) {
+		if _, ok := ch.Operations().(*gitilesNode); ok || !ch.IsDir() {
+			continue
+		}
+		if name == ".slothfs" && d.dir.Root() == d.dir {
+			continue
+		}
+		r[name] = ch
+	}
+	return r, nil
+}
+
+var _ = (fs.NodeLookuper)((*subtreeDir)(nil))
+
+func (d *subtreeDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if name == subtreeFile {
+		return d.NewInode(ctx, newDynamicNode(d.treeJSON), fs.StableAttr{Mode: syscall.S_IFREG}), 0
+	}
+	dirs, err := d.subdirs()
+	if err != nil {
+		return nil, errnoFor(err)
+	}
+	ch, ok := dirs[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	out.Mode = syscall.S_IFDIR | 0755
+	sub := &subtreeDir{dir: ch, root: d.root, prefix: path.Join(d.prefix, name)}
+	return d.NewInode(ctx, sub, fs.StableAttr{Mode: syscall.S_IFDIR}), 0
+}
+
+var _ = (fs.NodeReaddirer)((*subtreeDir)(nil))
+
+func (d *subtreeDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	dirs, err := d.subdirs()
+	if err != nil {
+		return nil, errnoFor(err)
+	}
+	r := []fuse.DirEntry{{Name: subtreeFile, Mode: syscall.S_IFREG}}
+	for name := range dirs {
+		r = append(r, fuse.DirEntry{Name: name, Mode: syscall.S_IFDIR})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return fs.NewListDirStream(r), 0
+}
+
+// entries returns the blobs below the mirrored directory, with names
+// relative to it, sorted by name.
+func (d *subtreeDir) entries() ([]gitiles.TreeEntry, error) {
+	var tree gitiles.Tree
+	if d.dir == nil {
+		full, err := d.root.fullTree()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range full.Entries {
+			rel, ok := relName(e.Name, d.prefix)
+			if !ok || e.Type != "blob" {
+				continue
+			}
+			e.Name = rel
+			tree.Entries = append(tree.Entries, e)
+		}
+	} else {
+		addSubtree(&tree, d.dir, "")
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool { return tree.Entries[i].Name < tree.Entries[j].Name })
+	return tree.Entries, nil
+}
+
+func (d *subtreeDir) treeJSON() ([]byte, error) {
+	entries, err := d.entries()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(&gitiles.Tree{Entries: entries}, "", " ")
+}
+
+// sha1List returns a line "path<TAB>sha1" for each blob below the
+// mirrored directory, sorted by path. Paths that contain a newline
+// or start with a quote are quoted as Go strings.
+func (d *subtreeDir) sha1List() ([]byte, error) {
+	entries, err := d.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		name := e.Name
+		if strings.Contains(name, "\n") || strings.HasPrefix(name, `"`) {
+			name = strconv.Quote(name)
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", name, e.ID)
+	}
+	return buf.Bytes(), nil
+}
+
+// fullTree returns the recursive tree, for the metadata files in
+// lazy mode. It is fetched in one request, on first use.
+func (r *gitilesRoot) fullTree() (*gitiles.Tree, error) {
+	r.fullTreeMu.Lock()
+	defer r.fullTreeMu.Unlock()
+	if r.recursiveTree != nil {
+		return r.recursiveTree, nil
+	}
+
+	id, err := parseID(r.treeID)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := loadTree(r.cache, r.service, &r.opts.GitilesOptions, id, true, "metadata")
+	if err != nil {
+		return nil, err
+	}
+	r.recursiveTree = r.exportTree(tree)
+	return r.recursiveTree, nil
+}
+
+// addSubtree adds the blobs below dir to tree, prefixing their names
+// with prefix.
+func addSubtree(tree *gitiles.Tree, dir *fs.Inode, prefix string) {
+	for name, ch := range canonicalChildren(dir) {
+		if name == ".slothfs" && dir.Root() == dir {
+			continue
+		}
+		if _, ok := ch.Operations().(*archiveDir); ok {
+			continue
+		}
+		n, ok := ch.Operations().(*gitilesNode)
+		if !ok {
+			if ch.IsDir() {
+				addSubtree(tree, ch, path.Join(prefix, name))
+			}
+			continue
+		}
+
+		size := int(n.size)
+		e := gitiles.TreeEntry{
+			Mode: int(n.mode),
+			Type: "blob",
+			ID:   n.id.String(),
+			Name: path.Join(prefix, name),
+			Size: &size,
+		}
+		if n.linkTarget != nil {
+			target := string(n.linkTarget)
+			e.Target = &target
+		}
+		tree.Entries = append(tree.Entries, e)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"syscall"
+	"testing"
+
+	"github.com/google/slothfs/gitiles"
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestSubtreeDir(t *testing.T) {
+	ctx := context.Background()
+	root := &fs.Inode{}
+	fs.NewNodeFS(root, &fs.Options{})
+
+	dir := func(parent *fs.Inode, name string) *fs.Inode {
+		ch := parent.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: syscall.S_IFDIR})
+		parent.AddChild(name, ch, false)
+		return ch
+	}
+	file := func(parent *fs.Inode, name string, n *gitilesNode) {
+		ch := parent.NewPersistentInode(ctx, n, fs.StableAttr{Mode: syscall.S_IFREG})
+		parent.AddChild(name, ch, false)
+	}
+
+	id := plumbing.NewHash("abcd1234abcd1234abcd1234abcd1234abcd1234")
+	a := dir(root, "a")
+	b := dir(a, "b")
+	file(b, "file", &gitilesNode{mode: 0100644, size: 3, id: id})
+	file(a, "link", &gitilesNode{mode: 0120000, size: 4, id: id, linkTarget: []byte("b/file")})
+	file(root, "top", &gitilesNode{mode: 0100644, size: 1, id: id})
+
+	trees := &subtreeDir{dir: root}
+	root.AddChild("trees", root.NewPersistentInode(ctx, trees, fs.StableAttr{Mode: syscall.S_IFDIR}), false)
+
+	var out fuse.EntryOut
+	ch, errno := trees.Lookup(ctx, "a", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup(a): %v", errno)
+	}
+	stream, errno := ch.Operations().(*subtreeDir).Readdir(ctx)
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	var names []string
+	for stream.HasNext() {
+		e, _ := stream.Next()
+		names = append(names, e.Name)
+	}
+	if len(names) != 2 || names[0] != "b" || names[1] != subtreeFile {
+		t.Errorf("got names %v, want [b tree.json]", names)
+	}
+
+	content, err := ch.Operations().(*subtreeDir).treeJSON()
+	if err != nil {
+		t.Fatalf("treeJSON: %v", err)
+	}
+	var tree gitiles.Tree
+	if err := json.Unmarshal(content, &tree); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(tree.Entries) != 2 {
+		t.Fatalf("got %d entries, want 2: %s", len(tree.Entries), content)
+	}
+	if e := tree.Entries[0]; e.Name != "b/file" || e.ID != id.String() || *e.Size != 3 || e.Target != nil {
+		t.Errorf("got %#v, want b/file", e)
+	}
+	if e := tree.Entries[1]; e.Name != "link" || e.Mode != 0120000 || e.Target == nil || *e.Target != "b/file" {
+		t.Errorf("got %#v, want link to b/file", e)
+	}
+
+	if _, errno := trees.Lookup(ctx, "top", &out); errno != syscall.ENOENT {
+		t.Errorf("Lookup(top): %v, want ENOENT", errno)
+	}
+}
+
+func TestSHA1List(t *testing.T) {
+	ctx := context.Background()
+	root := &fs.Inode{}
+	fs.NewNodeFS(root, &fs.Options{})
+
+	id := plumbing.NewHash("abcd1234abcd1234abcd1234abcd1234abcd1234")
+	sub := root.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: syscall.S_IFDIR})
+	root.AddChild("sub", sub, false)
+	for parent, names := range map[*fs.Inode][]string{
+		root: {"b", "new\nline", "tab\tname"},
+		sub:  {"a"},
+	} {
+		for _, name := range names {
+			ch := parent.NewPersistentInode(ctx, &gitilesNode{mode: 0100644, id: id}, fs.StableAttr{Mode: syscall.S_IFREG})
+			parent.AddChild(name, ch, false)
+		}
+	}
+
+	content, err := (&subtreeDir{dir: root}).sha1List()
+	if err != nil {
+		t.Fatalf("sha1List: %v", err)
+	}
+	got := string(content)
+	want := "b\t" + id.String() + "\n" +
+		`"new\nline"` + "\t" + id.String() + "\n" +
+		"sub/a\t" + id.String() + "\n" +
+		"tab\tname\t" + id.String() + "\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
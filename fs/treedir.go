@@ -0,0 +1,62 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// treeDir is a directory of the git tree. Its lookups, which the
+// kernel also issues for every entry of a READDIRPLUS, are answered
+// from the tree metadata.
+type treeDir struct {
+	fs.Inode
+
+	root *gitilesRoot
+}
+
+var _ = (fs.NodeLookuper)((*treeDir)(nil))
+
+func (d *treeDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ch := d.GetChild(name)
+	if ch == nil {
+		return nil, syscall.ENOENT
+	}
+	entryAttr(ctx, ch, out)
+	return ch, 0
+}
+
+// entryAttr fills in the attributes of a looked up child. Files of
+// the tree use their metadata; if that is incomplete, the attributes
+// expire immediately, so the kernel asks again with GETATTR when it
+// actually needs them.
+func entryAttr(ctx context.Context, ch *fs.Inode, out *fuse.EntryOut) {
+	switch n := ch.Operations().(type) {
+	case *gitilesNode:
+		if !n.lookupAttr(&out.Attr) {
+			out.SetAttrTimeout(time.Nanosecond)
+		}
+	case fs.NodeGetattrer:
+		var a fuse.AttrOut
+		if errno := n.Getattr(ctx, nil, &a); errno == 0 {
+			out.Attr = a.Attr
+		}
+	}
+}
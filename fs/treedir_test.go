@@ -0,0 +1,200 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/slothfs/gitiles"
+	fusefs "github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// newTreeDirRoot returns a root holding n files in dir/, with line
+// ending conversion for *.txt, and an export-ignored skip/ directory.
+func newTreeDirRoot(tb testing.TB, fix *testFixture, n int) *gitilesRoot {
+	attrs := []byte("*.txt eol=crlf\n/skip export-ignore\n")
+	attrsID := plumbing.ComputeHash(plumbing.BlobObject, attrs)
+	if _, err := fix.cache.Blob.Write(attrsID, bytes.NewReader(attrs)); err != nil {
+		tb.Fatalf("Write: %v", err)
+	}
+
+	size := 10
+	tree := &gitiles.Tree{
+		Entries: []gitiles.TreeEntry{
+			{Mode: 0100644, Type: "blob", ID: attrsID.String(), Name: ".gitattributes"},
+			{Mode: 0100644, Type: "blob", ID: "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", Name: "dir/notes.txt", Size: &size},
+			{Mode: 0100644, Type: "blob", ID: "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", Name: "skip/file", Size: &size},
+		},
+	}
+	for i := 0; i < n; i++ {
+		tree.Entries = append(tree.Entries, gitiles.TreeEntry{
+			Mode: 0100644,
+			Type: "blob",
+			ID:   fmt.Sprintf("%040x", i+1),
+			Name: fmt.Sprintf("dir/file%d", i),
+			Size: &size,
+		})
+	}
+
+	root := NewGitilesRoot(fix.cache, tree, nil, GitilesRevisionOptions{
+		GitilesOptions: GitilesOptions{Offline: true, GitAttributes: true},
+	})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	return root
+}
+
+func TestTreeDirLookup(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	ctx := context.Background()
+	root := newTreeDirRoot(t, fix, 1)
+	dir, ok := root.GetChild("dir").Operations().(*treeDir)
+	if !ok {
+		t.Fatalf("dir is %T, want *treeDir", root.GetChild("dir").Operations())
+	}
+
+	var out fuse.EntryOut
+	if _, errno := dir.Lookup(ctx, "file0", &out); errno != 0 {
+		t.Fatalf("Lookup(file0): %v", errno)
+	}
+	if out.Size != 10 || out.Mode != 0100644 || out.Mtime != 1 {
+		t.Errorf("file0: got %v", &out.Attr)
+	}
+	if out.AttrTimeout() != 0 {
+		t.Errorf("file0: got attr timeout %v, want the default", out.AttrTimeout())
+	}
+
+	// The converted size is unknown, and finding it would need the
+	// blob, which is neither cached nor available offline.
+	out = fuse.EntryOut{}
+	if _, errno := dir.Lookup(ctx, "notes.txt", &out); errno != 0 {
+		t.Fatalf("Lookup(notes.txt): %v", errno)
+	}
+	if got := out.AttrTimeout(); got == 0 || got > time.Microsecond {
+		t.Errorf("notes.txt: got attr timeout %v, want it to expire immediately", got)
+	}
+
+	// Neither does GETATTR fetch it: it reports the unconverted size
+	// until the file is opened.
+	var attrOut fuse.AttrOut
+	notes := dir.GetChild("notes.txt").Operations().(*gitilesNode)
+	if errno := notes.Getattr(ctx, nil, &attrOut); errno != 0 {
+		t.Fatalf("Getattr(notes.txt): %v", errno)
+	}
+	if attrOut.Size != 10 || attrOut.Timeout() != 0 {
+		t.Errorf("notes.txt: got size %d, timeout %v, want 10, 0", attrOut.Size, attrOut.Timeout())
+	}
+}
+
+func TestConvertedXattr(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	var entries []gitiles.TreeEntry
+	for name, content := range map[string]string{
+		".gitattributes": "*.txt eol=crlf\n",
+		"notes.txt":      "a\nb\n",
+		"plain":          "a\nb\n",
+	} {
+		id := plumbing.ComputeHash(plumbing.BlobObject, []byte(content))
+		if _, err := fix.cache.Blob.Write(id, bytes.NewBufferString(content)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		entries = append(entries, gitiles.TreeEntry{Mode: 0100644, Type: "blob", ID: id.String(), Name: name})
+	}
+	root := NewGitilesRoot(fix.cache, &gitiles.Tree{Entries: entries}, nil, GitilesRevisionOptions{
+		GitilesOptions: GitilesOptions{Offline: true, GitAttributes: true},
+	})
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+
+	ctx := context.Background()
+	dest := make([]byte, 1024)
+	notes := root.GetChild("notes.txt").Operations().(*gitilesNode)
+	sz, errno := notes.Listxattr(ctx, dest)
+	if got, want := string(dest[:sz]), xattrName+"\x00"+convertedXattrName+"\x00"; errno != 0 || got != want {
+		t.Errorf("Listxattr: got %q, %v, want %q", got, errno, want)
+	}
+	sz, errno = notes.Getxattr(ctx, convertedXattrName, dest)
+	want := plumbing.ComputeHash(plumbing.BlobObject, []byte("a\r\nb\r\n")).String()
+	if got := string(dest[:sz]); errno != 0 || got != want {
+		t.Errorf("Getxattr(%s): got %q, %v, want %q", convertedXattrName, got, errno, want)
+	}
+
+	plain := root.GetChild("plain").Operations().(*gitilesNode)
+	if _, errno := plain.Getxattr(ctx, convertedXattrName, dest); errno != syscall.ENODATA {
+		t.Errorf("Getxattr(%s) without conversion: got %v, want ENODATA", convertedXattrName, errno)
+	}
+}
+
+func TestTreeJSONExportIgnore(t *testing.T) {
+	fix, err := newTestFixture()
+	if err != nil {
+		t.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	root := newTreeDirRoot(t, fix, 1)
+	if root.GetChild("skip") != nil {
+		t.Errorf("skip/ is in the tree")
+	}
+	data := root.GetChild(".slothfs").GetChild("tree.json").Operations().(*fusefs.MemRegularFile).Data
+	var tree gitiles.Tree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	for _, e := range tree.Entries {
+		if e.Name == "skip/file" {
+			t.Errorf("tree.json lists %s", e.Name)
+		}
+	}
+	if len(tree.Entries) != 3 {
+		t.Errorf("got %d entries, want 3", len(tree.Entries))
+	}
+}
+
+func BenchmarkTreeDirLookup(b *testing.B) {
+	fix, err := newTestFixture()
+	if err != nil {
+		b.Fatalf("newTestFixture: %v", err)
+	}
+	defer fix.cleanup()
+
+	const n = 10000
+	ctx := context.Background()
+	dir := newTreeDirRoot(b, fix, n).GetChild("dir").Operations().(*treeDir)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out fuse.EntryOut
+		if _, errno := dir.Lookup(ctx, fmt.Sprintf("file%d", i%n), &out); errno != 0 {
+			b.Fatalf("Lookup: %v", errno)
+		}
+	}
+}
@@ -30,8 +30,12 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/slothfs/cookie"
 	"golang.org/x/net/context"
@@ -45,6 +49,22 @@ type Service struct {
 	client  http.Client
 	agent   string
 	debug   bool
+
+	// apiAddr is addr with the path prefix, for requests.
+	apiAddr url.URL
+	query   url.Values
+	header  http.Header
+
+	// jsonCache is nil if JSON responses are not cached.
+	jsonCache *jsonCache
+	offline   bool
+
+	listPageSize int
+
+	// mu protects the outcome of the last request.
+	mu        sync.Mutex
+	requested bool
+	lastErr   error
 }
 
 // Addr returns the address of the gitiles service.
@@ -69,36 +89,83 @@ type Options struct {
 	// HTTPClient allows callers to present their own http.Client instead of the default.
 	HTTPClient http.Client
 
+	// PathPrefix is inserted between the address and the
+	// repository name in requests. Gerrit hosts require "/a" for
+	// authenticated access. If empty and CookieJar is set, "/a"
+	// is used; set it to "/" to use no prefix.
+	PathPrefix string
+
+	// ExtraQuery holds query parameters to add to every request.
+	ExtraQuery url.Values
+
+	// ExtraHeader holds headers to add to every request.
+	ExtraHeader http.Header
+
+	// JSONCacheDir, if set, is a directory for caching responses
+	// of JSON requests, eg. commits and refs. Trees are not
+	// cached here.
+	JSONCacheDir string
+
+	// JSONCacheTTL is how long cached JSON responses are used
+	// without asking the server. After that, they are revalidated
+	// using their ETag, if the server sent one.
+	JSONCacheTTL time.Duration
+
+	// Offline forbids requests to the server. JSON responses are
+	// served from the JSON cache whatever their age, and all
+	// other requests fail.
+	Offline bool
+
+	// ListPageSize, if positive, makes List fetch the projects
+	// in pages of this many projects. Large hosts may be slow to
+	// list all projects at once, or truncate the list.
+	ListPageSize int
+
+	// TLSCert and TLSKey are PEM files holding a client
+	// certificate and its key, for servers that require mutual
+	// TLS.
+	TLSCert string
+	TLSKey  string
+
+	// TLSCA is a PEM file with the certificates of the CAs that
+	// may sign the server certificate. If set, the system CAs are
+	// not trusted.
+	TLSCA string
+
+	// TLSInsecureSkipVerify disables checking the server
+	// certificate. Only use this for test servers.
+	TLSInsecureSkipVerify bool
+
 	Debug bool
 }
 
 var defaultOptions Options
 
+// DefaultListPageSize is the default for the -gitiles_list_page_size
+// flag.
+const DefaultListPageSize = 1000
+
 // DefineFlags sets up standard command line flags, and returns the
 // options struct in which the values are put.
 func DefineFlags() *Options {
 	flag.StringVar(&defaultOptions.Address, "gitiles_url", "https://android.googlesource.com", "Set the URL of the Gitiles service.")
-	flag.StringVar(&defaultOptions.CookieJar, "gitiles_cookies", "", "Set path to cURL-style cookie jar file.")
+	flag.StringVar(&defaultOptions.CookieJar, "gitiles_cookies", "", "Set path to cURL-style cookie jar file, or to a Chrome or Firefox cookie database.")
 	flag.StringVar(&defaultOptions.UserAgent, "gitiles_agent", "slothfs", "Set the User-Agent string to report to Gitiles.")
 	flag.Float64Var(&defaultOptions.SustainedQPS, "gitiles_qps", 4, "Set the maximum QPS to send to Gitiles.")
 	flag.BoolVar(&defaultOptions.Debug, "gitiles_debug", false, "Print URLs as they are fetched.")
+	flag.StringVar(&defaultOptions.JSONCacheDir, "gitiles_cache_dir", "", "Cache JSON responses from Gitiles in this directory.")
+	flag.DurationVar(&defaultOptions.JSONCacheTTL, "gitiles_cache_ttl", time.Minute, "Use JSON responses from -gitiles_cache_dir without asking Gitiles if they are younger than this.")
+	flag.IntVar(&defaultOptions.ListPageSize, "gitiles_list_page_size", DefaultListPageSize, "List the projects of the host in pages of this size. 0 lists them in a single request.")
+	flag.StringVar(&defaultOptions.TLSCert, "gitiles_tls_cert", "", "Set path to a PEM client certificate for servers that require mutual TLS.")
+	flag.StringVar(&defaultOptions.TLSKey, "gitiles_tls_key", "", "Set path to the PEM key for -gitiles_tls_cert.")
+	flag.StringVar(&defaultOptions.TLSCA, "gitiles_tls_ca", "", "Set path to PEM certificates of the CAs to trust instead of the system CAs.")
+	flag.BoolVar(&defaultOptions.TLSInsecureSkipVerify, "gitiles_tls_insecure_skip_verify", false, "Do not check the server certificate. Only use this for test servers.")
+	flag.StringVar(&defaultOptions.PathPrefix, "gitiles_path_prefix", "", "Set the path prefix for Gitiles requests, eg. /a for authenticated Gerrit access. Defaults to /a if -gitiles_cookies is set.")
 	return &defaultOptions
 }
 
 // NewService returns a new Gitiles JSON client.
 func NewService(opts Options) (*Service, error) {
-	var jar http.CookieJar
-	if nm := opts.CookieJar; nm != "" {
-		var err error
-		jar, err = cookie.NewJar(nm)
-		if err != nil {
-			return nil, err
-		}
-		if err := cookie.WatchJar(jar, nm); err != nil {
-			return nil, err
-		}
-	}
-
 	if opts.SustainedQPS == 0.0 {
 		opts.SustainedQPS = 4
 	}
@@ -112,13 +179,50 @@ func NewService(opts Options) (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	var jar http.CookieJar
+	if nm := opts.CookieJar; nm != "" {
+		j, err := cookie.NewJar(nm, url.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		if err := j.Watch(); err != nil {
+			return nil, err
+		}
+		jar = j
+	}
+
 	s := &Service{
 		limiter: rate.NewLimiter(rate.Limit(opts.SustainedQPS), opts.BurstQPS),
 		addr:    *url,
 		agent:   opts.UserAgent,
 		client:  opts.HTTPClient,
+		query:   opts.ExtraQuery,
+		header:  opts.ExtraHeader,
+
+		listPageSize: opts.ListPageSize,
+		offline:      opts.Offline,
+	}
+
+	prefix := opts.PathPrefix
+	if prefix == "" && opts.CookieJar != "" {
+		prefix = "/a"
+	}
+	if opts.JSONCacheDir != "" {
+		if err := os.MkdirAll(opts.JSONCacheDir, 0700); err != nil {
+			return nil, err
+		}
+		s.jsonCache = &jsonCache{dir: opts.JSONCacheDir, ttl: opts.JSONCacheTTL}
 	}
 
+	s.apiAddr = s.addr
+	if prefix != "" && prefix != "/" {
+		s.apiAddr.Path = path.Join(s.apiAddr.Path, prefix)
+	}
+
+	if err := opts.setTLS(&s.client); err != nil {
+		return nil, err
+	}
 	s.client.Jar = jar
 	s.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		req.Header.Set("User-Agent", s.agent)
@@ -128,54 +232,168 @@ func NewService(opts Options) (*Service, error) {
 	return s, nil
 }
 
+// Saturated returns whether requests currently have to wait for the
+// rate limiter.
+func (s *Service) Saturated() bool {
+	// A reservation would use up a token, as canceling it only
+	// gives the token back if it is still in the future.
+	return s.limiter.Tokens() < 1
+}
+
+// LastRequest returns whether a request was sent to the server, and
+// the error of the last one, or nil if it succeeded.
+func (s *Service) LastRequest() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requested, s.lastErr
+}
+
 func (s *Service) stream(u *url.URL) (*http.Response, error) {
-	ctx := context.Background()
+	return s.streamIfNoneMatch(u, "")
+}
+
+// streamIfNoneMatch is like stream, but if etag is non-empty, it
+// asks the server to reply 304 Not Modified if the content still
+// has that ETag. The 304 response is returned as is.
+func (s *Service) streamIfNoneMatch(u *url.URL, etag string) (*http.Response, error) {
+	if s.offline {
+		return nil, fmt.Errorf("%s: Gitiles service is offline", u)
+	}
+
+	resp, err := s.send(u, etag)
+	s.mu.Lock()
+	s.requested = true
+	s.lastErr = err
+	s.mu.Unlock()
+	return resp, err
+}
 
+// send does the work of streamIfNoneMatch.
+func (s *Service) send(u *url.URL, etag string) (*http.Response, error) {
+	ctx := context.Background()
 	if err := s.limiter.Wait(ctx); err != nil {
 		return nil, err
 	}
+	if len(s.query) > 0 {
+		withQuery := *u
+		q := withQuery.Query()
+		for k, vs := range s.query {
+			for _, v := range vs {
+				q.Add(k, v)
+			}
+		}
+		withQuery.RawQuery = q.Encode()
+		u = &withQuery
+	}
+
 	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	for k, vs := range s.header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
 	req.Header.Add("User-Agent", s.agent)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
 	resp, err := s.client.Do(req)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
 	if resp.StatusCode != 200 {
-		resp.Body.Close()
-		return nil, fmt.Errorf("%s: %s", u.String(), resp.Status)
+		defer resp.Body.Close()
+		return nil, newHTTPError(u, resp)
 	}
 
 	if s.debug {
 		log.Printf("%s %s: %d", req.Method, req.URL, resp.StatusCode)
 	}
 	if got := resp.Request.URL.String(); got != u.String() {
-		resp.Body.Close()
+		defer resp.Body.Close()
 		// We accept redirects, but only for authentication.
 		// If we get a 200 from a different page than we
 		// requested, it's probably some sort of login page.
-		return nil, fmt.Errorf("got URL %s, want %s", got, u.String())
+		httpErr := newHTTPError(u, resp)
+		httpErr.RedirectURL = got
+		return nil, httpErr
 	}
 
 	return resp, nil
 }
 
+// maxJSONSize is the largest JSON response we accept. Recursive tree
+// listings of very large repositories are a few megabytes.
+const maxJSONSize = 64 << 20
+
 func (s *Service) get(u *url.URL) ([]byte, error) {
 	resp, err := s.stream(u)
 	if err != nil {
 		return nil, err
 	}
+	return readBody(resp, maxJSONSize)
+}
+
+// getCached is like get, but uses the JSON cache if configured.
+func (s *Service) getCached(u *url.URL) ([]byte, error) {
+	if s.jsonCache == nil {
+		return s.get(u)
+	}
+
+	key := u.String()
+	cached := s.jsonCache.get(key)
+	if cached != nil && (s.offline || s.jsonCache.fresh(cached)) {
+		return cached.Body, nil
+	}
+
+	etag := ""
+	if cached != nil {
+		etag = cached.ETag
+	}
+	resp, err := s.streamIfNoneMatch(u, etag)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		cached.Time = time.Now()
+		s.jsonCache.put(cached)
+		return cached.Body, nil
+	}
 
+	etag = resp.Header.Get("ETag")
+	c, err := readBody(resp, maxJSONSize)
+	if err != nil {
+		return nil, err
+	}
+	s.jsonCache.put(&cachedResponse{
+		URL:  key,
+		ETag: etag,
+		Time: time.Now(),
+		Body: c,
+	})
+	return c, nil
+}
+
+// readBody reads and closes the body of a response, decoding base64
+// for text responses. It fails for bodies larger than limit bytes.
+func readBody(resp *http.Response, limit int64) ([]byte, error) {
 	defer resp.Body.Close()
 
-	c, err := ioutil.ReadAll(resp.Body)
+	c, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(c)) > limit {
+		return nil, fmt.Errorf("response for %s is larger than %d bytes", resp.Request.URL, limit)
+	}
 
 	if resp.Header.Get("Content-Type") == "text/plain; charset=UTF-8" {
 		out := make([]byte, base64.StdEncoding.DecodedLen(len(c)))
@@ -187,18 +405,34 @@ func (s *Service) get(u *url.URL) ([]byte, error) {
 
 var xssTag = []byte(")]}'\n")
 
+// getJSON fetches and decodes a JSON response, using the JSON cache
+// if configured.
 func (s *Service) getJSON(u *url.URL, dest interface{}) error {
+	c, err := s.getCached(u)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(u, c, dest)
+}
+
+// getUncachedJSON is like getJSON, but skips the JSON cache. It is
+// for trees, which can be tens of megabytes, and which the TreeCache
+// keeps already.
+func (s *Service) getUncachedJSON(u *url.URL, dest interface{}) error {
 	c, err := s.get(u)
 	if err != nil {
 		return err
 	}
+	return decodeJSON(u, c, dest)
+}
 
+func decodeJSON(u *url.URL, c []byte, dest interface{}) error {
 	if !bytes.HasPrefix(c, xssTag) {
 		return fmt.Errorf("Gitiles JSON %s missing XSS tag: %q", u, c)
 	}
 	c = c[len(xssTag):]
 
-	err = json.Unmarshal(c, dest)
+	err := json.Unmarshal(c, dest)
 	if err != nil {
 		err = fmt.Errorf("Unmarshal(%s): %v", u, err)
 	}
@@ -207,15 +441,80 @@ func (s *Service) getJSON(u *url.URL, dest interface{}) error {
 
 // List retrieves the list of projects.
 func (s *Service) List(branches []string) (map[string]*Project, error) {
-	listURL := s.addr
-	listURL.RawQuery = "format=JSON"
-	for _, b := range branches {
-		listURL.RawQuery += "&b=" + b
+	return s.ListProjects(ListOptions{Branches: branches})
+}
+
+// ListOptions selects the projects returned by ListProjects.
+type ListOptions struct {
+	// Branches are looked up in each project, and returned in
+	// its Branches field.
+	Branches []string
+
+	// Prefix, if set, restricts the list to projects whose name
+	// starts with it.
+	Prefix string
+}
+
+// ListProjects retrieves the list of projects. If the ListPageSize
+// option is set, it is fetched in pages, until a page comes back
+// short.
+func (s *Service) ListProjects(opts ListOptions) (map[string]*Project, error) {
+	projects := map[string]*Project{}
+	seen := map[string]bool{}
+	for start := 0; ; {
+		page, err := s.listPage(&opts, start)
+		if err != nil {
+			return nil, err
+		}
+
+		added := 0
+		for k, v := range page {
+			if !seen[k] {
+				seen[k] = true
+				added++
+			}
+			// The server may not support the prefix.
+			if strings.HasPrefix(k, opts.Prefix) {
+				projects[k] = v
+			}
+		}
+
+		// A server that doesn't support paging returns all
+		// projects, or the same page again.
+		if n := s.listPageSize; n <= 0 || len(page) < n || added == 0 {
+			return projects, nil
+		}
+		start += len(page)
+	}
+}
+
+// listPage fetches the projects starting at the given index.
+func (s *Service) listPage(opts *ListOptions, start int) (map[string]*Project, error) {
+	listURL := s.apiAddr
+	// The project list is at the root of the prefix, with a
+	// trailing slash: "/a" is not the same as "/a/".
+	listURL.Path = strings.TrimSuffix(listURL.Path, "/") + "/"
+	q := url.Values{"format": {"JSON"}}
+	for _, b := range opts.Branches {
+		q.Add("b", b)
+	}
+	if opts.Prefix != "" {
+		q.Set("p", opts.Prefix)
+	}
+	if n := s.listPageSize; n > 0 {
+		q.Set("n", strconv.Itoa(n))
+		if start > 0 {
+			q.Set("s", strconv.Itoa(start))
+		}
 	}
+	listURL.RawQuery = q.Encode()
 
 	projects := map[string]*Project{}
 	err := s.getJSON(&listURL, &projects)
 	for k, v := range projects {
+		if v == nil {
+			return nil, fmt.Errorf("gitiles: key %q has no project", k)
+		}
 		if k != v.Name {
 			return nil, fmt.Errorf("gitiles: key %q had project name %q", k, v.Name)
 		}
@@ -239,9 +538,20 @@ type RepoService struct {
 	service *Service
 }
 
+// LastRequest is like Service.LastRequest.
+func (s *RepoService) LastRequest() (bool, error) {
+	return s.service.LastRequest()
+}
+
+// Saturated returns whether requests for this repository have to
+// wait for the rate limiter.
+func (s *RepoService) Saturated() bool {
+	return s.service.Saturated()
+}
+
 // Get retrieves a single project.
 func (s *RepoService) Get() (*Project, error) {
-	jsonURL := s.service.addr
+	jsonURL := s.service.apiAddr
 	jsonURL.Path = path.Join(jsonURL.Path, s.Name)
 	jsonURL.RawQuery = "format=JSON"
 
@@ -252,14 +562,41 @@ func (s *RepoService) Get() (*Project, error) {
 
 // GetBlob fetches a blob.
 func (s *RepoService) GetBlob(branch, filename string) ([]byte, error) {
-	blobURL := s.service.addr
+	rd, err := s.GetBlobStream(branch, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// GetBlobStream is like GetBlob, but returns a reader for the
+// contents, so large blobs need not be held in memory. The caller
+// must close it.
+func (s *RepoService) GetBlobStream(branch, filename string) (io.ReadCloser, error) {
+	blobURL := s.service.apiAddr
 
 	blobURL.Path = path.Join(blobURL.Path, s.Name, "+show", branch, filename)
 	blobURL.RawQuery = "format=TEXT"
 
 	// TODO(hanwen): invent a more structured mechanism for logging.
 	log.Println(blobURL.String())
-	return s.service.get(&blobURL)
+	resp, err := s.service.stream(&blobURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Content-Type") == "text/plain; charset=UTF-8" {
+		return &readCloser{
+			Reader: base64.NewDecoder(base64.StdEncoding, resp.Body),
+			Closer: resp.Body,
+		}, nil
+	}
+	return resp.Body, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
 
 // Archive formats for +archive. JGit also supports some shorthands.
@@ -281,7 +618,7 @@ const (
 // tar archive. revision is a git revision, either a branch/tag name
 // ("master") or a hex commit SHA1.
 func (s *RepoService) GetArchive(revision, dirPrefix, format string) (io.ReadCloser, error) {
-	u := s.service.addr
+	u := s.service.apiAddr
 	u.Path = path.Join(u.Path, s.Name, "+archive", revision)
 	if dirPrefix != "" {
 		u.Path = path.Join(u.Path, dirPrefix)
@@ -298,7 +635,7 @@ func (s *RepoService) GetArchive(revision, dirPrefix, format string) (io.ReadClo
 // blob. If recursive is given, the server recursively expands the
 // tree.
 func (s *RepoService) GetTree(branch, dir string, recursive bool) (*Tree, error) {
-	jsonURL := s.service.addr
+	jsonURL := s.service.apiAddr
 	jsonURL.Path = path.Join(jsonURL.Path, s.Name, "+", branch, dir)
 	if !strings.HasSuffix(jsonURL.Path, "/") {
 		jsonURL.Path += "/"
@@ -310,13 +647,18 @@ func (s *RepoService) GetTree(branch, dir string, recursive bool) (*Tree, error)
 	}
 
 	var tree Tree
-	err := s.service.getJSON(&jsonURL, &tree)
-	return &tree, err
+	if err := s.service.getUncachedJSON(&jsonURL, &tree); err != nil {
+		return nil, err
+	}
+	if err := tree.Check(); err != nil {
+		return nil, err
+	}
+	return &tree, nil
 }
 
 // GetCommit gets the data of a commit in a branch.
 func (s *RepoService) GetCommit(branch string) (*Commit, error) {
-	jsonURL := s.service.addr
+	jsonURL := s.service.apiAddr
 	jsonURL.Path = path.Join(jsonURL.Path, s.Name, "+", branch)
 	jsonURL.RawQuery = "format=JSON"
 
@@ -325,6 +667,68 @@ func (s *RepoService) GetCommit(branch string) (*Commit, error) {
 	return &c, err
 }
 
+// LogPage fetches a single page of the history of the given
+// revision. If filename is non-empty, only commits touching it are
+// returned. The start argument should be empty for the first page, and
+// the Next field of the previous page otherwise. If n is positive, the
+// page holds at most n commits; otherwise Gitiles picks the size.
+func (s *RepoService) LogPage(revision, filename, start string, n int) (*Log, error) {
+	jsonURL := s.service.apiAddr
+	jsonURL.Path = path.Join(jsonURL.Path, s.Name, "+log", revision, filename)
+	jsonURL.RawQuery = "format=JSON"
+	if n > 0 {
+		jsonURL.RawQuery += fmt.Sprintf("&n=%d", n)
+	}
+	if start != "" {
+		jsonURL.RawQuery += "&s=" + url.QueryEscape(start)
+	}
+
+	var l Log
+	err := s.service.getJSON(&jsonURL, &l)
+	return &l, err
+}
+
+// Log returns up to limit commits from the history of the given
+// revision, restricted to commits touching filename if it is
+// non-empty. If limit is 0, the entire history is returned.
+func (s *RepoService) Log(revision, filename string, limit int) ([]Commit, error) {
+	var result []Commit
+	start := ""
+	for {
+		n := 0
+		if limit > 0 {
+			n = limit - len(result)
+		}
+		page, err := s.LogPage(revision, filename, start, n)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, page.Log...)
+		if limit > 0 && len(result) >= limit {
+			return result[:limit], nil
+		}
+		if page.Next == "" {
+			return result, nil
+		}
+		start = page.Next
+	}
+}
+
+// GetPatch returns the changes that revision makes to its first
+// parent, as a text diff in the format of git diff.
+func (s *RepoService) GetPatch(revision string) ([]byte, error) {
+	patchURL := s.service.apiAddr
+	patchURL.Path = path.Join(patchURL.Path, s.Name, "+", revision+"^!") + "/"
+	patchURL.RawQuery = "format=TEXT"
+
+	resp, err := s.service.stream(&patchURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, resp.Body))
+}
+
 // Options for Describe.
 const (
 	// Return a ref that contains said commmit
@@ -344,7 +748,7 @@ const (
 // is visible to the caller. Currently, only the 'contains' flavor is
 // implemented, so options must always include 'contains'.
 func (s *RepoService) Describe(revision string, options ...string) (string, error) {
-	jsonURL := s.service.addr
+	jsonURL := s.service.apiAddr
 	jsonURL.Path = path.Join(jsonURL.Path, s.Name, "+describe", revision)
 	jsonURL.RawQuery = "format=JSON&" + strings.Join(options, "&")
 
@@ -368,7 +772,7 @@ func (s *RepoService) Describe(revision string, options ...string) (string, erro
 // Refs returns the refs of a repository, optionally filtered by prefix.
 func (s *RepoService) Refs(prefix string) (map[string]*RefData, error) {
 
-	jsonURL := s.service.addr
+	jsonURL := s.service.apiAddr
 	jsonURL.Path = path.Join(jsonURL.Path, s.Name, "+refs")
 	if prefix != "" {
 		jsonURL.Path = path.Join(jsonURL.Path, prefix)
@@ -0,0 +1,405 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitiles
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			w.Write([]byte("please log in"))
+		case "/private/+/master":
+			http.Redirect(w, r, "/login", http.StatusFound)
+		case "/busy/+/master":
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	service, err := NewService(Options{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+
+	for _, tc := range []struct {
+		repo                        string
+		notFound, unauth, temporary bool
+	}{
+		{repo: "missing", notFound: true},
+		{repo: "private", unauth: true},
+		{repo: "busy", temporary: true},
+	} {
+		_, err := service.NewRepoService(tc.repo).GetCommit("master")
+		httpErr, ok := err.(*HTTPError)
+		if !ok {
+			t.Errorf("%s: got error %v (%T), want *HTTPError", tc.repo, err, err)
+			continue
+		}
+		if got := httpErr.NotFound(); got != tc.notFound {
+			t.Errorf("%s: NotFound: got %v, want %v", tc.repo, got, tc.notFound)
+		}
+		if got := httpErr.Unauthorized(); got != tc.unauth {
+			t.Errorf("%s: Unauthorized: got %v, want %v", tc.repo, got, tc.unauth)
+		}
+		if got := httpErr.Temporary(); got != tc.temporary {
+			t.Errorf("%s: Temporary: got %v, want %v", tc.repo, got, tc.temporary)
+		}
+	}
+}
+
+func TestLogPagination(t *testing.T) {
+	pages := map[string]string{
+		"": `)]}'
+{"log": [{"commit": "c3"}, {"commit": "c2"}], "next": "c1"}`,
+		"c1": `)]}'
+{"log": [{"commit": "c1"}]}`,
+	}
+	var n string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/+log/master/dir/file" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		n = r.URL.Query().Get("n")
+		w.Write([]byte(pages[r.URL.Query().Get("s")]))
+	}))
+	defer ts.Close()
+
+	service, err := NewService(Options{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	repo := service.NewRepoService("repo")
+
+	commits, err := repo.Log("master", "dir/file", 0)
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	var got []string
+	for _, c := range commits {
+		got = append(got, c.Commit)
+	}
+	if want := []string{"c3", "c2", "c1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	commits, err = repo.Log("master", "dir/file", 1)
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if len(commits) != 1 || commits[0].Commit != "c3" {
+		t.Errorf("got %v, want just c3", commits)
+	}
+	if n != "1" {
+		t.Errorf("got n=%q, want 1", n)
+	}
+}
+
+func TestGetPatch(t *testing.T) {
+	patch := "diff --git a/file b/file\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/+/abc^!/" || r.URL.Query().Get("format") != "TEXT" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte(patch))))
+	}))
+	defer ts.Close()
+
+	service, err := NewService(Options{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	got, err := service.NewRepoService("repo").GetPatch("abc")
+	if err != nil {
+		t.Fatalf("GetPatch: %v", err)
+	}
+	if string(got) != patch {
+		t.Errorf("got %q, want %q", got, patch)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	names := []string{"a/1", "a/2", "a/3", "b/1", "c"}
+	requests := 0
+	paging := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		q := r.URL.Query()
+		page := names
+		if paging {
+			var matching []string
+			for _, nm := range names {
+				if strings.HasPrefix(nm, q.Get("p")) {
+					matching = append(matching, nm)
+				}
+			}
+			start, _ := strconv.Atoi(q.Get("s"))
+			n, _ := strconv.Atoi(q.Get("n"))
+			page = matching[start:]
+			if n < len(page) {
+				page = page[:n]
+			}
+		}
+		var entries []string
+		for _, nm := range page {
+			entries = append(entries, fmt.Sprintf("%q: {\"name\": %q}", nm, nm))
+		}
+		fmt.Fprintf(w, ")]}'\n{%s}", strings.Join(entries, ","))
+	}))
+	defer ts.Close()
+
+	service, err := NewService(Options{Address: ts.URL, ListPageSize: 2})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+
+	keys := func(m map[string]*Project) []string {
+		var r []string
+		for k := range m {
+			r = append(r, k)
+		}
+		sort.Strings(r)
+		return r
+	}
+
+	projects, err := service.List(nil)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if got := keys(projects); !reflect.DeepEqual(got, names) {
+		t.Errorf("got %v, want %v", got, names)
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+
+	projects, err = service.ListProjects(ListOptions{Prefix: "a/"})
+	if err != nil {
+		t.Fatalf("ListProjects: %v", err)
+	}
+	if got, want := keys(projects), names[:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A server that ignores n, s and p.
+	paging = false
+	requests = 0
+	projects, err = service.ListProjects(ListOptions{Prefix: "a/"})
+	if err != nil {
+		t.Fatalf("ListProjects: %v", err)
+	}
+	if got, want := keys(projects), names[:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+}
+
+func TestGetBlobStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/+show/master/file" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("hello world\n"))))
+	}))
+	defer ts.Close()
+
+	service, err := NewService(Options{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	rd, err := service.NewRepoService("repo").GetBlobStream("master", "file")
+	if err != nil {
+		t.Fatalf("GetBlobStream: %v", err)
+	}
+	defer rd.Close()
+	content, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := string(content), "hello world\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPathPrefixExtraParams(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a/repo/+/master" || r.URL.Query().Get("x") != "1" || r.Header.Get("X-Test") != "y" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`)]}'
+{"commit": "c1"}`))
+	}))
+	defer ts.Close()
+
+	service, err := NewService(Options{
+		Address:     ts.URL,
+		PathPrefix:  "/a",
+		ExtraQuery:  url.Values{"x": {"1"}},
+		ExtraHeader: http.Header{"X-Test": {"y"}},
+	})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	if got := service.Addr(); got != ts.URL {
+		t.Errorf("Addr: got %q, want %q", got, ts.URL)
+	}
+	commit, err := service.NewRepoService("repo").GetCommit("master")
+	if err != nil {
+		t.Fatalf("GetCommit: %v", err)
+	}
+	if commit.Commit != "c1" {
+		t.Errorf("got commit %q, want c1", commit.Commit)
+	}
+}
+
+func TestPathPrefixList(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a/" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`)]}'
+{"repo": {"name": "repo"}}`))
+	}))
+	defer ts.Close()
+
+	service, err := NewService(Options{Address: ts.URL, PathPrefix: "/a"})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	projects, err := service.List(nil)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(projects) != 1 || projects["repo"] == nil {
+		t.Errorf("got %v, want project repo", projects)
+	}
+}
+
+func TestJSONCache(t *testing.T) {
+	var requests, notModified, trees int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repo/+/master/" {
+			trees++
+			w.Write([]byte(`)]}'
+{"id": "t1", "entries": []}`))
+			return
+		}
+		if r.URL.Path != "/repo/+/master" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		requests++
+		if r.Header.Get("If-None-Match") == `"c1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"c1"`)
+		w.Write([]byte(`)]}'
+{"commit": "c1"}`))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := Options{Address: ts.URL, JSONCacheDir: dir, JSONCacheTTL: time.Hour}
+	service, err := NewService(opts)
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if c, err := service.NewRepoService("repo").GetCommit("master"); err != nil || c.Commit != "c1" {
+			t.Fatalf("GetCommit: %v, %v", c, err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+
+	// Trees are kept by the TreeCache, and not stored again.
+	for i := 0; i < 2; i++ {
+		if _, err := service.NewRepoService("repo").GetTree("master", "", true); err != nil {
+			t.Fatalf("GetTree: %v", err)
+		}
+	}
+	if trees != 2 {
+		t.Errorf("got %d tree requests, want 2", trees)
+	}
+
+	// A new service, as for the next mount, revalidates stale
+	// responses.
+	opts.JSONCacheTTL = 0
+	service, err = NewService(opts)
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	if c, err := service.NewRepoService("repo").GetCommit("master"); err != nil || c.Commit != "c1" {
+		t.Fatalf("GetCommit: %v, %v", c, err)
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("got %d requests, %d not modified; want 2, 1", requests, notModified)
+	}
+
+	if _, err := service.NewRepoService("repo").GetCommit("missing"); err == nil {
+		t.Errorf("GetCommit(missing) succeeded")
+	}
+
+	// Offline, stale responses are used, and nothing else is
+	// fetched.
+	opts.Offline = true
+	service, err = NewService(opts)
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+	before := requests
+	if c, err := service.NewRepoService("repo").GetCommit("master"); err != nil || c.Commit != "c1" {
+		t.Fatalf("GetCommit offline: %v, %v", c, err)
+	}
+	if _, err := service.NewRepoService("repo").GetTree("master", "", true); err == nil {
+		t.Errorf("GetTree offline succeeded")
+	}
+	if requests != before {
+		t.Errorf("got %d requests offline", requests-before)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitiles
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// maxErrorBody is the number of bytes of the response body that we
+// keep in an HTTPError.
+const maxErrorBody = 512
+
+// HTTPError is returned when Gitiles answers a request with an
+// unexpected response.
+type HTTPError struct {
+	// URL is the URL that was requested.
+	URL string
+
+	// StatusCode and Status are taken from the HTTP response.
+	StatusCode int
+	Status     string
+
+	// RedirectURL is set if we were redirected to a different
+	// page, typically a login page.
+	RedirectURL string
+
+	// Body holds the start of the response body.
+	Body string
+}
+
+func newHTTPError(u *url.URL, resp *http.Response) *HTTPError {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &HTTPError{
+		URL:        u.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(body),
+	}
+}
+
+func (e *HTTPError) Error() string {
+	if e.RedirectURL != "" {
+		return fmt.Sprintf("got URL %s, want %s", e.RedirectURL, e.URL)
+	}
+	return fmt.Sprintf("%s: %s", e.URL, e.Status)
+}
+
+// NotFound returns true if the requested object does not exist.
+func (e *HTTPError) NotFound() bool {
+	return e.RedirectURL == "" && e.StatusCode == http.StatusNotFound
+}
+
+// Unauthorized returns true if the request was refused for lack of
+// credentials, including redirects to a login page.
+func (e *HTTPError) Unauthorized() bool {
+	return e.RedirectURL != "" ||
+		e.StatusCode == http.StatusUnauthorized ||
+		e.StatusCode == http.StatusForbidden
+}
+
+// Temporary returns true if the request may succeed when retried
+// later, eg. because we are being rate limited.
+func (e *HTTPError) Temporary() bool {
+	return e.RedirectURL == "" &&
+		(e.StatusCode == http.StatusTooManyRequests ||
+			e.StatusCode == http.StatusServiceUnavailable ||
+			e.StatusCode == http.StatusGatewayTimeout)
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitiles
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// jsonCache stores responses of JSON endpoints on disk, so repeated
+// mounts of the same branch don't fetch the same commits and refs
+// again. It is meant for small responses only; nothing is evicted.
+type jsonCache struct {
+	dir string
+
+	// Responses younger than ttl are used without asking the
+	// server. Older ones are revalidated with their ETag.
+	ttl time.Duration
+}
+
+// cachedResponse is a response stored in the jsonCache.
+type cachedResponse struct {
+	URL  string
+	ETag string `json:",omitempty"`
+	Time time.Time
+	Body []byte
+}
+
+func (c *jsonCache) path(u string) string {
+	h := sha1.Sum([]byte(u))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:]))
+}
+
+// get returns the cached response for u, or nil.
+func (c *jsonCache) get(u string) *cachedResponse {
+	content, err := ioutil.ReadFile(c.path(u))
+	if err != nil {
+		return nil
+	}
+	var r cachedResponse
+	if err := json.Unmarshal(content, &r); err != nil || r.URL != u {
+		return nil
+	}
+	return &r
+}
+
+// fresh returns whether r can be used without asking the server.
+func (c *jsonCache) fresh(r *cachedResponse) bool {
+	return time.Since(r.Time) < c.ttl
+}
+
+// put stores a response. Failures are logged, as the cache is only an
+// optimization.
+func (c *jsonCache) put(r *cachedResponse) {
+	content, err := json.Marshal(r)
+	if err == nil {
+		err = c.write(c.path(r.URL), content)
+	}
+	if err != nil {
+		log.Printf("jsonCache.put(%s): %v", r.URL, err)
+	}
+}
+
+func (c *jsonCache) write(p string, content []byte) error {
+	f, err := ioutil.TempFile(c.dir, "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitiles
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// tlsConfig returns the TLS configuration for the TLS options, or nil
+// if none are set.
+func (o *Options) tlsConfig() (*tls.Config, error) {
+	if o.TLSCert == "" && o.TLSKey == "" && o.TLSCA == "" && !o.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: o.TLSInsecureSkipVerify,
+	}
+	if o.TLSCert != "" || o.TLSKey != "" {
+		if o.TLSCert == "" || o.TLSKey == "" {
+			return nil, fmt.Errorf("TLS client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("LoadX509KeyPair(%s, %s): %v", o.TLSCert, o.TLSKey, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if o.TLSCA != "" {
+		content, err := ioutil.ReadFile(o.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", o.TLSCA)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// setTLS makes client use the TLS options. If the client has a
+// transport, it must be an *http.Transport; it is copied rather than
+// changed.
+func (o *Options) setTLS(client *http.Client) error {
+	cfg, err := o.tlsConfig()
+	if err != nil || cfg == nil {
+		return err
+	}
+
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return fmt.Errorf("TLS options need an *http.Transport, got %T", t)
+	}
+	transport.TLSClientConfig = cfg
+	client.Transport = transport
+	return nil
+}
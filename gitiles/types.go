@@ -16,7 +16,10 @@ package gitiles
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
+	"strings"
+	"time"
 )
 
 // Project describes a repository
@@ -36,6 +39,14 @@ type Person struct {
 	Time string
 }
 
+// timeLayout is the format of Person.Time.
+const timeLayout = "Mon Jan _2 15:04:05 2006 -0700"
+
+// ParseTime returns Time as a time.Time.
+func (p *Person) ParseTime() (time.Time, error) {
+	return time.Parse(timeLayout, p.Time)
+}
+
 // DiffEntry describes a file difference.
 type DiffEntry struct {
 	Type    string
@@ -118,6 +129,44 @@ func (t *Tree) String() string {
 
 }
 
+// Check returns an error if the tree can't be served as a file
+// system, eg. because entries have malformed IDs or names that
+// escape the tree.
+func (t *Tree) Check() error {
+	for _, e := range t.Entries {
+		if err := e.check(); err != nil {
+			return fmt.Errorf("tree %s: entry %q: %v", t.ID, e.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *TreeEntry) check() error {
+	switch e.Type {
+	case "blob", "tree", "commit":
+	default:
+		return fmt.Errorf("unknown type %q", e.Type)
+	}
+	if b, err := hex.DecodeString(e.ID); err != nil || len(b) != 20 {
+		return fmt.Errorf("malformed ID %q", e.ID)
+	}
+	if e.Mode < 0 || e.Mode > 0177777 {
+		return fmt.Errorf("malformed mode %o", e.Mode)
+	}
+	if e.Size != nil && *e.Size < 0 {
+		return fmt.Errorf("negative size %d", *e.Size)
+	}
+	if e.Name == "" {
+		return fmt.Errorf("empty name")
+	}
+	for _, c := range strings.Split(e.Name, "/") {
+		if c == "" || c == "." || c == ".." || strings.IndexByte(c, 0) >= 0 {
+			return fmt.Errorf("invalid name")
+		}
+	}
+	return nil
+}
+
 // A git reference
 type RefData struct {
 	// The value to which a reference points.
@@ -16,7 +16,9 @@ package gitiles
 
 import (
 	"encoding/json"
+	"path"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -269,3 +271,46 @@ func TestTypes(t *testing.T) {
 		}
 	}
 }
+
+func TestTreeCheck(t *testing.T) {
+	const id = "582b4959fa1f8e90330027291c612b1cebc4447c"
+	for _, c := range []struct {
+		entry TreeEntry
+		ok    bool
+	}{
+		{TreeEntry{Mode: 0100644, Type: "blob", ID: id, Name: "dir/file"}, true},
+		{TreeEntry{Mode: 0160000, Type: "commit", ID: id, Name: "sub"}, true},
+		{TreeEntry{Mode: 0100644, Type: "tag", ID: id, Name: "file"}, false},
+		{TreeEntry{Mode: 0100644, Type: "blob", ID: "123", Name: "file"}, false},
+		{TreeEntry{Mode: 0100644, Type: "blob", ID: id, Name: ""}, false},
+		{TreeEntry{Mode: 0100644, Type: "blob", ID: id, Name: "/etc/passwd"}, false},
+		{TreeEntry{Mode: 0100644, Type: "blob", ID: id, Name: "dir/../../x"}, false},
+		{TreeEntry{Mode: 0100644, Type: "blob", ID: id, Name: "dir//x"}, false},
+		{TreeEntry{Mode: -1, Type: "blob", ID: id, Name: "file"}, false},
+	} {
+		tree := &Tree{Entries: []TreeEntry{c.entry}}
+		if err := tree.Check(); (err == nil) != c.ok {
+			t.Errorf("Check(%v): got %v, want ok=%v", &c.entry, err, c.ok)
+		}
+	}
+}
+
+func FuzzTree(f *testing.F) {
+	f.Add([]byte(`{"id": "0d1df06d6de43086af19990f85b7b7c01799f984", "entries": [{"mode": 33188, "type": "blob", "id": "582b4959fa1f8e90330027291c612b1cebc4447c", "name": "index.html", "size": 3}]}`))
+	f.Add([]byte(`{"entries": [{"mode": 40960, "type": "blob", "id": "582b4959fa1f8e90330027291c612b1cebc4447c", "name": "a/b", "target": "../c"}]}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var tree Tree
+		if err := json.Unmarshal(data, &tree); err != nil {
+			return
+		}
+		if err := tree.Check(); err != nil {
+			return
+		}
+		_ = tree.String()
+		for _, e := range tree.Entries {
+			if path.Clean(e.Name) != e.Name || strings.HasPrefix(e.Name, "/") || strings.HasPrefix(e.Name, "..") {
+				t.Errorf("Check accepted name %q", e.Name)
+			}
+		}
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import "sort"
+
+// ProjectChange describes a project whose revision differs between
+// two manifests.
+type ProjectChange struct {
+	Name        string
+	Path        string
+	OldRevision string
+	NewRevision string
+}
+
+// ManifestDiff lists the differences between two manifests. Projects
+// are matched by their path in the checkout.
+type ManifestDiff struct {
+	Added   []Project
+	Removed []Project
+	Changed []ProjectChange
+}
+
+// Empty returns true if the manifests have the same projects at the
+// same revisions.
+func (d *ManifestDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff compares the projects of manifest a to those of manifest b.
+// A project whose name changed at the same path is reported as
+// removed and added. The results are sorted by path.
+func Diff(a, b *Manifest) *ManifestDiff {
+	byPath := func(m *Manifest) map[string]*Project {
+		r := map[string]*Project{}
+		for i := range m.Project {
+			p := &m.Project[i]
+			r[p.GetPath()] = p
+		}
+		return r
+	}
+	before := byPath(a)
+	after := byPath(b)
+
+	d := &ManifestDiff{}
+	for path, op := range before {
+		np, ok := after[path]
+		if !ok || np.Name != op.Name {
+			d.Removed = append(d.Removed, *op)
+			continue
+		}
+		oldRev := a.ProjectRevision(op)
+		newRev := b.ProjectRevision(np)
+		if oldRev != newRev {
+			d.Changed = append(d.Changed, ProjectChange{
+				Name:        np.Name,
+				Path:        path,
+				OldRevision: oldRev,
+				NewRevision: newRev,
+			})
+		}
+	}
+	for path, np := range after {
+		if op, ok := before[path]; !ok || np.Name != op.Name {
+			d.Added = append(d.Added, *np)
+		}
+	}
+
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].GetPath() < d.Added[j].GetPath() })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].GetPath() < d.Removed[j].GetPath() })
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Path < d.Changed[j].Path })
+	return d
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	a := &Manifest{
+		Default: Default{Revision: "master"},
+		Project: []Project{
+			{Name: "platform/build", Path: newString("build")},
+			{Name: "platform/art", Path: newString("art"), Revision: "r1"},
+			{Name: "platform/old", Path: newString("old")},
+			{Name: "platform/renamed", Path: newString("moved")},
+		},
+	}
+	b := &Manifest{
+		Default: Default{Revision: "master"},
+		Project: []Project{
+			{Name: "platform/build", Path: newString("build"), Revision: "master"},
+			{Name: "platform/art", Path: newString("art"), Revision: "r2"},
+			{Name: "platform/new", Path: newString("new")},
+			{Name: "platform/other", Path: newString("moved")},
+		},
+	}
+
+	d := Diff(a, b)
+	if d.Empty() {
+		t.Fatalf("Diff is empty")
+	}
+	if len(d.Changed) != 1 || d.Changed[0] != (ProjectChange{
+		Name: "platform/art", Path: "art", OldRevision: "r1", NewRevision: "r2"}) {
+		t.Errorf("got changed %v", d.Changed)
+	}
+
+	var added, removed []string
+	for _, p := range d.Added {
+		added = append(added, p.Name)
+	}
+	for _, p := range d.Removed {
+		removed = append(removed, p.Name)
+	}
+	if len(added) != 2 || added[0] != "platform/other" || added[1] != "platform/new" {
+		t.Errorf("got added %v, want [platform/other platform/new]", added)
+	}
+	if len(removed) != 2 || removed[0] != "platform/renamed" || removed[1] != "platform/old" {
+		t.Errorf("got removed %v, want [platform/renamed platform/old]", removed)
+	}
+
+	if d := Diff(a, a); !d.Empty() {
+		t.Errorf("Diff(a, a) = %v, want empty", d)
+	}
+}
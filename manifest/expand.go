@@ -0,0 +1,76 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+var varRE = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ReadVars reads a JSON object mapping variable names to values, for
+// use with Expand.
+func ReadVars(contents []byte) (map[string]string, error) {
+	vars := map[string]string{}
+	if err := json.Unmarshal(contents, &vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// Expand replaces ${NAME} in the revisions, names, paths and URLs of
+// the remotes, default and projects with the value returned by
+// lookup, so one manifest can serve several sites. It is an error
+// to use a variable for which lookup returns false.
+func (mf *Manifest) Expand(lookup func(name string) (string, bool)) error {
+	var err error
+	expand := func(where string, s *string) {
+		*s = varRE.ReplaceAllStringFunc(*s, func(v string) string {
+			name := varRE.FindStringSubmatch(v)[1]
+			val, ok := lookup(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("%s: undefined variable ${%s}", where, name)
+			}
+			return val
+		})
+	}
+
+	d := &mf.Default
+	for _, s := range []*string{&d.Revision, &d.Remote, &d.DestBranch} {
+		expand("default", s)
+	}
+	for i := range mf.Remote {
+		r := &mf.Remote[i]
+		where := "remote " + r.Name
+		for _, s := range []*string{&r.Name, &r.Fetch, &r.Review, &r.Revision} {
+			expand(where, s)
+		}
+	}
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		where := "project " + p.Name
+		for _, s := range []*string{&p.Name, &p.Remote, &p.Revision, &p.DestBranch, &p.Upstream, &p.CloneURL} {
+			expand(where, s)
+		}
+		if p.Path != nil {
+			path := *p.Path
+			expand(where, &path)
+			p.Path = &path
+		}
+	}
+	return err
+}
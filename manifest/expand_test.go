@@ -0,0 +1,62 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	mf, err := Parse([]byte(`<manifest>
+  <remote name="site" fetch="https://${MIRROR}/" />
+  <default revision="${BRANCH}" remote="site" />
+  <project path="build" name="platform/build" />
+  <project name="platform/art" revision="${BRANCH}-art" />
+</manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	vars, err := ReadVars([]byte(`{"MIRROR": "mirror.corp", "BRANCH": "release"}`))
+	if err != nil {
+		t.Fatalf("ReadVars: %v", err)
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	if err := mf.Expand(lookup); err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+
+	if got, want := mf.Remote[0].Fetch, "https://mirror.corp/"; got != want {
+		t.Errorf("Fetch: got %q, want %q", got, want)
+	}
+	if got, want := mf.Default.Revision, "release"; got != want {
+		t.Errorf("default revision: got %q, want %q", got, want)
+	}
+	if got, want := mf.ProjectRevision(&mf.Project[1]), "release-art"; got != want {
+		t.Errorf("art revision: got %q, want %q", got, want)
+	}
+	if got, want := mf.Project[0].GetPath(), "build"; got != want {
+		t.Errorf("GetPath: got %q, want %q", got, want)
+	}
+
+	mf, err = Parse([]byte(`<manifest><project name="p" revision="${UNSET}" /></manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := mf.Expand(lookup); err == nil {
+		t.Errorf("Expand succeeded with undefined variable")
+	}
+}
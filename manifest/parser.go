@@ -15,8 +15,13 @@
 package manifest
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"regexp"
 	"sort"
 	"strings"
 )
@@ -45,8 +50,15 @@ func (p *Project) prepare() {
 	p.GroupsString = strings.Join(keys, ",")
 }
 
+// MaxSize is the largest manifest that Parse accepts.
+const MaxSize = 16 << 20
+
 // Parse parses the given XML data.
 func Parse(contents []byte) (*Manifest, error) {
+	if len(contents) > MaxSize {
+		return nil, fmt.Errorf("manifest is larger than %d bytes", MaxSize)
+	}
+
 	var m Manifest
 	if err := xml.Unmarshal(contents, &m); err != nil {
 		return nil, err
@@ -63,6 +75,7 @@ func (m *Manifest) MarshalXML() ([]byte, error) {
 	for i := range m.Project {
 		m.Project[i].prepare()
 	}
+	m.XMLName = xml.Name{Local: "manifest"}
 
 	content, err := xml.MarshalIndent(m, "", " ")
 	if err != nil {
@@ -88,6 +101,24 @@ func (mf *Manifest) ProjectRevision(p *Project) string {
 	return mf.Default.Revision
 }
 
+// Fingerprint returns a hex SHA-256 over the path and revision of all
+// projects. It does not depend on the order of the projects, and can
+// serve as a cache key for builds of the workspace.
+func (mf *Manifest) Fingerprint() string {
+	var lines []string
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		lines = append(lines, p.GetPath()+"\x00"+mf.ProjectRevision(p)+"\n")
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, l := range lines {
+		io.WriteString(h, l)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // Filter removes all notdefault projects from a manifest.
 func (mf *Manifest) Filter() {
 	filtered := *mf
@@ -100,3 +131,20 @@ func (mf *Manifest) Filter() {
 	}
 	*mf = filtered
 }
+
+// FilterPaths removes the projects whose path does not match
+// include, or matches exclude. Nil regexps are ignored.
+func (mf *Manifest) FilterPaths(include, exclude *regexp.Regexp) {
+	var kept []Project
+	for _, p := range mf.Project {
+		path := p.GetPath()
+		if include != nil && !include.MatchString(path) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(path) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	mf.Project = kept
+}
@@ -15,7 +15,10 @@
 package manifest
 
 import (
+	"encoding/xml"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -47,6 +50,7 @@ func TestBasic(t *testing.T) {
 	}
 
 	want := &Manifest{
+		XMLName: xml.Name{Local: "manifest"},
 		Remote: []Remote{{
 			Name:   "aosp",
 			Fetch:  "..",
@@ -116,3 +120,122 @@ func TestRoundtrip(t *testing.T) {
 		t.Errorf("got roundtrip %#v, want %#v", roundtrip, manifest)
 	}
 }
+
+var unknownContentManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<manifest>
+  <remote name="aosp" fetch=".." review="https://android-review.googlesource.com/" />
+  <default revision="master" remote="aosp" sync-j="4" />
+  <superproject name="platform/superproject" remote="aosp"/>
+  <contactinfo bugurl="go/repo-bug" />
+
+  <project path="build/make" name="platform/build" groups="pdk" some-future-attr="x">
+    <copyfile src="core/root.mk" dest="Makefile" />
+    <annotation name="team" value="build" />
+  </project>
+
+  <repo-hooks in-project="platform/tools/repohooks" enabled-list="pre-upload" />
+</manifest>`
+
+func TestRoundtripUnknownContent(t *testing.T) {
+	mf, err := Parse([]byte(unknownContentManifest))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	var names []string
+	for _, e := range mf.Extra {
+		names = append(names, e.XMLName.Local)
+	}
+	if want := []string{"superproject", "contactinfo", "repo-hooks"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got extra elements %v, want %v", names, want)
+	}
+
+	out, err := mf.MarshalXML()
+	if err != nil {
+		t.Fatalf("MarshalXML: %v", err)
+	}
+	for _, want := range []string{
+		"<manifest>",
+		`<repo-hooks in-project="platform/tools/repohooks" enabled-list="pre-upload">`,
+		`<superproject name="platform/superproject" remote="aosp">`,
+		`some-future-attr="x"`,
+		`<annotation name="team" value="build">`,
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("roundtrip output %s does not contain %q", out, want)
+		}
+	}
+
+	roundtrip, err := Parse(out)
+	if err != nil {
+		t.Fatalf("Parse(roundtrip): %v", err)
+	}
+	if !reflect.DeepEqual(roundtrip, mf) {
+		t.Errorf("got roundtrip %#v, want %#v", roundtrip, mf)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	mf, err := Parse([]byte(aospManifest))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	fp := mf.Fingerprint()
+	if len(fp) != 64 {
+		t.Fatalf("got fingerprint %q, want 64 hex digits", fp)
+	}
+
+	mf.Project[0], mf.Project[1] = mf.Project[1], mf.Project[0]
+	mf.Project[0].Copyfile = nil
+	if got := mf.Fingerprint(); got != fp {
+		t.Errorf("fingerprint changed with project order: %s, want %s", got, fp)
+	}
+
+	mf.Project[0].Revision = "f065f1478dc8bfebdc59f20fb2fc1f8da4d7c334"
+	if got := mf.Fingerprint(); got == fp {
+		t.Errorf("fingerprint did not change with revision")
+	}
+}
+
+func TestFilterPaths(t *testing.T) {
+	mf, err := Parse([]byte(aospManifest))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	mf.FilterPaths(regexp.MustCompile("^build"), regexp.MustCompile("^build/soong$"))
+	if len(mf.Project) != 1 || mf.Project[0].GetPath() != "build" {
+		t.Errorf("got %v, want only build", mf.Project)
+	}
+
+	mf.FilterPaths(nil, nil)
+	if len(mf.Project) != 1 {
+		t.Errorf("FilterPaths(nil, nil) removed projects: %v", mf.Project)
+	}
+}
+
+func TestParseTooLarge(t *testing.T) {
+	content := "<manifest>" + strings.Repeat(" ", MaxSize) + "</manifest>"
+	if _, err := Parse([]byte(content)); err == nil {
+		t.Errorf("Parse succeeded for oversized manifest")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte(aospManifest))
+	f.Add([]byte(`<manifest><include name="x.xml"/><project name="p" path="a/b" x="y"><annotation name="k" value="v"/></project></manifest>`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		mf, err := Parse(data)
+		if err != nil {
+			return
+		}
+		mf.Filter()
+		for i := range mf.Project {
+			mf.ProjectRevision(&mf.Project[i])
+			mf.Project[i].GetPath()
+		}
+		mf.Expand(func(string) (string, bool) { return "", false })
+		if _, err := mf.MarshalXML(); err != nil {
+			t.Errorf("MarshalXML: %v", err)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// ExtraRevisionElement names an element inside <project> that asks
+// for another revision of the project next to it, eg. to bisect one
+// project against an otherwise fixed tree:
+//
+//	<project name="platform/art" path="art">
+//	  <slothfs-revision revision="1234abcd..."/>
+//	</project>
+//
+// ExpandRevisions turns this into a second project at
+// "art@1234abcd...".
+const ExtraRevisionElement = "slothfs-revision"
+
+// ExtraRevisions returns the revisions asked for with
+// ExtraRevisionElement elements in p.
+func (p *Project) ExtraRevisions() []string {
+	var revs []string
+	for _, e := range p.Extra {
+		if e.XMLName.Local != ExtraRevisionElement {
+			continue
+		}
+		for _, a := range e.Attrs {
+			if a.Name.Local == "revision" {
+				revs = append(revs, a.Value)
+			}
+		}
+	}
+	return revs
+}
+
+// AddExtraRevision asks for revision rev of the project at path to be
+// served next to it, by adding an ExtraRevisionElement.
+func (mf *Manifest) AddExtraRevision(path, rev string) error {
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		if p.GetPath() != path {
+			continue
+		}
+		p.Extra = append(p.Extra, RawElement{
+			XMLName: xml.Name{Local: ExtraRevisionElement},
+			Attrs:   []xml.Attr{{Name: xml.Name{Local: "revision"}, Value: rev}},
+		})
+		return nil
+	}
+	return fmt.Errorf("no project at %q", path)
+}
+
+// ExpandRevisions adds a copy of each project for each of its extra
+// revisions, at the project's path with "@" and the revision
+// appended. The copies have no copyfile and linkfile elements, as
+// these would clash with those of the original. The
+// ExtraRevisionElement elements are removed, so expanding again is a
+// no-op.
+func (mf *Manifest) ExpandRevisions() error {
+	paths := map[string]bool{}
+	for i := range mf.Project {
+		paths[mf.Project[i].GetPath()] = true
+	}
+
+	var added []Project
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		revs := p.ExtraRevisions()
+		if len(revs) == 0 {
+			continue
+		}
+
+		var extra []RawElement
+		for _, e := range p.Extra {
+			if e.XMLName.Local != ExtraRevisionElement {
+				extra = append(extra, e)
+			}
+		}
+		p.Extra = extra
+
+		for _, rev := range revs {
+			if rev == "" || strings.Contains(rev, "/") {
+				return fmt.Errorf("project %s: revision %q can't be part of a path", p.GetPath(), rev)
+			}
+			path := p.GetPath() + "@" + rev
+			if paths[path] {
+				return fmt.Errorf("project %s: %s is already in the manifest", p.GetPath(), path)
+			}
+			paths[path] = true
+
+			c := *p
+			c.Path = &path
+			c.Revision = rev
+			c.Upstream = ""
+			c.DestBranch = ""
+			c.Copyfile = nil
+			c.Linkfile = nil
+			added = append(added, c)
+		}
+	}
+	mf.Project = append(mf.Project, added...)
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandRevisions(t *testing.T) {
+	mf, err := Parse([]byte(`<manifest>
+  <default revision="master" remote="aosp"/>
+  <project path="art" name="platform/art" upstream="master">
+    <copyfile src="a" dest="b"/>
+    <annotation name="team" value="art"/>
+    <slothfs-revision revision="1111111111111111111111111111111111111111"/>
+  </project>
+  <project path="build" name="platform/build"/>
+</manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := mf.AddExtraRevision("build", "v1"); err != nil {
+		t.Fatalf("AddExtraRevision: %v", err)
+	}
+	if err := mf.AddExtraRevision("nonexistent", "v1"); err == nil {
+		t.Error("AddExtraRevision succeeded for unknown path")
+	}
+
+	if err := mf.ExpandRevisions(); err != nil {
+		t.Fatalf("ExpandRevisions: %v", err)
+	}
+	// Expanding again changes nothing.
+	if err := mf.ExpandRevisions(); err != nil {
+		t.Fatalf("ExpandRevisions: %v", err)
+	}
+
+	got := map[string]string{}
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		got[p.GetPath()] = mf.ProjectRevision(p)
+	}
+	want := map[string]string{
+		"art": "master",
+		"art@1111111111111111111111111111111111111111": "1111111111111111111111111111111111111111",
+		"build":    "master",
+		"build@v1": "v1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	c := mf.Project[2]
+	if c.Name != "platform/art" || c.Upstream != "" || len(c.Copyfile) != 0 || len(c.Extra) != 1 || len(c.ExtraRevisions()) != 0 {
+		t.Errorf("got copy %#v", c)
+	}
+	if len(mf.Project[0].Copyfile) != 1 || len(mf.Project[0].ExtraRevisions()) != 0 {
+		t.Errorf("got original %#v", mf.Project[0])
+	}
+
+	bad := &Manifest{Project: []Project{{Name: "x"}}}
+	bad.AddExtraRevision("x", "refs/heads/x")
+	if err := bad.ExpandRevisions(); err == nil {
+		t.Error("ExpandRevisions accepted a revision with a slash")
+	}
+}
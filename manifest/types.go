@@ -16,6 +16,8 @@
 // https://gerrit.googlesource.com/git-repo/+/master/docs/manifest-format.txt.
 package manifest
 
+import "encoding/xml"
+
 // Copyfile indicates that a file should be copied in a checkout
 type Copyfile struct {
 	Src  string `xml:"src,attr"`
@@ -51,6 +53,11 @@ type Project struct {
 
 	// This is not part of the Manifest spec.
 	CloneURL string `xml:"clone-url,attr,omitempty"`
+
+	// Attributes and elements we don't know about, preserved so
+	// they survive a roundtrip.
+	ExtraAttrs []xml.Attr   `xml:",any,attr"`
+	Extra      []RawElement `xml:",any"`
 }
 
 // GetPath provides the path where to place the repository.
@@ -68,6 +75,8 @@ type Remote struct {
 	Fetch    string `xml:"fetch,attr"`
 	Review   string `xml:"review,attr"`
 	Revision string `xml:"revision,attr"`
+
+	ExtraAttrs []xml.Attr `xml:",any,attr"`
 }
 
 // Default holds default Project settings.
@@ -78,12 +87,28 @@ type Default struct {
 	SyncJ      string `xml:"sync-j,attr"`
 	SyncC      string `xml:"sync-c,attr"`
 	SyncS      string `xml:"sync-s,attr"`
+
+	ExtraAttrs []xml.Attr `xml:",any,attr"`
+}
+
+// RawElement holds an XML element verbatim, eg. <repo-hooks> or
+// <superproject>, which this package does not interpret.
+type RawElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
 }
 
 // Manifest holds the entire manifest, describing a set of git
 // projects to be stitched together
 type Manifest struct {
+	// Older versions of this package wrote <Manifest>, so we
+	// accept any name when parsing.
+	XMLName xml.Name
+
 	Default Default   `xml:"default"`
 	Remote  []Remote  `xml:"remote"`
 	Project []Project `xml:"project"`
+
+	Extra []RawElement `xml:",any"`
 }
@@ -16,8 +16,13 @@ package populate
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
 
@@ -65,8 +70,15 @@ func FetchManifest(service *gitiles.Service, repo, branch string) (*manifest.Man
 }
 
 // DerefManifest uses the Gitiles JSON interface to fill in
-// Project.Revision and Project.CloneURL in the given manifest.
+// Project.Revision and Project.CloneURL in the given manifest. Extra
+// revisions of projects are expanded into projects of their own
+// first. The clone URLs are those of the host; URL rewrites are left
+// to the git cache of the mount, which does the cloning.
 func DerefManifest(service *gitiles.Service, mf *manifest.Manifest) error {
+	if err := mf.ExpandRevisions(); err != nil {
+		return err
+	}
+
 	// Collect all branch names we might care about, so we can
 	// request data from all branches in one JSON call.  Normally,
 	// all projects use the same branch, but individual projects
@@ -96,25 +108,216 @@ func DerefManifest(service *gitiles.Service, mf *manifest.Manifest) error {
 
 	repos, err := service.List(branches)
 	if err != nil {
-		return err
+		log.Printf("List: %v; resolving projects one by one", err)
+		repos = nil
 	}
+
+	var missing []int
 	for _, i := range todoProjects {
 		p := &mf.Project[i]
 
 		proj, ok := repos[p.Name]
 		if !ok {
-			return fmt.Errorf("server list doesn't mention repo %s", p.Name)
+			missing = append(missing, i)
+			continue
 		}
 
-		p.CloneURL = proj.CloneURL
-
 		branch := mf.ProjectRevision(p)
 		commit, ok := proj.Branches[branch]
 		if !ok {
-			return fmt.Errorf("branch %q for repo %s not returned", branch, p.Name)
+			missing = append(missing, i)
+			continue
 		}
 
+		p.CloneURL = proj.CloneURL
 		p.Revision = commit
 	}
+
+	return derefProjects(service, mf, missing)
+}
+
+// derefParallelism bounds the number of concurrent requests in
+// derefProjects.
+const derefParallelism = 16
+
+// derefRetries is the number of attempts for resolving a project.
+const derefRetries = 3
+
+// derefBackoff is the wait before the first retry. It doubles for
+// each further attempt.
+var derefBackoff = time.Second
+
+// getCommitRetry is GetCommit, retried for errors that may be
+// transient.
+func getCommitRetry(repo *gitiles.RepoService, branch string) (*gitiles.Commit, error) {
+	backoff := derefBackoff
+	for attempt := 1; ; attempt++ {
+		commit, err := repo.GetCommit(branch)
+		if err == nil {
+			return commit, nil
+		}
+		var httpErr *gitiles.HTTPError
+		if attempt == derefRetries || (errors.As(err, &httpErr) && !httpErr.Temporary()) {
+			return nil, err
+		}
+		log.Printf("GetCommit(%s, %s): %v; retrying", repo.Name, branch, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// derefProgress logs how many projects were resolved, at most every
+// few seconds.
+type derefProgress struct {
+	mu      sync.Mutex
+	total   int
+	done    int
+	start   time.Time
+	lastLog time.Time
+}
+
+func (p *derefProgress) inc() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	now := time.Now()
+	if p.done == p.total || now.Sub(p.lastLog) < 2*time.Second {
+		return
+	}
+	p.lastLog = now
+	elapsed := now.Sub(p.start)
+	eta := time.Duration(float64(elapsed) / float64(p.done) * float64(p.total-p.done))
+	log.Printf("resolved %d of %d projects, ETA %v", p.done, p.total, eta.Round(time.Second))
+}
+
+// derefProjects resolves the revisions of the given projects with
+// one request per project. This is slower than a List call, but
+// works for projects or branches that the listing omits. The
+// requests run concurrently, subject to the service's rate limit,
+// and transient failures are retried.
+func derefProjects(service *gitiles.Service, mf *manifest.Manifest, todo []int) error {
+	now := time.Now()
+	progress := &derefProgress{total: len(todo), start: now, lastLog: now}
+	sem := make(chan struct{}, derefParallelism)
+	errs := make(chan error, len(todo))
+	for _, i := range todo {
+		go func(p *manifest.Project) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			defer progress.inc()
+
+			branch := mf.ProjectRevision(p)
+			commit, err := getCommitRetry(service.NewRepoService(p.Name), branch)
+			if err != nil {
+				errs <- fmt.Errorf("project %s, branch %q: %v", p.Name, branch, err)
+				return
+			}
+
+			if p.CloneURL == "" {
+				p.CloneURL = strings.TrimSuffix(service.Addr(), "/") + "/" + p.Name
+			}
+			p.Revision = commit.Commit
+			errs <- nil
+		}(&mf.Project[i])
+	}
+
+	var msgs []string
+	for range todo {
+		if err := <-errs; err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		sort.Strings(msgs)
+		return fmt.Errorf("could not resolve %d projects: %s", len(msgs), strings.Join(msgs, "; "))
+	}
 	return nil
 }
+
+// RecordUpstream sets Project.Upstream to the branch of each project
+// that tracks one, like "repo manifest -r", so CheckDrift knows the
+// branches after DerefManifest pinned the revisions.
+func RecordUpstream(mf *manifest.Manifest) {
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		if rev := mf.ProjectRevision(p); p.Upstream == "" && rev != "" {
+			if _, err := parseID(rev); err != nil {
+				p.Upstream = rev
+			}
+		}
+	}
+}
+
+// Drift describes a project whose pinned revision differs from the
+// head of its upstream branch.
+type Drift struct {
+	Name     string
+	Path     string
+	Upstream string
+	Revision string
+	Head     string
+}
+
+// upstreamBranch returns the branch a project in a dereferenced
+// manifest tracks, or "" if it is unknown.
+func upstreamBranch(mf *manifest.Manifest, p *manifest.Project) string {
+	for _, b := range []string{p.Upstream, p.DestBranch, mf.Default.Revision} {
+		if _, err := parseID(b); b != "" && err != nil {
+			return b
+		}
+	}
+	return ""
+}
+
+// CheckDrift compares the revision of each project in a
+// dereferenced manifest with the current head of its upstream
+// branch, and returns the projects that differ.
+func CheckDrift(service *gitiles.Service, mf *manifest.Manifest) ([]Drift, error) {
+	branchSet := map[string]struct{}{}
+	for i := range mf.Project {
+		if b := upstreamBranch(mf, &mf.Project[i]); b != "" {
+			branchSet[b] = struct{}{}
+		}
+	}
+
+	var branches []string
+	for k := range branchSet {
+		branches = append(branches, k)
+	}
+	sort.Strings(branches)
+
+	repos, err := service.List(branches)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Drift
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		branch := upstreamBranch(mf, p)
+		if branch == "" {
+			log.Printf("project %s: no upstream branch; skipping drift check", p.Name)
+			continue
+		}
+		proj, ok := repos[p.Name]
+		if !ok {
+			log.Printf("project %s: not found on server", p.Name)
+			continue
+		}
+		head, ok := proj.Branches[branch]
+		if !ok {
+			log.Printf("project %s: branch %q not found on server", p.Name, branch)
+			continue
+		}
+		if rev := mf.ProjectRevision(p); head != rev {
+			result = append(result, Drift{
+				Name:     p.Name,
+				Path:     p.GetPath(),
+				Upstream: branch,
+				Revision: rev,
+				Head:     head,
+			})
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Markers for the section of .git/info/exclude that we manage.
+const (
+	excludeBegin = "# BEGIN slothfs-populate"
+	excludeEnd   = "# END slothfs-populate"
+)
+
+// gitDir returns the git directory of the repository at dir, or ""
+// if dir is not the top of a git repository. It handles .git files
+// as used by git worktrees and newer versions of repo.
+func gitDir(dir string) string {
+	p := filepath.Join(dir, ".git")
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ""
+	}
+	if fi.IsDir() {
+		return p
+	}
+
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return ""
+	}
+	target := strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+	if target == "" {
+		return ""
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(dir, target)
+	}
+	return target
+}
+
+// writeExcludes lists the symlinks into the RO tree below rw, and the
+// files in placed (relative to rw), in the info/exclude file of the
+// git repository holding them, so they do not show up as untracked
+// files in git status.
+func writeExcludes(mount, rw string, placed map[string]bool) error {
+	mount = filepath.Clean(mount)
+
+	// git dir => patterns. Repositories without symlinks are
+	// kept too, so stale entries are removed.
+	excludes := map[string][]string{}
+
+	// directory => top of the enclosing repository.
+	repoOf := map[string]string{}
+	if err := filepath.Walk(rw, func(n string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			repo := repoOf[filepath.Dir(n)]
+			if d := gitDir(n); d != "" {
+				repo = n
+				excludes[d] = nil
+			}
+			repoOf[n] = repo
+			return nil
+		}
+		repo := repoOf[filepath.Dir(n)]
+		if repo == "" {
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			rel, err := filepath.Rel(rw, n)
+			if err != nil || !placed[rel] {
+				return err
+			}
+		} else {
+			target, err := os.Readlink(n)
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(target, mount+"/") {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(repo, n)
+		if err != nil {
+			return err
+		}
+		d := gitDir(repo)
+		excludes[d] = append(excludes[d], "/"+filepath.ToSlash(rel))
+		return nil
+	}); err != nil {
+		return fmt.Errorf("Walk %s: %v", rw, err)
+	}
+
+	for d, patterns := range excludes {
+		if err := updateExcludeFile(filepath.Join(d, "info", "exclude"), patterns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateExcludeFile replaces our section of an exclude file with the
+// given patterns, leaving the rest of the file alone.
+func updateExcludeFile(name string, patterns []string) error {
+	old, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var buf bytes.Buffer
+	inSection := false
+	scanner := bufio.NewScanner(bytes.NewReader(old))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == excludeBegin:
+			inSection = true
+		case line == excludeEnd:
+			inSection = false
+		case !inSection:
+			buf.WriteString(line + "\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(patterns) > 0 {
+		sort.Strings(patterns)
+		buf.WriteString(excludeBegin + "\n")
+		for _, p := range patterns {
+			buf.WriteString(p + "\n")
+		}
+		buf.WriteString(excludeEnd + "\n")
+	}
+
+	if bytes.Equal(buf.Bytes(), old) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, buf.Bytes(), 0644)
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/slothfs/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// How the files of the workspace are put into the R/W checkout.
+const (
+	// LinkSymlink makes symlinks into the RO workspace.
+	LinkSymlink = "symlink"
+
+	// LinkHardlink hardlinks files to the blob cache, for tools
+	// that refuse to follow symlinks out of the tree. Files that
+	// can't be hardlinked are copied.
+	LinkHardlink = "hardlink"
+
+	// LinkReflink copies files, sharing the data with the blob
+	// cache or the workspace where the file system supports it.
+	LinkReflink = "reflink"
+)
+
+// CheckoutOptions configures CheckoutWithOptions.
+type CheckoutOptions struct {
+	// LinkMode is one of the Link* constants. If empty,
+	// LinkSymlink is used.
+	LinkMode string
+
+	// Blobs is the blob cache of the SlothFS daemon. LinkHardlink
+	// needs it; LinkReflink reads file contents from it, rather
+	// than through FUSE, if it is set.
+	Blobs *cache.CAS
+}
+
+// MaterializedFile names the file in the root of a R/W checkout that
+// records the files that were hardlinked or copied from the
+// workspace, so they can be removed on the next populate.
+const MaterializedFile = ".slothfs-materialized"
+
+// materializedStash names the directory in the root of a R/W checkout
+// that holds unchanged materialized files during a populate, so they
+// can be put back if their blob is still the same.
+const materializedStash = ".slothfs-materialized.d"
+
+// materialized is the content of MaterializedFile.
+type materialized struct {
+	// Workspace is the name of the workspace in the mount.
+	Workspace string
+
+	Files []materializedEntry
+}
+
+// materializedEntry is a file placed in the R/W checkout. The size
+// and modification time tell whether it was changed since. ID is the
+// blob ID of the file, if the mount reported it.
+type materializedEntry struct {
+	Path  string
+	Size  int64
+	Mtime int64
+	ID    string `json:",omitempty"`
+}
+
+// readMaterialized reads the MaterializedFile of rw. It returns nil
+// if there is none.
+func readMaterialized(rw string) (*materialized, error) {
+	name := filepath.Join(rw, MaterializedFile)
+	content, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m materialized
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &m, nil
+}
+
+// unchanged returns whether the file of e below rw is still as it
+// was placed.
+func (e *materializedEntry) unchanged(rw string) (bool, error) {
+	fi, err := os.Lstat(filepath.Join(rw, e.Path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Size() == e.Size && fi.ModTime().UnixNano() == e.Mtime, nil
+}
+
+// removeMaterialized removes the files listed in the MaterializedFile
+// of rw that were not changed since, except for the paths listed in
+// the KeepFile. Files with a known blob ID are moved into the
+// materializedStash rather than removed. It returns the workspace
+// they came from, and the blob IDs of the stashed files keyed by
+// path.
+func removeMaterialized(rw string) (string, map[string]string, error) {
+	stash := filepath.Join(rw, materializedStash)
+	if err := os.RemoveAll(stash); err != nil {
+		return "", nil, err
+	}
+	m, err := readMaterialized(rw)
+	if m == nil || err != nil {
+		return "", nil, err
+	}
+
+	keep, err := readKeep(rw)
+	if err != nil {
+		return "", nil, err
+	}
+	stashed := map[string]string{}
+	for _, e := range m.Files {
+		if kept(keep, e.Path) {
+			continue
+		}
+		p := filepath.Join(rw, e.Path)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if fi.Size() != e.Size || fi.ModTime().UnixNano() != e.Mtime {
+			log.Printf("%s was changed; leaving it alone", p)
+			continue
+		}
+		if e.ID != "" {
+			dst := filepath.Join(stash, e.Path)
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return "", nil, err
+			}
+			if err := os.Rename(p, dst); err != nil {
+				return "", nil, err
+			}
+			stashed[e.Path] = e.ID
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return "", nil, err
+		}
+	}
+	return m.Workspace, stashed, os.Remove(filepath.Join(rw, MaterializedFile))
+}
+
+// materializeLinks replaces the symlinks into the workspace ro below
+// rw with files, and records them in the MaterializedFile. Files in
+// stashed, as returned by removeMaterialized, are moved back rather
+// than copied if their blob is unchanged. It returns the placed files
+// relative to rw.
+func materializeLinks(ro, rw string, opts CheckoutOptions, stashed map[string]string) (map[string]bool, error) {
+	var links []string
+	if err := filepath.Walk(rw, func(n string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && (fi.Name() == ".git" || n == filepath.Join(rw, materializedStash)) {
+			return filepath.SkipDir
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			links = append(links, n)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("Walk %s: %v", rw, err)
+	}
+
+	root, err := filepath.EvalSymlinks(ro)
+	if err != nil {
+		return nil, err
+	}
+	rec := materialized{Workspace: filepath.Base(ro)}
+	m := &materializer{
+		root: root,
+		opts: MaterializeOptions{
+			Blobs:    opts.Blobs,
+			Hardlink: opts.LinkMode == LinkHardlink,
+		},
+		active: map[string]bool{},
+		placed: func(dst string, id *plumbing.Hash) error {
+			fi, err := os.Lstat(dst)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(rw, dst)
+			if err != nil {
+				return err
+			}
+			e := materializedEntry{Path: rel, Size: fi.Size(), Mtime: fi.ModTime().UnixNano()}
+			if id != nil {
+				e.ID = id.String()
+			}
+			rec.Files = append(rec.Files, e)
+			return nil
+		},
+		reuse: func(dst string, id plumbing.Hash) bool {
+			rel, err := filepath.Rel(rw, dst)
+			if err != nil || stashed[rel] != id.String() {
+				return false
+			}
+			return os.Rename(filepath.Join(rw, materializedStash, rel), dst) == nil
+		},
+	}
+
+	var errs []string
+	for _, l := range links {
+		target, err := os.Readlink(l)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(target, ro+"/") {
+			continue
+		}
+		fi, err := os.Stat(l)
+		if err != nil {
+			// Dangling; leave it, so verify can report it.
+			continue
+		}
+		if err := os.Remove(l); err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(rw, l)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			err = m.copyDir(target, l, rel)
+		} else {
+			err = m.copyFile(target, l, fi)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	// Record what we placed even if some files failed, so the
+	// next populate cleans them up.
+	sort.Slice(rec.Files, func(i, j int) bool { return rec.Files[i].Path < rec.Files[j].Path })
+	content, err := json.MarshalIndent(&rec, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(rw, MaterializedFile), content, 0644); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	log.Printf("placed %d files: %d reused, %d hardlinked, %d reflinked, %d copied", m.stats.Files,
+		m.stats.Reused, m.stats.Hardlinked, m.stats.Reflinked,
+		m.stats.Files-m.stats.Reused-m.stats.Hardlinked-m.stats.Reflinked)
+	files := map[string]bool{}
+	for _, e := range rec.Files {
+		files[e.Path] = true
+	}
+	return files, nil
+}
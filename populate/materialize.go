@@ -0,0 +1,293 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/slothfs/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// MaterializeOptions configures Materialize.
+type MaterializeOptions struct {
+	// Blobs, if set, is the blob cache of the SlothFS daemon. Files
+	// whose content is in it are copied from there instead of read
+	// through FUSE.
+	Blobs *cache.CAS
+
+	// Hardlink, if set, hardlinks files to their blob in Blobs
+	// instead of copying them. The files are then read-only, and
+	// have the modification time of the blob. Executables, and
+	// files whose blob is not cached, are still copied.
+	Hardlink bool
+}
+
+// MaterializeStats summarizes what Materialize did.
+type MaterializeStats struct {
+	Dirs  int
+	Files int
+
+	// Cached counts files whose content came from the blob cache.
+	Cached int
+
+	// Reflinked counts files that share their data with the
+	// source, rather than being copied.
+	Reflinked int
+
+	// Hardlinked counts files that are hardlinks to the blob
+	// cache.
+	Hardlinked int
+
+	// Reused counts files that were kept from an earlier
+	// checkout, because their blob is unchanged.
+	Reused int
+
+	// Symlinks counts symlinks that were copied as symlinks,
+	// because they don't point into the tree being copied.
+	Symlinks int
+
+	// Skipped counts entries that are neither files, directories
+	// nor symlinks, which are left out.
+	Skipped int
+
+	Bytes int64
+}
+
+type materializer struct {
+	opts  MaterializeOptions
+	stats MaterializeStats
+
+	// real path of the tree being copied. Only symlinks that
+	// point into it are followed.
+	root string
+
+	// real paths of the directories being copied, to catch
+	// symlinks to a parent.
+	active map[string]bool
+
+	// If set, copies get the modification time of their source.
+	keepMtime bool
+
+	// If set, called for each file that was placed, with its blob
+	// ID if known.
+	placed func(dst string, id *plumbing.Hash) error
+
+	// If set, called for files whose blob ID is known before they
+	// are copied. It returns true if it put the file at dst itself.
+	reuse func(dst string, id plumbing.Hash) bool
+}
+
+// Materialize copies the RO workspace ws into dest, as a tree of
+// plain directories and files. Symlinks that point into ws are
+// replaced by what they point to; others, such as links to absolute
+// paths on the host, are copied as symlinks. The .slothfs directories
+// are left out. Where the file systems support it, data is reflinked
+// rather than copied.
+// dest must not exist, or be empty.
+func Materialize(ws, dest string, opts MaterializeOptions) (*MaterializeStats, error) {
+	if entries, err := ioutil.ReadDir(dest); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dest)
+	}
+
+	root, err := filepath.EvalSymlinks(ws)
+	if err != nil {
+		return nil, err
+	}
+	m := &materializer{
+		opts:      opts,
+		root:      root,
+		active:    map[string]bool{},
+		keepMtime: true,
+	}
+	if err := m.copyDir(ws, dest, ""); err != nil {
+		return nil, err
+	}
+	return &m.stats, nil
+}
+
+func (m *materializer) copyDir(src, dst, rel string) error {
+	real, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	if m.active[real] {
+		return fmt.Errorf("%s: symlink loop", rel)
+	}
+	m.active[real] = true
+	defer delete(m.active, real)
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	m.stats.Dirs++
+
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if name == ".slothfs" && e.IsDir() {
+			continue
+		}
+		childSrc := filepath.Join(src, name)
+		childDst := filepath.Join(dst, name)
+		childRel := filepath.Join(rel, name)
+
+		fi := e
+		if e.Mode()&os.ModeSymlink != 0 {
+			if !m.inside(childSrc) {
+				if err := m.copyLink(childSrc, childDst); err != nil {
+					return err
+				}
+				continue
+			}
+			if fi, err = os.Stat(childSrc); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case fi.IsDir():
+			err = m.copyDir(childSrc, childDst, childRel)
+		case fi.Mode().IsRegular():
+			err = m.copyFile(childSrc, childDst, fi)
+		default:
+			log.Printf("skipping %s: mode %v", childRel, fi.Mode())
+			m.stats.Skipped++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobID returns the ID of the blob for the workspace file src, if
+// the mount reports it, and whether it is in the blob cache with the
+// size of src. The mount may serve content with converted line
+// endings, which has another size.
+func (m *materializer) blobID(src string, fi os.FileInfo) (*plumbing.Hash, bool) {
+	id, err := readSHA1Attr(src)
+	if err != nil {
+		return nil, false
+	}
+	if m.opts.Blobs == nil {
+		return id, false
+	}
+	sz, ok := m.opts.Blobs.Size(*id)
+	return id, ok && sz == fi.Size()
+}
+
+func (m *materializer) copyFile(src, dst string, fi os.FileInfo) error {
+	id, cached := m.blobID(src, fi)
+	if id != nil && m.reuse != nil && m.reuse(dst, *id) {
+		m.stats.Reused++
+		return m.done(dst, fi, id)
+	}
+	if cached && m.opts.Hardlink && fi.Mode()&0111 == 0 {
+		if err := m.opts.Blobs.Link(*id, dst); err == nil {
+			m.stats.Hardlinked++
+			return m.done(dst, fi, id)
+		}
+		// Eg. the checkout is on another file system.
+	}
+
+	var in *os.File
+	if cached {
+		if f, ok := m.opts.Blobs.Open(*id); ok {
+			in = f
+			m.stats.Cached++
+		}
+	}
+	if in == nil {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		in = f
+	}
+	defer in.Close()
+
+	mode := os.FileMode(0644)
+	if fi.Mode()&0111 != 0 {
+		mode = 0755
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	if err = reflink(out, in); err == nil {
+		m.stats.Reflinked++
+	} else {
+		_, err = io.Copy(out, in)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("copy %s: %v", src, err)
+	}
+	if m.keepMtime {
+		if err := os.Chtimes(dst, fi.ModTime(), fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return m.done(dst, fi, id)
+}
+
+// inside returns whether the symlink src resolves to a path in the
+// tree being copied.
+func (m *materializer) inside(src string) bool {
+	real, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return false
+	}
+	return real == m.root || strings.HasPrefix(real, m.root+"/")
+}
+
+// copyLink copies the symlink src to dst as a symlink.
+func (m *materializer) copyLink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return err
+	}
+	m.stats.Symlinks++
+	if m.placed != nil {
+		return m.placed(dst, nil)
+	}
+	return nil
+}
+
+// done counts the file placed at dst.
+func (m *materializer) done(dst string, fi os.FileInfo, id *plumbing.Hash) error {
+	m.stats.Files++
+	m.stats.Bytes += fi.Size()
+	if m.placed != nil {
+		return m.placed(dst, id)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/google/slothfs/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestMaterialize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "materialize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws := filepath.Join(dir, "ws")
+	for name, content := range map[string]string{
+		"a/file":         "file",
+		"a/b/script":     "#!/bin/sh",
+		"cached":         "mount",
+		".slothfs/x.xml": "<manifest/>",
+	} {
+		p := filepath.Join(ws, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, "script") {
+			mode = 0755
+		}
+		if err := ioutil.WriteFile(p, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "outside"), []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"link":     "a/file",
+		"dirlink":  "a/b",
+		"dangling": "nonexistent",
+		"a/loop":   "..",
+		"a/escape": "../../outside",
+		"abs":      filepath.Join(dir, "outside"),
+	} {
+		if err := os.Symlink(target, filepath.Join(ws, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blobs, err := cache.NewCAS(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := plumbing.NewHash("0123456789012345678901234567890123456789")
+	if _, err := blobs.Write(id, strings.NewReader("cache")); err != nil {
+		t.Fatal(err)
+	}
+	useCache := syscall.Setxattr(filepath.Join(ws, "cached"), sha1Attr, []byte(id.String()), 0) == nil
+
+	dest := filepath.Join(dir, "dest")
+	if _, err := Materialize(ws, dest, MaterializeOptions{Blobs: blobs}); err == nil {
+		t.Fatal("Materialize succeeded with a symlink loop")
+	}
+	if err := os.Remove(filepath.Join(ws, "a/loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := Materialize(ws, dest, MaterializeOptions{Blobs: blobs})
+	if err != nil {
+		t.Fatalf("Materialize: %v", err)
+	}
+	if stats.Files != 5 || stats.Symlinks != 3 || stats.Skipped != 0 {
+		t.Errorf("got stats %+v, want 5 files, 3 symlinks", stats)
+	}
+
+	wantCached := "mount"
+	if useCache {
+		wantCached = "cache"
+	}
+	for name, want := range map[string]string{
+		"a/file":         "file",
+		"a/b/script":     "#!/bin/sh",
+		"link":           "file",
+		"dirlink/script": "#!/bin/sh",
+		"cached":         wantCached,
+	} {
+		p := filepath.Join(dest, name)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Errorf("Lstat(%s): %v", name, err)
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("%s: got mode %v, want regular file", name, fi.Mode())
+		}
+		if got, err := ioutil.ReadFile(p); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dest, "a/b/script")); err != nil || fi.Mode()&0111 == 0 {
+		t.Errorf("script: got %v, %v, want executable", fi, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, ".slothfs")); err == nil {
+		t.Errorf(".slothfs was copied")
+	}
+	for name, want := range map[string]string{
+		"dangling": "nonexistent",
+		"a/escape": "../../outside",
+		"abs":      filepath.Join(dir, "outside"),
+	} {
+		if got, err := os.Readlink(filepath.Join(dest, name)); err != nil || got != want {
+			t.Errorf("%s: got link %q, %v, want %q", name, got, err, want)
+		}
+	}
+
+	if _, err := Materialize(ws, dest, MaterializeOptions{}); err == nil {
+		t.Error("Materialize into non-empty directory succeeded")
+	}
+}
+
+func TestMaterializeLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "materialize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ro := filepath.Join(dir, "mnt", "ws")
+	rw := filepath.Join(dir, "rw")
+	for name, content := range map[string]string{
+		"mnt/ws/file":       "file",
+		"mnt/ws/cached":     "mount",
+		"mnt/ws/sub/nested": "nested",
+		"rw/local":          "local",
+		"other":             "other",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"file":   filepath.Join(ro, "file"),
+		"cached": filepath.Join(ro, "cached"),
+		"sub":    filepath.Join(ro, "sub"),
+		"other":  filepath.Join(dir, "other"),
+	} {
+		if err := os.Symlink(target, filepath.Join(rw, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blobs, err := cache.NewCAS(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := plumbing.NewHash("0123456789012345678901234567890123456789")
+	if _, err := blobs.Write(id, strings.NewReader("mount")); err != nil {
+		t.Fatal(err)
+	}
+	useCache := syscall.Setxattr(filepath.Join(ro, "cached"), sha1Attr, []byte(id.String()), 0) == nil
+
+	opts := CheckoutOptions{LinkMode: LinkHardlink, Blobs: blobs}
+	placed, err := materializeLinks(ro, rw, opts, nil)
+	if err != nil {
+		t.Fatalf("materializeLinks: %v", err)
+	}
+	want := map[string]bool{"file": true, "cached": true, "sub/nested": true}
+	if !reflect.DeepEqual(placed, want) {
+		t.Errorf("got placed %v, want %v", placed, want)
+	}
+	for name := range want {
+		if fi, err := os.Lstat(filepath.Join(rw, name)); err != nil || !fi.Mode().IsRegular() {
+			t.Errorf("%s: got %v, %v, want regular file", name, fi, err)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(rw, "other")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("other: got %v, %v, want symlink", fi, err)
+	}
+	cachedFI, err := os.Lstat(filepath.Join(rw, "cached"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if useCache {
+		if n := cachedFI.Sys().(*syscall.Stat_t).Nlink; n != 2 {
+			t.Errorf("cached: got %d links, want 2", n)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(rw, "file"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws, stashed, err := removeMaterialized(rw)
+	if err != nil {
+		t.Fatalf("removeMaterialized: %v", err)
+	}
+	if ws != "ws" {
+		t.Errorf("got workspace %q, want ws", ws)
+	}
+	wantStashed := map[string]string{}
+	if useCache {
+		wantStashed["cached"] = id.String()
+	}
+	if !reflect.DeepEqual(stashed, wantStashed) {
+		t.Errorf("got stashed %v, want %v", stashed, wantStashed)
+	}
+	for name, exist := range map[string]bool{
+		"file":           true,
+		"cached":         false,
+		"sub/nested":     false,
+		"local":          true,
+		MaterializedFile: false,
+	} {
+		if _, err := os.Lstat(filepath.Join(rw, name)); (err == nil) != exist {
+			t.Errorf("%s: got err %v, want exist %v", name, err, exist)
+		}
+	}
+	if !useCache {
+		return
+	}
+
+	// The unchanged file is put back rather than copied again.
+	if err := os.Symlink(filepath.Join(ro, "cached"), filepath.Join(rw, "cached")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := materializeLinks(ro, rw, opts, stashed); err != nil {
+		t.Fatalf("materializeLinks: %v", err)
+	}
+	if fi, err := os.Lstat(filepath.Join(rw, "cached")); err != nil || !os.SameFile(fi, cachedFI) {
+		t.Errorf("cached: got %v, %v, want the stashed file", fi, err)
+	}
+}
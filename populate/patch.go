@@ -0,0 +1,202 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// patchedFile is a file changed by a patch. OldPath is empty for
+// added files, NewPath for deleted ones.
+type patchedFile struct {
+	OldPath string
+	NewPath string
+
+	// Copied is set if OldPath is kept.
+	Copied bool
+}
+
+// stripPatchPath returns the path of a ---/+++ line, without its
+// a/ or b/ prefix.
+func stripPatchPath(p string) string {
+	if p == "/dev/null" {
+		return ""
+	}
+	if i := strings.Index(p, "\t"); i >= 0 {
+		p = p[:i]
+	}
+	if len(p) > 2 && p[1] == '/' {
+		p = p[2:]
+	}
+	return p
+}
+
+// parsePatch returns the files changed by a patch in the format of
+// git diff.
+func parsePatch(patch []byte) ([]patchedFile, error) {
+	var files []patchedFile
+
+	// The diff --git line of the current file, and what the lines
+	// after it said about the file.
+	var header string
+	var named, added, deleted bool
+	endFile := func() error {
+		if header == "" || named {
+			return nil
+		}
+		// For mode changes and empty files, the header line is
+		// all we have. It can only be split if it names the same
+		// file twice.
+		names := strings.TrimPrefix(header, "diff --git a/")
+		n := (len(names) - len(" b/")) / 2
+		if n <= 0 || names[n:n+3] != " b/" || names[:n] != names[n+3:] {
+			return fmt.Errorf("cannot parse %q", header)
+		}
+		f := &files[len(files)-1]
+		if !added {
+			f.OldPath = names[:n]
+		}
+		if !deleted {
+			f.NewPath = names[:n]
+		}
+		return nil
+	}
+
+	inHeader := false
+	for _, l := range strings.Split(string(patch), "\n") {
+		if strings.HasPrefix(l, "diff --git ") {
+			if strings.Contains(l, `"`) {
+				return nil, fmt.Errorf("quoted file names are not supported: %q", l)
+			}
+			if err := endFile(); err != nil {
+				return nil, err
+			}
+			files = append(files, patchedFile{})
+			header = l
+			named, added, deleted = false, false, false
+			inHeader = true
+			continue
+		}
+		if !inHeader {
+			continue
+		}
+
+		f := &files[len(files)-1]
+		switch {
+		case strings.HasPrefix(l, "@@"):
+			inHeader = false
+		case strings.HasPrefix(l, "new file mode "):
+			added = true
+		case strings.HasPrefix(l, "deleted file mode "):
+			deleted = true
+		case strings.HasPrefix(l, "--- "):
+			f.OldPath = stripPatchPath(l[4:])
+			named = true
+		case strings.HasPrefix(l, "+++ "):
+			f.NewPath = stripPatchPath(l[4:])
+			named = true
+		case strings.HasPrefix(l, "rename from "):
+			f.OldPath = strings.TrimPrefix(l, "rename from ")
+			named = true
+		case strings.HasPrefix(l, "rename to "):
+			f.NewPath = strings.TrimPrefix(l, "rename to ")
+			named = true
+		case strings.HasPrefix(l, "copy from "):
+			f.OldPath = strings.TrimPrefix(l, "copy from ")
+			f.Copied = true
+			named = true
+		case strings.HasPrefix(l, "copy to "):
+			f.NewPath = strings.TrimPrefix(l, "copy to ")
+			named = true
+		}
+	}
+	if err := endFile(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// copyFile copies src to dst, keeping the permission bits.
+func copyFile(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, content, fi.Mode().Perm())
+}
+
+// ApplyPatch applies a patch in the format of git diff, eg. from
+// gitiles.RepoService.GetPatch, to the files of the mounted tree. The
+// patched files are written below dir, which must not be in a git
+// repository. It returns the patched files as a LocalOverlay map for
+// the tree, and the paths of the files that the patch deletes, which
+// an overlay can't hide.
+func ApplyPatch(patch []byte, tree, dir string) (overlay map[string]string, deleted []string, err error) {
+	files, err := parsePatch(patch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("patch changes no files")
+	}
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range files {
+		if f.OldPath == "" {
+			continue
+		}
+		if err := copyFile(filepath.Join(tree, f.OldPath), filepath.Join(dir, f.OldPath)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cmd := exec.Command("git", "apply", "--whitespace=nowarn", "-")
+	cmd.Dir = dir
+	// Keep git from finding a repository above dir.
+	cmd.Env = append(os.Environ(), "GIT_CEILING_DIRECTORIES="+filepath.Dir(dir))
+	cmd.Stdin = bytes.NewReader(patch)
+	var errOut bytes.Buffer
+	cmd.Stderr = &errOut
+	if err := cmd.Run(); err != nil {
+		return nil, nil, fmt.Errorf("git apply: %v: %s", err, errOut.String())
+	}
+
+	overlay = map[string]string{}
+	for _, f := range files {
+		if f.NewPath != "" {
+			overlay[f.NewPath] = filepath.Join(dir, f.NewPath)
+		}
+		if f.OldPath != "" && f.OldPath != f.NewPath && !f.Copied {
+			deleted = append(deleted, f.OldPath)
+		}
+	}
+	return overlay, deleted, nil
+}
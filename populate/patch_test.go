@@ -0,0 +1,139 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := filepath.Join(dir, "tree")
+	for name, content := range map[string]string{
+		"a/changed":  "one\ntwo\nthree\n",
+		"a/deleted":  "gone\n",
+		"b/renamed":  "same\n",
+		"unmodified": "x\n",
+	} {
+		p := filepath.Join(tree, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	patch := `diff --git a/a/changed b/a/changed
+index 4c5fd91..bb38a8f 100644
+--- a/a/changed
++++ b/a/changed
+@@ -1,3 +1,3 @@
+ one
+-two
++TWO
+ three
+diff --git a/a/deleted b/a/deleted
+deleted file mode 100644
+index 2aa7a1b..0000000
+--- a/a/deleted
++++ /dev/null
+@@ -1 +0,0 @@
+-gone
+diff --git a/b/renamed b/c/renamed
+similarity index 100%
+rename from b/renamed
+rename to c/renamed
+diff --git a/new b/new
+new file mode 100755
+index 0000000..e69de29
+--- /dev/null
++++ b/new
+@@ -0,0 +1 @@
++--- not a header
+`
+	out := filepath.Join(dir, "out")
+	overlay, deleted, err := ApplyPatch([]byte(patch), tree, out)
+	if err != nil {
+		t.Fatalf("ApplyPatch: %v", err)
+	}
+
+	wantOverlay := map[string]string{
+		"a/changed": filepath.Join(out, "a/changed"),
+		"c/renamed": filepath.Join(out, "c/renamed"),
+		"new":       filepath.Join(out, "new"),
+	}
+	if !reflect.DeepEqual(overlay, wantOverlay) {
+		t.Errorf("got overlay %v, want %v", overlay, wantOverlay)
+	}
+	if want := []string{"a/deleted", "b/renamed"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("got deleted %v, want %v", deleted, want)
+	}
+
+	for name, want := range map[string]string{
+		"a/changed": "one\nTWO\nthree\n",
+		"c/renamed": "same\n",
+		"new":       "--- not a header\n",
+	} {
+		if got, err := ioutil.ReadFile(overlay[name]); err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if fi, err := os.Stat(overlay["new"]); err != nil || fi.Mode()&0111 == 0 {
+		t.Errorf("new: got %v, %v, want executable", fi, err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "unmodified")); !os.IsNotExist(err) {
+		t.Errorf("unmodified file was copied: %v", err)
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	patch := `diff --git a/foo b/dir/barbaz
+similarity index 100%
+rename from foo
+rename to dir/barbaz
+diff --git a/script b/script
+old mode 100644
+new mode 100755
+diff --git a/empty b/empty
+new file mode 100644
+index 0000000..e69de29
+`
+	got, err := parsePatch([]byte(patch))
+	if err != nil {
+		t.Fatalf("parsePatch: %v", err)
+	}
+	want := []patchedFile{
+		{OldPath: "foo", NewPath: "dir/barbaz"},
+		{OldPath: "script", NewPath: "script"},
+		{NewPath: "empty"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := parsePatch([]byte("diff --git a/foo b/barbaz\nold mode 100644\nnew mode 100755\n")); err == nil {
+		t.Errorf("parsePatch of an ambiguous header succeeded")
+	}
+}
@@ -17,16 +17,31 @@
 package populate
 
 import (
-	"bytes"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+
+	"github.com/google/slothfs/manifest"
 )
 
+// symlink links dest to src. If dest already exists, it is local
+// data in the way of the workspace: it is left alone, and recorded
+// in conflicts.
+func symlink(src, dest string, conflicts *[]string) error {
+	err := os.Symlink(src, dest)
+	if os.IsExist(err) {
+		*conflicts = append(*conflicts, dest)
+		return nil
+	}
+	return err
+}
+
 // symlinkRepo creates symlinks for all the files in `child`.
-func symlinkRepo(name string, child *repoTree, roRoot, rwRoot string) error {
+func symlinkRepo(name string, child *repoTree, roRoot, rwRoot string, conflicts *[]string) error {
 	fi, err := os.Stat(filepath.Join(rwRoot, name))
 	if err == nil && fi.IsDir() {
 		return nil
@@ -38,7 +53,7 @@ func symlinkRepo(name string, child *repoTree, roRoot, rwRoot string) error {
 		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
 			return err
 		}
-		if err := os.Symlink(filepath.Join(roRoot, name, e), dest); err != nil {
+		if err := symlink(filepath.Join(roRoot, name, e), dest, conflicts); err != nil {
 			return err
 		}
 	}
@@ -47,7 +62,7 @@ func symlinkRepo(name string, child *repoTree, roRoot, rwRoot string) error {
 
 // createTreeLinks tries to short-cut symlinks for whole trees by
 // symlinking to the root of a repository in the RO tree.
-func createTreeLinks(ro, rw *repoTree, roRoot, rwRoot string) error {
+func createTreeLinks(ro, rw *repoTree, roRoot, rwRoot string, conflicts *[]string) error {
 	allRW := rw.allChildren()
 
 outer:
@@ -78,7 +93,7 @@ outer:
 
 		switch {
 		case foundRecurse:
-			if err := createTreeLinks(ch, rw.children[nm], filepath.Join(roRoot, nm), filepath.Join(rwRoot, nm)); err != nil {
+			if err := createTreeLinks(ch, rw.children[nm], filepath.Join(roRoot, nm), filepath.Join(rwRoot, nm), conflicts); err != nil {
 				return err
 			}
 			continue outer
@@ -87,7 +102,7 @@ outer:
 			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
 				return err
 			}
-			if err := os.Symlink(filepath.Join(roRoot, nm), dest); err != nil {
+			if err := symlink(filepath.Join(roRoot, nm), dest, conflicts); err != nil {
 				return err
 			}
 		}
@@ -96,33 +111,145 @@ outer:
 }
 
 // createLinks will populate a RW tree with symlinks to the RO tree.
-func createLinks(ro, rw *repoTree, roRoot, rwRoot string) error {
-	if err := createTreeLinks(ro, rw, roRoot, rwRoot); err != nil {
+// Local files that are in the way are added to conflicts.
+func createLinks(ro, rw *repoTree, roRoot, rwRoot string, conflicts *[]string) error {
+	if err := createTreeLinks(ro, rw, roRoot, rwRoot, conflicts); err != nil {
 		return err
 	}
 
 	rwc := rw.allChildren()
 	for nm, ch := range ro.allChildren() {
 		if _, ok := rwc[nm]; !ok {
-			if err := symlinkRepo(nm, ch, roRoot, rwRoot); err != nil {
+			if err := symlinkRepo(nm, ch, roRoot, rwRoot, conflicts); err != nil {
 				return err
 			}
 		}
 	}
 
 	for _, c := range ro.copied {
-		if err := os.Symlink(filepath.Join(roRoot, c), filepath.Join(rwRoot, c)); err != nil && !os.IsExist(err) {
-			return err
+		// A broken copyfile should not prevent the rest of
+		// the checkout from being usable.
+		if err := linkCopied(filepath.Join(roRoot, c), filepath.Join(rwRoot, c), conflicts); err != nil {
+			log.Printf("copyfile %s: %v", c, err)
 		}
 	}
 
 	return nil
 }
 
-// clearLinks removes all symlinks to the RO tree. It returns the workspace names that were linked before.
+// linkCopied creates a symlink at dest pointing to src, creating
+// intermediate directories as necessary. If dest is an existing
+// directory and src is a directory too, the entries of src are
+// linked into dest recursively. Local files at dest are added to
+// conflicts.
+func linkCopied(src, dest string, conflicts *[]string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	destFi, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return os.Symlink(src, dest)
+	}
+	if err != nil {
+		return err
+	}
+	if !destFi.IsDir() {
+		// Already linked, or a file from the R/W checkout.
+		if destFi.Mode()&os.ModeSymlink == 0 {
+			if srcFi, err := os.Stat(src); err != nil || !os.SameFile(srcFi, destFi) {
+				*conflicts = append(*conflicts, dest)
+			}
+		}
+		return nil
+	}
+
+	srcFi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !srcFi.IsDir() {
+		return fmt.Errorf("%s is a directory, but %s is not", dest, src)
+	}
+
+	names, err := readDirNames(src)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, nm := range names {
+		if err := linkCopied(filepath.Join(src, nm), filepath.Join(dest, nm), conflicts); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// readDirNames returns the sorted entry names of a directory.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// KeepFile names the file in the root of a R/W checkout that lists
+// paths, one per line and relative to the root, that populating must
+// never remove. Listing a directory protects everything below it.
+const KeepFile = ".slothfs-keep"
+
+// readKeep returns the paths listed in the KeepFile of dir.
+func readKeep(dir string) (map[string]bool, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, KeepFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keep := map[string]bool{}
+	for _, l := range strings.Split(string(content), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		keep[filepath.Clean(l)] = true
+	}
+	return keep, nil
+}
+
+// kept returns whether rel or one of its parents is in keep.
+func kept(keep map[string]bool, rel string) bool {
+	for ; rel != "." && rel != "/"; rel = filepath.Dir(rel) {
+		if keep[rel] {
+			return true
+		}
+	}
+	return false
+}
+
+// clearLinks removes all symlinks to the RO tree, and the
+// directories that become empty, except for the paths listed in the
+// KeepFile. It returns the workspace names that were linked before.
 func clearLinks(mount, dir string) (map[string]struct{}, error) {
 	mount = filepath.Clean(mount)
 
+	keep, err := readKeep(dir)
+	if err != nil {
+		return nil, err
+	}
+
 	var dirs []string
 
 	prevPrefixes := map[string]struct{}{}
@@ -130,6 +257,12 @@ func clearLinks(mount, dir string) (map[string]struct{}, error) {
 		if fi == nil {
 			return fmt.Errorf("Walk %s: nil fileinfo for %s", dir, n)
 		}
+		if rel, err := filepath.Rel(dir, n); err == nil && kept(keep, rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if fi.Mode()&os.ModeSymlink != 0 {
 			target, err := os.Readlink(n)
 			if err != nil {
@@ -171,8 +304,14 @@ func trimMount(dir, mount string) string {
 }
 
 // Returns the filenames (as relative paths) in newDir that have
-// changed relative to the files in oldDir.
-func changedFiles(oldInfos map[string]*fileInfo, newInfos map[string]*fileInfo) (added, changed []string, err error) {
+// changed relative to the files in oldDir, and the ones that were
+// removed.
+func changedFiles(oldInfos map[string]*fileInfo, newInfos map[string]*fileInfo) (added, changed, removed []string, err error) {
+	for path := range oldInfos {
+		if _, ok := newInfos[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
 	for path, info := range newInfos {
 		old, ok := oldInfos[path]
 		if !ok {
@@ -180,27 +319,107 @@ func changedFiles(oldInfos map[string]*fileInfo, newInfos map[string]*fileInfo)
 			continue
 		}
 
-		if old.sha1 == nil || info.sha1 == nil {
-			changed = append(changed, path)
-			continue
-		}
-		if bytes.Compare(old.sha1[:], info.sha1[:]) != 0 {
+		if info.changed(old) {
 			changed = append(changed, path)
-			continue
 		}
 	}
 	sort.Strings(changed)
 	sort.Strings(added)
-	return added, changed, nil
+	sort.Strings(removed)
+	return added, changed, removed, nil
+}
+
+// changedProjects returns the paths of the projects that were added,
+// removed or changed revision between the manifests of two
+// workspaces. Both manifests must be dereferenced.
+func changedProjects(oldRoot, newRoot string) (map[string]bool, error) {
+	oldMF, err := manifest.ParseFile(filepath.Join(oldRoot, ".slothfs", "manifest.xml"))
+	if err != nil {
+		return nil, err
+	}
+	newMF, err := manifest.ParseFile(filepath.Join(newRoot, ".slothfs", "manifest.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Branch names don't tell us whether the content changed.
+	for _, mf := range []*manifest.Manifest{oldMF, newMF} {
+		for i := range mf.Project {
+			if _, err := parseID(mf.ProjectRevision(&mf.Project[i])); err != nil {
+				return nil, fmt.Errorf("project %s: revision is not a SHA1", mf.Project[i].Name)
+			}
+		}
+	}
+
+	d := manifest.Diff(oldMF, newMF)
+	r := map[string]bool{}
+	for _, p := range d.Added {
+		r[p.GetPath()] = true
+	}
+	for _, p := range d.Removed {
+		r[p.GetPath()] = true
+	}
+	for _, c := range d.Changed {
+		r[c.Path] = true
+	}
+	return r, nil
+}
+
+// Result describes how a checkout changed.
+type Result struct {
+	// Files that were added or changed, as paths in the RO
+	// workspace. These should be touched.
+	Added, Changed []string
+
+	// Files that were in the previous workspace, but not in the
+	// new one, relative to the workspace.
+	Removed []string
+
+	// Local files and directories that are in the way of entries of
+	// the workspace, relative to the R/W checkout. They are left
+	// alone, so the checkout may not see these workspace entries.
+	Conflicts []string
 }
 
 // Checkout updates a RW dir with new symlinks to the given RO dir.
 // Returns the files that should be touched.
 func Checkout(ro, rw string) (added, changed []string, err error) {
+	r, err := CheckoutResult(ro, rw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.Added, r.Changed, nil
+}
+
+// CheckoutResult is like Checkout, but also returns the files that
+// were removed.
+func CheckoutResult(ro, rw string) (*Result, error) {
+	return CheckoutWithOptions(ro, rw, CheckoutOptions{})
+}
+
+// CheckoutWithOptions is like CheckoutResult, but puts the files
+// into the RW dir as given by opts.
+func CheckoutWithOptions(ro, rw string, opts CheckoutOptions) (*Result, error) {
+	switch opts.LinkMode {
+	case "":
+		opts.LinkMode = LinkSymlink
+	case LinkSymlink, LinkHardlink, LinkReflink:
+	default:
+		return nil, fmt.Errorf("unknown link mode %q", opts.LinkMode)
+	}
+
 	ro = filepath.Clean(ro)
+	prevWS, stashed, err := removeMaterialized(rw)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(filepath.Join(rw, materializedStash))
 	wsNames, err := clearLinks(filepath.Dir(ro), rw)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if prevWS != "" {
+		wsNames[prevWS] = struct{}{}
 	}
 
 	oldRoot := ""
@@ -212,6 +431,17 @@ func Checkout(ro, rw string) (added, changed []string, err error) {
 		}
 	}
 
+	// If we know which projects changed, we only need to compare
+	// the files in those.
+	var only map[string]bool
+	if oldRoot != "" {
+		only, err = changedProjects(oldRoot, ro)
+		if err != nil {
+			log.Printf("changedProjects: %v; comparing all files", err)
+			only = nil
+		}
+	}
+
 	// Do the file system traversals in parallel.
 	errs := make(chan error, 3)
 	var rwTree, roTree *repoTree
@@ -219,7 +449,7 @@ func Checkout(ro, rw string) (added, changed []string, err error) {
 
 	if oldRoot != "" {
 		go func() {
-			t, err := repoTreeFromSlothFS(oldRoot)
+			t, err := repoTreeFromSlothFSProjects(oldRoot, only)
 			if t != nil {
 				oldInfos = t.allFiles()
 			}
@@ -244,18 +474,42 @@ func Checkout(ro, rw string) (added, changed []string, err error) {
 	for i := 0; i < cap(errs); i++ {
 		err := <-errs
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
 
-	if err := createLinks(roTree, rwTree, ro, rw); err != nil {
-		return nil, nil, err
+	var conflicts []string
+	if err := createLinks(roTree, rwTree, ro, rw, &conflicts); err != nil {
+		return nil, err
 	}
+	for i, c := range conflicts {
+		if rel, err := filepath.Rel(rw, c); err == nil {
+			conflicts[i] = rel
+		}
+	}
+	sort.Strings(conflicts)
 
-	newInfos := roTree.allFiles()
-	added, changed, err = changedFiles(oldInfos, newInfos)
+	var placed map[string]bool
+	if opts.LinkMode != LinkSymlink {
+		if placed, err = materializeLinks(ro, rw, opts, stashed); err != nil {
+			return nil, err
+		}
+	}
+
+	// Not fatal: the checkout works, but git status is noisy.
+	if err := writeExcludes(filepath.Dir(ro), rw, placed); err != nil {
+		log.Printf("writeExcludes: %v", err)
+	}
+
+	var newInfos map[string]*fileInfo
+	if only != nil {
+		newInfos = roTree.projectFiles(only)
+	} else {
+		newInfos = roTree.allFiles()
+	}
+	added, changed, removed, err := changedFiles(oldInfos, newInfos)
 	if err != nil {
-		return nil, nil, fmt.Errorf("changedFiles: %v", err)
+		return nil, fmt.Errorf("changedFiles: %v", err)
 	}
 
 	for i, p := range changed {
@@ -266,5 +520,5 @@ func Checkout(ro, rw string) (added, changed []string, err error) {
 		added[i] = filepath.Join(ro, p)
 	}
 
-	return added, changed, nil
+	return &Result{Added: added, Changed: changed, Removed: removed, Conflicts: conflicts}, nil
 }
@@ -17,11 +17,22 @@ package populate
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/google/slothfs/gitiles"
+	"github.com/google/slothfs/manifest"
 )
 
 const attr = "user.gitsha1"
@@ -160,3 +171,558 @@ func TestRepoTreeFromManifest(t *testing.T) {
 		t.Errorf("got %#v, want %#v", got, topT)
 	}
 }
+
+func TestFillFromDir(t *testing.T) {
+	dir, err := createFSTree([]string{
+		"file",
+		"sub/.git/HEAD",
+		"sub/subfile",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tree := makeRepoTree()
+	tree.children["sub"] = makeRepoTree()
+	if err := tree.fillFromDir(dir); err != nil {
+		t.Fatalf("fillFromDir: %v", err)
+	}
+
+	if len(tree.entries) != 1 {
+		t.Fatalf("got entries %v, want just 'file'", tree.entries)
+	}
+	fi := tree.entries["file"]
+	if fi == nil || fi.sha1 == nil || fi.sha1.String() != checksum {
+		t.Errorf("got %#v, want sha1 %s", fi, checksum)
+	}
+}
+
+func TestFillFromSHA1s(t *testing.T) {
+	tree := makeRepoTree()
+	content := "file\t" + checksum + "\n" +
+		`"new\nline"` + "\t" + checksum + "\n" +
+		"tab\tname\t" + checksum + "\n"
+	if err := tree.fillFromSHA1s([]byte(content)); err != nil {
+		t.Fatalf("fillFromSHA1s: %v", err)
+	}
+	for _, name := range []string{"file", "new\nline", "tab\tname"} {
+		fi := tree.entries[name]
+		if fi == nil || fi.sha1 == nil || fi.sha1.String() != checksum {
+			t.Errorf("%q: got %#v, want sha1 %s", name, fi, checksum)
+		}
+	}
+	if len(tree.entries) != 3 {
+		t.Errorf("got entries %v, want 3", tree.entries)
+	}
+
+	if err := makeRepoTree().fillFromSHA1s([]byte("file " + checksum + "\n")); err == nil {
+		t.Error("fillFromSHA1s accepted a line without tab")
+	}
+}
+
+func TestFileInfoChanged(t *testing.T) {
+	id1 := gitID(checksum)
+	id2 := gitID("f065f1478dc8bfebdc59f20fb2fc1f8da4d7c334")
+	now := time.Now()
+
+	for _, tc := range []struct {
+		old, new *fileInfo
+		want     bool
+	}{
+		{&fileInfo{sha1: id1}, &fileInfo{sha1: id1}, false},
+		{&fileInfo{sha1: id1}, &fileInfo{sha1: id2}, true},
+		{&fileInfo{stat: true, size: 1, mtime: now}, &fileInfo{stat: true, size: 1, mtime: now}, false},
+		{&fileInfo{stat: true, size: 1, mtime: now}, &fileInfo{stat: true, size: 2, mtime: now}, true},
+		{&fileInfo{sha1: id1}, &fileInfo{stat: true, size: 1, mtime: now}, true},
+	} {
+		if got := tc.new.changed(tc.old); got != tc.want {
+			t.Errorf("%#v.changed(%#v): got %v, want %v", tc.new, tc.old, got, tc.want)
+		}
+	}
+}
+
+func TestLinkCopied(t *testing.T) {
+	ro, err := createFSTree([]string{
+		"file",
+		"dir/a",
+		"dir/sub/b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(ro)
+
+	rw, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rw)
+
+	// A destination in a directory that does not exist yet.
+	var conflicts []string
+	if err := linkCopied(filepath.Join(ro, "file"), filepath.Join(rw, "x/y/file"), &conflicts); err != nil {
+		t.Fatalf("linkCopied(file): %v", err)
+	}
+	if got, err := os.Readlink(filepath.Join(rw, "x/y/file")); err != nil {
+		t.Fatal(err)
+	} else if want := filepath.Join(ro, "file"); got != want {
+		t.Errorf("Readlink: got %q, want %q", got, want)
+	}
+
+	// A directory source merged into an existing directory.
+	if err := os.MkdirAll(filepath.Join(rw, "dir/sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rw, "dir/a"), []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := linkCopied(filepath.Join(ro, "dir"), filepath.Join(rw, "dir"), &conflicts); err != nil {
+		t.Fatalf("linkCopied(dir): %v", err)
+	}
+	if got, err := os.Readlink(filepath.Join(rw, "dir/sub/b")); err != nil {
+		t.Fatal(err)
+	} else if want := filepath.Join(ro, "dir/sub/b"); got != want {
+		t.Errorf("Readlink: got %q, want %q", got, want)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(rw, "dir/a")); err != nil || string(content) != "local" {
+		t.Errorf("local file was overwritten: %q, %v", content, err)
+	}
+	if want := []string{filepath.Join(rw, "dir/a")}; !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("got conflicts %v, want %v", conflicts, want)
+	}
+
+	// A file source for an existing directory is an error.
+	if err := linkCopied(filepath.Join(ro, "file"), filepath.Join(rw, "dir"), &conflicts); err == nil {
+		t.Errorf("linkCopied(file, dir) succeeded")
+	}
+}
+
+func TestClearLinksKeep(t *testing.T) {
+	mount, err := createFSTree([]string{"ws/p/file", "ws/q/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(mount)
+
+	rw, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rw)
+
+	for _, d := range []string{"p", "q", "mine/empty", "other"} {
+		if err := os.MkdirAll(filepath.Join(rw, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"p/file", "q/file"} {
+		if err := os.Symlink(filepath.Join(mount, "ws", p), filepath.Join(rw, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rw, KeepFile), []byte("# local\nmine\n\nq/file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := clearLinks(mount, rw); err != nil {
+		t.Fatalf("clearLinks: %v", err)
+	}
+	for p, want := range map[string]bool{
+		"p":          false,
+		"other":      false,
+		"mine/empty": true,
+		"q/file":     true,
+	} {
+		if _, err := os.Lstat(filepath.Join(rw, p)); (err == nil) != want {
+			t.Errorf("%s: got exists %v, want %v", p, err == nil, want)
+		}
+	}
+
+	// The kept directory is in the way of the new workspace.
+	ro := makeRepoTree()
+	ro.children["q"] = makeRepoTree()
+	var conflicts []string
+	if err := createTreeLinks(ro, makeRepoTree(), filepath.Join(mount, "ws"), rw, &conflicts); err != nil {
+		t.Fatalf("createTreeLinks: %v", err)
+	}
+	if want := []string{filepath.Join(rw, "q")}; !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("got conflicts %v, want %v", conflicts, want)
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	head := "f065f1478dc8bfebdc59f20fb2fc1f8da4d7c334"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query()["b"]; !reflect.DeepEqual(got, []string{"master"}) {
+			t.Errorf("got branches %v, want [master]", got)
+		}
+		fmt.Fprintf(w, `)]}'
+{"a": {"name": "a", "branches": {"master": %q}},
+ "b": {"name": "b", "branches": {"master": %q}}}`, checksum, head)
+	}))
+	defer server.Close()
+
+	service, err := gitiles.NewService(gitiles.Options{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mf := &manifest.Manifest{
+		Project: []manifest.Project{
+			{Name: "a", Revision: "master"},
+			{Name: "b", Revision: "refs/heads/master", Upstream: "master"},
+			{Name: "c", Revision: checksum},
+		},
+	}
+	RecordUpstream(mf)
+	for i, want := range []string{"master", "master", ""} {
+		if got := mf.Project[i].Upstream; got != want {
+			t.Errorf("project %s: got upstream %q, want %q", mf.Project[i].Name, got, want)
+		}
+	}
+	for i := range mf.Project {
+		mf.Project[i].Revision = checksum
+	}
+	got, err := CheckDrift(service, mf)
+	if err != nil {
+		t.Fatalf("CheckDrift: %v", err)
+	}
+	want := []Drift{{Name: "b", Path: "b", Upstream: "master", Revision: checksum, Head: head}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDerefManifestFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `)]}'
+{"a": {"name": "a", "clone_url": "http://host/a", "branches": {"master": %q}}}`, checksum)
+		case "/b/+/master":
+			fmt.Fprintf(w, `)]}'
+{"commit": %q}`, checksum)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	service, err := gitiles.NewService(gitiles.Options{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mf := &manifest.Manifest{
+		Default: manifest.Default{Revision: "master"},
+		Project: []manifest.Project{{Name: "a"}, {Name: "b"}},
+	}
+	if err := DerefManifest(service, mf); err != nil {
+		t.Fatalf("DerefManifest: %v", err)
+	}
+	for _, p := range mf.Project {
+		if p.Revision != checksum || p.CloneURL == "" {
+			t.Errorf("project %s not resolved: %#v", p.Name, p)
+		}
+	}
+
+	mf.Project = append(mf.Project, manifest.Project{Name: "c", Revision: "master"})
+	if err := DerefManifest(service, mf); err == nil {
+		t.Errorf("DerefManifest succeeded for nonexistent project")
+	}
+}
+
+func TestDerefManifestRetry(t *testing.T) {
+	defer func(d time.Duration) { derefBackoff = d }(derefBackoff)
+	derefBackoff = time.Millisecond
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky/+/master":
+			if atomic.AddInt32(&calls, 1) < derefRetries {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintf(w, `)]}'
+{"commit": %q}`, checksum)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	service, err := gitiles.NewService(gitiles.Options{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mf := &manifest.Manifest{
+		Default: manifest.Default{Revision: "master"},
+		Project: []manifest.Project{{Name: "flaky"}},
+	}
+	if err := DerefManifest(service, mf); err != nil {
+		t.Fatalf("DerefManifest: %v", err)
+	}
+	if mf.Project[0].Revision != checksum {
+		t.Errorf("got revision %q, want %q", mf.Project[0].Revision, checksum)
+	}
+	if got := atomic.LoadInt32(&calls); got != derefRetries {
+		t.Errorf("got %d calls, want %d", got, derefRetries)
+	}
+}
+
+func TestWriteExcludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mount := filepath.Join(dir, "mnt")
+	rw := filepath.Join(dir, "rw")
+	for _, d := range []string{"proj/.git/info", "proj/sub", "other"} {
+		if err := os.MkdirAll(filepath.Join(rw, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exclude := filepath.Join(rw, "proj/.git/info/exclude")
+	if err := ioutil.WriteFile(exclude, []byte("*.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"proj/sub/nested": filepath.Join(mount, "ws/proj/sub/nested"),
+		"proj/elsewhere":  "/tmp",
+		"other/link":      filepath.Join(mount, "ws/other/link"),
+	} {
+		if err := os.Symlink(target, filepath.Join(rw, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writeExcludes(mount, rw, nil); err != nil {
+		t.Fatalf("writeExcludes: %v", err)
+	}
+	got, err := ioutil.ReadFile(exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "*.local\n" + excludeBegin + "\n/sub/nested\n" + excludeEnd + "\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Stale entries are removed.
+	if err := os.Remove(filepath.Join(rw, "proj/sub/nested")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeExcludes(mount, rw, nil); err != nil {
+		t.Fatalf("writeExcludes: %v", err)
+	}
+	if got, err := ioutil.ReadFile(exclude); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "*.local\n" {
+		t.Errorf("got %q, want only the user's entries", got)
+	}
+}
+
+func TestReadRepoManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".repo/manifest.xml": `<manifest><include name="default.xml"/></manifest>`,
+		".repo/manifests/default.xml": `<manifest>
+ <remote name="aosp" fetch=".."/>
+ <default revision="master" remote="aosp"/>
+ <project name="platform/build" path="build/make"/>
+ <project name="platform/art" path="art"/>
+ <include name="extra.xml"/>
+</manifest>`,
+		".repo/manifests/extra.xml": `<manifest><project name="platform/extra"/></manifest>`,
+		".repo/local_manifests/local.xml": `<manifest>
+ <remove-project name="platform/art"/>
+ <project name="my/tool" path="tool"/>
+</manifest>`,
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo, err := git.PlainInit(filepath.Join(dir, "build/make"), false)
+	if err != nil {
+		t.Fatalf("PlainInit: %v", err)
+	}
+	synced := plumbing.NewHash("ce34badf691d36e8048b63f89d1a86ee5fa4325c")
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/remotes/aosp/master", synced)); err != nil {
+		t.Fatalf("SetReference: %v", err)
+	}
+
+	mf, err := ReadRepoManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadRepoManifest: %v", err)
+	}
+
+	got := map[string]string{}
+	for _, p := range mf.Project {
+		got[p.GetPath()] = mf.ProjectRevision(&p)
+	}
+	want := map[string]string{
+		"build/make":     synced.String(),
+		"platform/extra": "master",
+		"tool":           "master",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got projects %v, want %v", got, want)
+	}
+	if len(mf.Extra) != 0 {
+		t.Errorf("got extra elements %v, want none", mf.Extra)
+	}
+}
+
+func TestRepoLocalWork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.PlainInit(filepath.Join(dir, "tool"), false)
+	if err != nil {
+		t.Fatalf("PlainInit: %v", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) plumbing.Hash {
+		if err := ioutil.WriteFile(filepath.Join(dir, "tool/file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add("file"); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		sig := &object.Signature{Name: "t", Email: "t@t", When: time.Now()}
+		id, err := wt.Commit(content, &git.CommitOptions{Author: sig, Committer: sig})
+		if err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+		return id
+	}
+	synced := commit("synced")
+
+	path := "tool"
+	mf := &manifest.Manifest{
+		Project: []manifest.Project{{Name: "my/tool", Path: &path, Revision: synced.String()}, {Name: "other"}},
+	}
+	w, err := RepoLocalWork(dir, mf, &mf.Project[0])
+	if err != nil {
+		t.Fatalf("RepoLocalWork: %v", err)
+	}
+	if w == nil || w.Dirty || len(w.LocalCommits) != 0 {
+		t.Errorf("synced checkout: got %+v, want no local work", w)
+	}
+
+	local := commit("local")
+	if err := ioutil.WriteFile(filepath.Join(dir, "tool/file"), []byte("dirty"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err = RepoLocalWork(dir, mf, &mf.Project[0])
+	if err != nil {
+		t.Fatalf("RepoLocalWork: %v", err)
+	}
+	want := &LocalWork{Dirty: true, LocalCommits: []string{local.String()}}
+	if !reflect.DeepEqual(w, want) {
+		t.Errorf("got %+v, want %+v", w, want)
+	}
+
+	if w, err := RepoLocalWork(dir, mf, &mf.Project[1]); w != nil || err != nil {
+		t.Errorf("not checked out: got %+v, %v", w, err)
+	}
+}
+
+func TestChangedProjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rev1 := "ce34badf691d36e8048b63f89d1a86ee5fa4325c"
+	rev2 := "58d9fdae2c26d82e04f3fcafc4358b99109f0e70"
+	treeJSON := fmt.Sprintf(`{"id": %q, "entries": [{"name": "file", "id": %q}]}`, rev1, checksum)
+	files := map[string]string{
+		"old/.slothfs/manifest.xml": fmt.Sprintf(`<manifest>
+ <project name="a" revision=%q/>
+ <project name="b" revision=%q/>
+</manifest>`, rev1, rev1),
+		"new/.slothfs/manifest.xml": fmt.Sprintf(`<manifest>
+ <project name="a" revision=%q/>
+ <project name="b" revision=%q/>
+ <project name="c" revision=%q/>
+</manifest>`, rev1, rev2, rev1),
+		"branch/.slothfs/manifest.xml": `<manifest><project name="a" revision="master"/></manifest>`,
+		"new/a/.slothfs/tree.json":     treeJSON,
+		"new/b/.slothfs/tree.json":     treeJSON,
+		"new/c/.slothfs/tree.json":     treeJSON,
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := changedProjects(filepath.Join(dir, "old"), filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatalf("changedProjects: %v", err)
+	}
+	if want := map[string]bool{"b": true, "c": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := changedProjects(filepath.Join(dir, "branch"), filepath.Join(dir, "new")); err == nil {
+		t.Errorf("changedProjects succeeded for manifest with branch names")
+	}
+
+	tree, err := repoTreeFromSlothFSProjects(filepath.Join(dir, "new"), got)
+	if err != nil {
+		t.Fatalf("repoTreeFromSlothFSProjects: %v", err)
+	}
+	if len(tree.children["a"].entries) != 0 {
+		t.Errorf("read entries of unchanged project a")
+	}
+	changed := tree.projectFiles(got)
+	if len(changed) != 2 || changed["b/file"] == nil || changed["c/file"] == nil {
+		t.Errorf("got files %v, want b/file and c/file", changed)
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	a := &fileInfo{sha1: gitID(checksum)}
+	b := &fileInfo{sha1: gitID("ce34badf691d36e8048b63f89d1a86ee5fa4325c")}
+	added, changed, removed, err := changedFiles(
+		map[string]*fileInfo{"same": a, "changed": a, "removed": a},
+		map[string]*fileInfo{"same": a, "changed": b, "added": b})
+	if err != nil {
+		t.Fatalf("changedFiles: %v", err)
+	}
+	if !reflect.DeepEqual(added, []string{"added"}) ||
+		!reflect.DeepEqual(changed, []string{"changed"}) ||
+		!reflect.DeepEqual(removed, []string{"removed"}) {
+		t.Errorf("got added %v, changed %v, removed %v", added, changed, removed)
+	}
+}
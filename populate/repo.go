@@ -0,0 +1,244 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	"github.com/google/slothfs/manifest"
+)
+
+// ReadRepoManifest reads the manifest of a checkout made by the repo
+// tool at dir. It follows <include> elements and merges the local
+// manifests. Each project revision is set to the commit that repo
+// last synced, if the project is checked out.
+func ReadRepoManifest(dir string) (*manifest.Manifest, error) {
+	repoDir := filepath.Join(dir, ".repo")
+	mf, err := readIncludes(filepath.Join(repoDir, "manifests"), filepath.Join(repoDir, "manifest.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	locals, err := filepath.Glob(filepath.Join(repoDir, "local_manifests", "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(locals)
+	// The single local manifest file is deprecated, but still
+	// honored by repo.
+	legacy := filepath.Join(repoDir, "local_manifest.xml")
+	if _, err := os.Stat(legacy); err == nil {
+		locals = append([]string{legacy}, locals...)
+	}
+	for _, l := range locals {
+		local, err := readIncludes(filepath.Dir(l), l)
+		if err != nil {
+			return nil, err
+		}
+		mergeManifest(mf, local)
+	}
+
+	for i := range mf.Project {
+		pinSyncedRevision(dir, mf, &mf.Project[i])
+	}
+	return mf, nil
+}
+
+// readIncludes parses a manifest file, and merges the files named
+// in its <include> elements, which are relative to includeDir.
+func readIncludes(includeDir, name string) (*manifest.Manifest, error) {
+	mf, err := manifest.ParseFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	extra := mf.Extra
+	mf.Extra = nil
+	for _, e := range extra {
+		if e.XMLName.Local != "include" {
+			mf.Extra = append(mf.Extra, e)
+			continue
+		}
+		inc := attrValue(e.Attrs, "name")
+		if inc == "" {
+			return nil, fmt.Errorf("%s: <include> without name", name)
+		}
+		sub, err := readIncludes(includeDir, filepath.Join(includeDir, inc))
+		if err != nil {
+			return nil, err
+		}
+		mergeManifest(mf, sub)
+	}
+	return mf, nil
+}
+
+// mergeManifest adds the remotes and projects of src to dst, and
+// applies its <remove-project> elements.
+func mergeManifest(dst, src *manifest.Manifest) {
+	if dst.Default.Remote == "" && dst.Default.Revision == "" {
+		dst.Default = src.Default
+	}
+	dst.Remote = append(dst.Remote, src.Remote...)
+
+	for _, e := range src.Extra {
+		if e.XMLName.Local != "remove-project" {
+			dst.Extra = append(dst.Extra, e)
+			continue
+		}
+		name := attrValue(e.Attrs, "name")
+		var kept []manifest.Project
+		for _, p := range dst.Project {
+			if p.Name != name {
+				kept = append(kept, p)
+			}
+		}
+		dst.Project = kept
+	}
+	dst.Project = append(dst.Project, src.Project...)
+}
+
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// pinSyncedRevision sets the revision of p to the commit of its
+// remote tracking branch in the checkout. This is what repo fetched
+// on the last sync, so unlike the local HEAD, it is known to exist
+// on the server.
+func pinSyncedRevision(dir string, mf *manifest.Manifest, p *manifest.Project) {
+	branch := mf.ProjectRevision(p)
+	if _, err := parseID(branch); err == nil {
+		return
+	}
+	remote := p.Remote
+	if remote == "" {
+		remote = mf.Default.Remote
+	}
+
+	repo, err := git.PlainOpen(filepath.Join(dir, p.GetPath()))
+	if err != nil {
+		// Not checked out, eg. because it is not in the
+		// groups that were synced.
+		return
+	}
+	short := strings.TrimPrefix(branch, "refs/heads/")
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName(remote, short), true)
+	if err != nil {
+		log.Printf("%s: no synced revision for %s/%s: %v", p.GetPath(), remote, short, err)
+		return
+	}
+
+	if p.Upstream == "" {
+		p.Upstream = branch
+	}
+	p.Revision = ref.Hash().String()
+}
+
+// maxLocalCommits bounds the number of local commits LocalWork lists
+// for a project.
+const maxLocalCommits = 100
+
+// LocalWork describes work in a project of a repo checkout that is
+// not on the server.
+type LocalWork struct {
+	// Dirty is set if the work tree has uncommitted changes.
+	Dirty bool `json:",omitempty"`
+
+	// LocalCommits lists the commits of HEAD that are not in the
+	// revision of the project, newest first, up to 100.
+	LocalCommits []string `json:",omitempty"`
+}
+
+// RepoLocalWork returns the local work in the checkout of p, in the
+// repo checkout at dir. The revision of p should be a commit, as set
+// by ReadRepoManifest. It returns nil if the project is not checked
+// out.
+func RepoLocalWork(dir string, mf *manifest.Manifest, p *manifest.Project) (*LocalWork, error) {
+	repo, err := git.PlainOpen(filepath.Join(dir, p.GetPath()))
+	if err == git.ErrRepositoryNotExists {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w := &LocalWork{}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("%s: Status: %v", p.GetPath(), err)
+	}
+	w.Dirty = !status.IsClean()
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("%s: HEAD: %v", p.GetPath(), err)
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.GetPath(), err)
+	}
+	rev := mf.ProjectRevision(p)
+	revID, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("%s: ResolveRevision(%s): %v", p.GetPath(), rev, err)
+	}
+	revCommit, err := repo.CommitObject(*revID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", p.GetPath(), err)
+	}
+
+	// Walk back from HEAD, stopping where it meets the revision.
+	bases, err := headCommit.MergeBase(revCommit)
+	if err != nil {
+		return nil, fmt.Errorf("%s: MergeBase: %v", p.GetPath(), err)
+	}
+	var ignore []plumbing.Hash
+	for _, b := range bases {
+		ignore = append(ignore, b.Hash)
+	}
+	iter := object.NewCommitPreorderIter(headCommit, nil, ignore)
+	defer iter.Close()
+	for len(w.LocalCommits) < maxLocalCommits {
+		c, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		w.LocalCommits = append(w.LocalCommits, c.Hash.String())
+	}
+	return w, nil
+}
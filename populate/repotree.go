@@ -23,7 +23,10 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
 
@@ -36,6 +39,24 @@ import (
 type fileInfo struct {
 	// the SHA1 of the file. This can be nil if getting it was too expensive.
 	sha1 *plumbing.Hash
+
+	// If the SHA1 is not available, size and modification time
+	// can be used to detect changes. stat is false if they
+	// were not recorded.
+	stat  bool
+	size  int64
+	mtime time.Time
+}
+
+// changed returns whether the file differs from the old one.
+func (fi *fileInfo) changed(old *fileInfo) bool {
+	if old.sha1 != nil && fi.sha1 != nil {
+		return *old.sha1 != *fi.sha1
+	}
+	if old.stat && fi.stat {
+		return old.size != fi.size || !old.mtime.Equal(fi.mtime)
+	}
+	return true
 }
 
 // repoTree is a nested set of Git repositories.
@@ -113,10 +134,18 @@ func repoTreeFromManifest(xmlFile string) (*repoTree, error) {
 	return root, nil
 }
 
-// fillFromSlothFS reads tree.json to fill Entries for this repoTree
-// node only, and does not recurse.
+// fillFromSlothFS reads sha1s.txt, or tree.json for older mounts, to
+// fill Entries for this repoTree node only, and does not recurse.
 func (t *repoTree) fillFromSlothFS(dir string) error {
+	if c, err := ioutil.ReadFile(filepath.Join(dir, ".slothfs", "sha1s.txt")); err == nil {
+		return t.fillFromSHA1s(c)
+	}
+
 	c, err := ioutil.ReadFile(filepath.Join(dir, ".slothfs", "tree.json"))
+	if os.IsNotExist(err) {
+		log.Printf("%s: no tree.json; falling back to reading the directory", dir)
+		return t.fillFromDir(dir)
+	}
 	if err != nil {
 		return err
 	}
@@ -139,17 +168,116 @@ func (t *repoTree) fillFromSlothFS(dir string) error {
 	return nil
 }
 
+// fillFromSHA1s fills Entries from the "path<TAB>sha1" lines of
+// .slothfs/sha1s.txt.
+func (t *repoTree) fillFromSHA1s(content []byte) error {
+	for _, l := range strings.Split(string(content), "\n") {
+		if l == "" {
+			continue
+		}
+		i := strings.LastIndex(l, "\t")
+		if i < 0 {
+			return fmt.Errorf("sha1s.txt: malformed line %q", l)
+		}
+		name := l[:i]
+		if strings.HasPrefix(name, `"`) {
+			var err error
+			if name, err = strconv.Unquote(name); err != nil {
+				return fmt.Errorf("sha1s.txt: name %s: %v", l[:i], err)
+			}
+		}
+		id, err := parseID(l[i+1:])
+		if err != nil {
+			return err
+		}
+		t.entries[name] = &fileInfo{sha1: id}
+	}
+	return nil
+}
+
+// fillFromDir fills Entries for this repoTree node by walking the
+// directory. It uses the SHA1 extended attribute if the file system
+// supports it, and size and modification time otherwise.
+func (t *repoTree) fillFromDir(dir string) error {
+	warned := false
+	return filepath.Walk(dir, func(n string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, n)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if _, ok := t.children[rel]; ok || fi.Name() == ".slothfs" || fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info := &fileInfo{}
+		if id, err := readSHA1Attr(n); err == nil {
+			info.sha1 = id
+		} else {
+			if !warned {
+				log.Printf("%s: cannot read %s attribute (%v); using size and mtime to detect changes", dir, sha1Attr, err)
+				warned = true
+			}
+			info.stat = true
+			info.size = fi.Size()
+			info.mtime = fi.ModTime()
+		}
+		t.entries[rel] = info
+		return nil
+	})
+}
+
+// sha1Attr is the extended attribute holding the git SHA1 of a file
+// in SlothFS.
+const sha1Attr = "user.gitsha1"
+
+// convertedSHA1Attr is the extended attribute holding the SHA1 of the
+// content SlothFS serves for a file with line ending conversion. It
+// differs from the git SHA1 of the file.
+const convertedSHA1Attr = "user.slothfs.convertedsha1"
+
+// readSHA1Attr reads the git SHA1 from the file's extended attributes.
+func readSHA1Attr(path string) (*plumbing.Hash, error) {
+	return readIDAttr(path, sha1Attr)
+}
+
+func readIDAttr(path, attr string) (*plumbing.Hash, error) {
+	var buf [40]byte
+	sz, err := syscall.Getxattr(path, attr, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	return parseID(string(buf[:sz]))
+}
+
 // repoTreeFromSlothFS reads data from .slothfs to construct a fully
 // populated repoTree tree.
 func repoTreeFromSlothFS(dir string) (*repoTree, error) {
+	return repoTreeFromSlothFSProjects(dir, nil)
+}
+
+// repoTreeFromSlothFSProjects is like repoTreeFromSlothFS, but if
+// only is non-nil, it only reads the entries of the repositories
+// whose paths are in only.
+func repoTreeFromSlothFSProjects(dir string, only map[string]bool) (*repoTree, error) {
 	root, err := repoTreeFromManifest(filepath.Join(dir, ".slothfs", "manifest.xml"))
 	if err != nil {
 		return nil, err
 	}
 
 	chs := root.allChildren()
+	for path := range chs {
+		if only != nil && !only[path] {
+			delete(chs, path)
+		}
+	}
 	errs := make(chan error, len(chs))
-	for path, ch := range root.allChildren() {
+	for path, ch := range chs {
 		go func(p string, t *repoTree) {
 			err := t.fillFromSlothFS(p)
 			errs <- err
@@ -194,6 +322,21 @@ func (t *repoTree) allChildren() map[string]*repoTree {
 	return r
 }
 
+// projectFiles returns the files of the repositories whose paths are
+// in only, keyed by path relative to the receiver.
+func (t *repoTree) projectFiles(only map[string]bool) map[string]*fileInfo {
+	r := map[string]*fileInfo{}
+	for path, ch := range t.allChildren() {
+		if !only[path] {
+			continue
+		}
+		for nm, info := range ch.entries {
+			r[filepath.Join(path, nm)] = info
+		}
+	}
+	return r
+}
+
 // allFiles returns all the files below this repoTree.
 func (t *repoTree) allFiles() map[string]*fileInfo {
 	r := map[string]*fileInfo{}
@@ -0,0 +1,231 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WorkspaceName returns the name for a workspace configured at time
+// t. The suffix, if given, is appended after a dash.
+func WorkspaceName(t time.Time, suffix string) string {
+	name := strings.Replace(t.Format("S"+time.RFC3339), ":", "_", -1)
+	if suffix != "" {
+		name += "-" + suffix
+	}
+	return name
+}
+
+// workspaceNameRE matches names made by WorkspaceName.
+var workspaceNameRE = regexp.MustCompile(`^S(\d{4}-\d\d-\d\dT\d\d_\d\d_\d\d(?:Z|[+-]\d\d_\d\d))(?:-|$)`)
+
+// workspaceTime returns the time at which a workspace named by
+// WorkspaceName was configured.
+func workspaceTime(name string) (time.Time, bool) {
+	m := workspaceNameRE.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, strings.Replace(m[1], "_", ":", -1))
+	return t, err == nil
+}
+
+// Retention says which of the workspaces named by WorkspaceName to
+// keep. Zero fields impose no limit.
+type Retention struct {
+	// Keep is the number of newest workspaces to keep.
+	Keep int
+
+	// MaxAge is the age beyond which workspaces are removed.
+	MaxAge time.Duration
+}
+
+// RemoveStaleWorkspaces removes the config entries of the workspaces
+// in mount that were named by WorkspaceName and that r drops, except
+// those in inUse. It returns the names of the removed workspaces.
+// Other workspaces are left alone.
+func RemoveStaleWorkspaces(mount string, r Retention, inUse map[string]bool, now time.Time) ([]string, error) {
+	configDir := filepath.Join(mount, "config")
+	entries, err := ioutil.ReadDir(configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type workspace struct {
+		name string
+		time time.Time
+	}
+	var wss []workspace
+	for _, e := range entries {
+		if t, ok := workspaceTime(e.Name()); ok {
+			wss = append(wss, workspace{e.Name(), t})
+		}
+	}
+	sort.Slice(wss, func(i, j int) bool { return wss[i].time.After(wss[j].time) })
+
+	var removed []string
+	for i, ws := range wss {
+		stale := (r.Keep > 0 && i >= r.Keep) || (r.MaxAge > 0 && now.Sub(ws.time) > r.MaxAge)
+		if !stale {
+			continue
+		}
+		if inUse[ws.name] {
+			log.Printf("keeping workspace %s: a checkout may still use it", ws.name)
+			continue
+		}
+		if err := os.Remove(filepath.Join(configDir, ws.name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, ws.name)
+	}
+	return removed, nil
+}
+
+// CheckoutsFile names the file in the cache directory that lists the
+// R/W checkouts that were populated, one per line. The first line
+// records when the list was started, as "# since TIME".
+const CheckoutsFile = "checkouts"
+
+const checkoutsHeader = "# since "
+
+// readCheckouts returns the checkouts listed in file that still
+// exist, and the time the list was started. The time is zero if the
+// file has no header.
+func readCheckouts(file string) ([]string, time.Time, error) {
+	var since time.Time
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, since, err
+	}
+	var dirs []string
+	for _, l := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(l, checkoutsHeader) {
+			since, _ = time.Parse(time.RFC3339, strings.TrimPrefix(l, checkoutsHeader))
+			continue
+		}
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if _, err := os.Stat(l); err == nil {
+			dirs = append(dirs, l)
+		}
+	}
+	return dirs, since, nil
+}
+
+// RegisterCheckout adds the R/W checkout rw to the list in file, and
+// drops the checkouts that no longer exist.
+func RegisterCheckout(file, rw string) error {
+	rw, err := filepath.Abs(rw)
+	if err != nil {
+		return err
+	}
+	dirs, since, err := readCheckouts(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if since.IsZero() {
+		since = time.Now()
+	}
+	found := false
+	for _, d := range dirs {
+		found = found || d == rw
+	}
+	if !found {
+		dirs = append(dirs, rw)
+	}
+	sort.Strings(dirs)
+
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	content := checkoutsHeader + since.UTC().Format(time.RFC3339) + "\n" + strings.Join(dirs, "\n") + "\n"
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// WorkspacesInUse returns the names of the workspaces in mount that
+// the checkouts listed in file link to, or have files from. Checkouts
+// populated before the list was started are not in it, so the
+// workspaces configured before then count as in use too. It fails if
+// file does not exist, as then any workspace may be in use.
+func WorkspacesInUse(file, mount string) (map[string]bool, error) {
+	dirs, since, err := readCheckouts(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no checkouts are registered in %s, so any workspace may be in use", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if since.IsZero() {
+		since = time.Now()
+	}
+
+	inUse := map[string]bool{}
+	for _, d := range dirs {
+		if content, err := ioutil.ReadFile(filepath.Join(d, MaterializedFile)); err == nil {
+			var m materialized
+			if err := json.Unmarshal(content, &m); err != nil {
+				return nil, fmt.Errorf("%s: %v", filepath.Join(d, MaterializedFile), err)
+			}
+			inUse[m.Workspace] = true
+			continue
+		}
+
+		ws, err := LinkedWorkspace(mount, d)
+		if err != nil {
+			// Most likely not populated from this mount.
+			log.Printf("LinkedWorkspace(%s): %v", d, err)
+			continue
+		}
+		inUse[filepath.Base(ws)] = true
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(mount, "config"))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if t, ok := workspaceTime(e.Name()); ok && t.Before(since) {
+			inUse[e.Name()] = true
+		}
+	}
+	return inUse, nil
+}
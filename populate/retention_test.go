@@ -0,0 +1,168 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWorkspaceTime(t *testing.T) {
+	now := time.Date(2016, 7, 1, 12, 30, 0, 0, time.FixedZone("", 2*3600))
+	for _, suffix := range []string{"", "repo", "0123456789ab"} {
+		name := WorkspaceName(now, suffix)
+		got, ok := workspaceTime(name)
+		if !ok || !got.Equal(now) {
+			t.Errorf("workspaceTime(%q) = %v, %v, want %v", name, got, ok, now)
+		}
+	}
+	for _, name := range []string{"ws", "S2016", "S2016-07-01T12_30_00Zfoo"} {
+		if _, ok := workspaceTime(name); ok {
+			t.Errorf("workspaceTime(%q) succeeded", name)
+		}
+	}
+}
+
+func TestRemoveStaleWorkspaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mount := filepath.Join(dir, "mnt")
+	if err := os.MkdirAll(filepath.Join(mount, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2016, 7, 1, 0, 0, 0, 0, time.UTC)
+	var names []string
+	for i := 0; i < 5; i++ {
+		names = append(names, WorkspaceName(now.Add(-time.Duration(i)*24*time.Hour), "repo"))
+	}
+	for _, n := range append(names, "manual") {
+		if err := os.Symlink("/dev/null", filepath.Join(mount, "config", n)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(mount, n, "p"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A symlinked checkout uses names[3], a materialized one
+	// names[4].
+	checkouts := filepath.Join(dir, CheckoutsFile)
+	linked := filepath.Join(dir, "linked")
+	if err := os.MkdirAll(linked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(mount, names[3], "p"), filepath.Join(linked, "p")); err != nil {
+		t.Fatal(err)
+	}
+	materialized := filepath.Join(dir, "materialized")
+	if err := os.MkdirAll(materialized, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(materialized, MaterializedFile),
+		[]byte(`{"Workspace": "`+names[4]+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WorkspacesInUse(checkouts, mount); err == nil {
+		t.Error("WorkspacesInUse succeeded without registered checkouts")
+	}
+
+	// The workspaces were all configured after the list was
+	// started.
+	header := checkoutsHeader + now.Add(-10*24*time.Hour).Format(time.RFC3339) + "\n"
+	if err := ioutil.WriteFile(checkouts, []byte(header), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gone := filepath.Join(dir, "gone")
+	for _, d := range []string{linked, materialized, gone, linked} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterCheckout(checkouts, d); err != nil {
+			t.Fatalf("RegisterCheckout: %v", err)
+		}
+	}
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterCheckout(checkouts, linked); err != nil {
+		t.Fatalf("RegisterCheckout: %v", err)
+	}
+	content, err := ioutil.ReadFile(checkouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(content), header+linked+"\n"+materialized+"\n"; got != want {
+		t.Errorf("got checkouts %q, want %q", got, want)
+	}
+
+	inUse, err := WorkspacesInUse(checkouts, mount)
+	if err != nil {
+		t.Fatalf("WorkspacesInUse: %v", err)
+	}
+	if want := map[string]bool{names[3]: true, names[4]: true}; !reflect.DeepEqual(inUse, want) {
+		t.Errorf("got in use %v, want %v", inUse, want)
+	}
+
+	// Checkouts populated before the list was started may use
+	// the workspaces configured before then.
+	later := checkoutsHeader + now.Add(-36*time.Hour).Format(time.RFC3339) + "\n" + linked + "\n"
+	if err := ioutil.WriteFile(checkouts, []byte(later), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := WorkspacesInUse(checkouts, mount); err != nil {
+		t.Fatalf("WorkspacesInUse: %v", err)
+	} else if want := map[string]bool{names[2]: true, names[3]: true, names[4]: true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got in use %v, want %v", got, want)
+	}
+
+	removed, err := RemoveStaleWorkspaces(mount, Retention{Keep: 3}, inUse, now)
+	if err != nil {
+		t.Fatalf("RemoveStaleWorkspaces: %v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("removed %v, want nothing", removed)
+	}
+
+	removed, err = RemoveStaleWorkspaces(mount, Retention{MaxAge: 36 * time.Hour}, nil, now)
+	if err != nil {
+		t.Fatalf("RemoveStaleWorkspaces: %v", err)
+	}
+	if want := names[2:]; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(mount, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	want := append([]string{"manual"}, names[:2]...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("got config entries %v, want %v", left, want)
+	}
+}
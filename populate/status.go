@@ -0,0 +1,269 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+
+	"github.com/google/slothfs/manifest"
+)
+
+// States of a project in a R/W checkout, as reported by Status.
+const (
+	// The project is served by symlinks into the RO workspace, or
+	// by unchanged files placed from it in another link mode.
+	StateLinked = "linked"
+
+	// The project is a local git checkout.
+	StateCheckout = "checkout"
+
+	// The project directory has local files next to files linked
+	// from the RO workspace.
+	StateMixed = "mixed"
+
+	// The project is not in the R/W checkout.
+	StateMissing = "missing"
+)
+
+// ProjectStatus describes how a project of the workspace is present
+// in a R/W checkout.
+type ProjectStatus struct {
+	Path string
+
+	// State is one of the State* constants.
+	State string
+
+	// Revision is the commit that the workspace manifest pins.
+	Revision string
+
+	// Head is the commit checked out in a local git checkout, and
+	// Branch the branch, if HEAD is on one.
+	Head   string `json:",omitempty"`
+	Branch string `json:",omitempty"`
+
+	// Local lists the local files of a mixed project, relative
+	// to the project.
+	Local []string `json:",omitempty"`
+}
+
+// Diverged returns whether a local checkout is at another commit than
+// the one pinned by the workspace.
+func (s *ProjectStatus) Diverged() bool {
+	return s.Head != "" && s.Head != s.Revision
+}
+
+func (s *ProjectStatus) String() string {
+	switch s.State {
+	case StateCheckout:
+		at := s.Head
+		if s.Branch != "" {
+			at = fmt.Sprintf("%s on branch %s", s.Head, s.Branch)
+		}
+		if s.Diverged() {
+			return fmt.Sprintf("%s: %s at %s, pinned %s", s.Path, s.State, at, s.Revision)
+		}
+		return fmt.Sprintf("%s: %s at %s", s.Path, s.State, at)
+	case StateMixed:
+		return fmt.Sprintf("%s: %s, %d local files", s.Path, s.State, len(s.Local))
+	}
+	return fmt.Sprintf("%s: %s", s.Path, s.State)
+}
+
+// Status reports for each project of the RO workspace ro how it is
+// present in the R/W checkout rw, like "repo status" for a checkout
+// made by the repo tool. Files listed in the MaterializedFile count as
+// linked while they are unchanged. The result is sorted by path.
+func Status(ro, rw string) ([]*ProjectStatus, error) {
+	ro = filepath.Clean(ro)
+	rw = filepath.Clean(rw)
+
+	mf, err := manifest.ParseFile(filepath.Join(ro, ".slothfs", "manifest.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	projects := map[string]bool{}
+	for _, p := range mf.Project {
+		projects[p.GetPath()] = true
+	}
+
+	mount := filepath.Dir(ro)
+	realMount, err := filepath.EvalSymlinks(mount)
+	if err != nil {
+		return nil, err
+	}
+
+	placed := map[string]bool{}
+	mat, err := readMaterialized(rw)
+	if err != nil {
+		return nil, err
+	}
+	if mat != nil {
+		for i := range mat.Files {
+			e := &mat.Files[i]
+			ok, err := e.unchanged(rw)
+			if err != nil {
+				return nil, err
+			}
+			placed[e.Path] = ok
+		}
+	}
+
+	var result []*ProjectStatus
+	for i := range mf.Project {
+		p := &mf.Project[i]
+		s := &ProjectStatus{
+			Path:     p.GetPath(),
+			Revision: mf.ProjectRevision(p),
+		}
+		if err := projectStatus(mount, realMount, rw, projects, placed, s); err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+// projectStatus fills in the state of the project at s.Path.
+// realMount is mount with symlinks resolved, and placed holds the
+// unchanged materialized files relative to rw.
+func projectStatus(mount, realMount, rw string, projects, placed map[string]bool, s *ProjectStatus) error {
+	dir := filepath.Join(rw, s.Path)
+
+	// The project, or a directory above it, is a symlink into
+	// the mount.
+	if real, err := filepath.EvalSymlinks(dir); err == nil && strings.HasPrefix(real, realMount+"/") {
+		s.State = StateLinked
+		return nil
+	}
+
+	fi, err := os.Lstat(dir)
+	if os.IsNotExist(err) || (err == nil && fi.Mode()&os.ModeSymlink != 0 && linksInto(dir, mount)) {
+		// Not there, or a dangling link into the mount.
+		s.State = StateMissing
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		s.State = StateCheckout
+		repo, err := git.PlainOpen(dir)
+		if err != nil {
+			return fmt.Errorf("PlainOpen(%s): %v", dir, err)
+		}
+		head, err := repo.Head()
+		if err != nil {
+			return fmt.Errorf("%s: HEAD: %v", s.Path, err)
+		}
+		s.Head = head.Hash().String()
+		if head.Name().IsBranch() {
+			s.Branch = head.Name().Short()
+		}
+		return nil
+	}
+
+	// A directory made by slothfs-populate, because another
+	// project is checked out below it, or because files were
+	// linked one by one.
+	linked := 0
+	if err := filepath.Walk(dir, func(n string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, n)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if n != dir && projects[filepath.Join(s.Path, rel)] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if (fi.Mode()&os.ModeSymlink != 0 && linksInto(n, mount)) || placed[filepath.Join(s.Path, rel)] {
+			linked++
+		} else {
+			s.Local = append(s.Local, rel)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("Walk %s: %v", dir, err)
+	}
+
+	switch {
+	case len(s.Local) > 0:
+		s.State = StateMixed
+	case linked > 0:
+		s.State = StateLinked
+	default:
+		s.State = StateMissing
+	}
+	return nil
+}
+
+// linksInto returns whether the symlink at n points below mount.
+func linksInto(n, mount string) bool {
+	target, err := os.Readlink(n)
+	return err == nil && strings.HasPrefix(target, mount+"/")
+}
+
+// LinkedWorkspace returns the RO workspace below mount that the
+// symlinks in the R/W checkout rw point to, or that its materialized
+// files were placed from.
+func LinkedWorkspace(mount, rw string) (string, error) {
+	mount = filepath.Clean(mount)
+	if m, err := readMaterialized(rw); err != nil {
+		return "", err
+	} else if m != nil && m.Workspace != "" {
+		return filepath.Join(mount, m.Workspace), nil
+	}
+	errFound := errors.New("found")
+	ws := ""
+	err := filepath.Walk(rw, func(n string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if fi.Mode()&os.ModeSymlink == 0 || !linksInto(n, mount) {
+			return nil
+		}
+		target, err := os.Readlink(n)
+		if err != nil {
+			return err
+		}
+		ws = filepath.Join(mount, trimMount(target, mount))
+		return errFound
+	})
+	if err != nil && err != errFound {
+		return "", fmt.Errorf("Walk %s: %v", rw, err)
+	}
+	if ws == "" {
+		return "", fmt.Errorf("%s has no symlinks into %s", rw, mount)
+	}
+	return ws, nil
+}
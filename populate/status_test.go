@@ -0,0 +1,162 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rev := "ce34badf691d36e8048b63f89d1a86ee5fa4325c"
+	ro := filepath.Join(dir, "mnt/ws")
+	var projects string
+	for _, p := range []string{"a", "a/nested", "b", "c", "d", "e", "f", "f/g", "h", "i"} {
+		projects += fmt.Sprintf(" <project name=%q revision=%q/>\n", p, rev)
+	}
+	files := map[string]string{
+		".slothfs/manifest.xml": "<manifest>\n" + projects + "</manifest>",
+		"a/file":                "",
+		"a/nested/file":         "",
+		"d/file":                "",
+		"e/file":                "",
+		"f/file":                "",
+		"h/file":                "",
+		"i/file":                "",
+	}
+	for name, content := range files {
+		p := filepath.Join(ro, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rw := filepath.Join(dir, "rw")
+	for _, d := range []string{"d", "e", "f/g", "h", "i"} {
+		if err := os.MkdirAll(filepath.Join(rw, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"a":      "a",
+		"d/file": "d/file",
+		"e/file": "e/file",
+		"f/file": "f/file",
+	} {
+		if err := os.Symlink(filepath.Join(ro, target), filepath.Join(rw, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rw, "d/local"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// h/file and i/file were materialized, and i/file was
+	// changed since.
+	rec := materialized{Workspace: "ws"}
+	for _, p := range []string{"h/file", "i/file"} {
+		if err := ioutil.WriteFile(filepath.Join(rw, p), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(filepath.Join(rw, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Files = append(rec.Files, materializedEntry{Path: p, Size: fi.Size(), Mtime: fi.ModTime().UnixNano()})
+	}
+	if err := ioutil.WriteFile(filepath.Join(rw, "i/file"), []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content, err := json.Marshal(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rw, MaterializedFile), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	local := plumbing.NewHash("0123456789012345678901234567890123456789")
+	for p, ref := range map[string]plumbing.ReferenceName{"b": "refs/heads/master", "f/g": "HEAD"} {
+		repo, err := git.PlainInit(filepath.Join(rw, p), false)
+		if err != nil {
+			t.Fatalf("PlainInit: %v", err)
+		}
+		id := plumbing.NewHash(rev)
+		if p == "f/g" {
+			id = local
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(ref, id)); err != nil {
+			t.Fatalf("SetReference: %v", err)
+		}
+	}
+
+	got, err := Status(ro, rw)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	want := []*ProjectStatus{
+		{Path: "a", State: StateLinked, Revision: rev},
+		{Path: "a/nested", State: StateLinked, Revision: rev},
+		{Path: "b", State: StateCheckout, Revision: rev, Head: rev, Branch: "master"},
+		{Path: "c", State: StateMissing, Revision: rev},
+		{Path: "d", State: StateMixed, Revision: rev, Local: []string{"local"}},
+		{Path: "e", State: StateLinked, Revision: rev},
+		{Path: "f", State: StateLinked, Revision: rev},
+		{Path: "f/g", State: StateCheckout, Revision: rev, Head: local.String()},
+		{Path: "h", State: StateLinked, Revision: rev},
+		{Path: "i", State: StateMixed, Revision: rev, Local: []string{"file"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for i := range got {
+			t.Logf("got %+v", got[i])
+		}
+		t.Fatalf("want %v", want)
+	}
+	if got[1].Diverged() || !got[7].Diverged() {
+		t.Errorf("Diverged: got %v for %s, %v for %s", got[1].Diverged(), got[1].Path, got[7].Diverged(), got[7].Path)
+	}
+
+	ws, err := LinkedWorkspace(filepath.Join(dir, "mnt"), rw)
+	if err != nil || ws != ro {
+		t.Errorf("LinkedWorkspace: got %q, %v, want %q", ws, err, ro)
+	}
+
+	// Without the MaterializedFile, the workspace is found from
+	// the symlinks.
+	if err := os.Remove(filepath.Join(rw, MaterializedFile)); err != nil {
+		t.Fatal(err)
+	}
+	ws, err = LinkedWorkspace(filepath.Join(dir, "mnt"), rw)
+	if err != nil || ws != ro {
+		t.Errorf("LinkedWorkspace: got %q, %v, want %q", ws, err, ro)
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// Kinds of problems found by Verify.
+const (
+	// A file of the RO workspace is not reachable from the R/W checkout.
+	ProblemMissing = "missing"
+
+	// A symlink points into the mount, but its target does not exist.
+	ProblemDangling = "dangling"
+
+	// A symlink points to another file than the one in the RO workspace.
+	ProblemWrongTarget = "wrong-target"
+
+	// A file in the R/W checkout hides the file of the RO workspace.
+	ProblemShadowed = "shadowed"
+
+	// The content served by the mount does not hash to the SHA1 in
+	// the tree of the manifest.
+	ProblemSHA1 = "sha1-mismatch"
+)
+
+// Problem is an inconsistency between a R/W checkout and the
+// SlothFS workspace it was populated from.
+type Problem struct {
+	// Kind is one of the Problem* constants.
+	Kind string
+
+	// Path relative to the R/W checkout. For problems with a
+	// symlink, this is where the symlink is or should be.
+	Path string
+
+	// Detail describes what was found.
+	Detail string
+
+	// Repaired is set if VerifyOptions.Repair fixed the problem.
+	Repaired bool
+}
+
+// Suggestion returns a description of how to fix the problem.
+func (p *Problem) Suggestion() string {
+	switch p.Kind {
+	case ProblemMissing, ProblemWrongTarget, ProblemDangling:
+		return "run slothfs-verify -repair, or slothfs-populate again"
+	case ProblemShadowed:
+		return fmt.Sprintf("remove %s if it is not a local change", p.Path)
+	case ProblemSHA1:
+		return "remove the blob from the cache, and restart slothfs"
+	}
+	return ""
+}
+
+func (p *Problem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Path, p.Kind, p.Detail)
+}
+
+// VerifyOptions controls the checks of Verify.
+type VerifyOptions struct {
+	// Repair fixes missing, dangling and misdirected symlinks.
+	Repair bool
+
+	// CheckSHA1 reads every file served by the mount, and checks
+	// that its content hashes to the SHA1 in the tree listing. This
+	// fetches all blobs, so it is slow for large workspaces.
+	CheckSHA1 bool
+}
+
+// Verify checks that the symlink forest in the R/W checkout rw is
+// complete and points into the RO workspace ro. It returns the
+// problems found, sorted by path.
+func Verify(ro, rw string, opts VerifyOptions) ([]*Problem, error) {
+	ro = filepath.Clean(ro)
+	rw = filepath.Clean(rw)
+
+	roTree, err := repoTreeFromSlothFS(ro)
+	if err != nil {
+		return nil, err
+	}
+	rwTree, err := newRepoTree(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []*Problem
+	seen := map[string]bool{}
+	report := func(p *Problem) {
+		if seen[p.Path] {
+			// A missing or broken directory link shows up for
+			// each file below it.
+			return
+		}
+		seen[p.Path] = true
+		problems = append(problems, p)
+	}
+
+	rwc := rwTree.allChildren()
+	for nm, ch := range roTree.allChildren() {
+		if _, ok := rwc[nm]; ok {
+			continue
+		}
+		for e, info := range ch.entries {
+			rel := filepath.Join(nm, e)
+			p, err := verifyFile(ro, rw, rel, opts)
+			if err != nil {
+				return nil, err
+			}
+			if p == nil && opts.CheckSHA1 && info.sha1 != nil {
+				p, err = verifySHA1(filepath.Join(ro, rel), rel, info)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if p != nil {
+				report(p)
+			}
+		}
+	}
+
+	for _, c := range roTree.copied {
+		if _, err := os.Lstat(filepath.Join(rw, c)); !os.IsNotExist(err) {
+			continue
+		}
+		p := &Problem{Kind: ProblemMissing, Path: c, Detail: "copyfile or linkfile destination does not exist"}
+		if opts.Repair {
+			var conflicts []string
+			if err := linkCopied(filepath.Join(ro, c), filepath.Join(rw, c), &conflicts); err != nil {
+				return nil, err
+			}
+			p.Repaired = true
+		}
+		report(p)
+	}
+
+	// Links to projects that are no longer in the workspace are
+	// not found by looking at the workspace.
+	mount := filepath.Dir(ro)
+	if err := filepath.Walk(rw, func(n string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(rw, n)
+		if err != nil {
+			return err
+		}
+		if seen[rel] {
+			return nil
+		}
+		target, err := os.Readlink(n)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(target, mount+"/") {
+			return nil
+		}
+		if _, err := os.Stat(target); !os.IsNotExist(err) {
+			return nil
+		}
+		p := &Problem{Kind: ProblemDangling, Path: rel, Detail: fmt.Sprintf("target %s does not exist", target)}
+		if opts.Repair {
+			if err := os.Remove(n); err != nil {
+				return err
+			}
+			p.Repaired = true
+		}
+		report(p)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("Walk %s: %v", rw, err)
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	return problems, nil
+}
+
+// verifyFile checks that rel in the R/W checkout leads to rel in the
+// RO workspace, either through a symlink for the file, or for one of
+// its parent directories.
+func verifyFile(ro, rw, rel string, opts VerifyOptions) (*Problem, error) {
+	want := filepath.Join(ro, rel)
+	comps := strings.Split(rel, string(filepath.Separator))
+
+	for i := range comps {
+		prefix := filepath.Join(comps[:i+1]...)
+		n := filepath.Join(rw, prefix)
+		fi, err := os.Lstat(n)
+		if os.IsNotExist(err) {
+			p := &Problem{Kind: ProblemMissing, Path: prefix, Detail: fmt.Sprintf("no symlink to %s", filepath.Join(ro, prefix))}
+			if opts.Repair {
+				if err := os.MkdirAll(filepath.Dir(n), 0755); err != nil {
+					return nil, err
+				}
+				if err := os.Symlink(filepath.Join(ro, prefix), n); err != nil {
+					return nil, err
+				}
+				p.Repaired = true
+			}
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if i == len(comps)-1 {
+				return &Problem{Kind: ProblemShadowed, Path: rel, Detail: "regular file in the R/W checkout"}, nil
+			}
+			continue
+		}
+
+		target, err := os.Readlink(n)
+		if err != nil {
+			return nil, err
+		}
+		got := filepath.Join(append([]string{target}, comps[i+1:]...)...)
+
+		var p *Problem
+		if got != want {
+			p = &Problem{Kind: ProblemWrongTarget, Path: prefix, Detail: fmt.Sprintf("points to %s, want %s", target, filepath.Join(ro, prefix))}
+		} else if _, err := os.Lstat(got); err != nil {
+			p = &Problem{Kind: ProblemDangling, Path: prefix, Detail: err.Error()}
+		} else {
+			return nil, nil
+		}
+
+		if opts.Repair {
+			if err := os.Remove(n); err != nil {
+				return nil, err
+			}
+			if err := os.Symlink(filepath.Join(ro, prefix), n); err != nil {
+				return nil, err
+			}
+			p.Repaired = true
+		}
+		return p, nil
+	}
+	return nil, nil
+}
+
+// verifySHA1 hashes the content of the file at path, as served by
+// the mount, and compares it with the SHA1 from the tree listing, or
+// for files with line ending conversion, with the SHA1 the mount
+// reports for the converted content.
+func verifySHA1(path, rel string, info *fileInfo) (*Problem, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	want := *info.sha1
+	if id, err := readIDAttr(path, convertedSHA1Attr); err == nil {
+		want = *id
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return &Problem{Kind: ProblemSHA1, Path: rel, Detail: err.Error()}, nil
+	}
+	defer f.Close()
+
+	h := plumbing.NewHasher(plumbing.BlobObject, fi.Size())
+	if n, err := io.Copy(h, f); err != nil {
+		return &Problem{Kind: ProblemSHA1, Path: rel, Detail: fmt.Sprintf("reading: %v", err)}, nil
+	} else if n != fi.Size() {
+		return &Problem{Kind: ProblemSHA1, Path: rel, Detail: fmt.Sprintf("read %d bytes, size is %d", n, fi.Size())}, nil
+	}
+	if id := h.Sum(); id != want {
+		return &Problem{Kind: ProblemSHA1, Path: rel, Detail: fmt.Sprintf("content hashes to %s, want %s", id, want)}, nil
+	}
+	return nil, nil
+}
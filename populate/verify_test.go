@@ -0,0 +1,167 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package populate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rev := "ce34badf691d36e8048b63f89d1a86ee5fa4325c"
+	blob := plumbing.ComputeHash(plumbing.BlobObject, []byte{42})
+	tree := func(names ...string) string {
+		s := ""
+		for i, n := range names {
+			if i > 0 {
+				s += ","
+			}
+			s += fmt.Sprintf(`{"name": %q, "id": %q}`, n, blob)
+		}
+		return fmt.Sprintf(`{"id": %q, "entries": [%s]}`, rev, s)
+	}
+	ro := filepath.Join(dir, "mnt/ws")
+	files := map[string]string{
+		".slothfs/manifest.xml": fmt.Sprintf(`<manifest>
+ <project name="a" revision=%q/>
+ <project name="b" revision=%q/>
+ <project name="c" revision=%q/>
+ <project name="d" revision=%q/>
+ <project name="e" revision=%q/>
+</manifest>`, rev, rev, rev, rev, rev),
+		"a/.slothfs/tree.json": tree("file", "sub/x"),
+		"b/.slothfs/tree.json": tree("file"),
+		"c/.slothfs/tree.json": tree("file"),
+		"d/.slothfs/tree.json": tree("file"),
+		"e/.slothfs/tree.json": tree("f"),
+	}
+	for name, content := range files {
+		p := filepath.Join(ro, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a/file", "a/sub/x", "b/file", "c/file", "d/file", "e/f"} {
+		p := filepath.Join(ro, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte{42}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rw := filepath.Join(dir, "rw")
+	for _, d := range []string{"b/.git", "e"} {
+		if err := os.MkdirAll(filepath.Join(rw, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(rw, "e/f"), []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"a":   filepath.Join(ro, "a"),
+		"d":   filepath.Join(ro, "a"),
+		"old": filepath.Join(dir, "mnt/oldws/old"),
+	} {
+		if err := os.Symlink(target, filepath.Join(rw, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	kinds := func(ps []*Problem) map[string]string {
+		r := map[string]string{}
+		for _, p := range ps {
+			r[p.Path] = p.Kind
+		}
+		return r
+	}
+
+	got, err := Verify(ro, rw, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	want := map[string]string{
+		"c":   ProblemMissing,
+		"d":   ProblemWrongTarget,
+		"e/f": ProblemShadowed,
+		"old": ProblemDangling,
+	}
+	if !reflect.DeepEqual(kinds(got), want) {
+		t.Fatalf("got %v, want %v", kinds(got), want)
+	}
+
+	got, err = Verify(ro, rw, VerifyOptions{Repair: true})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	for _, p := range got {
+		if p.Repaired != (p.Kind != ProblemShadowed) {
+			t.Errorf("%v: got Repaired %v", p, p.Repaired)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(rw, "d")); err != nil || target != filepath.Join(ro, "d") {
+		t.Errorf("Readlink(d): %q, %v", target, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(ro, "a/sub/x"), []byte{43}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = Verify(ro, rw, VerifyOptions{CheckSHA1: true})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	want = map[string]string{
+		"a/sub/x": ProblemSHA1,
+		"e/f":     ProblemShadowed,
+	}
+	if !reflect.DeepEqual(kinds(got), want) {
+		t.Errorf("after repair: got %v, want %v", kinds(got), want)
+	}
+
+	// Content with line ending conversion is checked against the
+	// SHA1 the mount reports for it.
+	converted := plumbing.ComputeHash(plumbing.BlobObject, []byte{43})
+	if syscall.Setxattr(filepath.Join(ro, "a/sub/x"), convertedSHA1Attr, []byte(converted.String()), 0) != nil {
+		t.Skip("no xattr support")
+	}
+	got, err = Verify(ro, rw, VerifyOptions{CheckSHA1: true})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	want = map[string]string{
+		"e/f": ProblemShadowed,
+	}
+	if !reflect.DeepEqual(kinds(got), want) {
+		t.Errorf("converted: got %v, want %v", kinds(got), want)
+	}
+}
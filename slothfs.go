@@ -0,0 +1,188 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package slothfs mounts SlothFS file systems from Go programs, eg.
+// build orchestrators, without going through the commands in cmd/.
+package slothfs
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/fs"
+	"github.com/google/slothfs/gitiles"
+	fusefs "github.com/hanwen/go-fuse/fs"
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Config describes a file system to mount.
+type Config struct {
+	// MountPoint is the directory to mount on.
+	MountPoint string
+
+	// CacheDir holds the blob, tree and git caches. It can be
+	// shared with other SlothFS mounts.
+	CacheDir string
+	Cache    cache.Options
+
+	// Gitiles selects the host and its options.
+	Gitiles gitiles.Options
+
+	// Repo is the repository to serve. If empty, all
+	// repositories of the host are served, like slothfs-hostfs.
+	Repo string
+
+	// RepoPrefix, if set and Repo is empty, restricts the
+	// repositories served to those whose name starts with it.
+	RepoPrefix string
+
+	// Revision, if set, is a branch, tag or commit whose tree is
+	// served at the root of the mount. Otherwise, trees are
+	// served in directories named by their SHA1, like
+	// slothfs-gitilesfs.
+	Revision string
+
+	// FS holds the file system options. CloneURL is looked up on
+	// Gitiles if empty. If Repo is empty, the options apply to
+	// every repository, and CloneURL and LocalOverlay must not be
+	// set.
+	FS fs.GitilesOptions
+
+	// Timeouts are the kernel cache timeouts for the mount. They
+	// default to fs.DefaultTimeouts.
+	Timeouts fs.Timeouts
+
+	// Debug prints FUSE debug info.
+	Debug bool
+}
+
+// Handle is a mounted file system.
+type Handle struct {
+	// MountPoint is where the file system is mounted.
+	MountPoint string
+
+	// Revision is the commit served at the root, if
+	// Config.Revision was set.
+	Revision string
+
+	server *fuse.Server
+}
+
+// Unmount unmounts the file system. It fails if files are still in
+// use.
+func (h *Handle) Unmount() error {
+	return h.server.Unmount()
+}
+
+// Wait returns after the file system was unmounted.
+func (h *Handle) Wait() {
+	h.server.Wait()
+}
+
+// Mount sets up the cache and the Gitiles client, and mounts the file
+// system described by cfg. The file system is unmounted when ctx is
+// canceled.
+func Mount(ctx context.Context, cfg Config) (*Handle, error) {
+	if cfg.MountPoint == "" || cfg.CacheDir == "" {
+		return nil, fmt.Errorf("slothfs: MountPoint and CacheDir must be set")
+	}
+
+	c, err := cache.NewCache(cfg.CacheDir, cfg.Cache)
+	if err != nil {
+		return nil, fmt.Errorf("NewCache: %v", err)
+	}
+	service, err := gitiles.NewService(cfg.Gitiles)
+	if err != nil {
+		return nil, fmt.Errorf("NewService: %v", err)
+	}
+
+	h := &Handle{MountPoint: cfg.MountPoint}
+	root, err := newRoot(c, service, &cfg, h)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := cfg.Timeouts
+	if timeouts == (fs.Timeouts{}) {
+		timeouts = fs.DefaultTimeouts
+	}
+	fuseOpts := timeouts.MountOptions()
+	fuseOpts.Debug = cfg.Debug
+	if err := cfg.FS.Mount.Apply(fuseOpts); err != nil {
+		return nil, err
+	}
+	h.server, err = fusefs.Mount(cfg.MountPoint, root, fuseOpts)
+	if err != nil {
+		return nil, fmt.Errorf("Mount(%s): %v", cfg.MountPoint, err)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := h.server.Unmount(); err != nil {
+				log.Printf("Unmount(%s): %v", cfg.MountPoint, err)
+			}
+		case <-waitChan(h.server):
+		}
+	}()
+	return h, nil
+}
+
+// waitChan returns a channel that is closed when the server exits.
+func waitChan(server *fuse.Server) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// newRoot returns the root node for cfg. If a revision is served, it
+// records the resolved commit in h.
+func newRoot(c *cache.Cache, service *gitiles.Service, cfg *Config, h *Handle) (fusefs.InodeEmbedder, error) {
+	if cfg.Repo == "" {
+		return fs.NewHostFS(c, service, &cfg.FS, cfg.RepoPrefix)
+	}
+
+	repoService := service.NewRepoService(cfg.Repo)
+	opts := cfg.FS
+	if opts.CloneURL == "" {
+		url, err := fs.CloneURL(service, cfg.Repo, opts.Offline)
+		if err != nil {
+			return nil, err
+		}
+		opts.CloneURL = url
+	}
+
+	if cfg.Revision == "" {
+		return fs.NewGitilesConfigFSRoot(c, repoService, &opts), nil
+	}
+
+	commit, err := repoService.GetCommit(cfg.Revision)
+	if err != nil {
+		return nil, fmt.Errorf("GetCommit(%s, %s): %v", cfg.Repo, cfg.Revision, err)
+	}
+	tree, err := repoService.GetTree(commit.Commit, "", true)
+	if err != nil {
+		return nil, fmt.Errorf("GetTree(%s, %s): %v", cfg.Repo, commit.Commit, err)
+	}
+	h.Revision = commit.Commit
+	return fs.NewGitilesRoot(c, tree, repoService, fs.GitilesRevisionOptions{
+		Revision:       commit.Commit,
+		GitilesOptions: opts,
+	}), nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slothfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/google/slothfs/cache"
+	"github.com/google/slothfs/fs"
+	"github.com/google/slothfs/gitiles"
+	fusefs "github.com/hanwen/go-fuse/fs"
+)
+
+func TestNewRootRevision(t *testing.T) {
+	commit := "ce34badf691d36e8048b63f89d1a86ee5fa4325c"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repo":
+			w.Write([]byte(`)]}'
+{"name": "repo", "clone_url": "https://host/repo"}`))
+		case "/repo/+/master":
+			w.Write([]byte(`)]}'
+{"commit": "` + commit + `"}`))
+		case "/repo/+/" + commit + "/":
+			w.Write([]byte(`)]}'
+{"id": "4b825dc642cb6eb9a060e54bf8d69288fbee4904",
+ "entries": [{"mode": 33188, "type": "blob", "id": "787d767f94fd634ed29cd69ec9f93bab2b25f5d4", "name": "dir/file", "size": 5}]}`))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := cache.NewCache(dir, cache.Options{})
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	service, err := gitiles.NewService(gitiles.Options{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+
+	cfg := Config{Repo: "repo", Revision: "master"}
+	h := &Handle{}
+	root, err := newRoot(c, service, &cfg, h)
+	if err != nil {
+		t.Fatalf("newRoot: %v", err)
+	}
+	if h.Revision != commit {
+		t.Errorf("got revision %q, want %q", h.Revision, commit)
+	}
+
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	if d := root.EmbeddedInode().GetChild("dir"); d == nil || d.GetChild("file") == nil {
+		t.Errorf("dir/file not found in root")
+	}
+
+	cfg.Revision = "missing"
+	if _, err := newRoot(c, service, &cfg, h); err == nil {
+		t.Errorf("newRoot succeeded for missing revision")
+	}
+}
+
+func TestNewRootHostOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := cache.NewCache(dir, cache.Options{})
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	service, err := gitiles.NewService(gitiles.Options{Address: "http://localhost:0"})
+	if err != nil {
+		t.Fatalf("NewService: %v", err)
+	}
+
+	for _, opts := range []fs.GitilesOptions{
+		{CloneURL: "https://host/repo"},
+		{LocalOverlay: map[string]string{"out": dir}},
+	} {
+		cfg := Config{FS: opts}
+		if _, err := newRoot(c, service, &cfg, &Handle{}); err == nil {
+			t.Errorf("newRoot(%+v) succeeded for a host", opts)
+		}
+	}
+}
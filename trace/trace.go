@@ -0,0 +1,276 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package trace records spans for the read path of the file system,
+// and exports them to an OpenTelemetry collector, using OTLP over
+// HTTP with JSON encoding.
+package trace
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Span is a timed operation. The methods of a nil Span do nothing,
+// so callers need not check whether tracing is enabled.
+type Span struct {
+	exp      *exporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]string
+}
+
+type spanKey struct{}
+
+// current holds the *exporter if tracing is enabled.
+var current atomic.Value
+
+// Start starts a span as a child of the span in ctx, if any, and
+// returns a context holding the new span. If tracing is not enabled,
+// it returns ctx and a nil span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	exp, _ := current.Load().(*exporter)
+	if exp == nil {
+		return ctx, nil
+	}
+
+	s := &Span{
+		exp:   exp,
+		name:  name,
+		start: time.Now(),
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttr records an attribute of the span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = map[string]string{}
+	}
+	s.attrs[key] = fmt.Sprint(value)
+}
+
+// End finishes the span. If err is non-nil, the span is marked as
+// failed.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	o := otlpSpan{
+		TraceID:   hex.EncodeToString(s.traceID[:]),
+		SpanID:    hex.EncodeToString(s.spanID[:]),
+		Name:      s.name,
+		Kind:      spanKindInternal,
+		StartTime: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTime:   strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	if s.parentID != ([8]byte{}) {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	s.mu.Lock()
+	var keys []string
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o.Attributes = append(o.Attributes, stringAttr(k, s.attrs[k]))
+	}
+	s.mu.Unlock()
+	if err != nil {
+		o.Status = &otlpStatus{Code: statusCodeError, Message: err.Error()}
+	}
+	s.exp.add(o)
+}
+
+// SetEndpoint enables tracing. Spans are sent in batches to the
+// OTLP/HTTP collector at url, eg. http://localhost:4318, attributed
+// to the given service name.
+func SetEndpoint(url, service string) {
+	exp := &exporter{
+		url:     strings.TrimSuffix(url, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	current.Store(exp)
+	go exp.loop()
+}
+
+// exportInterval is how often spans are sent to the collector.
+const exportInterval = 5 * time.Second
+
+// maxQueue is the number of finished spans kept for export. If the
+// collector cannot keep up, further spans are dropped.
+const maxQueue = 10000
+
+type exporter struct {
+	url     string
+	service string
+	client  *http.Client
+
+	mu      sync.Mutex
+	spans   []otlpSpan
+	dropped int
+}
+
+func (e *exporter) add(s otlpSpan) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.spans) >= maxQueue {
+		e.dropped++
+		return
+	}
+	e.spans = append(e.spans, s)
+}
+
+func (e *exporter) loop() {
+	for range time.Tick(exportInterval) {
+		if err := e.flush(); err != nil {
+			log.Printf("trace: export to %s: %v", e.url, err)
+		}
+	}
+}
+
+// flush sends the queued spans to the collector.
+func (e *exporter) flush() error {
+	e.mu.Lock()
+	spans := e.spans
+	dropped := e.dropped
+	e.spans = nil
+	e.dropped = 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		log.Printf("trace: dropped %d spans", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	req := otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttr{stringAttr("service.name", e.service)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/google/slothfs"},
+				Spans: spans,
+			}},
+		}},
+	}
+	content, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding; see
+// https://github.com/open-telemetry/opentelemetry-proto.
+
+const (
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	StartTime    string      `json:"startTimeUnixNano"`
+	EndTime      string      `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr  `json:"attributes,omitempty"`
+	Status       *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func stringAttr(k, v string) otlpAttr {
+	return otlpAttr{Key: k, Value: otlpValue{StringValue: v}}
+}
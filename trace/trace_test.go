@@ -0,0 +1,79 @@
+// Copyright 2019 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	var got otlpRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	if _, s := Start(context.Background(), "disabled"); s != nil {
+		t.Errorf("got span %v while tracing is disabled", s)
+	}
+
+	SetEndpoint(ts.URL, "test")
+	defer current.Store((*exporter)(nil))
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	child.SetAttr("bytes", 42)
+	child.End(errors.New("boom"))
+	parent.End(nil)
+
+	if err := current.Load().(*exporter).flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %#v, want one batch", got)
+	}
+	if attrs := got.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Value.StringValue != "test" {
+		t.Errorf("got resource attributes %v, want service.name", attrs)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "child" || p.Name != "parent" {
+		t.Fatalf("got spans %q, %q", c.Name, p.Name)
+	}
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" {
+		t.Errorf("child %#v is not a child of %#v", c, p)
+	}
+	if c.Status == nil || c.Status.Code != statusCodeError || c.Status.Message != "boom" {
+		t.Errorf("got status %#v, want error", c.Status)
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Key != "bytes" || c.Attributes[0].Value.StringValue != "42" {
+		t.Errorf("got attributes %v", c.Attributes)
+	}
+}